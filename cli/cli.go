@@ -4,22 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	gpg "github.com/Geo25rey/crypto/openpgp"
-	"github.com/Geo25rey/crypto/openpgp/packet"
 	"github.com/Jguer/yay/v10/pkg/intrange"
 	"github.com/ipfs/go-cid"
-	iface "github.com/ipfs/interface-go-ipfs-core"
-	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/skip2/go-qrcode"
 	"github.com/spf13/viper"
+	"io"
 	"ipmail/libipmail"
 	"ipmail/libipmail/crypto"
 	"ipmail/libipmail/util"
 	"os"
-	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func hasInvalidCharacters(s string) (bool, int32) {
@@ -47,11 +47,31 @@ func prompt(scanner *bufio.Scanner, field string) string {
 	return ""
 }
 
-func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
-	identity crypto.SelfIdentity, contacts crypto.ContactsIdentityList,
-	messages ipmail.MessageList, sent ipmail.MessageList, requests ipmail.MessageList) {
+// Run starts the command line client. The ipmail: links in open, which the app was opened with, are added as
+// contacts you confirm once the local files are loaded, before the prompt
+func Run(ipfs ipmail.Transport, sender ipmail.Sender, receiver ipmail.Receiver, store ipmail.LocalStore,
+	sealer util.Sealer, remotePins []ipmail.RemotePinService, bodies crypto.BodyStore, open []string) {
 
 	scanner := bufio.NewScanner(os.Stdin)
+	if !unlock(scanner, store) {
+		return
+	}
+	data, err := store.Load()
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	identity, contacts := data.Identity, data.Contacts
+	messages, sent, requests := data.Messages, data.Sent, data.Requests
+	drafts, outbox, labels, flags := data.Drafts, data.Outbox, data.Labels, data.Flags
+	seen, pins, sessions, pending, names, profiles, details := data.Seen, data.Pins, data.Sessions, data.Pending,
+		data.Names, data.Profiles, data.Details
+	syncLog, syncHead := data.Sync, cid.Undef
+	if !viper.GetBool("forward-secrecy") {
+		sessions = nil
+	} else if sessions == nil {
+		sessions = crypto.NewSessionStore()
+	}
 	if messages == nil {
 		messages = ipmail.NewMessageList()
 	}
@@ -61,22 +81,46 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 	if requests == nil {
 		requests = ipmail.NewMessageList()
 	}
+	if drafts == nil {
+		drafts = ipmail.NewDraftList()
+	}
+	if labels == nil {
+		labels = ipmail.NewMessageLabels()
+	}
+	if flags == nil {
+		flags = ipmail.NewMessageFlags()
+	}
+	emptyTrash(false, messages, sent, labels, flags, sealer)
 
 	if identity == nil {
 		println("Looks like this is your first time here. Welcome!")
+		fmt.Print("Do you already use ipmail on another device? [y/N]\n> ")
+		if scanner.Scan() && strings.EqualFold(strings.TrimSpace(scanner.Text()), "y") {
+			if link := linkThisDevice(scanner, ipfs, receiver); link != nil {
+				identity, syncHead = link.Identity, link.Head
+				syncLog, err = ipmail.NewSyncLog(link.SyncKey)
+				if err != nil {
+					println(err.Error())
+					return
+				}
+			}
+		}
+	}
+	if identity == nil {
 		println("You can optionally enter your name, a comment, and your email")
 		println("to help identify yourself to people you message.")
 		println("Don't worry this information is only stored on your computer.")
 		name := prompt(scanner, "Name")
 		comment := prompt(scanner, "Comment")
 		email := prompt(scanner, "Email")
-		var err error
 		identity, err = crypto.NewSelfIdentity(name, comment, email)
 		if err != nil {
 			println(err.Error())
 			return
 		}
-		err = identity.SaveToFile(viper.GetString("identity"))
+	}
+	if data.Identity == nil {
+		err = identity.SaveToFile(viper.GetString("identity"), sealer)
 		if err != nil {
 			println(err.Error())
 			return
@@ -88,178 +132,151 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 
 	if contacts == nil {
 		contacts = crypto.NewContactsIdentityList(identity.EntityList())
-		err := contacts.SaveToFile(viper.GetString("contacts"))
+		err := contacts.SaveToFile(viper.GetString("contacts"), sealer)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	identityHashList := newEntityHashList(identity.EntityList(), ipfs)
-	contactsHashList := newEntityHashList(contacts.ToArray(), ipfs)
+	printOutboxUpdates(outbox)
 
-	receiver.OnMessage(func(message iface.PubSubMessage) {
-		seq, _ := util.BytesToUint64(message.Seq())
-		origin := message.From()
-		hash := message.Data()
-		topics := strings.Join(message.Topics(), "")
-		if strings.Contains(topics, crypto.MessageTopicName) {
-			if bytes.HasPrefix(hash, []byte(crypto.MessageCidPrefix)) &&
-				bytes.HasSuffix(hash, []byte(crypto.MessageCidPostfix)) {
-				hash = bytes.TrimPrefix(hash, []byte(crypto.MessageCidPrefix))
-				hash = bytes.TrimSuffix(hash, []byte(crypto.MessageCidPostfix))
-				parse, err := cid.Parse(hash)
-				if err != nil {
-					return
-				}
-				encryptedMsg, err := ipfs.Cat(path.IpfsPath(parse))
-				if err != nil {
-					return
-				}
-				msg := crypto.NewMessage(encryptedMsg, seq, origin, ipfs, identity, contacts,
-					func(keys []gpg.Key, symmetric bool) ([]byte, error) {
-						result := make([]byte, 0)
-						for _, key := range keys {
-							println("==> End your passphrase for", key.PublicKey.KeyIdShortString())
-							print("==> ")
-							if !scanner.Scan() {
-								return nil, errors.New("EOF")
-							}
-							result = append(result, scanner.Bytes()...)
-						}
-						return result, nil
-					})
-				if msg != nil {
-					entities := identity.EntityList()
-					for _, entity := range entities { // if msg is from self add to sent list
-						if msg.IsFrom(entity) {
-							fmt.Println("Message added to sent list")
-							sent.Add(msg)
-							err := sent.SaveToFile(viper.GetString("sent"))
-							if err != nil {
-								println("warning: sent messages could not be saved to file due to:", err.Error())
-							}
-							return
-						}
-					}
-
-					entities = contacts.ToArray()
-					inContacts := false
-					for _, entity := range entities { // if msg is from a non contact add to requests list
-						if msg.IsFrom(entity) {
-							inContacts = true
-							break
-						}
-					}
-					if !inContacts {
-						fmt.Println("Contact Request added")
-						requests.Add(msg)
-						err := messages.SaveToFile(viper.GetString("requests"))
-						if err != nil {
-							println("warning: contact requests could not be saved to file due to:", err.Error())
-						}
-					}
+	contactsHashList := newEntityHashList(contacts.ToArray(), ipfs, nil)
 
-					fmt.Println("Message added to inbox")
-					messages.Add(msg)
-					err := messages.SaveToFile(viper.GetString("messages"))
-					if err != nil {
-						println("warning: received messages could not be saved to file due to:", err.Error())
-					}
-				} else {
-					//println("Message isn't meant for you")
-				}
-				print("==> ")
+	unlockKeys := func(keys []gpg.Key, symmetric bool) ([]byte, error) {
+		result := make([]byte, 0)
+		for _, key := range keys {
+			println("==> End your passphrase for", key.PublicKey.KeyIdShortString())
+			print("==> ")
+			if !scanner.Scan() {
+				return nil, errors.New("EOF")
+			}
+			result = append(result, scanner.Bytes()...)
+		}
+		return result, nil
+	}
+	mailbox := ipmail.NewMailbox(ipmail.MailboxConfig{
+		Ipfs:         ipfs,
+		Sender:       sender,
+		Outbox:       outbox,
+		Identity:     identity,
+		Contacts:     contacts,
+		Messages:     messages,
+		Sent:         sent,
+		Requests:     requests,
+		Seen:         seen,
+		Pins:         pins,
+		PinTtl:       viper.GetDuration("pin-ttl"),
+		RemotePins:   remotePins,
+		Bodies:       bodies,
+		FetchTimeout: viper.GetDuration("ipfs-timeout"),
+		Sessions:     sessions,
+		Pending:      pending,
+		Names:        names,
+		Profiles:     profiles,
+		Details:      details,
+		Labels:       labels,
+		Flags:        flags,
+		Sync:         syncLog,
+		Files: ipmail.MailboxFiles{
+			Contacts: viper.GetString("contacts"),
+			Messages: viper.GetString("messages"),
+			Sent:     viper.GetString("sent"),
+			Requests: viper.GetString("requests"),
+			Seen:     viper.GetString("seen"),
+			Pins:     viper.GetString("pins"),
+			Sessions: viper.GetString("sessions"),
+			Pending:  viper.GetString("pending-requests"),
+			Names:    viper.GetString("contact-names"),
+			Profiles: viper.GetString("profiles"),
+			Details:  viper.GetString("contact-details"),
+			Labels:   viper.GetString("labels"),
+			Flags:    viper.GetString("flags"),
+			Sync:     viper.GetString("sync"),
+		},
+		Sealer: sealer,
+	})
+	identityHashList, identityName := list.New(), &atomic.Value{}
+	publishIdentity(mailbox, ipfs, identityHashList, identityName)
+	refreshContacts(mailbox, ipfs, contactsHashList)
+	for _, link := range open { // before the prompt, which also uses the contacts' content IDs
+		addSharedContact(scanner, mailbox, ipfs, contactsHashList, link)
+	}
+	mailbox.Events().Subscribe(context.Background(), func(event ipmail.Event) {
+		switch event.Type {
+		case ipmail.SentEcho:
+			fmt.Println("Message added to sent list")
+		case ipmail.ContactRequest:
+			fmt.Println("Contact Request added")
+		case ipmail.ContactAccepted:
+			if found, err := contacts.GetByPublicKey(*event.Message.From().PrimaryKey); err == nil && len(found.ToArray()) > 0 {
+				fmt.Println(util.EntityToString(event.Message.From()), "accepted your contact request")
+			} else {
+				fmt.Println("Contact Request added")
 			}
+		case ipmail.ContactDeclined:
+			fmt.Println(util.EntityToString(event.Message.From()), "declined your contact request")
+		default:
+			fmt.Println("Message added to inbox")
 		}
-	}, true)
+		print("==> ")
+	}, ipmail.SentEcho, ipmail.ContactRequest, ipmail.ContactAccepted, ipmail.ContactDeclined, ipmail.MessageReceived)
+	mailbox.Receive(context.Background(), receiver, unlockKeys)
+	startSync(mailbox, ipfs, contactsHashList, syncHead)
 
 	print("==> ")
 	for scanner.Scan() {
 		read := scanner.Text()
-		sharing := false
-	send:
 		if strings.HasPrefix(read, "send ") {
 			to := crypto.NewIdentityList()
 			trimmed := strings.TrimPrefix(read, "send ")
-			split := strings.Split(trimmed, " ")
+			split := ipmail.SplitQuoted(trimmed)
 			removed := 0
+			sendAt := time.Time{}
+			var invalidAt error
 			for i, v := range split {
-				if strings.HasPrefix(v, "to:") {
-					v = strings.TrimPrefix(v, "to:")
-					found := contacts.GetByName(v).ToArray()
-					//for _, val := range found {
-					//	println(val, "is a recipient candidate")
-					//}
-					if len(found) > 1 {
-						println("More than one contact found:")
-						array, err := chooseFromArray("Send to who?", func() string {
-							scanner.Scan()
-							return scanner.Text()
-						}, found, util.EntityToString) // TODO print the IPFS CID hashes
-						if err != nil {
-							println("warning:", err)
-							found = found[:0]
-						} else {
-							found = array
-						}
+				if strings.HasPrefix(v, "at:") {
+					at, err := ipmail.ParseSendAt(strings.TrimPrefix(v, "at:"), time.Now())
+					if err != nil {
+						invalidAt = err
+					} else {
+						sendAt = at
 					}
-					//for _, val := range found {
-					//	println(val, "was added to the recipient list")
-					//}
-					to.Add(found...)
 					split = append(split[:i-removed], split[i-removed+1:]...)
 					removed++
-				} else if sharing && strings.HasPrefix(v, "ipfsto:") { // FIXME EOF error on message received ---- fixed?
-					v = strings.TrimPrefix(v, "ipfsto:") // FIXME new "unexpected EOF" ---- 2) fixed by x/crypto fork
-					id, err := cid.Parse(v)
-					if err == nil {
-						entityBuf, err := ipfs.Cat(path.IpfsPath(id))
-						if err == nil {
-							entity, err := gpg.ReadEntity(
-								packet.NewReader(
-									bytes.NewBuffer(entityBuf),
-								),
-							)
-							if err == nil {
-								to.Add(entity)
-							} else {
-								println(err.Error())
-							}
-						} else {
-							println(err.Error())
-						}
-					} else {
-						println(err.Error())
+				} else if strings.HasPrefix(v, "to:") {
+					found, err := findRecipients(scanner, mailbox, strings.TrimPrefix(v, "to:"))
+					if err != nil {
+						println("warning:", err.Error())
 					}
+					to.Add(found...)
 					split = append(split[:i-removed], split[i-removed+1:]...)
 					removed++
 				}
 			}
 			toArr := to.ToArray()
-			if len(toArr) > 0 {
+			if invalidAt != nil {
+				fmt.Println("Message not sent:", invalidAt)
+			} else if len(toArr) > 0 {
 				toSend := bytes.NewBufferString(strings.Join(split, " "))
-				send, err := sender.Send(toSend, true, identity.DefaultIdentity(), append(toArr, identity.DefaultIdentity())...)
+				err := queueMessage(mailbox, toSend, sendAt, toArr...)
 				if err != nil {
-					println(err)
-				} else {
-					fmt.Printf("Message Sent with CID: %s\n", send)
+					println(err.Error())
 				}
 			} else {
 				fmt.Println("Message has no Recipient")
 			}
 		} else if strings.HasPrefix(read, "list") {
-			read = strings.TrimSpace(read[4:])
-			if strings.HasPrefix(read, "sent") {
-				println("---- Sent ----")
-				sent.ForEach(func(message crypto.Message) {
-					println(message.String())
-				})
-			} else {
-				println("--- Inbox ----")
-				messages.ForEach(func(message crypto.Message) {
-					println(message.String())
-				})
-			}
+			runListCommand(strings.TrimSpace(read[4:]), messages, sent, labels, flags)
+		} else if strings.HasPrefix(read, "folders") || strings.HasPrefix(read, "labels") {
+			split := strings.SplitN(read, " ", 2)
+			runFolderCommand(split[0], strings.TrimSpace(strings.TrimPrefix(read, split[0])), labels, sealer)
+		} else if command := strings.SplitN(read, " ", 2)[0]; command == "move" || command == "archive" ||
+			command == "delete" || command == "restore" || command == "label" || command == "unlabel" {
+			runMessageCommand(command, strings.TrimSpace(read[len(command):]), messages, sent, labels, flags, sealer)
+		} else if command == "mark" || command == "unmark" {
+			runMarkCommand(command, strings.TrimSpace(read[len(command):]), messages, sent, flags, sealer)
+		} else if strings.HasPrefix(read, "trash empty") {
+			emptyTrash(true, messages, sent, labels, flags, sealer)
 		} else if strings.HasPrefix(read, "read ") {
 			trimmed := strings.TrimSpace(read[5:])
 			reading := messages
@@ -268,98 +285,101 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 				reading = sent
 				split = split[1:]
 			}
-			id, err := strconv.ParseUint(split[0], 10, 64)
+			msg, err := findMessage(reading, split[0])
 			if err != nil {
-				println(err)
+				println(err.Error())
 			} else {
-				msg := reading.FromId(id)
-				if msg != nil {
-					fmt.Printf("%s\n%s\n", msg.String(), msg.Data())
-				} else {
-					fmt.Println("Could not find message")
+				body := string(msg.Data())
+				if handshake := msg.Handshake(); handshake != nil {
+					body = handshake.String() // instead of the armored key it carries
+				}
+				fmt.Printf("%s\nCID: %s\n%s\n", msg.String(), msg.Cid(), body)
+				if !flags.Has(ipmail.MessageKey(msg), ipmail.FlagSeen) {
+					flags.Set(ipmail.MessageKey(msg), ipmail.FlagSeen)
+					saveFlags(flags, sealer)
 				}
 			}
 		} else if strings.HasPrefix(read, "contacts ") {
 			read = strings.TrimPrefix(read, "contacts ")
 			if strings.HasPrefix(read, "add ") {
-				read = strings.TrimPrefix(read, "add ")
-				println("Parsing entity")
+				locator := strings.TrimSpace(read[4:])
 				go func() {
-					entity, err := util.ParseEntity(read, ipfs)
-					println("Finished parsing entity")
-					if err != nil {
-						fmt.Printf("\"%s\" is not a valid entity\n", read)
-					} else {
-						resolved, err := func() (path.Resolved, error) {
-							buf := bytes.NewBuffer(make([]byte, 0))
-							err := entity.Serialize(buf)
-							if err != nil {
-								return nil, err
-							}
-							return ipfs.AddFromReader(buf)
-						}()
-						if err != nil {
-							contactsHashList.PushBack(nil)
-							println("warning: entity not added to IPFS:", err)
-						} else {
-							contactsHashList.PushBack(resolved.Cid())
-						}
-						contacts.Add(entity)
-						err = contacts.SaveToFile(viper.GetString("contacts"))
-						if err != nil {
-							fmt.Println("warning: contacts could not be saved to file due to:", err.Error())
-						}
-						fmt.Println("Added", util.EntityToString(entity), "to contacts")
-						print("==> ")
-					}
+					addContact(mailbox, ipfs, contactsHashList, locator)
+					print("==> ")
 				}()
+			} else if strings.HasPrefix(read, "accept-key ") {
+				acceptKeyChange(mailbox, ipfs, contactsHashList, strings.TrimSpace(read[len("accept-key "):]))
+			} else if strings.HasPrefix(read, "scan ") {
+				scanContact(scanner, mailbox, ipfs, contactsHashList, strings.TrimSpace(read[5:]))
 			} else if strings.HasPrefix(read, "list") || len(strings.TrimSpace(read)) == 0 {
-				printEntities(read, contacts.ToArray(), contactsHashList)
+				printEntities(read, contacts.ToArray(), contactsHashList, mailbox.Profiles(), mailbox.Details())
+			} else if command := strings.SplitN(read, " ", 2)[0]; command == "remove" || command == "rename" ||
+				command == "note" {
+				runContactCommand(scanner, command, read[len(command):], mailbox, ipfs, contactsHashList)
 			} else if strings.HasPrefix(read, "requests") {
 				read := strings.TrimSpace(read[8:])
-				if strings.HasPrefix(read, "accept") {
-					read = strings.TrimSpace(read[6:])
-					split := strings.Split(read, " ")
-					for _, toAccept := range split {
-						id, err := strconv.ParseUint(toAccept, 10, 64)
-						if err != nil {
-							fmt.Println("warning: could not parse", toAccept, " due to:", err.Error())
-						} else {
-							msg := requests.FromId(id)
-							contacts.Add(msg.From())
-							requests.Remove(msg)
+				if strings.HasPrefix(read, "accept") || strings.HasPrefix(read, "deny") {
+					command := strings.Fields(read)[0]
+					for _, arg := range strings.Fields(read)[1:] {
+						msg, err := findMessage(requests, arg)
+						if err == nil {
+							if command == "accept" {
+								err = mailbox.AcceptRequest(msg)
+								hashes := newEntityHashList(contacts.ToArray(), ipfs, nil)
+								contactsHashList.Init()
+								contactsHashList.PushBackList(hashes)
+							} else {
+								err = mailbox.DenyRequest(msg)
+							}
 						}
-					}
-				} else if strings.HasPrefix(read, "deny") {
-					read = strings.TrimSpace(read[4:])
-					split := strings.Split(read, " ")
-					for _, toDeny := range split {
-						id, err := strconv.ParseUint(toDeny, 10, 64)
 						if err != nil {
-							fmt.Println("warning: could not parse", toDeny, " due to:", err.Error())
-						} else {
-							msg := requests.FromId(id)
-							requests.Remove(msg)
+							println(err.Error())
 						}
 					}
 				} else {
 					println("-- Requests --")
 					requests.ForEach(func(message crypto.Message) {
 						println(message.String())
+						if handshake := message.Handshake(); handshake != nil && len(handshake.Note) > 0 {
+							println("   ", handshake.Note)
+						}
 					})
 				}
 			}
+		} else if strings.HasPrefix(read, "draft") {
+			read = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(read, "drafts"), "draft"))
+			runDraftCommand(read, scanner, drafts, mailbox, sealer)
+		} else if strings.HasPrefix(read, "outbox") {
+			runOutboxCommand(strings.TrimSpace(read[6:]), outbox)
 		} else if strings.HasPrefix(read, "identity") {
 			read = strings.TrimSpace(read[8:])
 			if strings.HasPrefix(read, "share") {
-				read = strings.TrimSpace(read[5:])
-				id := identityHashList.Front().Value.(cid.Cid)
-				read = "send ipfsto:" + read + " ipfs:" + id.String()
-				sharing = true
-				goto send
+				split := strings.SplitN(strings.TrimSpace(read[5:]), " ", 2)
+				note := ""
+				if len(split) > 1 {
+					note = strings.TrimSpace(split[1])
+				}
+				go sendRequest(mailbox, ipfs, split[0], note)
 			} else {
-				printEntities(read, identity.EntityList(), identityHashList)
+				printEntities(read, identity.EntityList(), identityHashList, mailbox.Profiles(), nil)
+				if name, ok := identityName.Load().(string); ok {
+					fmt.Printf("Contacts can also add you by your IPNS name %s, or by name@domain with a DNSLink to it\n", name)
+				}
 			}
+		} else if strings.HasPrefix(read, "profile") {
+			runProfileCommand(strings.TrimSpace(read[7:]), mailbox, func() {
+				publishIdentity(mailbox, ipfs, identityHashList, identityName)
+			})
+		} else if strings.TrimSpace(read) == "passphrase" {
+			runPassphraseCommand(scanner, store)
+		} else if strings.HasPrefix(read, "devices") {
+			runDevicesCommand(scanner, strings.TrimSpace(read[7:]), mailbox, ipfs)
+		} else if strings.TrimSpace(read) == "sync" {
+			runSyncCommand(mailbox)
+		} else if strings.TrimSpace(read) == "gc" {
+			runGcCommand(mailbox)
+		} else if strings.HasPrefix(read, "node") {
+			runNodeCommand(strings.TrimSpace(read[4:]), ipfs)
 		} else if strings.HasPrefix(read, "exit") ||
 			strings.HasPrefix(read, "quit") {
 			return
@@ -368,30 +388,100 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 			println("-------- Commands --------\n")
 			println("help - Prints out this message")
 			println("? - Prints out this message")
+			println("Any <message ID> can also be given as the message CID shown by read")
+			println("archive <message ID>... - Moves messages out of your inbox into the archive")
 			println("contacts [list] - Prints a list of your contacts")
+			println("contacts add <ipmail: link> - Adds a contact by the link they shared, checking its fingerprint")
 			println("contacts add <content ID> - Tries to add a contact by their content ID")
+			println("contacts add <ipns:name|name@domain> - Adds a contact by their IPNS name or DNSLink, following their key changes")
+			println("contacts accept-key <address> - Replaces the key of a contact with the new key their address points to, which their old key didn't certify")
+			println("contacts scan <image file> - Adds a contact by the QR code of their ipmail: link in a PNG or JPEG image once you confirm their fingerprint")
+			println("contacts remove <contact> - Removes a contact found by their fingerprint, nickname, name or email")
+			println("contacts rename <contact> [nickname] - Gives a contact a nickname only you see, or removes it")
+			println("contacts note <contact> [note] - Keeps a note about a contact only you see, or removes it")
+			println("        Quote a <contact> with spaces in it, like \"Jane Doe\"")
 			println("contacts requests - Prints a list of your contact requests")
 			println("contacts requests [accept|deny] <request ID> - Accepts or denies a contact request")
+			println("delete <message ID>... - Moves messages to the trash, or deletes them forever if already there")
+			println("devices - Prints the devices linked to your account")
+			println("devices link <ipmail: link> - Links the device which showed the link to your account, sending it your identity once you confirm its fingerprint")
+			println("draft [list] - Prints a list of your drafts")
+			println("draft new - Writes a new draft in your $EDITOR")
+			println("draft edit <draft ID> - Opens a draft in your $EDITOR")
+			println("draft send <draft ID> - Sends a draft to the contacts on its To line")
+			println("draft delete <draft ID> - Deletes a draft")
 			println("exit - Quits the mail client")
-			println("identity - Prints an IPFS content ID for your default identity")
-			println("identity qrcode - Prints a QR code of your default identity")
-			println("identity share <content ID> - Shares your identity with anyone by their content ID")
+			println("folders [list] - Prints a list of your folders")
+			println("folders [create|delete] <name> - Creates or deletes a folder")
+			println("gc - Unpins sent messages once acknowledged or expired and deleted messages, then frees their space")
+			println("identity - Prints an ipmail: link to share your default identity with, and its IPNS name once published")
+			println("identity qrcode - Prints a QR code of the link to your default identity")
+			println("identity share <ipmail: link|content ID> [note] - Sends a contact request introduced by note to anyone")
+			println("label <message ID>... <label> - Adds a label to messages")
+			println("labels [list] - Prints a list of your labels")
+			println("labels [create|delete] <name> - Creates or deletes a label")
 			println("list - Prints a summary of your received messages")
 			println("list sent - Prints a summary of all your sent messages")
+			println("list <folder> - Prints a summary of the messages in a folder such as archive or trash")
+			println("list label <label> - Prints a summary of the messages with a label")
+			println("list [unread|starred] - Prints a summary of your unread or starred messages")
+			println("mark <message ID>... <seen|starred|answered|forwarded> - Sets a flag on messages")
+			println("move <message ID>... <folder> - Moves messages to a folder")
+			println("node - Prints the peer ID of your IPFS node, which stays the same between runs")
+			println("node export <file> - Saves the peer ID and private key of your IPFS node to a file")
+			println("outbox [list] - Prints the messages waiting to be sent")
+			println("outbox cancel <outbox ID> - Stops a message from being sent")
+			println("outbox retry <outbox ID> - Sends a waiting message right away")
+			println("passphrase - Sets or changes the passphrase your local files are encrypted with")
+			println("profile - Prints your profile, which is published with your identity")
+			println("profile [name|bio] <text> - Sets the display name or bio of your profile")
+			println("profile languages <tag>... - Sets your preferred languages, like en-US de")
+			println("profile avatar <image file|none> - Sets or removes the PNG or JPEG avatar of your profile")
 			println("quit - Quits the mail client")
 			println("read <message ID> - Prints out a received message with a given message ID")
 			println("read sent <message ID> - Prints out a sent message with a given message ID")
-			println("send [to:<contact name>] [ipfsto:<contact content ID>] <message>")
+			println("restore <message ID>... - Moves messages back to your inbox")
+			println("send [to:<contact>] [ipfsto:<contact content ID>] [at:<time>] <message>")
 			println("        Sends a message to recipients listed by to and ipfsto arguments using")
-			println("        the contact's name and contact's content ID, respectively. There can")
+			println("        the contact's name, nickname, email, key ID or a part of them, quoted like")
+			println("        to:\"Alice Smith\" if it has spaces, and the contact's content ID. There can")
 			println("        be as many to and ipfsto arguments as you like and they can even be")
 			println("        in the message and collected, so be careful not to start a word with")
-			println("        \"to:\" or \"ipfsto:\".")
+			println("        \"to:\", \"ipfsto:\" or \"at:\". The message waits in the outbox")
+			println("        until the at time (+10m, 15:04 or 2006-01-02T15:04) or the undo window")
+			println("        has passed.")
+			println("sync - Syncs your contacts, messages, folders and flags with your linked devices right away")
+			println("trash empty - Deletes every message in the trash forever")
+			println("unlabel <message ID>... <label> - Removes a label from messages")
+			println("unmark <message ID>... <seen|starred|answered|forwarded> - Clears a flag on messages")
 		}
 		print("==> ")
 	}
 }
 
+// sendRequest fetches the identity shared as the ipmail: link or content ID to and sends it a contact request
+// introduced by note
+func sendRequest(mailbox ipmail.Mailbox, ipfs ipmail.Transport, to string, note string) {
+	defer print("==> ")
+	locator := to
+	if c, err := cid.Decode(to); err == nil {
+		locator = "ipfs:" + string(c.Bytes())
+	}
+	entity, _, err := crypto.ParseContact(context.Background(), locator, ipfs) // gives up after ipfs-timeout
+	if err != nil {
+		fmt.Printf("\"%s\" is not a valid entity: %s\n", to, err)
+		return
+	}
+	sendAt := time.Now().Add(viper.GetDuration("undo-send"))
+	entry, err := mailbox.SendRequest(note, sendAt, entity)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	fmt.Printf("Contact request %d to %s will be sent at %s, run \"outbox cancel %d\" before then to undo it\n",
+		entry.Id, util.EntityToString(entity), entry.SendAt.Format(time.Stamp), entry.Id)
+}
+
 func chooseFromArray(prompt string, input func() string, array []*gpg.Entity, toString func(entity *gpg.Entity) string) ([]*gpg.Entity, error) {
 	for i, entity := range array {
 		println("", "", i+1, toString(entity))
@@ -432,14 +522,26 @@ func chooseFromArray(prompt string, input func() string, array []*gpg.Entity, to
 	return toEdit, nil
 }
 
-func newEntityHashList(entities gpg.EntityList, ipfs *ipmail.Ipfs) *list.List {
+// newEntityHashList adds entities to IPFS, written by serialize if it isn't nil, like Mailbox.SerializeIdentity
+func newEntityHashList(entities gpg.EntityList, ipfs ipmail.Transport,
+	serialize func(w io.Writer, entity *gpg.Entity) error) *list.List {
 	identityHashList := list.New()
 	buf := bytes.NewBuffer(make([]byte, 0))
 	for _, entity := range entities {
-		if err := entity.Serialize(buf); err != nil {
+		var err error
+		if serialize != nil {
+			err = serialize(buf, entity)
+		} else {
+			err = entity.Serialize(buf)
+		}
+		if err != nil {
+			buf.Reset()
 			continue
 		}
 		resolved, _ := ipfs.AddFromReader(buf)
+		if pinner, ok := ipfs.(ipmail.Pinner); ok && resolved != nil {
+			_ = pinner.Pin(resolved.Cid()) // shared identities are never garbage collected
+		}
 		if resolved != nil {
 			identityHashList.PushBack(resolved.Cid())
 		} else {
@@ -449,7 +551,10 @@ func newEntityHashList(entities gpg.EntityList, ipfs *ipmail.Ipfs) *list.List {
 	return identityHashList
 }
 
-func printEntities(read string, entities gpg.EntityList, hashList *list.List) {
+// printEntities prints the ipmail: links of entities with their profile, and with the nickname and note you
+// gave them if details isn't nil
+func printEntities(read string, entities gpg.EntityList, hashList *list.List, profiles ipmail.ProfileCache,
+	details ipmail.ContactDetails) {
 	printQR := false
 	if strings.EqualFold(read, "qrcode") {
 		printQR = true
@@ -458,17 +563,30 @@ func printEntities(read string, entities gpg.EntityList, hashList *list.List) {
 		if hash.Value == nil {
 			continue
 		}
-		id := hash.Value.(cid.Cid)
 		entity := entities[i]
+		uri := crypto.NewIdentityUri(hash.Value.(cid.Cid), entity).String()
 		entityStr := util.EntityToString(entity)
 		qrStr := ""
 		if printQR {
-			qr, err := qrcode.New(id.String(), qrcode.Low)
+			qr, err := qrcode.New(uri, qrcode.Low)
 			if err != nil {
 				continue
 			}
 			qrStr = qr.ToSmallString(false)
 		}
-		fmt.Printf("%s%s -> %s\n", qrStr, id, entityStr)
+		detail := ipmail.ContactDetail{}
+		if details != nil {
+			detail = details.Get(entity)
+		}
+		if len(detail.Nickname) > 0 {
+			entityStr = "\"" + detail.Nickname + "\" " + entityStr
+		}
+		fmt.Printf("%s%s -> %s\n", qrStr, uri, entityStr)
+		if len(detail.Note) > 0 {
+			fmt.Println("    Note:", strings.ReplaceAll(detail.Note, "\n", "\n    "))
+		}
+		if profile := profiles.Get(entity); profile != nil {
+			printProfile(profile)
+		}
 	}
 }
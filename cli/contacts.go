@@ -0,0 +1,294 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/spf13/viper"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// addContact adds the identity locator points to, keeping its content ID in hashList. An ipmail: link is
+// also checked against the fingerprint in it, and an IPNS name or name@domain address is followed when it changes
+func addContact(mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List, locator string) {
+	if _, err := ipmail.NameOfAddress(locator); err == nil {
+		addContactByName(mailbox, hashList, locator)
+		return
+	}
+	println("Parsing entity")
+	contact, err := crypto.ReadContact(context.Background(), locator, ipfs) // gives up after ipfs-timeout
+	println("Finished parsing entity")
+	if err != nil {
+		fmt.Printf("\"%s\" is not a valid entity: %s\n", locator, err)
+		return
+	}
+	saveContact(mailbox, ipfs, hashList, contact)
+}
+
+// addSharedContact adds the identity shared as an ipmail: link from outside the client, such as a QR code or the
+// link the client was opened with, once you confirmed its fingerprint. Anything else is refused
+func addSharedContact(scanner *bufio.Scanner, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	link string) {
+	uri, err := crypto.ParseIdentityUri(strings.TrimSpace(link))
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	println("Fetching", uri.Cid.String())
+	contact, err := uri.FetchContact(context.Background(), ipfs) // gives up after ipfs-timeout
+	if err != nil {
+		fmt.Printf("The identity shared as %s could not be fetched: %s\n", uri.Cid, err)
+		return
+	}
+	fmt.Printf("Add %s to contacts, fingerprint %X? [y/N]\n> ", util.EntityToString(contact.Entity),
+		contact.Entity.PrimaryKey.Fingerprint)
+	if !scanner.Scan() || !strings.EqualFold(strings.TrimSpace(scanner.Text()), "y") {
+		return
+	}
+	saveContact(mailbox, ipfs, hashList, contact)
+}
+
+// saveContact adds contact to the mailbox, keeping its content ID in hashList
+func saveContact(mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List, contact *crypto.Contact) {
+	entity, bundle := contact.Entity, contact.Bundle
+	resolved, err := func() (path.Resolved, error) {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		err := entity.Serialize(buf)
+		if err != nil {
+			return nil, err
+		}
+		return ipfs.AddFromReader(buf)
+	}()
+	if err != nil {
+		hashList.PushBack(nil)
+		println("warning: entity not added to IPFS:", err)
+	} else {
+		hashList.PushBack(resolved.Cid())
+	}
+	err = mailbox.AddContact(entity, bundle)
+	if err != nil {
+		fmt.Println("warning: prekey bundle of the contact is invalid:", err.Error())
+		_ = mailbox.AddContact(entity, nil)
+	}
+	fmt.Printf("Added %s to contacts, fingerprint %X\n", util.EntityToString(entity), entity.PrimaryKey.Fingerprint)
+	if contact.Profile.Defined() {
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+		defer cancel()
+		err = mailbox.UpdateProfile(ctx, entity, contact.Profile)
+		if err != nil {
+			println("warning: profile of the contact could not be fetched due to:", err.Error())
+		}
+	}
+}
+
+func addContactByName(mailbox ipmail.Mailbox, hashList *list.List, address string) {
+	println("Resolving", address)
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+	defer cancel()
+	entity, c, err := mailbox.AddContactByName(ctx, address)
+	if err != nil {
+		fmt.Printf("\"%s\" could not be resolved to an entity: %s\n", address, err)
+		return
+	}
+	hashList.PushBack(c)
+	fmt.Printf("Added %s to contacts, fingerprint %X\n", util.EntityToString(entity), entity.PrimaryKey.Fingerprint)
+}
+
+// publishIdentity adds your identities to IPFS again with your profile, replacing their content IDs in
+// identityHashList, and points your IPNS name at the default one
+func publishIdentity(mailbox ipmail.Mailbox, ipfs ipmail.Transport, identityHashList *list.List, published *atomic.Value) {
+	hashes := newEntityHashList(mailbox.Identity().EntityList(), ipfs, mailbox.SerializeIdentity)
+	identityHashList.Init()
+	identityHashList.PushBackList(hashes)
+	for e := identityHashList.Front(); e != nil; e = e.Next() {
+		if c, ok := e.Value.(cid.Cid); ok { // identities which couldn't be shared are nil
+			mailbox.PinRemotely(c, "ipmail identity")
+		}
+	}
+	go publishName(mailbox, identityHashList, published)
+}
+
+// publishName points your IPNS name at your default identity, keeping the name in published
+func publishName(mailbox ipmail.Mailbox, identityHashList *list.List, published *atomic.Value) {
+	front := identityHashList.Front()
+	if front == nil || front.Value == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+	defer cancel()
+	name, err := mailbox.PublishName(ctx, front.Value.(cid.Cid))
+	if err == ipmail.ErrNoNameSystem {
+		return
+	} else if err != nil {
+		println("warning: identity could not be published under its IPNS name due to:", err.Error())
+		return
+	}
+	published.Store(name)
+}
+
+// refreshContacts follows the key changes of contacts added by an address every name-refresh
+func refreshContacts(mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List) {
+	interval := viper.GetDuration("name-refresh")
+	if interval <= 0 {
+		return
+	}
+	mailbox.RefreshContactsEvery(context.Background(), interval, func(change ipmail.ContactChange) {
+		if change.Held {
+			fmt.Printf("%s now points to a key with fingerprint %X which %s didn't certify, run \"contacts "+
+				"accept-key %s\" once you checked it with them to replace their key\n", change.Address,
+				change.New.PrimaryKey.Fingerprint, util.EntityToString(change.Old), change.Address)
+			print("==> ")
+			return
+		}
+		hashes := newEntityHashList(mailbox.Contacts().ToArray(), ipfs, nil) // the new key is last in the contacts
+		hashList.Init()
+		hashList.PushBackList(hashes)
+		fmt.Printf("%s changed their key, %s now has fingerprint %X\n", util.EntityToString(change.Old),
+			change.Address, change.New.PrimaryKey.Fingerprint)
+		print("==> ")
+	})
+}
+
+// acceptKeyChange replaces the key of the contact added by address with the key change RefreshContacts held
+func acceptKeyChange(mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List, address string) {
+	for _, change := range mailbox.HeldContactChanges() {
+		if change.Address != address {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+		defer cancel()
+		err := mailbox.AcceptContactChange(ctx, change)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		hashes := newEntityHashList(mailbox.Contacts().ToArray(), ipfs, nil)
+		hashList.Init()
+		hashList.PushBackList(hashes)
+		fmt.Printf("Replaced the key of %s, %s now has fingerprint %X\n", util.EntityToString(change.Old),
+			address, change.New.PrimaryKey.Fingerprint)
+		return
+	}
+	fmt.Printf("No key change of %s is waiting\n", address)
+}
+
+// scanContact adds the identity shared by the QR code in a PNG or JPEG image, like addSharedContact
+func scanContact(scanner *bufio.Scanner, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	text, err := util.DecodeQrCode(f)
+	_ = f.Close()
+	if err != nil {
+		fmt.Printf("No QR code found in %s: %s\n", file, err)
+		return
+	}
+	addSharedContact(scanner, mailbox, ipfs, hashList, text)
+}
+
+// splitArgument splits the first argument off read, which can be quoted to contain spaces
+func splitArgument(read string) (string, string) {
+	read = strings.TrimSpace(read)
+	if strings.HasPrefix(read, "\"") {
+		if end := strings.Index(read[1:], "\""); end >= 0 {
+			return read[1 : end+1], strings.TrimSpace(read[end+2:])
+		}
+	}
+	split := strings.SplitN(read, " ", 2)
+	if len(split) < 2 {
+		return split[0], ""
+	}
+	return split[0], strings.TrimSpace(split[1])
+}
+
+// findContact finds the one contact that matches arg best, like ipmail.FindContacts, asking the user whether a
+// contact that only matched weakly is the one they meant
+func findContact(scanner *bufio.Scanner, mailbox ipmail.Mailbox, arg string) (*gpg.Entity, error) {
+	if len(arg) == 0 {
+		return nil, errors.New("no contact given")
+	}
+	matches := ipmail.FindContacts(mailbox.Contacts().ToArray(), mailbox.Details(), arg)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no contact matches \"%s\"", arg)
+	} else if best := matches.Best(); best != nil {
+		return best, nil
+	} else if closest := matches.Closest(); closest != nil {
+		fmt.Printf("Did you mean %s, fingerprint %X? [y/N]\n> ", util.EntityToString(closest),
+			closest.PrimaryKey.Fingerprint)
+		if !scanner.Scan() || !strings.EqualFold(strings.TrimSpace(scanner.Text()), "y") {
+			return nil, fmt.Errorf("no contact chosen for \"%s\"", arg)
+		}
+		return closest, nil
+	}
+	return nil, fmt.Errorf("%d contacts match \"%s\" equally well, give their fingerprint instead", len(matches), arg)
+}
+
+// findRecipients finds the contact query is for, asking the user to choose when several match equally well or
+// none matches closely
+func findRecipients(scanner *bufio.Scanner, mailbox ipmail.Mailbox, query string) ([]*gpg.Entity, error) {
+	matches := ipmail.FindContacts(mailbox.Contacts().ToArray(), mailbox.Details(), query)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("\"%s\" is not in your contacts", query)
+	} else if best := matches.Best(); best != nil {
+		return []*gpg.Entity{best}, nil
+	}
+	if matches.Closest() != nil {
+		fmt.Printf("No contact matches \"%s\" closely:\n", query)
+	} else {
+		println("More than one contact found:")
+	}
+	return chooseFromArray("Send to who?", func() string {
+		scanner.Scan()
+		return scanner.Text()
+	}, matches.Entities(), util.EntityToString)
+}
+
+// runContactCommand removes a contact or changes their nickname or note, keeping hashList parallel to the
+// contacts
+func runContactCommand(scanner *bufio.Scanner, command string, read string, mailbox ipmail.Mailbox, ipfs ipmail.Transport,
+	hashList *list.List) {
+	arg, value := splitArgument(read)
+	contact, err := findContact(scanner, mailbox, arg)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	detail, changed := mailbox.Details().Get(contact), "nickname"
+	switch command {
+	case "remove":
+		err = mailbox.RemoveContact(contact)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		hashes := newEntityHashList(mailbox.Contacts().ToArray(), ipfs, nil)
+		hashList.Init()
+		hashList.PushBackList(hashes)
+		fmt.Printf("Removed %s from contacts\n", util.EntityToString(contact))
+		return
+	case "rename":
+		detail.Nickname = value
+	case "note":
+		detail.Note, changed = value, "note"
+	}
+	err = mailbox.SetContactDetail(contact, detail)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	fmt.Printf("Changed the %s of %s\n", changed, util.EntityToString(contact))
+}
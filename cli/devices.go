@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/viper"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"strings"
+)
+
+// linkThisDevice shows a link for the device already using your account to link this one with, and waits for
+// it. It returns nil if the user doesn't confirm the account the link is to
+func linkThisDevice(scanner *bufio.Scanner, ipfs ipmail.Transport, receiver ipmail.Receiver) *crypto.DeviceLink {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "ipmail device"
+	}
+	device, err := crypto.NewDeviceKey(name)
+	if err != nil {
+		println(err.Error())
+		return nil
+	}
+	link, err := ipmail.ShareDeviceKey(ipfs, device)
+	if err != nil {
+		println("the key of this device could not be shared due to:", err.Error())
+		return nil
+	}
+	if qr, err := qrcode.New(link, qrcode.Low); err == nil {
+		fmt.Print(qr.ToSmallString(false))
+	}
+	fmt.Println(link)
+	fmt.Printf("This device has fingerprint %X\n", device.PrimaryKey.Fingerprint)
+	fmt.Println("On the device already using your account, run \"devices link\" with the link above.")
+	fmt.Println("Waiting for it to link this device...")
+	linked, err := ipmail.WaitForDeviceLink(context.Background(), receiver, ipfs, device)
+	if err != nil {
+		println(err.Error())
+		return nil
+	}
+	self := linked.Identity.DefaultIdentity()
+	fmt.Printf("This device was linked to %s, fingerprint %X\n", util.EntityToString(self), self.PrimaryKey.Fingerprint)
+	fmt.Print("Is this your account? [y/N]\n> ")
+	if !scanner.Scan() || !strings.EqualFold(strings.TrimSpace(scanner.Text()), "y") {
+		return nil
+	}
+	return linked
+}
+
+// startSync syncs the mailbox with your other devices in the background, first from head if it is defined
+func startSync(mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List, head cid.Cid) {
+	onSynced := func(result ipmail.SyncResult) {
+		if result.Merged == 0 {
+			return
+		}
+		hashes := newEntityHashList(mailbox.Contacts().ToArray(), ipfs, nil)
+		hashList.Init()
+		hashList.PushBackList(hashes)
+		fmt.Println("Synced", result.Merged, "changes from your other devices")
+		print("==> ")
+	}
+	if head.Defined() {
+		go func() {
+			result, err := mailbox.Sync(context.Background(), head)
+			if err != nil {
+				println("warning: your devices could not be synced due to:", err.Error())
+			}
+			onSynced(result)
+		}()
+	}
+	if interval := viper.GetDuration("sync-interval"); interval > 0 {
+		mailbox.SyncEvery(context.Background(), interval, onSynced)
+	}
+}
+
+func runDevicesCommand(scanner *bufio.Scanner, read string, mailbox ipmail.Mailbox, ipfs ipmail.Transport) {
+	if strings.HasPrefix(read, "link ") {
+		linkDevice(scanner, mailbox, ipfs, strings.TrimSpace(read[5:]))
+		return
+	}
+	devices := mailbox.Devices()
+	if len(devices) == 0 {
+		fmt.Println("No devices are linked to your account")
+		return
+	}
+	println("-- Devices --")
+	for _, device := range devices {
+		fmt.Printf("%s, fingerprint %s\n", device.Name, strings.ToUpper(device.Fingerprint))
+	}
+}
+
+// linkDevice sends a link to your account to the device which showed the ipmail: link, once you confirmed the
+// fingerprint it shows
+func linkDevice(scanner *bufio.Scanner, mailbox ipmail.Mailbox, ipfs ipmail.Transport, link string) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+	defer cancel()
+	device, err := ipmail.FetchDeviceKey(ctx, ipfs, link)
+	if err != nil {
+		fmt.Printf("\"%s\" is not a valid device link: %s\n", link, err)
+		return
+	}
+	fmt.Printf("Send your private identity to %s, fingerprint %X? Only confirm if the new device shows this "+
+		"fingerprint [y/N]\n> ", util.EntityToString(device), device.PrimaryKey.Fingerprint)
+	if !scanner.Scan() || !strings.EqualFold(strings.TrimSpace(scanner.Text()), "y") {
+		return
+	}
+	err = mailbox.LinkDevice(ctx, device)
+	if err != nil {
+		println("the device could not be linked due to:", err.Error())
+		return
+	}
+	fmt.Printf("Linked %s, fingerprint %X. It now has your identity and syncs with this device\n",
+		util.EntityToString(device), device.PrimaryKey.Fingerprint)
+}
+
+func runSyncCommand(mailbox ipmail.Mailbox) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+	defer cancel()
+	result, err := mailbox.Sync(ctx)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	fmt.Println("Synced", result.Merged, "changes from your other devices and sent them", result.Recorded, "changes")
+	if result.Pending > 0 {
+		fmt.Println(result.Pending, "changes can't be applied yet, like messages which couldn't be fetched")
+	}
+}
@@ -0,0 +1,205 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const draftTemplateHelp = "# Lines starting with '#' are ignored. Separate recipients with commas.\n"
+
+func editor() string {
+	if e := os.Getenv("VISUAL"); len(e) > 0 {
+		return e
+	}
+	if e := os.Getenv("EDITOR"); len(e) > 0 {
+		return e
+	}
+	return "vi"
+}
+
+// editDraft opens the user's editor on a temporary file holding draft and reads the result back into it
+func editDraft(draft *ipmail.Draft) error {
+	f, err := ioutil.TempFile("", "ipmail-draft-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = fmt.Fprintf(f, "%sTo: %s\nSubject: %s\n\n%s",
+		draftTemplateHelp, strings.Join(draft.To, ", "), draft.Subject, draft.Body)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	split := strings.Fields(editor())
+	cmd := exec.Command(split[0], append(split[1:], f.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("editor exited with an error: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	parseDraft(string(b), draft)
+	return nil
+}
+
+// parseDraft reads the headers and body written by editDraft
+func parseDraft(text string, draft *ipmail.Draft) {
+	draft.To = nil
+	draft.Subject = ""
+	lines := strings.Split(text, "\n")
+	i := 0
+	for ; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			i++
+			break
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			break // not a header so the body starts here
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(strings.TrimSpace(line[:colon])) {
+		case "to":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); len(name) > 0 {
+					draft.To = append(draft.To, name)
+				}
+			}
+		case "subject":
+			draft.Subject = value
+		}
+	}
+	draft.Body = strings.TrimRight(strings.Join(lines[i:], "\n"), "\n")
+}
+
+func saveDrafts(drafts ipmail.DraftList, identity crypto.SelfIdentity, sealer util.Sealer) {
+	err := drafts.SaveToFile(viper.GetString("drafts"), sealer, identity)
+	if err != nil {
+		println("warning: drafts could not be saved to file due to:", err.Error())
+	}
+}
+
+func draftFromArg(arg string, drafts ipmail.DraftList) (*ipmail.Draft, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(arg), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	draft := drafts.FromId(id)
+	if draft == nil {
+		return nil, errors.New("could not find draft " + arg)
+	}
+	return draft, nil
+}
+
+// resolveRecipients finds the contacts a draft is addressed to, asking the user when a name is ambiguous or weak
+func resolveRecipients(scanner *bufio.Scanner, names []string, mailbox ipmail.Mailbox) ([]*gpg.Entity, error) {
+	result := make([]*gpg.Entity, 0)
+	for _, name := range names {
+		found, err := findRecipients(scanner, mailbox, name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, found...)
+	}
+	return result, nil
+}
+
+func runDraftCommand(read string, scanner *bufio.Scanner, drafts ipmail.DraftList, mailbox ipmail.Mailbox,
+	sealer util.Sealer) {
+	identity := mailbox.Identity()
+	split := strings.SplitN(read, " ", 2)
+	arg := ""
+	if len(split) > 1 {
+		arg = split[1]
+	}
+	switch split[0] {
+	case "new":
+		draft := drafts.New()
+		err := editDraft(draft)
+		if err != nil {
+			drafts.Remove(draft.Id) // New already added it
+			println("warning: draft could not be edited due to:", err.Error())
+			return
+		}
+		drafts.Update(draft)
+		saveDrafts(drafts, identity, sealer)
+		fmt.Println("Saved draft", draft.Id)
+	case "edit":
+		draft, err := draftFromArg(arg, drafts)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		err = editDraft(draft)
+		if err != nil {
+			println("warning: draft could not be edited due to:", err.Error())
+			return
+		}
+		drafts.Update(draft)
+		saveDrafts(drafts, identity, sealer)
+		fmt.Println("Saved draft", draft.Id)
+	case "send":
+		draft, err := draftFromArg(arg, drafts)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		to, err := resolveRecipients(scanner, draft.To, mailbox)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		if len(to) == 0 {
+			fmt.Println("Message has no Recipient")
+			return
+		}
+		err = queueMessage(mailbox, draft.Content(), time.Time{}, to...)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		drafts.Remove(draft.Id)
+		saveDrafts(drafts, identity, sealer)
+	case "delete":
+		draft, err := draftFromArg(arg, drafts)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		drafts.Remove(draft.Id)
+		saveDrafts(drafts, identity, sealer)
+	case "list", "":
+		println("--- Drafts ---")
+		drafts.ForEach(func(draft *ipmail.Draft) {
+			println(draft.String())
+		})
+	default:
+		fmt.Printf("Unknown draft command \"%s\"\n", split[0])
+	}
+}
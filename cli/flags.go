@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+)
+
+func saveFlags(flags ipmail.MessageFlags, sealer util.Sealer) {
+	err := flags.SaveToFile(viper.GetString("flags"), sealer)
+	if err != nil {
+		println("warning: message flags could not be saved to file due to:", err.Error())
+	}
+}
+
+// runMarkCommand handles "mark" and "unmark" which set or clear a flag such as read or starred on messages
+func runMarkCommand(command string, read string,
+	messages ipmail.MessageList, sent ipmail.MessageList, flags ipmail.MessageFlags, sealer util.Sealer) {
+	args := strings.Fields(read)
+	if len(args) < 2 {
+		fmt.Printf("%s needs at least one message ID and a flag\n", command)
+		return
+	}
+	flag, err := ipmail.ParseMessageFlag(args[len(args)-1])
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	all := ipmail.NewMessageListView(func(message crypto.Message) bool { return true }, messages, sent)
+	for _, arg := range args[:len(args)-1] {
+		msg, err := findMessage(all, arg)
+		if err != nil {
+			println(err.Error())
+			continue
+		}
+		if command == "mark" {
+			flags.Set(ipmail.MessageKey(msg), flag)
+		} else {
+			flags.Clear(ipmail.MessageKey(msg), flag)
+		}
+	}
+	saveFlags(flags, sealer)
+}
@@ -0,0 +1,212 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/spf13/viper"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strconv"
+	"strings"
+)
+
+func saveLabels(labels ipmail.MessageLabels, sealer util.Sealer) {
+	err := labels.SaveToFile(viper.GetString("labels"), sealer)
+	if err != nil {
+		println("warning: folders and labels could not be saved to file due to:", err.Error())
+	}
+}
+
+func saveMessageLists(messages ipmail.MessageList, sent ipmail.MessageList, sealer util.Sealer) {
+	err := messages.SaveToFile(viper.GetString("messages"), sealer)
+	if err != nil {
+		println("warning: received messages could not be saved to file due to:", err.Error())
+	}
+	err = sent.SaveToFile(viper.GetString("sent"), sealer)
+	if err != nil {
+		println("warning: sent messages could not be saved to file due to:", err.Error())
+	}
+}
+
+// findMessage looks a message up in list by its local ID, or by its CID for IDs which are ambiguous. Local IDs are
+// only unique within the inbox, sent or requests list, so an ID of a view over several of them may be ambiguous
+func findMessage(list ipmail.MessageList, arg string) (crypto.Message, error) {
+	var msg crypto.Message = nil
+	if id, err := strconv.ParseUint(arg, 10, 64); err == nil {
+		found := 0
+		list.ForEach(func(message crypto.Message) {
+			if message.Id() == id {
+				msg = message
+				found++
+			}
+		})
+		if found > 1 {
+			return nil, fmt.Errorf("more than one message has ID %d, use the CID which read shows instead", id)
+		}
+	} else if c, err := cid.Parse(arg); err == nil {
+		msg = list.FromCid(c)
+	} else {
+		return nil, fmt.Errorf("\"%s\" is neither a message ID nor a CID", arg)
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("could not find message %s", arg)
+	}
+	return msg, nil
+}
+
+func printMessages(title string, list ipmail.MessageList, labels ipmail.MessageLabels, flags ipmail.MessageFlags) {
+	println(title)
+	list.ForEach(func(message crypto.Message) {
+		line := fmt.Sprintf("%-3s %s", flags.Flags(ipmail.MessageKey(message)).Marks(), message.String())
+		if messageLabels := labels.Labels(ipmail.MessageKey(message)); len(messageLabels) > 0 {
+			line += " [" + strings.Join(messageLabels, ", ") + "]"
+		}
+		println(line)
+	})
+}
+
+// runListCommand prints the messages in the folder or label named by read, or the inbox by default
+func runListCommand(read string, messages ipmail.MessageList, sent ipmail.MessageList,
+	labels ipmail.MessageLabels, flags ipmail.MessageFlags) {
+	all := ipmail.NewMessageListView(func(message crypto.Message) bool { return true }, messages, sent)
+	switch {
+	case strings.HasPrefix(read, "sent"):
+		printMessages("---- Sent ----", ipmail.NewMessageListView(ipmail.NotInTrash(labels), sent), labels, flags)
+	case strings.HasPrefix(read, "label "):
+		label := strings.TrimSpace(read[6:])
+		printMessages("--- "+label+" ---", ipmail.NewMessageListView(ipmail.WithLabel(labels, label), all), labels, flags)
+	case strings.EqualFold(read, "unread"):
+		unread := func(message crypto.Message) bool {
+			return !flags.Has(ipmail.MessageKey(message), ipmail.FlagSeen)
+		}
+		printMessages("--- Unread ---", ipmail.NewMessageListView(unread,
+			ipmail.NewMessageListView(ipmail.NotInTrash(labels), messages)), labels, flags)
+	case strings.EqualFold(read, "starred"):
+		printMessages("--- Starred --", ipmail.NewMessageListView(ipmail.WithFlag(flags, ipmail.FlagStarred),
+			ipmail.NewMessageListView(ipmail.NotInTrash(labels), all)), labels, flags)
+	case len(read) == 0 || strings.EqualFold(read, "inbox"):
+		inbox := ipmail.NewMessageListView(ipmail.InFolder(labels, ipmail.InboxFolder), messages)
+		printMessages(fmt.Sprintf("--- Inbox (%d unread) ---", flags.Unseen(inbox)), inbox, labels, flags)
+	default:
+		printMessages("--- "+read+" ---", ipmail.NewMessageListView(ipmail.InFolder(labels, read), all), labels, flags)
+	}
+}
+
+// runFolderCommand handles "folders" and "labels" which manage the folder and label names
+func runFolderCommand(kind string, read string, labels ipmail.MessageLabels, sealer util.Sealer) {
+	split := strings.SplitN(read, " ", 2)
+	name := ""
+	if len(split) > 1 {
+		name = strings.TrimSpace(split[1])
+	}
+	var err error = nil
+	switch split[0] {
+	case "", "list":
+		names := labels.LabelNames()
+		if kind == "folders" {
+			names = append([]string{"Inbox", ipmail.ArchiveFolder, ipmail.TrashFolder}, labels.Folders()...)
+		}
+		for _, n := range names {
+			println(n)
+		}
+		return
+	case "create":
+		if kind == "folders" {
+			err = labels.CreateFolder(name)
+		} else {
+			err = labels.CreateLabel(name)
+		}
+	case "delete":
+		if kind == "folders" {
+			err = labels.DeleteFolder(name)
+		} else {
+			err = labels.DeleteLabel(name)
+		}
+	default:
+		fmt.Printf("Unknown %s command \"%s\"\n", kind, split[0])
+		return
+	}
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	saveLabels(labels, sealer)
+}
+
+// runMessageCommand handles the commands which file a message: move, archive, delete, restore, label and unlabel
+func runMessageCommand(command string, read string, messages ipmail.MessageList, sent ipmail.MessageList,
+	labels ipmail.MessageLabels, flags ipmail.MessageFlags, sealer util.Sealer) {
+	args := strings.Fields(read)
+	target := ""
+	switch command {
+	case "move", "label", "unlabel":
+		if len(args) < 2 {
+			fmt.Printf("%s needs at least one message ID and a name\n", command)
+			return
+		}
+		target = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+	all := ipmail.NewMessageListView(func(message crypto.Message) bool { return true }, messages, sent)
+	listsChanged := false
+	for _, arg := range args {
+		msg, err := findMessage(all, arg)
+		if err != nil {
+			println(err.Error())
+			continue
+		}
+		key := ipmail.MessageKey(msg)
+		switch command {
+		case "move":
+			err = labels.Move(key, target)
+		case "archive":
+			err = labels.Move(key, ipmail.ArchiveFolder)
+		case "restore":
+			err = labels.Move(key, ipmail.InboxFolder)
+		case "delete":
+			if labels.Folder(key) == ipmail.TrashFolder {
+				ipmail.DeleteForever(labels, key, messages, sent)
+				flags.Forget(key)
+				listsChanged = true
+				fmt.Println("Message", arg, "deleted forever")
+			} else {
+				err = labels.Move(key, ipmail.TrashFolder)
+			}
+		case "label":
+			err = labels.AddLabel(key, target)
+		case "unlabel":
+			labels.RemoveLabel(key, target)
+		}
+		if err != nil {
+			println(err.Error())
+		}
+	}
+	if listsChanged {
+		saveMessageLists(messages, sent, sealer)
+		saveFlags(flags, sealer)
+	}
+	saveLabels(labels, sealer)
+}
+
+// emptyTrash permanently deletes trashed messages older than the trash-retention setting,
+// or every trashed message if all is set
+func emptyTrash(all bool, messages ipmail.MessageList, sent ipmail.MessageList,
+	labels ipmail.MessageLabels, flags ipmail.MessageFlags, sealer util.Sealer) {
+	retention := viper.GetDuration("trash-retention")
+	if all {
+		retention = -1
+	}
+	deleted := ipmail.PurgeTrash(labels, retention, messages, sent)
+	if len(deleted) > 0 {
+		for _, key := range deleted {
+			flags.Forget(key)
+		}
+		saveMessageLists(messages, sent, sealer)
+		saveLabels(labels, sealer)
+		saveFlags(flags, sealer)
+		if all {
+			fmt.Println("Deleted", len(deleted), "messages from the trash")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"fmt"
+	"ipmail/libipmail"
+	"os"
+	"strings"
+)
+
+func runNodeCommand(read string, ipfs ipmail.Transport) {
+	node, ok := ipfs.(ipmail.NodeIdentity)
+	if !ok {
+		println("the IPFS node is run by a daemon, use its own tools to manage it")
+		return
+	}
+	if strings.HasPrefix(read, "export ") {
+		file := strings.TrimSpace(strings.TrimPrefix(read, "export "))
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		err = node.ExportIdentity(f)
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			println("node identity could not be exported due to:", err.Error())
+			return
+		}
+		fmt.Println("Exported node identity to", file, "- keep it secret, it contains the node's private key")
+		return
+	}
+	id, err := node.PeerId()
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	fmt.Println("Peer ID:", id.Pretty())
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for i := n / unit; i >= unit; i /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func runGcCommand(mailbox ipmail.Mailbox) {
+	result, err := mailbox.CollectGarbage()
+	fmt.Println("Unpinned", result.Unpinned, "messages, deleted", result.Bodies, "message bodies and freed",
+		formatBytes(result.Freed))
+	if err == ipmail.ErrDaemonGcOff {
+		fmt.Println("The IPFS daemon wasn't garbage collected since other applications may share it, " +
+			"run with -ipfs-api-gc to allow it")
+	} else if err != nil {
+		println("garbage collection failed due to:", err.Error())
+	}
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/spf13/viper"
+	"io"
+	"ipmail/libipmail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queueMessage encrypts content for to and puts it in the outbox to be sent at sendAt,
+// or once the undo window has passed if sendAt is earlier
+func queueMessage(mailbox ipmail.Mailbox, content io.Reader, sendAt time.Time, to ...*gpg.Entity) error {
+	undoUntil := time.Now().Add(viper.GetDuration("undo-send"))
+	if sendAt.Before(undoUntil) {
+		sendAt = undoUntil
+	}
+	entry, err := mailbox.Queue(content, sendAt, to...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Message %d will be sent at %s, run \"outbox cancel %d\" before then to undo it\n",
+		entry.Id, entry.SendAt.Format(time.Stamp), entry.Id)
+	return nil
+}
+
+func printOutboxUpdates(outbox ipmail.Outbox) {
+	outbox.OnChange(func(entry ipmail.OutboxEntry) {
+		switch entry.State {
+		case ipmail.OutboxSent:
+			fmt.Printf("\nMessage %d Sent with CID: %s\n", entry.Id, entry.Cid)
+		case ipmail.OutboxRetrying:
+			fmt.Printf("\nwarning: message %d could not be sent due to: %s (retrying at %s)\n",
+				entry.Id, entry.LastError, entry.NextAttempt.Format(time.Stamp))
+		default:
+			return
+		}
+		print("==> ")
+	})
+}
+
+func runOutboxCommand(read string, outbox ipmail.Outbox) {
+	split := strings.Fields(read)
+	if len(split) == 0 || split[0] == "list" {
+		println("--- Outbox ---")
+		outbox.ForEach(func(entry ipmail.OutboxEntry) {
+			println(entry.String())
+		})
+		return
+	}
+	for _, arg := range split[1:] {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			fmt.Println("warning: could not parse", arg, "due to:", err.Error())
+			continue
+		}
+		switch split[0] {
+		case "cancel":
+			err = outbox.Cancel(id)
+			if err == nil {
+				fmt.Println("Message", id, "cancelled")
+			}
+		case "retry":
+			err = outbox.SendNow(id)
+		default:
+			fmt.Printf("Unknown outbox command \"%s\"\n", split[0])
+			return
+		}
+		if err != nil {
+			println(err.Error())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/Geo25rey/crypto/ssh/terminal"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"os"
+)
+
+// readPassphrase reads a line without echoing it when stdin is a terminal
+func readPassphrase(scanner *bufio.Scanner, field string) ([]byte, bool) {
+	fmt.Printf("==> %s\n==> ", field)
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		passphrase, err := terminal.ReadPassword(fd)
+		fmt.Println() // the enter key wasn't echoed either
+		return passphrase, err == nil
+	}
+	if !scanner.Scan() {
+		return nil, false
+	}
+	return append([]byte{}, scanner.Bytes()...), true
+}
+
+// unlock asks for the passphrase until it is right, returning false if the input ends first
+func unlock(scanner *bufio.Scanner, store ipmail.LocalStore) bool {
+	for store.Locked() {
+		passphrase, ok := readPassphrase(scanner, "Enter your passphrase to unlock your mail")
+		if !ok {
+			return false
+		}
+		err := store.Unlock(passphrase)
+		if err == crypto.ErrWrongPassphrase {
+			println("Wrong passphrase, try again")
+		} else if err != nil {
+			println(err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+func runPassphraseCommand(scanner *bufio.Scanner, store ipmail.LocalStore) {
+	passphrase, ok := readPassphrase(scanner, "Enter the new passphrase")
+	if !ok {
+		return
+	}
+	repeated, ok := readPassphrase(scanner, "Repeat the new passphrase")
+	if !ok {
+		return
+	}
+	if len(passphrase) == 0 || !bytes.Equal(passphrase, repeated) {
+		println("The passphrases are empty or don't match, nothing was changed")
+		return
+	}
+	err := store.SetPassphrase(passphrase)
+	if err != nil {
+		println("passphrase could not be set due to:", err.Error())
+		return
+	}
+	fmt.Println("Your local files are encrypted with the new passphrase, which is asked for at startup")
+}
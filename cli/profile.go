@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"strings"
+)
+
+func printProfile(profile *crypto.Profile) {
+	line := "    " + profile.DisplayName
+	if len(profile.Languages) > 0 {
+		line += " (" + strings.Join(profile.Languages, ", ") + ")"
+	}
+	if len(profile.Avatar) > 0 {
+		line += " [avatar]"
+	}
+	fmt.Println(line)
+	if len(profile.Bio) > 0 {
+		fmt.Println("    " + strings.ReplaceAll(profile.Bio, "\n", "\n    "))
+	}
+}
+
+// runProfileCommand prints or changes your profile, calling republish once it changed so contacts see it
+func runProfileCommand(read string, mailbox ipmail.Mailbox, republish func()) {
+	self := mailbox.Identity().DefaultIdentity()
+	profile := crypto.Profile{}
+	if current := mailbox.Profiles().Get(self); current != nil {
+		profile = *current
+	}
+	split := strings.SplitN(read, " ", 2)
+	value := ""
+	if len(split) > 1 {
+		value = strings.TrimSpace(split[1])
+	}
+	switch split[0] {
+	case "":
+		if mailbox.Profiles().Get(self) == nil {
+			println("You have no profile yet")
+		} else {
+			printProfile(&profile)
+		}
+		return
+	case "name":
+		profile.DisplayName = value
+	case "bio":
+		profile.Bio = value
+	case "languages":
+		profile.Languages = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	case "avatar":
+		if value == "none" {
+			profile.Avatar = nil
+			break
+		}
+		avatar, err := ioutil.ReadFile(value)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		profile.Avatar = avatar
+	default:
+		fmt.Printf("Unknown profile command \"%s\"\n", split[0])
+		return
+	}
+	_, err := mailbox.SetProfile(profile)
+	if err != nil {
+		println("profile could not be changed due to:", err.Error())
+		return
+	}
+	republish()
+	println("Profile changed, contacts see it once they fetch your identity again")
+}
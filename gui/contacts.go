@@ -0,0 +1,274 @@
+package gui
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"fyne.io/fyne"
+	"fyne.io/fyne/container"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/storage"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"github.com/spf13/viper"
+	views "ipmail/gui/fyne_views"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+	"sync/atomic"
+)
+
+// addContact adds the identity locator points to, keeping its content ID in hashList. An ipmail: link is
+// also checked against the fingerprint in it, and an IPNS name or name@domain address is followed when it changes
+func addContact(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	onAdded func(), locator string) {
+	if _, err := ipmail.NameOfAddress(locator); err == nil {
+		addContactByName(window, mailbox, hashList, onAdded, locator)
+		return
+	}
+	go func() {
+		contact, err := crypto.ReadContact(context.Background(), locator, ipfs) // gives up after ipfs-timeout
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		saveContact(window, mailbox, ipfs, hashList, onAdded, contact)
+	}()
+}
+
+// addSharedContact adds the identity shared as an ipmail: link from outside the app, such as a QR code or the link
+// the app was opened with, once you confirmed its fingerprint. Anything else is refused
+func addSharedContact(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	onAdded func(), link string) {
+	uri, err := crypto.ParseIdentityUri(strings.TrimSpace(link))
+	if err != nil {
+		dialog.ShowError(err, window)
+		return
+	}
+	go func() {
+		contact, err := uri.FetchContact(context.Background(), ipfs) // gives up after ipfs-timeout
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		entity := contact.Entity
+		dialog.ShowConfirm("Add Contact", fmt.Sprintf("Add %s to your contacts?\nFingerprint: %X",
+			util.EntityToString(entity), entity.PrimaryKey.Fingerprint), func(confirmed bool) {
+			if confirmed {
+				go saveContact(window, mailbox, ipfs, hashList, onAdded, contact)
+			}
+		}, window)
+	}()
+}
+
+// saveContact adds contact to the mailbox, keeping its content ID in hashList
+func saveContact(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	onAdded func(), contact *crypto.Contact) {
+	entity, bundle := contact.Entity, contact.Bundle
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err := entity.Serialize(buf)
+	if err == nil {
+		resolved, err := ipfs.AddFromReader(buf)
+		if err == nil {
+			hashList.PushBack(resolved.Cid())
+		} else {
+			hashList.PushBack(nil)
+		}
+	}
+	err = mailbox.AddContact(entity, bundle)
+	if err != nil {
+		println("warning: prekey bundle of the contact is invalid:", err.Error())
+		_ = mailbox.AddContact(entity, nil)
+	}
+	if contact.Profile.Defined() {
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+		err = mailbox.UpdateProfile(ctx, entity, contact.Profile)
+		cancel()
+		if err != nil {
+			println("warning: profile of the contact could not be fetched due to:", err.Error())
+		}
+	}
+	onAdded()
+	dialog.ShowInformation("Contact Added", fmt.Sprintf("%s\nFingerprint: %X",
+		util.EntityToString(entity), entity.PrimaryKey.Fingerprint), window)
+}
+
+func addContactByName(window fyne.Window, mailbox ipmail.Mailbox, hashList *list.List, onAdded func(), address string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+		defer cancel()
+		entity, c, err := mailbox.AddContactByName(ctx, address)
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		hashList.PushBack(c)
+		onAdded()
+		dialog.ShowInformation("Contact Added", fmt.Sprintf("%s\nAddress: %s\nFingerprint: %X",
+			util.EntityToString(entity), address, entity.PrimaryKey.Fingerprint), window)
+	}()
+}
+
+// publishIdentity adds your identities to IPFS again with your profile, replacing their content IDs in
+// identityHashList, and points your IPNS name at the default one
+func publishIdentity(mailbox ipmail.Mailbox, ipfs ipmail.Transport, identityHashList *list.List, published *atomic.Value) {
+	hashes := newEntityHashList(mailbox.Identity().EntityList(), ipfs, mailbox.SerializeIdentity)
+	identityHashList.Init()
+	identityHashList.PushBackList(hashes)
+	for e := identityHashList.Front(); e != nil; e = e.Next() {
+		if c, ok := e.Value.(cid.Cid); ok { // identities which couldn't be shared are nil
+			mailbox.PinRemotely(c, "ipmail identity")
+		}
+	}
+	go publishName(mailbox, identityHashList, published)
+}
+
+// publishName points your IPNS name at your default identity, keeping the name in published
+func publishName(mailbox ipmail.Mailbox, identityHashList *list.List, published *atomic.Value) {
+	front := identityHashList.Front()
+	if front == nil || front.Value == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+	defer cancel()
+	name, err := mailbox.PublishName(ctx, front.Value.(cid.Cid))
+	if err == ipmail.ErrNoNameSystem {
+		return
+	} else if err != nil {
+		println("warning: identity could not be published under its IPNS name due to:", err.Error())
+		return
+	}
+	published.Store(name)
+}
+
+// refreshContacts follows the key changes of contacts added by an address every name-refresh
+func refreshContacts(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	onChanged func()) {
+	interval := viper.GetDuration("name-refresh")
+	if interval <= 0 {
+		return
+	}
+	mailbox.RefreshContactsEvery(context.Background(), interval, func(change ipmail.ContactChange) {
+		if change.Held {
+			promptKeyChange(window, mailbox, ipfs, hashList, onChanged, change)
+			return
+		}
+		hashes := newEntityHashList(mailbox.Contacts().ToArray(), ipfs, nil) // the new key is last in the contacts
+		hashList.Init()
+		hashList.PushBackList(hashes)
+		onChanged()
+		dialog.ShowInformation("Contact Key Changed", fmt.Sprintf("%s changed their key\nAddress: %s\nFingerprint: %X",
+			util.EntityToString(change.Old), change.Address, change.New.PrimaryKey.Fingerprint), window)
+	})
+}
+
+// promptKeyChange asks whether to replace the key of a contact with the key change RefreshContacts held
+func promptKeyChange(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	onChanged func(), change ipmail.ContactChange) {
+	message := fmt.Sprintf("%s now points to a new key which %s didn't certify.\nFingerprint: %X\n"+
+		"Only replace their key once you checked the fingerprint with them.", change.Address,
+		util.EntityToString(change.Old), change.New.PrimaryKey.Fingerprint)
+	dialog.ShowCustomConfirm("Contact Key Changed", "Replace Key", "Keep Old Key", widget.NewLabel(message),
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+				defer cancel()
+				err := mailbox.AcceptContactChange(ctx, change)
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				hashes := newEntityHashList(mailbox.Contacts().ToArray(), ipfs, nil)
+				hashList.Init()
+				hashList.PushBackList(hashes)
+				onChanged()
+			}()
+		}, window)
+}
+
+// promptAddContact asks for an ipmail: link, an IPNS name or name@domain address, or an image of a link's QR
+// code, to add as a contact
+func promptAddContact(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List,
+	onAdded func()) {
+	link := widget.NewEntry()
+	link.SetPlaceHolder("ipmail: link, ipns: name or name@domain")
+	var d dialog.Dialog
+	scan := widget.NewButton("Scan QR Code Image...", func() {
+		open := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			defer reader.Close()
+			text, err := util.DecodeQrCode(reader)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			d.Hide()
+			addSharedContact(window, mailbox, ipfs, hashList, onAdded, text)
+		}, window)
+		open.SetFilter(storage.NewExtensionFileFilter([]string{".png", ".jpg", ".jpeg"}))
+		open.Show()
+	})
+	d = dialog.NewCustomConfirm("Add Contact", "Add", "Cancel", container.NewVBox(link, scan), func(confirmed bool) {
+		if confirmed {
+			addContact(window, mailbox, ipfs, hashList, onAdded, link.Text)
+		}
+	}, window)
+	d.Show()
+}
+
+// contactActions rename, annotate and remove contacts, calling onChanged once a contact changed
+func contactActions(window fyne.Window, mailbox ipmail.Mailbox, onChanged func()) []views.ContactAction {
+	editDetail := func(title string, multiLine bool, get func(*ipmail.ContactDetail) *string) func(*gpg.Entity) {
+		return func(contact *gpg.Entity) {
+			detail := mailbox.Details().Get(contact)
+			entry := widget.NewEntry()
+			if multiLine {
+				entry = widget.NewMultiLineEntry()
+			}
+			entry.SetText(*get(&detail))
+			form := widget.NewForm(widget.NewFormItem("Contact:", widget.NewLabel(util.EntityToString(contact))),
+				widget.NewFormItem(title+":", entry))
+			dialog.ShowCustomConfirm("Edit "+title, "Save", "Cancel", form, func(confirmed bool) {
+				if !confirmed {
+					return
+				}
+				*get(&detail) = strings.TrimSpace(entry.Text)
+				err := mailbox.SetContactDetail(contact, detail)
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				onChanged()
+			}, window)
+		}
+	}
+	return []views.ContactAction{
+		{Label: "Rename", Icon: theme.DocumentCreateIcon(), Do: editDetail("Nickname", false,
+			func(detail *ipmail.ContactDetail) *string { return &detail.Nickname })},
+		{Label: "Note", Icon: theme.InfoIcon(), Do: editDetail("Note", true,
+			func(detail *ipmail.ContactDetail) *string { return &detail.Note })},
+		{Label: "Remove", Icon: theme.DeleteIcon(), Do: func(contact *gpg.Entity) {
+			dialog.ShowConfirm("Remove Contact", fmt.Sprintf("Remove %s from your contacts?",
+				util.EntityToString(contact)), func(confirmed bool) {
+				if !confirmed {
+					return
+				}
+				err := mailbox.RemoveContact(contact)
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				onChanged()
+			}, window)
+		}},
+	}
+}
@@ -0,0 +1,220 @@
+package gui
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"fyne.io/fyne"
+	"fyne.io/fyne/container"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/storage"
+	"fyne.io/fyne/widget"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"github.com/spf13/viper"
+	views "ipmail/gui/fyne_views"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"strings"
+)
+
+// linkThisDevice shows a link and its QR code for the device already using your account to link this one with,
+// and waits for it. onLinked is called once the user confirms the account the link is to, onCancelled otherwise
+func linkThisDevice(window fyne.Window, ipfs ipmail.Transport, receiver ipmail.Receiver,
+	onLinked func(*crypto.DeviceLink), onCancelled func()) {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "ipmail device"
+	}
+	device, err := crypto.NewDeviceKey(name)
+	if err != nil {
+		dialog.ShowError(err, window)
+		onCancelled()
+		return
+	}
+	link, err := ipmail.ShareDeviceKey(ipfs, device)
+	if err != nil {
+		dialog.ShowError(fmt.Errorf("the key of this device could not be shared: %w", err), window)
+		onCancelled()
+		return
+	}
+	linkEntry := widget.NewEntry()
+	linkEntry.SetText(link)
+	info := widget.NewLabel(fmt.Sprintf("This device has fingerprint %X\n\nOn the device already using your "+
+		"account, choose Link Device... and enter the link above or scan its QR code. Waiting for it to link this "+
+		"device...", device.PrimaryKey.Fingerprint))
+	info.Wrapping = fyne.TextWrapWord
+	items := []fyne.CanvasObject{linkEntry}
+	if qr, err := views.MakeQRCode(link); err == nil {
+		items = append(items, qr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := dialog.NewCustom("Link This Device", "Cancel", container.NewVBox(append(items, info)...), window)
+	waiting.SetOnClosed(cancel)
+	waiting.Show()
+	go func() {
+		linked, err := ipmail.WaitForDeviceLink(ctx, receiver, ipfs, device)
+		if err == context.Canceled {
+			onCancelled()
+			return
+		}
+		waiting.SetOnClosed(nil)
+		waiting.Hide()
+		cancel()
+		if err != nil {
+			dialog.ShowError(err, window)
+			onCancelled()
+			return
+		}
+		self := linked.Identity.DefaultIdentity()
+		dialog.ShowConfirm("Link This Device", fmt.Sprintf("This device was linked to %s\nFingerprint: %X\n"+
+			"Is this your account?", util.EntityToString(self), self.PrimaryKey.Fingerprint), func(confirmed bool) {
+			if confirmed {
+				go onLinked(linked)
+			} else {
+				go onCancelled()
+			}
+		}, window)
+	}()
+}
+
+// promptLinkDevice asks for the ipmail: link another device shows, or an image of its QR code, and sends it a
+// link to your account
+func promptLinkDevice(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport) {
+	link := widget.NewEntry()
+	link.SetPlaceHolder("ipmail: link of the new device")
+	var d dialog.Dialog
+	scan := widget.NewButton("Scan QR Code Image...", func() {
+		open := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			defer reader.Close()
+			text, err := util.DecodeQrCode(reader)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			d.Hide()
+			linkDevice(window, mailbox, ipfs, text)
+		}, window)
+		open.SetFilter(storage.NewExtensionFileFilter([]string{".png", ".jpg", ".jpeg"}))
+		open.Show()
+	})
+	d = dialog.NewCustomConfirm("Link Device", "Link", "Cancel", container.NewVBox(link, scan), func(confirmed bool) {
+		if confirmed {
+			linkDevice(window, mailbox, ipfs, link.Text)
+		}
+	}, window)
+	d.Show()
+}
+
+// linkDevice sends a link to your account to the device which showed the ipmail: link, once you confirmed the
+// fingerprint it shows
+func linkDevice(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, link string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+		device, err := ipmail.FetchDeviceKey(ctx, ipfs, link)
+		cancel()
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("not a valid device link: %w", err), window)
+			return
+		}
+		dialog.ShowConfirm("Link Device", fmt.Sprintf("Send your private identity to %s?\nFingerprint: %X\n"+
+			"Only confirm if the new device shows this fingerprint.", util.EntityToString(device),
+			device.PrimaryKey.Fingerprint), func(confirmed bool) {
+			if confirmed {
+				go sendDeviceLink(window, mailbox, device)
+			}
+		}, window)
+	}()
+}
+
+// sendDeviceLink sends a link to your account to device
+func sendDeviceLink(window fyne.Window, mailbox ipmail.Mailbox, device *gpg.Entity) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+	defer cancel()
+	err := mailbox.LinkDevice(ctx, device)
+	if err != nil {
+		dialog.ShowError(err, window)
+		return
+	}
+	dialog.ShowInformation("Device Linked", fmt.Sprintf("%s\nFingerprint: %X\nIt now has your identity and "+
+		"syncs with this device", util.EntityToString(device), device.PrimaryKey.Fingerprint), window)
+}
+
+// showDevices lists the devices linked to your account, and lets the user link another one or sync them now
+func showDevices(window fyne.Window, mailbox ipmail.Mailbox, ipfs ipmail.Transport, onSynced func(ipmail.SyncResult)) {
+	items := make([]fyne.CanvasObject, 0)
+	devices := mailbox.Devices()
+	if len(devices) == 0 {
+		items = append(items, widget.NewLabel("No devices are linked to your account"))
+	}
+	for _, device := range devices {
+		items = append(items, widget.NewLabel(fmt.Sprintf("%s\nFingerprint: %s", device.Name,
+			strings.ToUpper(device.Fingerprint))))
+	}
+	var d dialog.Dialog
+	items = append(items, widget.NewSeparator(),
+		widget.NewButton("Link Device...", func() {
+			d.Hide()
+			promptLinkDevice(window, mailbox, ipfs)
+		}),
+		widget.NewButton("Sync Now", func() {
+			d.Hide()
+			syncNow(window, mailbox, onSynced)
+		}))
+	d = dialog.NewCustom("Devices", "Close", container.NewVBox(items...), window)
+	d.Show()
+}
+
+// syncNow syncs the mailbox with your other devices, showing how many changes were synced
+func syncNow(window fyne.Window, mailbox ipmail.Mailbox, onSynced func(ipmail.SyncResult)) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("ipfs-timeout"))
+		defer cancel()
+		result, err := mailbox.Sync(ctx)
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		onSynced(result)
+		text := fmt.Sprintf("Synced %d changes from your other devices and sent them %d changes",
+			result.Merged, result.Recorded)
+		if result.Pending > 0 {
+			text += fmt.Sprintf("\n%d changes can't be applied yet, like messages which couldn't be fetched",
+				result.Pending)
+		}
+		dialog.ShowInformation("Devices Synced", text, window)
+	}()
+}
+
+// startSync syncs the mailbox with your other devices in the background, first from head if it is defined,
+// keeping the content IDs of the contacts in hashList
+func startSync(mailbox ipmail.Mailbox, ipfs ipmail.Transport, hashList *list.List, head cid.Cid,
+	onChanged func()) func(ipmail.SyncResult) {
+	onSynced := func(result ipmail.SyncResult) {
+		if result.Merged == 0 {
+			return
+		}
+		hashes := newEntityHashList(mailbox.Contacts().ToArray(), ipfs, nil)
+		hashList.Init()
+		hashList.PushBackList(hashes)
+		onChanged()
+	}
+	if head.Defined() {
+		go func() {
+			result, err := mailbox.Sync(context.Background(), head)
+			if err != nil {
+				println("warning: your devices could not be synced due to:", err.Error())
+			}
+			onSynced(result)
+		}()
+	}
+	if interval := viper.GetDuration("sync-interval"); interval > 0 {
+		mailbox.SyncEvery(context.Background(), interval, onSynced)
+	}
+	return onSynced
+}
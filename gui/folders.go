@@ -0,0 +1,199 @@
+package gui
+
+import (
+	"errors"
+	"fyne.io/fyne"
+	"fyne.io/fyne/container"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+	"github.com/spf13/viper"
+	views "ipmail/gui/fyne_views"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+)
+
+const labelPrefix = "Label: "
+
+func saveLabels(labels ipmail.MessageLabels, sealer util.Sealer) {
+	err := labels.SaveToFile(viper.GetString("labels"), sealer)
+	if err != nil {
+		println("warning: folders and labels could not be saved to file due to:", err.Error())
+	}
+}
+
+func saveFlags(flags ipmail.MessageFlags, sealer util.Sealer) {
+	err := flags.SaveToFile(viper.GetString("flags"), sealer)
+	if err != nil {
+		println("warning: message flags could not be saved to file due to:", err.Error())
+	}
+}
+
+func saveMessageLists(messages ipmail.MessageList, sent ipmail.MessageList, sealer util.Sealer) {
+	err := messages.SaveToFile(viper.GetString("messages"), sealer)
+	if err != nil {
+		println("warning: received messages could not be saved to file due to:", err.Error())
+	}
+	err = sent.SaveToFile(viper.GetString("sent"), sealer)
+	if err != nil {
+		println("warning: sent messages could not be saved to file due to:", err.Error())
+	}
+}
+
+// chooseName asks the user to pick one of options, or to type a new name if allowNew is set
+func chooseName(window fyne.Window, title string, options []string, allowNew bool, onChosen func(name string)) {
+	chosen := ""
+	items := make([]fyne.CanvasObject, 0)
+	if len(options) > 0 {
+		items = append(items, widget.NewSelect(options, func(s string) {
+			chosen = s
+		}))
+	}
+	var entry *widget.Entry = nil
+	if allowNew {
+		entry = widget.NewEntry()
+		entry.PlaceHolder = "New name"
+		items = append(items, entry)
+	}
+	dialog.ShowCustomConfirm(title, "OK", "Cancel", container.NewVBox(items...), func(ok bool) {
+		if !ok {
+			return
+		}
+		if entry != nil && len(strings.TrimSpace(entry.Text)) > 0 {
+			chosen = strings.TrimSpace(entry.Text)
+		}
+		if len(chosen) > 0 {
+			onChosen(chosen)
+		}
+	}, window)
+}
+
+func messageActions(window fyne.Window, labels ipmail.MessageLabels, flags ipmail.MessageFlags,
+	messages ipmail.MessageList, sent ipmail.MessageList, sealer util.Sealer) []views.MessageAction {
+	move := func(folder string) func(message crypto.Message) {
+		return func(message crypto.Message) {
+			err := labels.Move(ipmail.MessageKey(message), folder)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			saveLabels(labels, sealer)
+		}
+	}
+	return []views.MessageAction{
+		{Icon: theme.MailReplyIcon(), Do: move(ipmail.InboxFolder)},
+		{Icon: theme.FolderIcon(), Do: move(ipmail.ArchiveFolder)},
+		{Icon: theme.DeleteIcon(), Do: func(message crypto.Message) {
+			key := ipmail.MessageKey(message)
+			if labels.Folder(key) != ipmail.TrashFolder {
+				move(ipmail.TrashFolder)(message)
+				return
+			}
+			dialog.ShowConfirm("Delete Forever", "This message will be deleted forever. Continue?", func(ok bool) {
+				if ok {
+					ipmail.DeleteForever(labels, key, messages, sent)
+					flags.Forget(key)
+					saveMessageLists(messages, sent, sealer)
+					saveLabels(labels, sealer)
+					saveFlags(flags, sealer)
+				}
+			}, window)
+		}},
+		{Icon: theme.RadioButtonCheckedIcon(), Do: func(message crypto.Message) {
+			key := ipmail.MessageKey(message)
+			if flags.Has(key, ipmail.FlagStarred) {
+				flags.Clear(key, ipmail.FlagStarred)
+			} else {
+				flags.Set(key, ipmail.FlagStarred)
+			}
+			saveFlags(flags, sealer)
+		}},
+		{Icon: theme.MailComposeIcon(), Do: func(message crypto.Message) {
+			flags.Clear(ipmail.MessageKey(message), ipmail.FlagSeen)
+			saveFlags(flags, sealer)
+		}},
+		{Icon: theme.FolderOpenIcon(), Do: func(message crypto.Message) {
+			chooseName(window, "Move To", labels.Folders(), false, func(name string) {
+				move(name)(message)
+			})
+		}},
+		{Icon: theme.ContentAddIcon(), Do: func(message crypto.Message) {
+			chooseName(window, "Add Label", labels.LabelNames(), true, func(name string) {
+				if labels.CreateLabel(name) == nil {
+					saveLabels(labels, sealer)
+				}
+				err := labels.AddLabel(ipmail.MessageKey(message), name)
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				saveLabels(labels, sealer)
+			})
+		}},
+		{Icon: theme.ContentRemoveIcon(), Do: func(message crypto.Message) {
+			key := ipmail.MessageKey(message)
+			chooseName(window, "Remove Label", labels.Labels(key), false, func(name string) {
+				labels.RemoveLabel(key, name)
+				saveLabels(labels, sealer)
+			})
+		}},
+	}
+}
+
+// folderNavItems lists the archive, trash, user folders and labels after the fixed items
+func folderNavItems(labels ipmail.MessageLabels, messages ipmail.MessageList, sent ipmail.MessageList,
+	makeContent func(list ipmail.MessageList) fyne.CanvasObject, show func(object fyne.CanvasObject)) []views.NavItem {
+	all := ipmail.NewMessageListView(func(message crypto.Message) bool { return true }, messages, sent)
+	showFolder := func(folder string) views.SelectFunction {
+		return func() {
+			show(makeContent(ipmail.NewMessageListView(ipmail.InFolder(labels, folder), all)))
+		}
+	}
+	result := []views.NavItem{
+		{Name: ipmail.ArchiveFolder, Select: showFolder(ipmail.ArchiveFolder)},
+		{Name: ipmail.TrashFolder, Select: showFolder(ipmail.TrashFolder)},
+	}
+	for _, folder := range labels.Folders() {
+		result = append(result, views.NavItem{Name: folder, Select: showFolder(folder)})
+	}
+	for _, label := range labels.LabelNames() {
+		label := label
+		result = append(result, views.NavItem{Name: labelPrefix + label, Select: func() {
+			show(makeContent(ipmail.NewMessageListView(ipmail.WithLabel(labels, label), all)))
+		}})
+	}
+	return result
+}
+
+func newFolder(window fyne.Window, labels ipmail.MessageLabels, sealer util.Sealer) views.FolderFunction {
+	return func(_ string, done func()) {
+		chooseName(window, "New Folder", nil, true, func(name string) {
+			err := labels.CreateFolder(name)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			saveLabels(labels, sealer)
+			done()
+		})
+	}
+}
+
+func deleteFolder(window fyne.Window, labels ipmail.MessageLabels, sealer util.Sealer) views.FolderFunction {
+	return func(name string, done func()) {
+		var err error
+		if strings.HasPrefix(name, labelPrefix) {
+			err = labels.DeleteLabel(strings.TrimPrefix(name, labelPrefix))
+		} else {
+			err = labels.DeleteFolder(name)
+		}
+		if err != nil {
+			dialog.ShowError(errors.New("only your own folders and labels can be deleted"), window)
+			return
+		}
+		saveLabels(labels, sealer)
+		done()
+	}
+}
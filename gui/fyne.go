@@ -4,6 +4,7 @@ import "C"
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"fyne.io/fyne"
@@ -14,18 +15,17 @@ import (
 	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
 	gpg "github.com/Geo25rey/crypto/openpgp"
-	"github.com/Geo25rey/crypto/openpgp/packet"
 	"github.com/ipfs/go-cid"
-	iface "github.com/ipfs/interface-go-ipfs-core"
-	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/spf13/viper"
+	"io"
 	views "ipmail/gui/fyne_views"
 	"ipmail/libipmail"
 	"ipmail/libipmail/crypto"
 	"ipmail/libipmail/util"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func hasInvalidCharacters(s string) error {
@@ -38,7 +38,8 @@ func hasInvalidCharacters(s string) error {
 	return nil
 }
 
-func prompt(window fyne.Window, onResults func([]string, error), isPassword bool, title string, content string, width int, fields ...string) {
+func prompt(window fyne.Window, onResults func([]string, error), isPassword bool, title string, confirm string,
+	content string, width int, fields ...string) {
 	results := make([]string, 0)
 	contentLbl := widget.NewLabel(content)
 	contentLbl.Wrapping = fyne.TextWrapWord
@@ -69,7 +70,7 @@ func prompt(window fyne.Window, onResults func([]string, error), isPassword bool
 	form := &widget.Form{
 		Items: formItems,
 	}
-	dialogBox := dialog.NewCustomConfirm(title, "Create", "Exit",
+	dialogBox := dialog.NewCustomConfirm(title, confirm, "Exit",
 		container.NewVBox(
 			widget.NewSeparator(),
 			contentLbl,
@@ -88,20 +89,14 @@ func prompt(window fyne.Window, onResults func([]string, error), isPassword bool
 	dialogBox.Refresh()
 }
 
-func initMenuBar(w *fyne.Window,
-	identity *crypto.SelfIdentity, contacts *crypto.ContactsIdentityList,
-	sender *ipmail.Sender) {
+func initMenuBar(w *fyne.Window, compose func()) {
 	a := fyne.CurrentApp()
 	shortcutFocused := func(s fyne.Shortcut, w fyne.Window) {
 		if focused, ok := w.Canvas().Focused().(fyne.Shortcutable); ok {
 			focused.TypedShortcut(s)
 		}
 	}
-	newItem := fyne.NewMenuItem("Compose Message", func() {
-		w := a.NewWindow("New Message")
-		w.SetContent(views.MakeMessageComposer(w, *identity, *contacts, *sender))
-		w.Show()
-	})
+	newItem := fyne.NewMenuItem("Compose Message", compose)
 	settingsItem := fyne.NewMenuItem("Settings", func() {
 		w := a.NewWindow("Fyne Settings")
 		w.SetContent(settings.NewSettings().LoadAppearanceScreen(w))
@@ -151,10 +146,45 @@ func initMenuBar(w *fyne.Window,
 	(*w).SetMainMenu(mainMenu)
 }
 
-func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
-	identity crypto.SelfIdentity, contacts crypto.ContactsIdentityList,
-	messages ipmail.MessageList, sent ipmail.MessageList, requests ipmail.MessageList) {
+// Run starts the app. The ipmail: links in open, which the app was opened with, are added as contacts you
+// confirm once the local files are loaded
+func Run(ipfs ipmail.Transport, sender ipmail.Sender, receiver ipmail.Receiver, store ipmail.LocalStore,
+	sealer util.Sealer, remotePins []ipmail.RemotePinService, bodies crypto.BodyStore, open []string) {
+
+	a := app.NewWithID("io.libipmail")
+	topWindow := a.NewWindow("InterPlanetary Mail")
+	load := func() {
+		data, err := store.Load()
+		if err != nil {
+			println(err.Error())
+			os.Exit(0)
+		}
+		show(a, topWindow, ipfs, sender, receiver, store, sealer, data, remotePins, bodies, open)
+	}
+	if store.Locked() {
+		promptUnlock(topWindow, store, "", load)
+	} else {
+		load()
+	}
+	topWindow.ShowAndRun()
+}
+
+// show fills topWindow with the mailbox once data is loaded
+func show(a fyne.App, topWindow fyne.Window, ipfs ipmail.Transport, sender ipmail.Sender, receiver ipmail.Receiver,
+	store ipmail.LocalStore, sealer util.Sealer, data ipmail.LocalData, remotePins []ipmail.RemotePinService,
+	bodies crypto.BodyStore, open []string) {
 
+	identity, contacts := data.Identity, data.Contacts
+	messages, sent, requests := data.Messages, data.Sent, data.Requests
+	drafts, outbox, labels, flags := data.Drafts, data.Outbox, data.Labels, data.Flags
+	seen, pins, sessions, pending, names, profiles, details := data.Seen, data.Pins, data.Sessions, data.Pending,
+		data.Names, data.Profiles, data.Details
+	syncLog, syncHead := data.Sync, cid.Undef
+	if !viper.GetBool("forward-secrecy") {
+		sessions = nil
+	} else if sessions == nil {
+		sessions = crypto.NewSessionStore()
+	}
 	if messages == nil {
 		messages = ipmail.NewMessageList()
 	}
@@ -164,47 +194,119 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 	if requests == nil {
 		requests = ipmail.NewMessageList()
 	}
+	if drafts == nil {
+		drafts = ipmail.NewDraftList()
+	}
+	if profiles == nil {
+		profiles = ipmail.NewProfileCache() // shared with the mailbox so message rows show the profiles it fetches
+	}
+	if details == nil {
+		details = ipmail.NewContactDetails() // shared with the mailbox so message rows show the nicknames given
+	}
+	if labels == nil {
+		labels = ipmail.NewMessageLabels()
+	}
+	if flags == nil {
+		flags = ipmail.NewMessageFlags()
+	}
+	if deleted := ipmail.PurgeTrash(labels, viper.GetDuration("trash-retention"), messages, sent); len(deleted) > 0 {
+		for _, key := range deleted {
+			flags.Forget(key)
+		}
+		saveMessageLists(messages, sent, sealer)
+		saveLabels(labels, sealer)
+		saveFlags(flags, sealer)
+	}
 
-	a := app.NewWithID("io.libipmail")
-	topWindow := a.NewWindow("InterPlanetary Mail")
-	initMenuBar(&topWindow, &identity, &contacts, &sender)
+	var draftsView *widget.List
+	onDraftsChanged := func() {
+		if identity != nil {
+			err := drafts.SaveToFile(viper.GetString("drafts"), sealer, identity)
+			if err != nil {
+				println("warning: drafts could not be saved to file due to:", err.Error())
+			}
+		}
+		if draftsView != nil {
+			draftsView.Refresh()
+		}
+	}
+	onQueued := func(entry ipmail.OutboxEntry) {
+		undo := dialog.NewConfirm("Message Queued",
+			"Your message will be sent at "+entry.SendAt.Format(time.Stamp)+". Undo?",
+			func(undo bool) {
+				if undo {
+					err := outbox.Cancel(entry.Id)
+					if err != nil {
+						dialog.ShowError(err, topWindow)
+					}
+				}
+			}, topWindow)
+		undo.Show()
+		time.AfterFunc(time.Until(entry.SendAt), undo.Hide)
+	}
+	// the composer queues through the mailbox, which is made once the identity is loaded
+	var loadedMailbox ipmail.Mailbox
+	loadedMailboxMtx := sync.Mutex{}
+	queue := func(content io.Reader, sendAt time.Time, to ...*gpg.Entity) (ipmail.OutboxEntry, error) {
+		loadedMailboxMtx.Lock()
+		mailbox := loadedMailbox
+		loadedMailboxMtx.Unlock()
+		if mailbox == nil {
+			return ipmail.OutboxEntry{}, errors.New("your mailbox is still loading")
+		}
+		return mailbox.Queue(content, sendAt, to...)
+	}
+	openComposer := func(draft *ipmail.Draft) {
+		w := a.NewWindow("New Message")
+		w.SetContent(views.MakeMessageComposer(w, contacts, details, queue,
+			viper.GetDuration("undo-send"), onQueued, drafts, draft, onDraftsChanged))
+		w.Show()
+	}
+	initMenuBar(&topWindow, func() {
+		openComposer(nil)
+	})
 	topWindow.SetMaster()
-	inboxView := views.MakeContent(messages)
-	sentView := views.MakeContent(sent)
+	actions := messageActions(topWindow, labels, flags, messages, sent, sealer)
+	makeContent := func(list ipmail.MessageList) fyne.CanvasObject {
+		return views.MakeContent(list, profiles, details, flags, func() {
+			saveFlags(flags, sealer)
+		}, actions...)
+	}
+	inboxView := makeContent(ipmail.NewMessageListView(ipmail.InFolder(labels, ipmail.InboxFolder), messages))
+	draftsView = views.MakeDraftList(drafts, openComposer, onDraftsChanged)
+	outboxView := views.MakeOutbox(outbox)
 	var content *container.Split
+	setWindowContent := func(object fyne.CanvasObject) {
+		content.Trailing = object
+		content.Refresh()
+	}
 	setWindowContentTo := func(object fyne.CanvasObject) func() {
 		return func() {
-			content.Trailing = object
-			content.Refresh()
+			setWindowContent(object)
 		}
 	}
+	navItems := func() []views.NavItem {
+		return append([]views.NavItem{
+			{Name: "Inbox", Select: setWindowContentTo(inboxView)},
+			{Name: "Sent", Select: func() {
+				setWindowContent(makeContent(ipmail.NewMessageListView(ipmail.NotInTrash(labels), sent)))
+			}},
+			{Name: "Drafts", Select: setWindowContentTo(draftsView)},
+			{Name: "Outbox", Select: setWindowContentTo(outboxView)},
+		}, folderNavItems(labels, messages, sent, makeContent, setWindowContent)...)
+	}
 	toolbar := widget.NewToolbar(widget.NewToolbarSpacer())
 	content = container.NewHSplit(
-		views.MakeNav(map[string]views.SelectFunction{
-			"Inbox": setWindowContentTo(inboxView),
-			"Sent":  setWindowContentTo(sentView),
-		}), inboxView)
+		views.MakeNav(navItems, newFolder(topWindow, labels, sealer), deleteFolder(topWindow, labels, sealer)), inboxView)
 	// TODO add container.NewAppTabs()
 	topWindow.SetContent(container.NewBorder(toolbar, nil, nil, nil, content))
 
 	identitySet := sync.Mutex{}
 	if identity == nil {
 		identitySet.Lock()
-		println("Prompting for identity")
-		onResults := func(results []string, err error) {
-			if err != nil {
-				println(err.Error())
-				os.Exit(0)
-			}
-			name := results[0]
-			comment := results[1]
-			email := results[2]
-			identity, err = crypto.NewSelfIdentity(name, comment, email)
-			if err != nil {
-				println(err.Error())
-				os.Exit(0)
-			}
-			err = identity.SaveToFile(viper.GetString("identity"))
+		setIdentity := func(created crypto.SelfIdentity) {
+			identity = created
+			err := identity.SaveToFile(viper.GetString("identity"), sealer)
 			if err != nil {
 				println(err.Error())
 				os.Exit(0)
@@ -214,14 +316,47 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 			}
 			identitySet.Unlock()
 		}
-		windowSize := topWindow.Canvas().Size()
-		width := fyne.Min(int(0.8*float64(windowSize.Width)), 400)
-		prompt(topWindow, onResults, false, "Welcome",
-			"Looks like this is your first time here. Welcome! "+
-				"You can optionally enter your name, a comment, and your email "+
-				"to help identify yourself to people you message. "+
-				"Don't worry this information is only stored on your computer.",
-			width, "Name", "Comment", "Email")
+		promptIdentity := func() {
+			println("Prompting for identity")
+			onResults := func(results []string, err error) {
+				if err != nil {
+					println(err.Error())
+					os.Exit(0)
+				}
+				name := results[0]
+				comment := results[1]
+				email := results[2]
+				created, err := crypto.NewSelfIdentity(name, comment, email)
+				if err != nil {
+					println(err.Error())
+					os.Exit(0)
+				}
+				setIdentity(created)
+			}
+			windowSize := topWindow.Canvas().Size()
+			width := fyne.Min(int(0.8*float64(windowSize.Width)), 400)
+			prompt(topWindow, onResults, false, "Welcome", "Create",
+				"Looks like this is your first time here. Welcome! "+
+					"You can optionally enter your name, a comment, and your email "+
+					"to help identify yourself to people you message. "+
+					"Don't worry this information is only stored on your computer.",
+				width, "Name", "Comment", "Email")
+		}
+		dialog.ShowConfirm("Welcome", "Do you already use ipmail on another device?", func(linking bool) {
+			if !linking {
+				promptIdentity()
+				return
+			}
+			linkThisDevice(topWindow, ipfs, receiver, func(link *crypto.DeviceLink) {
+				log, err := ipmail.NewSyncLog(link.SyncKey)
+				if err != nil {
+					println(err.Error())
+					os.Exit(0)
+				}
+				syncLog, syncHead = log, link.Head
+				setIdentity(link.Identity)
+			}, promptIdentity)
+		}, topWindow)
 	}
 
 	go func() {
@@ -229,155 +364,181 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 			identitySet.Lock()
 			contacts = crypto.NewContactsIdentityList(identity.EntityList())
 			identitySet.Unlock()
-			err := contacts.SaveToFile(viper.GetString("contacts"))
+			err := contacts.SaveToFile(viper.GetString("contacts"), sealer)
 			if err != nil {
 				panic(err.Error())
 			}
 		}
 		identitySet.Lock()
 		identitySet.Unlock()
+		mailbox := ipmail.NewMailbox(ipmail.MailboxConfig{
+			Ipfs:         ipfs,
+			Sender:       sender,
+			Outbox:       outbox,
+			Identity:     identity,
+			Contacts:     contacts,
+			Messages:     messages,
+			Sent:         sent,
+			Requests:     requests,
+			Seen:         seen,
+			Pins:         pins,
+			PinTtl:       viper.GetDuration("pin-ttl"),
+			RemotePins:   remotePins,
+			Bodies:       bodies,
+			FetchTimeout: viper.GetDuration("ipfs-timeout"),
+			Sessions:     sessions,
+			Pending:      pending,
+			Names:        names,
+			Profiles:     profiles,
+			Details:      details,
+			Labels:       labels,
+			Flags:        flags,
+			Sync:         syncLog,
+			Files: ipmail.MailboxFiles{
+				Contacts: viper.GetString("contacts"),
+				Messages: viper.GetString("messages"),
+				Sent:     viper.GetString("sent"),
+				Requests: viper.GetString("requests"),
+				Seen:     viper.GetString("seen"),
+				Pins:     viper.GetString("pins"),
+				Sessions: viper.GetString("sessions"),
+				Pending:  viper.GetString("pending-requests"),
+				Names:    viper.GetString("contact-names"),
+				Profiles: viper.GetString("profiles"),
+				Details:  viper.GetString("contact-details"),
+				Labels:   viper.GetString("labels"),
+				Flags:    viper.GetString("flags"),
+				Sync:     viper.GetString("sync"),
+			},
+			Sealer: sealer,
+		})
+		loadedMailboxMtx.Lock()
+		loadedMailbox = mailbox
+		loadedMailboxMtx.Unlock()
 
 		toolbar.Append(widget.NewToolbarAction(theme.MailComposeIcon(), func() {
-			w := a.NewWindow("New Message")
-			w.SetContent(views.MakeMessageComposer(w, identity, contacts, sender))
-			w.Show()
+			openComposer(nil)
 		}))
 
-		contactRequests := views.MakeContactRequestsManager(contacts, requests)
+		contactsHashList := newEntityHashList(contacts.ToArray(), ipfs, nil)
+		var contactsList fyne.CanvasObject
+		onContactsChanged := func() {
+			hashes := newEntityHashList(contacts.ToArray(), ipfs, nil)
+			contactsHashList.Init()
+			contactsHashList.PushBackList(hashes)
+			contactsList.Refresh()
+		}
+		contactsList = views.MakeContactsList(contacts, profiles, details, contactsHashList,
+			contactActions(topWindow, mailbox, onContactsChanged)...)
+
+		contactRequests := views.MakeContactRequestsManager(mailbox, onContactsChanged)
 		toolbar.Append(widget.NewToolbarAction(theme.VisibilityIcon(), func() {
 			w := a.NewWindow("Contact Requests")
 			w.SetContent(contactRequests)
 			w.Show()
 		}))
 
-		contactsHashList := newEntityHashList(contacts.ToArray(), ipfs)
-		contactsList := views.MakeContactsList(contacts, contactsHashList)
 		toolbar.Append(widget.NewToolbarAction(theme.ComputerIcon(), func() {
 			w := a.NewWindow("Contacts List")
 			w.SetContent(contactsList)
 			w.Show()
 		}))
+		toolbar.Append(widget.NewToolbarAction(theme.ContentAddIcon(), func() {
+			promptAddContact(topWindow, mailbox, ipfs, contactsHashList, contactsList.Refresh)
+		}))
+		refreshContacts(topWindow, mailbox, ipfs, contactsHashList, contactsList.Refresh)
+		for _, link := range open {
+			addSharedContact(topWindow, mailbox, ipfs, contactsHashList, contactsList.Refresh, link)
+		}
+
+		onSynced := startSync(mailbox, ipfs, contactsHashList, syncHead, func() {
+			contactsList.Refresh()
+			content.Refresh()
+		})
+		toolbar.Append(widget.NewToolbarAction(theme.ViewRefreshIcon(), func() {
+			showDevices(topWindow, mailbox, ipfs, onSynced)
+		}))
+
+		identityHashList, identityName := list.New(), &atomic.Value{}
+		publishIdentity(mailbox, ipfs, identityHashList, identityName)
+		toolbar.Append(widget.NewToolbarAction(theme.FileImageIcon(), func() {
+			editProfile(topWindow, mailbox, func() {
+				publishIdentity(mailbox, ipfs, identityHashList, identityName)
+			})
+		}))
 
-		identityHashList := newEntityHashList(identity.EntityList(), ipfs)
+		toolbar.Append(widget.NewToolbarAction(theme.SettingsIcon(), func() {
+			setPassphrase(topWindow, store)
+		}))
 
 		toolbar.Append(widget.NewToolbarAction(theme.MailSendIcon(), func() {
 			self_id := identityHashList.Front().Value.(cid.Cid)
-			d := dialog.NewEntryDialog("Your ID is \""+self_id.String()+"\"", "Share to:", func(s string) {
-				id, err := cid.Parse(s)
-				to := crypto.NewIdentityList(identity.DefaultIdentity())
-				if err == nil {
-					entityBuf, err := ipfs.Cat(path.IpfsPath(id))
-					if err == nil {
-						entity, err := gpg.ReadEntity(
-							packet.NewReader(
-								bytes.NewBuffer(entityBuf),
-							),
-						)
-						if err == nil {
-							to.Add(entity) // TODO don't suppress errors
-						} else {
-							println(err.Error())
-							return
-						}
-					} else {
-						println(err.Error())
-						return
-					}
-				} else {
-					println(err.Error())
+			self_link := widget.NewEntry()
+			self_link.SetText(crypto.NewIdentityUri(self_id, identity.DefaultIdentity()).String())
+			to, note := widget.NewEntry(), widget.NewMultiLineEntry()
+			to.SetPlaceHolder("ipmail: link or content ID")
+			note.SetPlaceHolder("Introduce yourself")
+			form := widget.NewForm(widget.NewFormItem("Your link:", self_link))
+			if name, ok := identityName.Load().(string); ok {
+				self_name := widget.NewEntry()
+				self_name.SetText(name)
+				form.Append("Your IPNS name:", self_name)
+			}
+			form.AppendItem(widget.NewFormItem("Share to:", to))
+			form.AppendItem(widget.NewFormItem("Note:", note))
+			d := dialog.NewCustomConfirm("Send a Contact Request", "Send Request", "Cancel", form, func(confirmed bool) {
+				if !confirmed {
 					return
 				}
-				content := bytes.NewBuffer(append([]byte("ipfs:"), self_id.Bytes()...))
-				_, err = sender.Send(content, true, identity.DefaultIdentity(), to.ToArray()...)
-			}, topWindow)
-			d.Show()
-		}))
-
-		receiver.OnMessage(func(message iface.PubSubMessage) {
-			seq, _ := util.BytesToUint64(message.Seq())
-			origin := message.From()
-			hash := message.Data()
-			topics := strings.Join(message.Topics(), "")
-			if strings.Contains(topics, crypto.MessageTopicName) {
-				if bytes.HasPrefix(hash, []byte(crypto.MessageCidPrefix)) &&
-					bytes.HasSuffix(hash, []byte(crypto.MessageCidPostfix)) {
-					hash = bytes.TrimPrefix(hash, []byte(crypto.MessageCidPrefix))
-					hash = bytes.TrimSuffix(hash, []byte(crypto.MessageCidPostfix))
-					parse, err := cid.Parse(hash)
+				locator := to.Text
+				if id, err := cid.Decode(to.Text); err == nil {
+					locator = "ipfs:" + string(id.Bytes())
+				}
+				go func() {
+					entity, _, err := crypto.ParseContact(context.Background(), locator, ipfs)
 					if err != nil {
+						dialog.ShowError(err, topWindow)
 						return
 					}
-					encryptedMsg, err := ipfs.Cat(path.IpfsPath(parse))
+					entry, err := mailbox.SendRequest(note.Text, time.Now().Add(viper.GetDuration("undo-send")), entity)
 					if err != nil {
+						dialog.ShowError(err, topWindow)
 						return
 					}
-					msg := crypto.NewMessage(encryptedMsg, seq, origin, ipfs, identity, contacts,
-						func(keys []gpg.Key, symmetric bool) ([]byte, error) {
-							result := make([]byte, 0)
-							keyStrings := make([]string, 0)
-							for _, key := range keys {
-								keyStrings = append(keyStrings, key.PublicKey.KeyIdShortString())
-							}
-							resultMtx := sync.Mutex{}
-							resultMtx.Lock()
-							onResults := func(results []string, err error) {
-								for _, str := range results {
-									result = append(result, str...)
-								}
-								resultMtx.Unlock()
-							}
-							prompt(topWindow, onResults, true,
-								"Unlock your encrypted private keys", "", 400, keyStrings...)
-							resultMtx.Lock()
-							defer resultMtx.Unlock()
-							return result, err
-						})
-					if msg != nil {
-						entities := identity.EntityList()
-						for _, entity := range entities { // if msg is from self add to sent list
-							if msg.IsFrom(entity) {
-								sent.Add(msg)
-								err := sent.SaveToFile(viper.GetString("sent"))
-								if err != nil {
-									println("warning: sent messages could not be saved to file due to:", err.Error())
-								}
-								return
-							}
-						}
-
-						entities = contacts.ToArray()
-						inContacts := false
-						for _, entity := range entities { // if msg is from a non contact add to requests list
-							if msg.IsFrom(entity) {
-								inContacts = true
-								break
-							}
-						}
-						if !inContacts {
-							requests.Add(msg)
-							err := messages.SaveToFile(viper.GetString("requests"))
-							if err != nil {
-								println("warning: contact requests could not be saved to file due to:", err.Error())
-							}
-							contactRequests.Refresh()
-							return
-						}
+					onQueued(entry)
+				}()
+			}, topWindow)
+			d.Show()
+		}))
 
-						messages.Add(msg)
-						err := messages.SaveToFile(viper.GetString("messages"))
-						if err != nil {
-							println("warning: received messages could not be saved to file due to:", err.Error())
-						}
-					} else {
-						//println("Message isn't meant for you")
-					}
+		unlockKeys := func(keys []gpg.Key, symmetric bool) ([]byte, error) {
+			result := make([]byte, 0)
+			keyStrings := make([]string, 0)
+			for _, key := range keys {
+				keyStrings = append(keyStrings, key.PublicKey.KeyIdShortString())
+			}
+			resultMtx := sync.Mutex{}
+			resultMtx.Lock()
+			var err error
+			onResults := func(results []string, resultErr error) {
+				for _, str := range results {
+					result = append(result, str...)
 				}
+				err = resultErr
+				resultMtx.Unlock()
 			}
-		}, true)
+			prompt(topWindow, onResults, true,
+				"Unlock your encrypted private keys", "Create", "", 400, keyStrings...)
+			resultMtx.Lock()
+			defer resultMtx.Unlock()
+			return result, err
+		}
+		mailbox.Events().Subscribe(context.Background(), func(event ipmail.Event) {
+			contactRequests.Refresh()
+		}, ipmail.ContactRequest, ipmail.ContactAccepted)
+		mailbox.Receive(context.Background(), receiver, unlockKeys)
 	}()
 
-	topWindow.ShowAndRun()
-
 	//print("==> ")
 	//for false {
 	//	read := ""
@@ -598,14 +759,26 @@ func Run(ipfs *ipmail.Ipfs, sender ipmail.Sender, receiver ipmail.Receiver,
 
 }
 
-func newEntityHashList(entities gpg.EntityList, ipfs *ipmail.Ipfs) *list.List {
+// newEntityHashList adds entities to IPFS, written by serialize if it isn't nil, like Mailbox.SerializeIdentity
+func newEntityHashList(entities gpg.EntityList, ipfs ipmail.Transport,
+	serialize func(w io.Writer, entity *gpg.Entity) error) *list.List {
 	identityHashList := list.New()
 	buf := bytes.NewBuffer(make([]byte, 0))
 	for _, entity := range entities {
-		if err := entity.Serialize(buf); err != nil {
+		var err error
+		if serialize != nil {
+			err = serialize(buf, entity)
+		} else {
+			err = entity.Serialize(buf)
+		}
+		if err != nil {
+			buf.Reset()
 			continue
 		}
 		resolved, _ := ipfs.AddFromReader(buf)
+		if pinner, ok := ipfs.(ipmail.Pinner); ok && resolved != nil {
+			_ = pinner.Pin(resolved.Cid()) // shared identities are never garbage collected
+		}
 		if resolved != nil {
 			identityHashList.PushBack(resolved.Cid())
 		} else {
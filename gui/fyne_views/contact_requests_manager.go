@@ -6,12 +6,11 @@ import (
 	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
 	"ipmail/libipmail"
-	"ipmail/libipmail/crypto"
 )
 
-func MakeContactRequestsManager(
-	contacts crypto.ContactsIdentityList, requests ipmail.MessageList,
-) fyne.CanvasObject {
+// MakeContactRequestsManager lists contact requests to accept or deny, calling onAccepted once one became a contact
+func MakeContactRequestsManager(mailbox ipmail.Mailbox, onAccepted func()) fyne.CanvasObject {
+	requests := mailbox.Requests()
 	var list *widget.List
 	list = widget.NewList(
 		func() int {
@@ -25,16 +24,24 @@ func MakeContactRequestsManager(
 		func(id widget.ListItemID, item fyne.CanvasObject) {
 			msg := requests.FromIndex(id)
 			objs := item.(*fyne.Container).Objects
-			objs[0].(*widget.Label).SetText(msg.String())
+			text := msg.String()
+			if handshake := msg.Handshake(); handshake != nil && len(handshake.Note) > 0 {
+				text += "\n" + handshake.Note
+			}
+			objs[0].(*widget.Label).SetText(text)
 			objs[1].(*widget.Button).OnTapped = func() {
 				// accepted
-				contacts.Add(msg.From())
-				requests.Remove(msg)
+				if err := mailbox.AcceptRequest(msg); err != nil {
+					println(err.Error())
+				}
+				onAccepted()
 				(*(&list)).Refresh()
 			}
 			objs[2].(*widget.Button).OnTapped = func() {
 				// rejected
-				requests.Remove(msg)
+				if err := mailbox.DenyRequest(msg); err != nil {
+					println(err.Error())
+				}
 				(*(&list)).Refresh()
 			}
 		},
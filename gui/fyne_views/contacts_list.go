@@ -3,52 +3,68 @@ package views
 import (
 	"bytes"
 	"container/list"
+	"errors"
 	"fyne.io/fyne"
 	"fyne.io/fyne/canvas"
 	"fyne.io/fyne/container"
 	"fyne.io/fyne/widget"
+	gpg "github.com/Geo25rey/crypto/openpgp"
 	"github.com/ipfs/go-cid"
 	"github.com/skip2/go-qrcode"
 	"image"
+	"ipmail/libipmail"
 	"ipmail/libipmail/crypto"
 	"time"
 )
 
-func generateQRCode(index int, hashList *list.List) (fyne.CanvasObject, error, cid.Cid) {
-	var qr *qrcode.QRCode = nil
-	var err error = nil
+// generateQRCode makes a QR code of the ipmail: link to entity, which is at index in hashList
+func generateQRCode(index int, entity *gpg.Entity, hashList *list.List) (fyne.CanvasObject, error, cid.Cid) {
 	id := cid.Undef
-	for i, hash := 0, hashList.Front(); hash != nil; i, hash = i+1, hash.Next() {
-		if hash.Value == nil && i != index {
-			continue
-		}
-		id = hash.Value.(cid.Cid)
-		qr, err = qrcode.New(id.String(), qrcode.Low)
-		if err != nil {
-			qr = nil
-			break
+	for i, hash := 0, hashList.Front(); hash != nil && i <= index; i, hash = i+1, hash.Next() {
+		if i == index && hash.Value != nil {
+			id = hash.Value.(cid.Cid)
 		}
 	}
-	if qr == nil {
-		return nil, err, id
+	if id == cid.Undef {
+		return nil, errors.New("contact isn't on IPFS"), id
+	}
+	img, err := MakeQRCode(crypto.NewIdentityUri(id, entity).String())
+	return img, err, id
+}
+
+// MakeQRCode shows a QR code of text, such as an ipmail: link
+func MakeQRCode(text string) (fyne.CanvasObject, error) {
+	qr, err := qrcode.New(text, qrcode.Low)
+	if err != nil {
+		return nil, err
 	}
 	png, err := qr.PNG(256)
 	if err != nil {
-		return nil, err, id
+		return nil, err
 	}
 	buf := bytes.NewBuffer(png)
 	decode, _, err := image.Decode(buf)
 	if err != nil {
-		return nil, err, id
+		return nil, err
 	}
 	img := canvas.NewImageFromImage(decode)
 	img.Resize(fyne.NewSize(256, 256))
 	img.SetMinSize(fyne.NewSize(256, 256))
 	img.FillMode = canvas.ImageFillContain
-	return img, nil, id
+	return img, nil
+}
+
+// ContactAction is an action the user can take on a contact, such as removing it
+type ContactAction struct {
+	Label string
+	Icon  fyne.Resource
+	Do    func(contact *gpg.Entity)
 }
 
-func MakeContactsList(contacts crypto.ContactsIdentityList, hashList *list.List) fyne.CanvasObject {
+// MakeContactsList shows contacts with their profile from profiles, the nickname and note from details and
+// the QR code of their link, with a button for every action
+func MakeContactsList(contacts crypto.ContactsIdentityList, profiles ipmail.ProfileCache, details ipmail.ContactDetails,
+	hashList *list.List, actions ...ContactAction) fyne.CanvasObject {
 	var l *widget.List
 	l = widget.NewList(func() int {
 		return len(contacts.ToArray())
@@ -58,6 +74,9 @@ func MakeContactsList(contacts crypto.ContactsIdentityList, hashList *list.List)
 			widget.NewLabel(""),
 			container.NewVBox(),
 			widget.NewLabel(""),
+			container.NewHBox(newAvatar(64), widget.NewLabel("")),
+			widget.NewLabel(""),
+			container.NewHBox(),
 		)
 		return widget.NewAccordion(
 			widget.NewAccordionItem("",
@@ -71,6 +90,28 @@ func MakeContactsList(contacts crypto.ContactsIdentityList, hashList *list.List)
 		invalidLabel := box.Objects[3].(*widget.Label)
 		cidLabel := box.Objects[1].(*widget.Label)
 		contact := contacts.ToArray()[index]
+		profile := profiles.Get(contact)
+		profileBox := box.Objects[4].(*fyne.Container)
+		setAvatar(profileBox.Objects[0].(*canvas.Image), profile)
+		profileLabel := profileBox.Objects[1].(*widget.Label)
+		profileLabel.Text = profileSummary(profile)
+		if profile != nil && len(profile.Bio) > 0 {
+			profileLabel.Text += "\n" + profile.Bio
+		}
+		detail := details.Get(contact)
+		noteLabel := box.Objects[5].(*widget.Label)
+		noteLabel.Text = ""
+		if len(detail.Note) > 0 {
+			noteLabel.Text = "Note: " + detail.Note
+		}
+		actionBox := box.Objects[6].(*fyne.Container)
+		actionBox.Objects = nil
+		for _, action := range actions {
+			action := action
+			actionBox.Add(widget.NewButtonWithIcon(action.Label, action.Icon, func() {
+				action.Do(contact)
+			}))
+		}
 		for _, identity := range contact.Identities {
 			id := identity.UserId
 			if len(id.Name) == len(id.Comment) && len(id.Name) == len(id.Email) && len(id.Name) == 0 {
@@ -78,13 +119,18 @@ func MakeContactsList(contacts crypto.ContactsIdentityList, hashList *list.List)
 			} else {
 				item.Title = id.Id
 			}
+			if len(detail.Nickname) > 0 {
+				item.Title = detail.Nickname + " - " + item.Title
+			} else if profile != nil && len(profile.DisplayName) > 0 {
+				item.Title = profile.DisplayName + " - " + item.Title
+			}
 			publicKeyLabel.Text = string(append([]byte("Public Key: "), contact.PrimaryKey.KeyIdString()...))
 			if identity.SelfSignature.KeyExpired(time.Now()) {
 				invalidLabel.Text = "Key has expired"
 			} else {
 				invalidLabel.Text = ""
 			}
-			img, err, cID := generateQRCode(index, hashList)
+			img, err, cID := generateQRCode(index, contact, hashList)
 			if cID != cid.Undef {
 				cidLabel.Text = string(append([]byte("Content ID: "), cID.String()...))
 			}
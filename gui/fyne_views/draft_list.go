@@ -0,0 +1,45 @@
+package views
+
+import (
+	"fyne.io/fyne"
+	"fyne.io/fyne/container"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+	"ipmail/libipmail"
+)
+
+type OpenDraftFunction func(draft *ipmail.Draft)
+
+func MakeDraftList(drafts ipmail.DraftList, open OpenDraftFunction, onDraftsChanged func()) *widget.List {
+	var list *widget.List
+	list = widget.NewList(
+		func() int {
+			return drafts.Len()
+		},
+		func() fyne.CanvasObject {
+			return container.NewHBox(widget.NewIcon(theme.DocumentCreateIcon()),
+				widget.NewLabel("Template Object"),
+				widget.NewButtonWithIcon("", theme.DeleteIcon(), nil))
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			draft := drafts.FromIndex(id)
+			if draft == nil {
+				return
+			}
+			objs := item.(*fyne.Container).Objects
+			objs[1].(*widget.Label).SetText(draft.String())
+			objs[2].(*widget.Button).OnTapped = func() {
+				drafts.Remove(draft.Id)
+				onDraftsChanged()
+			}
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		draft := drafts.FromIndex(id)
+		list.Unselect(id)
+		if draft != nil {
+			open(draft)
+		}
+	}
+	return list
+}
@@ -1,16 +1,29 @@
 package views
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
 	"fyne.io/fyne"
 	"fyne.io/fyne/container"
 	"fyne.io/fyne/dialog"
 	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io"
 	"ipmail/libipmail"
 	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+	"sync"
+	"time"
 )
 
+// autosaveDelay is how long the composer waits after the last edit before saving the draft
+const autosaveDelay = 2 * time.Second
+
+// maxCompletions bounds how many contacts are suggested for a recipient
+const maxCompletions = 8
+
 func makeToolBar(w fyne.Window, send func()) *widget.Toolbar {
 	return widget.NewToolbar(widget.NewToolbarAction(theme.CancelIcon(), func() {
 		w.Close()
@@ -18,34 +31,164 @@ func makeToolBar(w fyne.Window, send func()) *widget.Toolbar {
 		widget.NewToolbarAction(theme.MailSendIcon(), send))
 }
 
+// MakeMessageComposer shows a composer for draft, or for a new draft if draft is nil. Edits are
+// autosaved to drafts and onDraftsChanged is called after every save so the caller can persist them.
+// Sent messages are queued with queue (see ipmail.Mailbox.Queue) no earlier than undoWindow from now and passed to
+// onQueued. Recipients are completed from contacts and the nicknames in details.
 func MakeMessageComposer(w fyne.Window,
-	identity crypto.SelfIdentity, contacts crypto.ContactsIdentityList, sender ipmail.Sender) fyne.CanvasObject {
+	contacts crypto.ContactsIdentityList, details ipmail.ContactDetails,
+	queue func(content io.Reader, sendAt time.Time, to ...*gpg.Entity) (ipmail.OutboxEntry, error),
+	undoWindow time.Duration, onQueued func(entry ipmail.OutboxEntry),
+	drafts ipmail.DraftList, draft *ipmail.Draft, onDraftsChanged func()) fyne.CanvasObject {
 	subject := widget.NewEntry()
 	subject.PlaceHolder = "Subject"
-	recipient := widget.NewEntry()
-	// TODO add error checking for recipient
-	// TODO add support for multiple recipients
-	// TODO add recipient auto complete
-	recipient.PlaceHolder = "Recipient"
+	recipient := widget.NewSelectEntry(nil)
+	recipient.PlaceHolder = "Recipients, separated by commas"
 	body := widget.NewMultiLineEntry()
+	sendAt := widget.NewEntry()
+	sendAt.PlaceHolder = "Send at (optional, e.g. +10m, 15:04 or 2006-01-02 15:04)"
 	// TODO add image support using canvas
 	//textCanvas := canvas.NewText("", color.Black)
 	//var r io.Reader
 	//imageCanvas := canvas.NewImageFromImage(image.Decode(r))
+	if draft != nil {
+		subject.SetText(draft.Subject)
+		recipient.SetText(strings.Join(draft.To, ", "))
+		body.SetText(draft.Body)
+	}
+
+	saveMtx := sync.Mutex{}
+	var autosave *time.Timer = nil
+	sent := false
+	save := func() {
+		saveMtx.Lock()
+		defer saveMtx.Unlock()
+		if autosave != nil {
+			autosave.Stop()
+			autosave = nil
+		}
+		if sent {
+			return
+		}
+		if draft == nil {
+			if len(subject.Text) == 0 && len(recipient.Text) == 0 && len(body.Text) == 0 {
+				return
+			}
+			draft = drafts.New()
+		}
+		draft.Subject = subject.Text
+		draft.To = draft.To[:0]
+		for _, name := range strings.Split(recipient.Text, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				draft.To = append(draft.To, name)
+			}
+		}
+		draft.Body = body.Text
+		drafts.Update(draft)
+		onDraftsChanged()
+	}
+	onChanged := func(string) {
+		saveMtx.Lock()
+		defer saveMtx.Unlock()
+		if autosave != nil {
+			autosave.Stop()
+		}
+		autosave = time.AfterFunc(autosaveDelay, save)
+	}
+	subject.OnChanged = onChanged
+	recipient.OnChanged = func(text string) {
+		recipient.SetOptions(completeRecipients(text, contacts, details))
+		onChanged(text)
+	}
+	body.OnChanged = onChanged
+	w.SetOnClosed(save)
+
 	toolbar := makeToolBar(w, func() {
-		r := bytes.NewReader(append(
-			append(
-				append([]byte("subject:"), subject.Text...),
-				'\n'),
-			body.Text...))
-		_, err := sender.Send(r, true, identity.DefaultIdentity(),
-			identity.DefaultIdentity(), contacts.GetByName(recipient.Text).GetAny())
+		save()
+		toSend := draft
+		if toSend == nil {
+			toSend = &ipmail.Draft{}
+		}
+		now := time.Now()
+		at := now
+		var err error = nil
+		if len(sendAt.Text) > 0 {
+			at, err = ipmail.ParseSendAt(sendAt.Text, now)
+		}
+		if at.Before(now.Add(undoWindow)) {
+			at = now.Add(undoWindow)
+		}
+		to, unsure := make([]*gpg.Entity, 0, len(toSend.To)), make([]string, 0)
+		for _, name := range toSend.To {
+			if err != nil {
+				break
+			}
+			matches := ipmail.FindContacts(contacts.ToArray(), details, name)
+			contact := matches.Best()
+			if contact == nil {
+				contact = matches.Closest()
+				if contact != nil { // matched weakly, so the user is asked first
+					unsure = append(unsure, fmt.Sprintf("\"%s\": %s\nFingerprint: %X", name,
+						util.EntityToString(contact), contact.PrimaryKey.Fingerprint))
+				}
+			}
+			if contact == nil {
+				err = fmt.Errorf("\"%s\" is not one of your contacts", name)
+			}
+			to = append(to, contact)
+		}
+		if err == nil && len(to) == 0 {
+			err = errors.New("message has no recipient")
+		}
 		if err != nil {
 			errDialog := dialog.NewError(err, w)
 			errDialog.Show()
-		} else {
+			return
+		}
+		send := func() {
+			entry, err := queue(toSend.Content(), at, to...)
+			if err != nil {
+				errDialog := dialog.NewError(err, w)
+				errDialog.Show()
+				return
+			}
+			onQueued(entry)
+			saveMtx.Lock()
+			sent = true
+			saveMtx.Unlock()
+			if draft != nil {
+				drafts.Remove(draft.Id)
+				onDraftsChanged()
+			}
 			w.Close()
 		}
+		if len(unsure) == 0 {
+			send()
+			return
+		}
+		dialog.ShowConfirm("Confirm Recipients", "Did you mean\n\n"+strings.Join(unsure, "\n\n")+"\n\nSend to them?",
+			func(confirmed bool) {
+				if confirmed {
+					send()
+				}
+			}, w)
 	})
-	return container.NewVBox(toolbar, subject, recipient, body)
+	return container.NewVBox(toolbar, subject, recipient, sendAt, body)
+}
+
+// completeRecipients suggests the contacts that best match the recipient being typed after the last comma in
+// text, each after the recipients before it
+func completeRecipients(text string, contacts crypto.ContactsIdentityList, details ipmail.ContactDetails) []string {
+	before, typing := "", text
+	if i := strings.LastIndex(text, ","); i >= 0 {
+		before, typing = text[:i+1]+" ", text[i+1:]
+	}
+	result := make([]string, 0)
+	for _, contact := range ipmail.FindContacts(contacts.ToArray(), details, typing).Entities() {
+		if len(result) == maxCompletions {
+			break
+		}
+		result = append(result, before+util.EntityToString(contact))
+	}
+	return result
 }
@@ -2,37 +2,118 @@ package views
 
 import (
 	"fyne.io/fyne"
+	"fyne.io/fyne/canvas"
 	"fyne.io/fyne/container"
 	"fyne.io/fyne/layout"
 	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
 	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
 )
 
-func MakeContent(messages ipmail.MessageList) fyne.CanvasObject {
+// MessageAction is an action the user can take on the selected message, such as archiving it
+type MessageAction struct {
+	Icon fyne.Resource
+	Do   func(message crypto.Message)
+}
+
+func flagIcon(flags ipmail.MessageFlag) fyne.Resource {
+	switch {
+	case flags&ipmail.FlagForwarded != 0:
+		return theme.MailForwardIcon()
+	case flags&ipmail.FlagAnswered != 0:
+		return theme.MailReplyIcon()
+	case flags&ipmail.FlagSeen == 0:
+		return theme.MailComposeIcon()
+	}
+	return theme.DocumentIcon()
+}
+
+// MakeContent lists messages with unread messages in bold and the avatar and display name of their sender from
+// profiles, or the nickname you gave them in details, marking a message as seen once it is selected
+func MakeContent(messages ipmail.MessageList, profiles ipmail.ProfileCache, details ipmail.ContactDetails,
+	flags ipmail.MessageFlags, onFlagsChanged func(), actions ...MessageAction) fyne.CanvasObject {
 	icon := widget.NewIcon(nil)
 	label := widget.NewLabel("Select An Item From The List")
 	hbox := container.NewHBox(icon, label)
 
+	var selected crypto.Message = nil
+	selectedId := -1
 	list := widget.NewList(
 		func() int {
 			return messages.Len()
 		},
 		func() fyne.CanvasObject {
-			return container.NewHBox(widget.NewIcon(theme.MailComposeIcon()),
-				widget.NewLabel("Template Object"))
+			return container.NewHBox(widget.NewIcon(theme.MailComposeIcon()), newAvatar(24),
+				widget.NewLabel("Template Object"), widget.NewIcon(nil))
 		},
 		func(id widget.ListItemID, item fyne.CanvasObject) {
-			item.(*fyne.Container).Objects[1].(*widget.Label).SetText(messages.FromIndex(id).String())
+			msg := messages.FromIndex(id)
+			if msg == nil {
+				return
+			}
+			msgFlags := flags.Flags(ipmail.MessageKey(msg))
+			objects := item.(*fyne.Container).Objects
+			objects[0].(*widget.Icon).SetResource(flagIcon(msgFlags))
+			var profile *crypto.Profile
+			nickname := ""
+			if from := msg.From(); from != nil {
+				profile, nickname = profiles.Get(from), details.Get(from).Nickname
+			}
+			setAvatar(objects[1].(*canvas.Image), profile)
+			label := objects[2].(*widget.Label)
+			label.TextStyle = fyne.TextStyle{Bold: msgFlags&ipmail.FlagSeen == 0}
+			if len(nickname) > 0 {
+				label.SetText(msg.String() + " - " + nickname)
+			} else if profile != nil && len(profile.DisplayName) > 0 {
+				label.SetText(msg.String() + " - " + profile.DisplayName)
+			} else {
+				label.SetText(msg.String())
+			}
+			if msgFlags&ipmail.FlagStarred != 0 {
+				objects[3].(*widget.Icon).SetResource(theme.RadioButtonCheckedIcon())
+			} else {
+				objects[3].(*widget.Icon).SetResource(nil)
+			}
 		},
 	)
 	list.OnSelected = func(id widget.ListItemID) {
-		label.SetText(string(messages.FromIndex(id).Data()))
+		selectedId = id
+		selected = messages.FromIndex(id)
+		if selected == nil {
+			return
+		}
+		if handshake := selected.Handshake(); handshake != nil {
+			label.SetText(handshake.String()) // instead of the armored key it carries
+		} else {
+			label.SetText(string(selected.Data()))
+		}
 		icon.SetResource(theme.DocumentIcon())
+		if key := ipmail.MessageKey(selected); !flags.Has(key, ipmail.FlagSeen) {
+			flags.Set(key, ipmail.FlagSeen)
+			onFlagsChanged()
+			list.Refresh()
+		}
 	}
 	list.OnUnselected = func(id widget.ListItemID) {
+		selected = nil
 		label.SetText("Select An Item From The List")
 		icon.SetResource(nil)
 	}
-	return container.NewHSplit(list, fyne.NewContainerWithLayout(layout.NewCenterLayout(), hbox))
+
+	toolbar := widget.NewToolbar()
+	for _, action := range actions {
+		action := action
+		toolbar.Append(widget.NewToolbarAction(action.Icon, func() {
+			if selected == nil {
+				return
+			}
+			action.Do(selected)
+			list.Unselect(selectedId)
+			list.Refresh()
+		}))
+	}
+	detail := container.NewBorder(toolbar, nil, nil, nil,
+		fyne.NewContainerWithLayout(layout.NewCenterLayout(), hbox))
+	return container.NewHSplit(list, detail)
 }
@@ -2,19 +2,34 @@ package views
 
 import (
 	"fyne.io/fyne"
+	"fyne.io/fyne/container"
+	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
 )
 
 type SelectFunction func()
 
-func MakeNav(lists map[string]SelectFunction) fyne.CanvasObject {
+type NavItem struct {
+	Name   string
+	Select SelectFunction
+}
+
+// FolderFunction creates or deletes a folder, calling done once the navigation should be refreshed
+type FolderFunction func(name string, done func())
+
+// MakeNav shows the items returned by items, which is called again whenever the tree is refreshed.
+// The new folder button calls newFolder with an empty name and the delete button calls deleteFolder
+// with the selected item.
+func MakeNav(items func() []NavItem, newFolder FolderFunction, deleteFolder FolderFunction) fyne.CanvasObject {
 	tree := &widget.Tree{}
-	keys := make([]string, 0, len(lists))
-	for k := range lists {
-		keys = append(keys, k)
-	}
+	selected := ""
 	tree.ChildUIDs = func(id string) []string {
 		if tree.IsBranch(id) {
+			all := items()
+			keys := make([]string, 0, len(all))
+			for _, item := range all {
+				keys = append(keys, item.Name)
+			}
 			return keys
 		}
 		return make([]string, 0)
@@ -29,9 +44,30 @@ func MakeNav(lists map[string]SelectFunction) fyne.CanvasObject {
 		node.(*widget.Label).SetText(uid)
 	}
 	tree.OnSelected = func(id string) {
-		lists[id]()
+		selected = id
+		for _, item := range items() {
+			if item.Name == id {
+				item.Select()
+				break
+			}
+		}
 	}
 	tree.ExtendBaseWidget(tree)
 
-	return tree
+	toolbar := widget.NewToolbar(
+		widget.NewToolbarAction(theme.FolderNewIcon(), func() {
+			newFolder("", tree.Refresh)
+		}),
+		widget.NewToolbarAction(theme.DeleteIcon(), func() {
+			if len(selected) > 0 {
+				deleteFolder(selected, func() {
+					tree.Unselect(selected)
+					selected = ""
+					tree.Refresh()
+				})
+			}
+		}),
+	)
+
+	return container.NewBorder(nil, toolbar, nil, nil, tree)
 }
@@ -0,0 +1,43 @@
+package views
+
+import (
+	"fyne.io/fyne"
+	"fyne.io/fyne/container"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+	"ipmail/libipmail"
+)
+
+func MakeOutbox(outbox ipmail.Outbox) *widget.List {
+	list := widget.NewList(
+		func() int {
+			return outbox.Len()
+		},
+		func() fyne.CanvasObject {
+			return container.NewHBox(widget.NewIcon(theme.MailSendIcon()),
+				widget.NewLabel("Template Object"),
+				widget.NewButtonWithIcon("", theme.MailForwardIcon(), nil),
+				widget.NewButtonWithIcon("", theme.CancelIcon(), nil))
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			entry, ok := outbox.FromIndex(id)
+			if !ok {
+				return
+			}
+			objs := item.(*fyne.Container).Objects
+			objs[1].(*widget.Label).SetText(entry.String())
+			objs[2].(*widget.Button).OnTapped = func() {
+				// send now
+				_ = outbox.SendNow(entry.Id)
+			}
+			objs[3].(*widget.Button).OnTapped = func() {
+				// undo send
+				_ = outbox.Cancel(entry.Id)
+			}
+		},
+	)
+	outbox.OnChange(func(entry ipmail.OutboxEntry) {
+		list.Refresh()
+	})
+	return list
+}
@@ -0,0 +1,62 @@
+package views
+
+import (
+	"bytes"
+	"fyne.io/fyne"
+	"fyne.io/fyne/canvas"
+	"image"
+	_ "image/jpeg" // avatars are PNG or JPEG images
+	_ "image/png"
+	"ipmail/libipmail/crypto"
+	"strings"
+	"sync"
+)
+
+var avatars = struct {
+	sync.Mutex
+	// decoded are the avatars by the profile they are in, so list rows don't decode them again
+	decoded map[*crypto.Profile]image.Image
+}{decoded: make(map[*crypto.Profile]image.Image)}
+
+// avatar decodes the avatar of profile once, returning nil if it has none or one too large to decode
+func avatar(profile *crypto.Profile) image.Image {
+	if profile == nil || len(profile.Avatar) == 0 {
+		return nil
+	}
+	avatars.Lock()
+	defer avatars.Unlock()
+	if img, ok := avatars.decoded[profile]; ok {
+		return img
+	}
+	var img image.Image
+	if crypto.CheckAvatar(profile.Avatar) == nil { // profiles saved before avatars were bounded aren't checked
+		img, _, _ = image.Decode(bytes.NewBuffer(profile.Avatar))
+	}
+	avatars.decoded[profile] = img
+	return img
+}
+
+// newAvatar makes an image of size for list rows to show an avatar in
+func newAvatar(size int) *canvas.Image {
+	img := &canvas.Image{FillMode: canvas.ImageFillContain}
+	img.SetMinSize(fyne.NewSize(size, size))
+	return img
+}
+
+// setAvatar shows the avatar of profile in img, which is left empty without one
+func setAvatar(img *canvas.Image, profile *crypto.Profile) {
+	img.Image = avatar(profile)
+	img.Refresh()
+}
+
+// profileSummary is the display name and preferred languages of profile
+func profileSummary(profile *crypto.Profile) string {
+	if profile == nil {
+		return ""
+	}
+	result := profile.DisplayName
+	if len(profile.Languages) > 0 {
+		result += " (" + strings.Join(profile.Languages, ", ") + ")"
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package gui
+
+import (
+	"errors"
+	"fyne.io/fyne"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/widget"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"os"
+)
+
+// promptUnlock asks for the passphrase until it is right, then calls unlocked
+func promptUnlock(window fyne.Window, store ipmail.LocalStore, retry string, unlocked func()) {
+	onResults := func(results []string, err error) {
+		if err != nil {
+			println(err.Error())
+			os.Exit(0)
+		}
+		err = store.Unlock([]byte(results[0]))
+		if err == crypto.ErrWrongPassphrase {
+			promptUnlock(window, store, "Wrong passphrase, try again.", unlocked)
+			return
+		} else if err != nil {
+			println(err.Error())
+			os.Exit(0)
+		}
+		unlocked()
+	}
+	prompt(window, onResults, true, "Unlock", "Unlock",
+		"Your mail is encrypted with your passphrase. "+retry, 400, "Passphrase")
+}
+
+// setPassphrase asks for a new passphrase to encrypt the local files with
+func setPassphrase(window fyne.Window, store ipmail.LocalStore) {
+	passphrase := widget.NewPasswordEntry()
+	repeated := widget.NewPasswordEntry()
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			widget.NewFormItem("Passphrase", passphrase),
+			widget.NewFormItem("Repeat Passphrase", repeated),
+		},
+	}
+	dialog.ShowCustomConfirm("Set Passphrase", "Set", "Cancel", form, func(ok bool) {
+		if !ok {
+			return
+		}
+		if len(passphrase.Text) == 0 || passphrase.Text != repeated.Text {
+			dialog.ShowError(errors.New("the passphrases are empty or don't match"), window)
+			return
+		}
+		err := store.SetPassphrase([]byte(passphrase.Text))
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		dialog.ShowInformation("Set Passphrase",
+			"Your local files are encrypted with the new passphrase, which is asked for at startup.", window)
+	}, window)
+}
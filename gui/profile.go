@@ -0,0 +1,72 @@
+package gui
+
+import (
+	"fyne.io/fyne"
+	"fyne.io/fyne/container"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/storage"
+	"fyne.io/fyne/widget"
+	"io/ioutil"
+	"ipmail/libipmail"
+	"ipmail/libipmail/crypto"
+	"strings"
+)
+
+// editProfile changes your profile, calling republish once it changed so contacts see it
+func editProfile(window fyne.Window, mailbox ipmail.Mailbox, republish func()) {
+	profile := crypto.Profile{}
+	if current := mailbox.Profiles().Get(mailbox.Identity().DefaultIdentity()); current != nil {
+		profile = *current
+	}
+	name, bio, languages := widget.NewEntry(), widget.NewMultiLineEntry(), widget.NewEntry()
+	name.SetText(profile.DisplayName)
+	bio.SetText(profile.Bio)
+	languages.SetText(strings.Join(profile.Languages, ", "))
+	languages.SetPlaceHolder("en-US, de")
+	avatar := profile.Avatar
+	avatarLabel := widget.NewLabel("No avatar")
+	if len(avatar) > 0 {
+		avatarLabel.SetText("Avatar set")
+	}
+	chooseAvatar := widget.NewButton("Choose Avatar...", func() {
+		open := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			defer reader.Close()
+			b, err := ioutil.ReadAll(reader)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			avatar = b
+			avatarLabel.SetText(reader.URI().Name())
+		}, window)
+		open.SetFilter(storage.NewExtensionFileFilter([]string{".png", ".jpg", ".jpeg"}))
+		open.Show()
+	})
+	removeAvatar := widget.NewButton("Remove Avatar", func() {
+		avatar = nil
+		avatarLabel.SetText("No avatar")
+	})
+	form := widget.NewForm(widget.NewFormItem("Display name:", name), widget.NewFormItem("Bio:", bio),
+		widget.NewFormItem("Languages:", languages), widget.NewFormItem("Avatar:",
+			container.NewVBox(avatarLabel, chooseAvatar, removeAvatar)))
+	dialog.ShowCustomConfirm("Edit Profile", "Save", "Cancel", form, func(confirmed bool) {
+		if !confirmed {
+			return
+		}
+		profile.DisplayName = strings.TrimSpace(name.Text)
+		profile.Bio = strings.TrimSpace(bio.Text)
+		profile.Languages = strings.FieldsFunc(languages.Text, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		profile.Avatar = avatar
+		_, err := mailbox.SetProfile(profile)
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		go republish()
+	}, window)
+}
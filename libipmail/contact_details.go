@@ -0,0 +1,100 @@
+package ipmail
+
+import (
+	"bytes"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io"
+	"ipmail/libipmail/util"
+	"sync"
+)
+
+// ContactDetail is what you keep about a contact for yourself. It is never part of their signed user ID
+type ContactDetail struct {
+	// Nickname is shown instead of the name in their user ID, unless it is empty
+	Nickname string
+	Note     string
+}
+
+// ContactDetails are the nicknames and notes of contacts
+type ContactDetails interface {
+	// Get returns the detail of contact, which is empty if none was set
+	Get(contact *gpg.Entity) ContactDetail
+	// Set replaces the detail of contact, removing it if it is empty
+	Set(contact *gpg.Entity, detail ContactDetail)
+	Remove(contact *gpg.Entity)
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type contactDetails struct {
+	mtx sync.Mutex
+	// details are by contact fingerprint
+	details map[string]ContactDetail
+}
+
+func NewContactDetails() ContactDetails {
+	return &contactDetails{details: make(map[string]ContactDetail)}
+}
+
+func NewContactDetailsFromFile(file string, sealer util.Sealer) (ContactDetails, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := &contactDetails{details: make(map[string]ContactDetail)}
+	r := bytes.NewBuffer(b)
+	for r.Len() > 0 {
+		fingerprint, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		detail := ContactDetail{}
+		detail.Nickname, err = util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		detail.Note, err = util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		result.details[fingerprint] = detail
+	}
+	return result, nil
+}
+
+func (c *contactDetails) Get(contact *gpg.Entity) ContactDetail {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.details[entityFingerprint(contact)]
+}
+
+func (c *contactDetails) Set(contact *gpg.Entity, detail ContactDetail) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if detail == (ContactDetail{}) {
+		delete(c.details, entityFingerprint(contact))
+		return
+	}
+	c.details[entityFingerprint(contact)] = detail
+}
+
+func (c *contactDetails) Remove(contact *gpg.Entity) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.details, entityFingerprint(contact))
+}
+
+func (c *contactDetails) SaveToFile(file string, sealer util.Sealer) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		for fingerprint, detail := range c.details {
+			for _, s := range []string{fingerprint, detail.Nickname, detail.Note} {
+				err := util.WriteString(w, s)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,154 @@
+package ipmail
+
+import (
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContactDetails(t *testing.T) {
+	alice, _ := gpg.NewEntity("alice", "", "", util.DefaultEncryptionConfig())
+	dir, err := ioutil.TempDir("", "ipmail-details")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "details")
+
+	tests := []struct {
+		name   string
+		detail ContactDetail
+	}{
+		{"Nickname", ContactDetail{Nickname: "Al"}},
+		{"Note", ContactDetail{Nickname: "Al", Note: "met at the\nconference"}},
+		{"Cleared", ContactDetail{}},
+	}
+	details := NewContactDetails()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			details.Set(alice, tt.detail)
+			if err := details.SaveToFile(file, nil); err != nil {
+				t.Fatalf("SaveToFile() error = %v", err)
+			}
+			loaded, err := NewContactDetailsFromFile(file, nil)
+			if err != nil {
+				t.Fatalf("NewContactDetailsFromFile() error = %v", err)
+			}
+			if got := loaded.Get(alice); got != tt.detail {
+				t.Errorf("Get() = %v, want %v", got, tt.detail)
+			}
+		})
+	}
+}
+
+func TestMailbox_RemoveContact(t *testing.T) {
+	stranger, _ := gpg.NewEntity("stranger", "", "", util.DefaultEncryptionConfig())
+	contact, _ := gpg.NewEntity("contact", "", "", util.DefaultEncryptionConfig())
+	dir, err := ioutil.TempDir("", "ipmail-contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := MailboxFiles{Contacts: filepath.Join(dir, "contacts"), Details: filepath.Join(dir, "details")}
+	m := newTestMailbox(t, func(config *MailboxConfig) {
+		config.Files = files
+	})
+	self := m.Identity().DefaultIdentity()
+	if err = m.AddContact(contact, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetContactDetail(contact, ContactDetail{Nickname: "friend"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetContactDetail(stranger, ContactDetail{Nickname: "stranger"}); err == nil {
+		t.Error("SetContactDetail() of a stranger succeeded")
+	}
+
+	tests := []struct {
+		name      string
+		entity    *gpg.Entity
+		wantErr   bool
+		wantSaved bool
+	}{
+		{"Stranger", stranger, true, true},
+		{"Yourself", self, true, true},
+		{"Contact", contact, false, false},
+		{"Removed", contact, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.RemoveContact(tt.entity); (err != nil) != tt.wantErr {
+				t.Fatalf("RemoveContact() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			saved, err := crypto.NewContactsIdentityListFromFile(files.Contacts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := containsEntity(contact, saved.ToArray()); got != tt.wantSaved {
+				t.Errorf("contact saved = %v, want %v", got, tt.wantSaved)
+			}
+			if !containsEntity(self, m.Contacts().ToArray()) {
+				t.Error("your own identity was removed")
+			}
+		})
+	}
+	details, err := NewContactDetailsFromFile(files.Details, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := details.Get(contact); got != (ContactDetail{}) {
+		t.Errorf("saved detail of the removed contact = %v, want none", got)
+	}
+}
+
+func TestMailbox_RemoveContact_messages(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice")
+	bob := newLoopbackUser(t, network, "bob")
+	alice.mailbox.Contacts().Add(bob.identity.DefaultIdentity())
+	bob.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+	bob.send(t, "hi alice", alice)
+	bob.expect(t, SentEcho)
+	received := alice.expect(t, MessageReceived).Message
+	if err := alice.mailbox.RemoveContact(bob.identity.DefaultIdentity()); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "ipmail-removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inbox")
+	if err = alice.mailbox.Messages().SaveToFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := crypto.NewSelfIdentity("stranger", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := alice.mailbox.(*mailbox).config
+	tests := []struct {
+		name     string
+		identity crypto.SelfIdentity
+		contacts crypto.ContactsIdentityList
+		wantLen  int
+	}{
+		{"Removed Sender", config.Identity, config.Contacts, 1},
+		{"Unreadable", stranger, crypto.NewContactsIdentityList(stranger.EntityList()), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := NewMessageListFromFile(file, nil, nil, config.Ipfs, tt.identity, tt.contacts)
+			if loaded == nil || loaded.Len() != tt.wantLen {
+				t.Fatalf("NewMessageListFromFile() = %v, want %v messages", loaded, tt.wantLen)
+			}
+			if tt.wantLen > 0 && !loaded.FromCid(received.Cid()).IsFrom(bob.identity.DefaultIdentity()) {
+				t.Error("the message isn't from bob after reading it back")
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package ipmail
+
+import (
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// How well a query term matched a field of a contact, the best of which counts for the term
+const (
+	matchExact       = 100
+	matchPrefix      = 80
+	matchWordPrefix  = 60
+	matchSubstring   = 40
+	matchTypo        = 20
+	matchSubsequence = 10
+	// matchNickname is added when the nickname you gave a contact matched, as you chose it to find them by
+	matchNickname = 5
+)
+
+// ContactMatch is a contact found by FindContacts, with how well it matched
+type ContactMatch struct {
+	Contact *gpg.Entity
+	Score   int
+	// Close is whether every term matched at least the beginning of a word, rather than only fuzzily or in the
+	// middle of one
+	Close bool
+}
+
+// ContactMatches are contacts found by FindContacts, best first
+type ContactMatches []ContactMatch
+
+// Entities returns the contacts that matched, best first
+func (c ContactMatches) Entities() []*gpg.Entity {
+	result := make([]*gpg.Entity, 0, len(c))
+	for _, match := range c {
+		result = append(result, match.Contact)
+	}
+	return result
+}
+
+// Best returns the contact that matched closely and better than every other one, which can be picked without
+// asking, or nil if none did
+func (c ContactMatches) Best() *gpg.Entity {
+	if closest := c.Closest(); closest != nil && c[0].Close {
+		return closest
+	}
+	return nil
+}
+
+// Closest returns the contact that matched better than every other one, however weakly, or nil if none did.
+// Unless it is also Best, ask whether it is the contact that was meant
+func (c ContactMatches) Closest() *gpg.Entity {
+	if len(c) == 0 || len(c) > 1 && c[0].Score == c[1].Score {
+		return nil
+	}
+	return c[0].Contact
+}
+
+// SplitQuoted splits s at every space that isn't between double quotes, keeping the quotes
+func SplitQuoted(s string) []string {
+	result := make([]string, 0)
+	quoted, start := false, 0
+	for i, r := range s {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ' ' && !quoted {
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+// FindContacts ranks the contacts matching every term of query, ignoring case. A term matches the nickname
+// from details, which can be nil, or the name, email or user ID of a contact by prefix, by substring or
+// fuzzily, and their key ID or fingerprint in hex by prefix. A "quoted term" is matched as a whole, and so is
+// the whole query when it is a nickname or user ID
+func FindContacts(contacts []*gpg.Entity, details ContactDetails, query string) ContactMatches {
+	terms := make([]string, 0)
+	for _, term := range SplitQuoted(strings.ToLower(strings.TrimSpace(query))) {
+		if term = strings.TrimSpace(strings.Trim(term, "\"")); len(term) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return ContactMatches{}
+	}
+	whole := strings.Trim(strings.ToLower(strings.TrimSpace(query)), "\"")
+	result := make(ContactMatches, 0)
+	for _, contact := range contacts {
+		nickname := ""
+		if details != nil {
+			nickname = strings.ToLower(details.Get(contact).Nickname)
+		}
+		fields := []string{nickname}
+		for _, identity := range contact.Identities {
+			id := identity.UserId
+			fields = append(fields, strings.ToLower(id.Name), strings.ToLower(id.Email), strings.ToLower(id.Id))
+		}
+		keys := []string{strings.ToLower(contact.PrimaryKey.KeyIdString()),
+			strings.ToLower(fmt.Sprintf("%X", contact.PrimaryKey.Fingerprint))}
+		score, close := 0, true
+		for _, term := range terms {
+			termScore := matchContact(term, fields, keys)
+			if termScore == 0 {
+				score = 0
+				break
+			}
+			score += termScore
+			close = close && termScore >= matchWordPrefix
+		}
+		if len(terms) > 1 {
+			wholeScore := matchContact(whole, fields, nil)
+			if wholeScore*len(terms) > score {
+				score, close = wholeScore*len(terms), wholeScore >= matchWordPrefix
+			}
+		}
+		if score > 0 {
+			result = append(result, ContactMatch{contact, score, close})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Score > result[j].Score
+	})
+	return result
+}
+
+// matchContact is how well term matches the best of fields, the first of which is the nickname, or the
+// beginning of the best of the hex keys
+func matchContact(term string, fields []string, keys []string) int {
+	best := 0
+	for i, field := range fields {
+		score := matchField(term, field)
+		if i == 0 && score > 0 {
+			score += matchNickname
+		}
+		if score > best {
+			best = score
+		}
+	}
+	hex := strings.TrimPrefix(term, "0x")
+	for _, key := range keys {
+		if len(hex) >= 4 && strings.HasPrefix(key, hex) {
+			score := matchPrefix
+			if hex == key {
+				score = matchExact
+			}
+			if score > best {
+				best = score
+			}
+		}
+	}
+	return best
+}
+
+// matchField is how well term matches field, both in lower case
+func matchField(term string, field string) int {
+	switch {
+	case len(field) == 0:
+		return 0
+	case term == field:
+		return matchExact
+	case strings.HasPrefix(field, term):
+		return matchPrefix
+	}
+	words := strings.FieldsFunc(field, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if strings.HasPrefix(word, term) {
+			return matchWordPrefix
+		}
+	}
+	if strings.Contains(field, term) {
+		return matchSubstring
+	}
+	termRunes := []rune(term)
+	if len(termRunes) < 4 { // shorter terms would fuzzily match almost anything
+		return 0
+	}
+	typos := 1
+	if len(termRunes) >= 8 {
+		typos = 2
+	}
+	for _, word := range append(words, field) {
+		wordRunes := []rune(word)
+		if len(wordRunes) > len(termRunes) {
+			wordRunes = wordRunes[:len(termRunes)] // so a mistyped beginning of a word is found too
+		}
+		if editDistance(termRunes, wordRunes) <= typos {
+			return matchTypo
+		}
+	}
+	if isSubsequence(termRunes, []rune(field)) {
+		return matchSubsequence
+	}
+	return 0
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps of neighbours that turn a into b
+func editDistance(a []rune, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+// isSubsequence reports whether every rune of a is in b in the same order
+func isSubsequence(a []rune, b []rune) bool {
+	i := 0
+	for _, r := range b {
+		if i < len(a) && a[i] == r {
+			i++
+		}
+	}
+	return i == len(a)
+}
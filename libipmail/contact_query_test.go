@@ -0,0 +1,95 @@
+package ipmail
+
+import (
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"ipmail/libipmail/util"
+	"reflect"
+	"testing"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want []string
+	}{
+		{"Words", "to:alice hi", []string{"to:alice", "hi"}},
+		{"Quoted", `to:"Alice Smith" hi there`, []string{`to:"Alice Smith"`, "hi", "there"}},
+		{"Unterminated", `"Alice Smith`, []string{`"Alice Smith`}},
+		{"Spaces Kept", "a  b", []string{"a", "", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SplitQuoted(tt.s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitQuoted() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindContacts(t *testing.T) {
+	newContact := func(name string, email string) *gpg.Entity {
+		entity, err := gpg.NewEntity(name, "", email, util.DefaultEncryptionConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entity
+	}
+	aliceSmith := newContact("Alice Smith", "alice@example.com")
+	aliceJones := newContact("Alice Jones", "jones@example.org")
+	bob := newContact("Bob", "bob@example.org")
+	contacts := []*gpg.Entity{aliceSmith, aliceJones, bob}
+	details := NewContactDetails()
+	details.Set(bob, ContactDetail{Nickname: "Uncle Bob"})
+
+	tests := []struct {
+		name        string
+		query       string
+		want        []*gpg.Entity
+		wantBest    *gpg.Entity
+		wantClosest *gpg.Entity
+	}{
+		{"Prefix Ambiguous", "alice", []*gpg.Entity{aliceSmith, aliceJones}, nil, nil},
+		{"Case Insensitive", "ALICE SMITH", []*gpg.Entity{aliceSmith}, aliceSmith, aliceSmith},
+		{"Quoted Name", `"Alice Smith"`, []*gpg.Entity{aliceSmith}, aliceSmith, aliceSmith},
+		{"Every Term", "alice example.org", []*gpg.Entity{aliceJones}, nil, aliceJones},
+		{"Email", "alice@example.com", []*gpg.Entity{aliceSmith}, aliceSmith, aliceSmith},
+		{"Exact Before Prefix", "bob", []*gpg.Entity{bob}, bob, bob},
+		{"Nickname", "uncle", []*gpg.Entity{bob}, bob, bob},
+		{"Word Prefix", "jon", []*gpg.Entity{aliceJones}, aliceJones, aliceJones},
+		{"Substring", "mit", []*gpg.Entity{aliceSmith}, nil, aliceSmith},
+		{"Typo", "smtih", []*gpg.Entity{aliceSmith}, nil, aliceSmith},
+		{"Key ID", bob.PrimaryKey.KeyIdString(), []*gpg.Entity{bob}, bob, bob},
+		{"Fingerprint", fmt.Sprintf("0x%x", aliceJones.PrimaryKey.Fingerprint[:4]), []*gpg.Entity{aliceJones}, aliceJones,
+			aliceJones},
+		{"User ID", "Alice Smith <alice@example.com>", []*gpg.Entity{aliceSmith}, aliceSmith, aliceSmith},
+		{"No Match", "carol", []*gpg.Entity{}, nil, nil},
+		{"Empty", " ", []*gpg.Entity{}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := FindContacts(contacts, details, tt.query)
+			if got := matches.Entities(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindContacts() found %d contacts, want %d", len(got), len(tt.want))
+			}
+			if got := matches.Best(); got != tt.wantBest {
+				t.Errorf("Best() = %v, want %v", got, tt.wantBest)
+			}
+			if got := matches.Closest(); got != tt.wantClosest {
+				t.Errorf("Closest() = %v, want %v", got, tt.wantClosest)
+			}
+		})
+	}
+
+	t.Run("Ranked", func(t *testing.T) {
+		matches := FindContacts([]*gpg.Entity{aliceJones, aliceSmith}, nil, "smith")
+		if len(matches) != 1 || matches[0].Contact != aliceSmith {
+			t.Fatalf("FindContacts() = %v, want only Alice Smith", matches)
+		}
+		matches = FindContacts([]*gpg.Entity{aliceSmith, bob}, details, "example")
+		if len(matches) != 2 || matches[0].Score < matches[1].Score {
+			t.Errorf("FindContacts() = %v, want both ranked best first", matches)
+		}
+	})
+}
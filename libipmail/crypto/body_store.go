@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+)
+
+// BodyStore keeps the encrypted bodies of messages on disk so messages don't have to hold them in memory. They
+// are sealed like the other local files, which matters for the bodies of sealed messages since they are only
+// encrypted to the identity once opened
+type BodyStore interface {
+	// Put saves the encrypted body of the message c. A body that is already stored isn't written again
+	Put(c cid.Cid, encrypted io.Reader) error
+	// Replace saves body in place of the stored body of c, which is kept if reading body fails
+	Replace(c cid.Cid, body io.Reader) error
+	Open(c cid.Cid) (io.ReadCloser, error)
+	Has(c cid.Cid) bool
+	Remove(c cid.Cid) error
+	// ForEach goes through the CIDs of every stored body
+	ForEach(do func(c cid.Cid)) error
+	// Reseal writes every stored body again with the store's util.Sealer, like once a passphrase is first set
+	Reseal() error
+}
+
+type bodyStore struct {
+	dir    string
+	sealer util.Sealer
+}
+
+// NewBodyStore keeps bodies as files in dir, which is created if it doesn't exist, sealed with sealer
+func NewBodyStore(dir string, sealer util.Sealer) (BodyStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &bodyStore{dir: dir, sealer: sealer}, nil
+}
+
+func (s *bodyStore) file(c cid.Cid) string {
+	return filepath.Join(s.dir, c.String())
+}
+
+func (s *bodyStore) Put(c cid.Cid, encrypted io.Reader) error {
+	if s.Has(c) {
+		_, err := io.Copy(ioutil.Discard, encrypted) // callers may rely on encrypted being read, like a pipe
+		return err
+	}
+	return util.WriteSealedStream(s.file(c), s.sealer, func(w io.Writer) error {
+		_, err := io.Copy(w, encrypted)
+		return err
+	})
+}
+
+func (s *bodyStore) Replace(c cid.Cid, body io.Reader) error {
+	return util.WriteSealedStream(s.file(c), s.sealer, func(w io.Writer) error {
+		_, err := io.Copy(w, body)
+		return err
+	})
+}
+
+func (s *bodyStore) Open(c cid.Cid) (io.ReadCloser, error) {
+	return util.OpenSealedStream(s.file(c), s.sealer)
+}
+
+func (s *bodyStore) Has(c cid.Cid) bool {
+	_, err := os.Stat(s.file(c))
+	return err == nil
+}
+
+func (s *bodyStore) Remove(c cid.Cid) error {
+	err := os.Remove(s.file(c))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *bodyStore) ForEach(do func(c cid.Cid)) error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		c, err := cid.Decode(info.Name())
+		if err != nil || info.IsDir() {
+			continue // not a body, like a leftover .tmp file
+		}
+		do(c)
+	}
+	return nil
+}
+
+func (s *bodyStore) Reseal() error {
+	var err error
+	forEachErr := s.ForEach(func(c cid.Cid) {
+		if err == nil {
+			err = util.SealStreamFile(s.file(c), s.sealer)
+		}
+	})
+	if forEachErr != nil {
+		return forEachErr
+	}
+	return err
+}
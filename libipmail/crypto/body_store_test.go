@@ -0,0 +1,195 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"strings"
+	"testing"
+)
+
+// failingReader fails every read, like a sealed message which turns out to be corrupt
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("corrupt")
+}
+
+func newTestBodyStore(t *testing.T, sealer util.Sealer) BodyStore {
+	dir, err := ioutil.TempDir("", "ipmail-bodies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	store, err := NewBodyStore(dir, sealer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestBodyStore(t *testing.T) {
+	store := newTestBodyStore(t, nil)
+	c, _ := util.ContentCid([]byte("body"))
+	if store.Has(c) {
+		t.Fatal("Has() of an empty store = true")
+	}
+	if err := store.Put(c, bytes.NewBufferString("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(c, bytes.NewBufferString("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.Open(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	_ = r.Close()
+	if string(got) != "body" {
+		t.Errorf("Open() = %q, want %q", got, "body")
+	}
+	failing := io.MultiReader(bytes.NewBufferString("half"), failingReader{})
+	if err := store.Replace(c, failing); err == nil {
+		t.Error("Replace() with a failing reader succeeded")
+	}
+	if err := store.Replace(c, bytes.NewBufferString("opened")); err != nil {
+		t.Fatal(err)
+	}
+	r, err = store.Open(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = ioutil.ReadAll(r)
+	_ = r.Close()
+	if string(got) != "opened" {
+		t.Errorf("Open() after Replace() = %q, want %q", got, "opened")
+	}
+	stored := make([]cid.Cid, 0)
+	_ = store.ForEach(func(c cid.Cid) {
+		stored = append(stored, c)
+	})
+	if len(stored) != 1 || !stored[0].Equals(c) {
+		t.Errorf("ForEach() = %v, want [%v]", stored, c)
+	}
+	if err := store.Remove(c); err != nil {
+		t.Fatal(err)
+	}
+	if store.Has(c) {
+		t.Error("Has() after Remove() = true")
+	}
+}
+
+func TestBodyStore_sealed(t *testing.T) {
+	sealer := util.NewSealerSwitch()
+	store := newTestBodyStore(t, sealer)
+	c, _ := util.ContentCid([]byte("before"))
+	if err := store.Put(c, bytes.NewBufferString("opened before the passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	vault, err := NewVault([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer.Switch(vault)
+	if err = store.Reseal(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := util.ContentCid([]byte("after"))
+	if err = store.Put(after, bytes.NewBufferString("opened after the passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []cid.Cid{c, after} {
+		raw, _ := ioutil.ReadFile(store.(*bodyStore).file(id))
+		if bytes.Contains(raw, []byte("opened")) {
+			t.Errorf("body %v isn't sealed", id)
+		}
+		r, err := store.Open(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		_ = r.Close()
+		if !strings.HasPrefix(string(got), "opened") {
+			t.Errorf("Open() = %q, want the body", got)
+		}
+	}
+	sealer.Switch(nil) // like a new run before unlocking
+	if _, err = store.Open(after); err != util.ErrLocked {
+		t.Errorf("Open() while locked error = %v, want %v", err, util.ErrLocked)
+	}
+}
+
+func TestReadMessageWithStore(t *testing.T) {
+	self := &selfIdentity{identities: NewIdentityList(entity1), defaultIdentity: entity1}
+	contacts := NewContactsIdentityList(gpg.EntityList{})
+	content := strings.Repeat("a big message ", 1000)
+	buf := bytes.NewBuffer(make([]byte, 0))
+	w, err := EncryptToSelf(buf, MessageEncoding, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(content))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := buf.Bytes()
+	contentCid, _ := util.ContentCid(encrypted)
+	origin, _ := peer.Decode("QmQQtheqZouh43hfV4E9woribXBGi6yLdefrrpvsCk7RxB")
+	inline := bytes.NewBuffer(make([]byte, 0))
+	if err = NewMessage(encrypted, contentCid, origin, nil, self, contacts, nil).Serialize(inline); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestBodyStore(t, nil)
+	moved, err := ReadMessageWithStore(inline, store, nil, self, contacts)
+	if err != nil {
+		t.Fatalf("ReadMessageWithStore() error = %v", err)
+	}
+	if !store.Has(contentCid) || moved.(*message).encryptedData != nil {
+		t.Fatal("the message data wasn't moved to the store")
+	}
+	saved := bytes.NewBuffer(make([]byte, 0))
+	if err = moved.Serialize(saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Len() >= len(encrypted) {
+		t.Errorf("Serialize() wrote %d bytes, want the data left out", saved.Len())
+	}
+	savedCopy := bytes.NewBuffer(saved.Bytes())
+
+	tests := []struct {
+		name    string
+		store   BodyStore
+		wantErr bool
+	}{
+		{"With Store", store, false},
+		{"Without Store", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadMessageWithStore(bytes.NewBuffer(savedCopy.Bytes()), tt.store, nil, self, contacts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadMessageWithStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			body, err := got.Body()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(body)
+			_ = body.Close()
+			if string(b) != content || string(got.Data()) != content {
+				t.Errorf("Body() = %d bytes, want the %d bytes sent", len(b), len(content))
+			}
+		})
+	}
+}
@@ -1,14 +1,15 @@
 package crypto
 
 import (
+	"bytes"
 	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io"
 	"ipmail/libipmail/util"
-	"os"
 )
 
 type ContactsIdentityList interface {
 	IdentityList
-	SaveToFile(file string) error
+	SaveToFile(file string, sealer util.Sealer) error
 }
 
 type contactsIdentityList struct {
@@ -21,14 +22,13 @@ func NewContactsIdentityList(entities gpg.EntityList) ContactsIdentityList {
 	return &result
 }
 
-func NewContactsIdentityListFromFile(file string) (ContactsIdentityList, error) {
+func NewContactsIdentityListFromFile(file string, sealer util.Sealer) (ContactsIdentityList, error) {
 	result := contactsIdentityList{}
-	f, err := os.Open(file)
+	b, err := util.ReadSealedFile(file, sealer)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	entities, err := util.LoadEntities(f)
+	entities, err := util.LoadEntities(bytes.NewBuffer(b))
 	if err != nil {
 		return nil, err
 	}
@@ -36,10 +36,8 @@ func NewContactsIdentityListFromFile(file string) (ContactsIdentityList, error)
 	return &result, nil
 }
 
-func (c *contactsIdentityList) SaveToFile(file string) error {
-	f, err := os.Create(file)
-	if err != nil {
-		return err
-	}
-	return util.SaveEntities(f, c.ToArray()...)
+func (c *contactsIdentityList) SaveToFile(file string, sealer util.Sealer) error {
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		return util.SaveEntities(w, c.ToArray()...)
+	})
 }
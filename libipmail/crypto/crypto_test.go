@@ -5,8 +5,10 @@ import (
 	"container/list"
 	gpg "github.com/Geo25rey/crypto/openpgp"
 	"github.com/Geo25rey/crypto/openpgp/packet"
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"io"
+	"io/ioutil"
 	"ipmail/libipmail/util"
 	"reflect"
 	"testing"
@@ -89,7 +91,7 @@ func TestNewContactsIdentityListFromFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := NewContactsIdentityListFromFile(tt.args.file)
+			got, err := NewContactsIdentityListFromFile(tt.args.file, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewContactsIdentityListFromFile() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -186,7 +188,7 @@ func TestNewIdentityList1(t *testing.T) {
 func TestNewMessage(t *testing.T) {
 	type args struct {
 		encryptedData []byte
-		id            uint64
+		cid           cid.Cid
 		origin        peer.ID
 		ipfs          util.Cat
 		identity      SelfIdentity
@@ -202,7 +204,7 @@ func TestNewMessage(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewMessage(tt.args.encryptedData, tt.args.id, tt.args.origin, tt.args.ipfs, tt.args.identity, tt.args.contacts, tt.args.prompt); !reflect.DeepEqual(got, tt.want) {
+			if got := NewMessage(tt.args.encryptedData, tt.args.cid, tt.args.origin, tt.args.ipfs, tt.args.identity, tt.args.contacts, tt.args.prompt); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewMessage() = %v, want %v", got, tt.want)
 			}
 		})
@@ -250,7 +252,7 @@ func TestNewSelfIdentityFromFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewSelfIdentityFromFile(tt.args.path); !reflect.DeepEqual(got, tt.want) {
+			if got := NewSelfIdentityFromFile(tt.args.path, nil); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewSelfIdentityFromFile() = %v, want %v", got, tt.want)
 			}
 		})
@@ -306,7 +308,7 @@ func Test_contactsIdentityList_SaveToFile(t *testing.T) {
 			c := &contactsIdentityList{
 				IdentityList: tt.fields.IdentityList,
 			}
-			if err := c.SaveToFile(tt.args.file); (err != nil) != tt.wantErr {
+			if err := c.SaveToFile(tt.args.file, nil); (err != nil) != tt.wantErr {
 				t.Errorf("SaveToFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -340,6 +342,27 @@ func Test_identityList_Add(t *testing.T) {
 	}
 }
 
+func Test_identityList_Remove(t *testing.T) {
+	tests := []struct {
+		name     string
+		list     IdentityList
+		entities []*gpg.Entity
+		want     []*gpg.Entity
+	}{
+		{"Contained", NewIdentityList(entity1, entity2), []*gpg.Entity{entity1}, []*gpg.Entity{entity2}},
+		{"Not Contained", NewIdentityList(entity2), []*gpg.Entity{entity1}, []*gpg.Entity{entity2}},
+		{"All", NewIdentityList(entity1, entity2), []*gpg.Entity{entity2, entity1}, []*gpg.Entity{}},
+		{"Nil", NewIdentityList(entity1), []*gpg.Entity{nil}, []*gpg.Entity{entity1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.list.Remove(tt.entities...); !reflect.DeepEqual(tt.list.ToArray(), tt.want) {
+				t.Errorf("Remove() = %v, want %v", tt.list.ToArray(), tt.want)
+			}
+		})
+	}
+}
+
 func Test_identityList_AddFromKeyRing(t *testing.T) {
 	type fields struct {
 		list *list.List
@@ -531,7 +554,6 @@ func Test_identityList_ToArray(t *testing.T) {
 func Test_message_Data(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -548,7 +570,6 @@ func Test_message_Data(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -564,7 +585,6 @@ func Test_message_Data(t *testing.T) {
 func Test_message_From(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -581,7 +601,6 @@ func Test_message_From(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -597,7 +616,6 @@ func Test_message_From(t *testing.T) {
 func Test_message_FromEmail(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -614,7 +632,6 @@ func Test_message_FromEmail(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -630,7 +647,6 @@ func Test_message_FromEmail(t *testing.T) {
 func Test_message_FromName(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -647,7 +663,6 @@ func Test_message_FromName(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -663,7 +678,6 @@ func Test_message_FromName(t *testing.T) {
 func Test_message_Id(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -680,7 +694,6 @@ func Test_message_Id(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -696,7 +709,6 @@ func Test_message_Id(t *testing.T) {
 func Test_message_IsFrom(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -717,7 +729,6 @@ func Test_message_IsFrom(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -733,7 +744,6 @@ func Test_message_IsFrom(t *testing.T) {
 func Test_message_Serialize(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -751,7 +761,6 @@ func Test_message_Serialize(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -773,7 +782,6 @@ func Test_message_Serialize(t *testing.T) {
 func Test_message_String(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -790,7 +798,6 @@ func Test_message_String(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -806,7 +813,6 @@ func Test_message_String(t *testing.T) {
 func Test_message_decrypt(t *testing.T) {
 	type fields struct {
 		encryptedData []byte
-		decryptedData []byte
 		from          *packet.UserId
 		fromEntity    *gpg.Entity
 		id            uint64
@@ -830,7 +836,6 @@ func Test_message_decrypt(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			m := &message{
 				encryptedData: tt.fields.encryptedData,
-				decryptedData: tt.fields.decryptedData,
 				from:          tt.fields.from,
 				fromEntity:    tt.fields.fromEntity,
 				id:            tt.fields.id,
@@ -915,9 +920,152 @@ func Test_selfIdentity_SaveToFile(t *testing.T) {
 				identities:      tt.fields.identities,
 				defaultIdentity: tt.fields.defaultIdentity,
 			}
-			if err := s.SaveToFile(tt.args.path); (err != nil) != tt.wantErr {
+			if err := s.SaveToFile(tt.args.path, nil); (err != nil) != tt.wantErr {
 				t.Errorf("SaveToFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestEncryptToSelf(t *testing.T) {
+	self1 := &selfIdentity{identities: NewIdentityList(entity1), defaultIdentity: entity1}
+	self2 := &selfIdentity{identities: NewIdentityList(entity2), defaultIdentity: entity2}
+	type args struct {
+		data     []byte
+		encoding string
+		identity SelfIdentity
+	}
+	tests := []struct {
+		name      string
+		args      args
+		decryptAs SelfIdentity
+		decodeAs  string
+		wantErr   bool
+	}{
+		{
+			"Round Trip",
+			args{[]byte("some draft"), "test encoding", self1},
+			self1,
+			"test encoding",
+			false,
+		},
+		{
+			"Empty Data",
+			args{[]byte{}, "test encoding", self1},
+			self1,
+			"test encoding",
+			false,
+		},
+		{
+			"Wrong Encoding",
+			args{[]byte("some draft"), "test encoding", self1},
+			self1,
+			"other encoding",
+			true,
+		},
+		{
+			"Wrong Identity",
+			args{[]byte("some draft"), "test encoding", self1},
+			self2,
+			"test encoding",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(make([]byte, 0))
+			w, err := EncryptToSelf(buf, tt.args.encoding, tt.args.identity)
+			if err != nil {
+				t.Fatalf("EncryptToSelf() error = %v", err)
+			}
+			_, _ = w.Write(tt.args.data)
+			if err = w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if bytes.Contains(buf.Bytes(), tt.args.data) && len(tt.args.data) > 0 {
+				t.Errorf("EncryptToSelf() wrote plaintext")
+			}
+			r, err := DecryptFromSelf(buf, tt.decodeAs, tt.decryptAs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DecryptFromSelf() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("ReadAll() error = %v", err)
+				return
+			}
+			if !bytes.Equal(got, tt.args.data) {
+				t.Errorf("DecryptFromSelf() got = %s, want %s", got, tt.args.data)
+			}
+		})
+	}
+}
+
+func TestReadMessage_versions(t *testing.T) {
+	self := &selfIdentity{identities: NewIdentityList(entity1), defaultIdentity: entity1}
+	contacts := NewContactsIdentityList(gpg.EntityList{})
+	buf := bytes.NewBuffer(make([]byte, 0))
+	w, err := EncryptToSelf(buf, MessageEncoding, self)
+	if err != nil {
+		t.Fatalf("EncryptToSelf() error = %v", err)
+	}
+	_, _ = w.Write([]byte("hello"))
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	encrypted := buf.Bytes()
+	contentCid, err := util.ContentCid(encrypted)
+	if err != nil {
+		t.Fatalf("ContentCid() error = %v", err)
+	}
+	origin, _ := peer.Decode("QmQQtheqZouh43hfV4E9woribXBGi6yLdefrrpvsCk7RxB")
+	marshal, _ := origin.Marshal()
+
+	legacy := bytes.NewBuffer(make([]byte, 0))
+	_, _ = legacy.Write(util.Int64ToBytes(int64(len(encrypted))))
+	_, _ = legacy.Write(encrypted)
+	_, _ = legacy.Write(util.Int64ToBytes(int64(len(marshal))))
+	_, _ = legacy.Write(marshal)
+	_, _ = legacy.Write(util.Uint64ToBytes(42))
+
+	current := bytes.NewBuffer(make([]byte, 0))
+	msg := NewMessage(encrypted, contentCid, origin, nil, self, contacts, nil)
+	msg.SetId(7)
+	if err = msg.Serialize(current); err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		r            io.Reader
+		wantId       uint64
+		wantLegacyId uint64
+	}{
+		{"Legacy", legacy, 0, 42},
+		{"Current", current, 7, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadMessage(tt.r, nil, self, contacts)
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if !got.Cid().Equals(contentCid) {
+				t.Errorf("Cid() = %v, want %v", got.Cid(), contentCid)
+			}
+			if got.Id() != tt.wantId {
+				t.Errorf("Id() = %v, want %v", got.Id(), tt.wantId)
+			}
+			if legacyId, _ := got.(*message).LegacyId(); legacyId != tt.wantLegacyId {
+				t.Errorf("LegacyId() = %v, want %v", legacyId, tt.wantLegacyId)
+			}
+			if decrypted := got.Data(); string(decrypted) != "hello" {
+				t.Errorf("Data() = %q, want %q", decrypted, "hello")
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/armor"
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+)
+
+// DeviceLinkEncoding is the armor type of a DeviceLink
+const DeviceLinkEncoding = "Dv3kLq9Zr1mWx6TpNa0sE"
+
+const deviceLinkVersion = 1
+
+// deviceLinkPrefix starts every sealed DeviceLink
+const deviceLinkPrefix = "-----BEGIN " + DeviceLinkEncoding
+
+// maxDeviceLinkSize bounds how much is read to open a DeviceLink
+const maxDeviceLinkSize = 1 << 20
+
+// deviceKeyComment is in the user ID of every key NewDeviceKey makes
+const deviceKeyComment = "ipmail device"
+
+// DeviceLink authorizes a new device to use an account. It carries the private keys of the identity, so it is
+// only ever sealed to the key of the new device
+type DeviceLink struct {
+	Identity SelfIdentity
+	// SyncKey encrypts the log the devices of the account sync through
+	SyncKey SyncKey
+	// Head is the newest entry of that log when the device was linked, cid.Undef if there was none
+	Head cid.Cid
+}
+
+// NewDeviceKey makes the key a device is linked to an account with. It is only used to open the DeviceLink
+func NewDeviceKey(name string) (*gpg.Entity, error) {
+	return gpg.NewEntity(name, deviceKeyComment, "", util.DefaultEncryptionConfig())
+}
+
+// IsDeviceKey is whether entity was made by NewDeviceKey rather than being the identity of someone
+func IsDeviceKey(entity *gpg.Entity) bool {
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && identity.UserId.Comment == deviceKeyComment {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *DeviceLink) serializeContents(w io.Writer) error {
+	err := util.WriteInt64(w, deviceLinkVersion)
+	if err != nil {
+		return err
+	}
+	err = util.WriteBytes(w, l.SyncKey)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 0)
+	if l.Head.Defined() {
+		head = l.Head.Bytes()
+	}
+	err = util.WriteBytes(w, head)
+	if err != nil {
+		return err
+	}
+	identities := gpg.EntityList{l.Identity.DefaultIdentity()} // the default identity is read back first
+	for _, entity := range l.Identity.EntityList() {
+		if entity != l.Identity.DefaultIdentity() {
+			identities = append(identities, entity)
+		}
+	}
+	return util.SaveEntitiesPrivate(w, identities...)
+}
+
+// Seal writes the link encrypted to device and signed by the default identity
+func (l *DeviceLink) Seal(w io.Writer, device *gpg.Entity) error {
+	contents := bytes.NewBuffer(make([]byte, 0))
+	err := l.serializeContents(contents)
+	if err != nil {
+		return err
+	}
+	signature := bytes.NewBuffer(make([]byte, 0))
+	err = gpg.DetachSign(signature, l.Identity.DefaultIdentity(), bytes.NewBuffer(contents.Bytes()),
+		util.DefaultEncryptionConfig())
+	if err != nil {
+		return err
+	}
+	encode, err := armor.Encode(w, DeviceLinkEncoding, make(map[string]string))
+	if err != nil {
+		return err
+	}
+	encrypt, err := gpg.Encrypt(encode, gpg.EntityList{device}, nil, nil, util.DefaultEncryptionConfig())
+	if err != nil {
+		return err
+	}
+	err = util.WriteBytes(encrypt, contents.Bytes())
+	if err != nil {
+		return err
+	}
+	err = util.WriteBytes(encrypt, signature.Bytes())
+	if err != nil {
+		return err
+	}
+	err = encrypt.Close()
+	if err != nil {
+		return err
+	}
+	return encode.Close()
+}
+
+// OpenDeviceLink decrypts a link sealed to device, failing if it isn't signed by the identity in it. Make
+// sure that identity is your account before using it, as anyone who knows the device key can seal a link to it
+func OpenDeviceLink(r io.Reader, device *gpg.Entity) (*DeviceLink, error) {
+	buffered := bufio.NewReader(r)
+	prefix, err := buffered.Peek(len(deviceLinkPrefix))
+	if err != nil || !bytes.Equal(prefix, []byte(deviceLinkPrefix)) {
+		return nil, errors.New("data is not a device link")
+	}
+	decode, err := armor.Decode(io.LimitReader(buffered, maxDeviceLinkSize))
+	if err != nil {
+		return nil, err
+	}
+	if decode.Type != DeviceLinkEncoding {
+		return nil, errors.New("data not encoded as a device link")
+	}
+	md, err := gpg.ReadMessage(decode.Body, gpg.EntityList{device}, nil, util.DefaultEncryptionConfig())
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(b)
+	contents, err := readUntrustedBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := readUntrustedBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = bytes.NewBuffer(contents)
+	version, err := util.ReadInt64(buf)
+	if err != nil {
+		return nil, err
+	}
+	if version != deviceLinkVersion {
+		return nil, errors.New("unsupported device link version")
+	}
+	result := &DeviceLink{}
+	key, err := readUntrustedBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	result.SyncKey = key
+	head, err := readUntrustedBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(head) > 0 {
+		result.Head, err = cid.Cast(head)
+		if err != nil {
+			return nil, err
+		}
+	}
+	entities, err := util.LoadEntities(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, errors.New("device link has no private identity")
+	}
+	_, err = gpg.CheckDetachedSignature(gpg.EntityList{entities[0]}, bytes.NewBuffer(contents),
+		bytes.NewBuffer(signature))
+	if err != nil {
+		return nil, err
+	}
+	result.Identity = &selfIdentity{defaultIdentity: entities[0], identities: NewIdentityList(entities...)}
+	return result, nil
+}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"testing"
+)
+
+func TestDeviceLink(t *testing.T) {
+	identity := newTestIdentity(t)
+	device, err := NewDeviceKey("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewDeviceKey("desktop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewSyncKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ := util.ContentCid([]byte("head"))
+	link := &DeviceLink{Identity: identity, SyncKey: key, Head: head}
+	sealed := bytes.NewBuffer(make([]byte, 0))
+	if err = link.Seal(sealed, device); err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, sealed.Bytes()...)
+	tampered[len(tampered)/2] ^= 1
+
+	tests := []struct {
+		name    string
+		sealed  []byte
+		wantErr bool
+	}{
+		{"Linked Device", sealed.Bytes(), false},
+		{"Tampered", tampered, true},
+		{"Not A Link", []byte("hello"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OpenDeviceLink(bytes.NewBuffer(tt.sealed), device)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OpenDeviceLink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			self := got.Identity.DefaultIdentity()
+			if self.PrimaryKey.Fingerprint != identity.DefaultIdentity().PrimaryKey.Fingerprint || self.PrivateKey == nil {
+				t.Error("OpenDeviceLink() didn't return the private identity")
+			}
+			if !bytes.Equal(got.SyncKey, key) || !got.Head.Equals(head) {
+				t.Errorf("OpenDeviceLink() = key %x head %s, want key %x head %s", got.SyncKey, got.Head, key, head)
+			}
+		})
+	}
+	t.Run("Other Device", func(t *testing.T) {
+		if _, err := OpenDeviceLink(bytes.NewBuffer(sealed.Bytes()), other); err == nil {
+			t.Error("a link was opened by a device it wasn't sealed to")
+		}
+	})
+}
+
+func TestSyncKey(t *testing.T) {
+	key, err := NewSyncKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSyncKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := key.Seal([]byte("entry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		key     SyncKey
+		want    string
+		wantErr bool
+	}{
+		{"Same Key", key, "entry", false},
+		{"Other Key", other, "", true},
+		{"Short Key", key[:16], "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.key.Open(sealed)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Open() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if key.Topic() == other.Topic() {
+		t.Error("different keys announce on the same topic")
+	}
+}
+
+func TestSyncKey_stream(t *testing.T) {
+	key, err := NewSyncKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSyncKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := bytes.Repeat([]byte("synced message "), 10000)
+	sealed := bytes.NewBuffer(make([]byte, 0))
+	w, err := key.SealStream(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Bytes(), []byte("synced message")) {
+		t.Fatal("SealStream() left the message readable")
+	}
+	tampered := append([]byte{}, sealed.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		key     SyncKey
+		sealed  []byte
+		wantErr bool
+	}{
+		{"Same Key", key, sealed.Bytes(), false},
+		{"Other Key", other, sealed.Bytes(), true},
+		{"Tampered", key, tampered, true},
+		{"Cut Off", key, sealed.Bytes()[:sealed.Len()/2], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := tt.key.OpenStream(bytes.NewBuffer(tt.sealed))
+			var got []byte
+			if err == nil {
+				got, err = ioutil.ReadAll(r)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OpenStream() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, message) {
+				t.Errorf("OpenStream() read %d bytes, want the %d sealed", len(got), len(message))
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/armor"
+	"github.com/Geo25rey/crypto/openpgp/packet"
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+)
+
+// HandshakeEncoding is the armor type of the body of a Handshake message
+const HandshakeEncoding = "Hs4vT0ekq8NbW2mzLr7cy"
+
+const handshakeVersion = 1
+
+// handshakePrefix starts the body of every Handshake message
+const handshakePrefix = "-----BEGIN " + HandshakeEncoding
+
+// maxHandshakeSize bounds how much of a message is read to find its handshake
+const maxHandshakeSize = 1 << 20
+
+type HandshakeKind int64
+
+const (
+	// HandshakeRequest asks to become a contact of the recipient
+	HandshakeRequest HandshakeKind = iota
+	// HandshakeAccept answers a request, after which both sides are contacts
+	HandshakeAccept
+	// HandshakeDecline answers a request which wasn't accepted
+	HandshakeDecline
+)
+
+func (k HandshakeKind) String() string {
+	switch k {
+	case HandshakeRequest:
+		return "request"
+	case HandshakeAccept:
+		return "accept"
+	case HandshakeDecline:
+		return "decline"
+	}
+	return "unknown"
+}
+
+// Handshake is the body of a message which makes two people contacts. It carries the public key of its
+// sender, which is only trusted once it verifies the signature of the message
+type Handshake struct {
+	Kind HandshakeKind
+	// Note introduces the sender of a request, or says why a request was declined
+	Note string
+	Key  *gpg.Entity
+	// Bundle is the prekey bundle of Key, nil if the sender doesn't support sessions
+	Bundle *PrekeyBundle
+	// Profile is the content ID of the profile of Key, cid.Undef if the sender has none
+	Profile cid.Cid
+}
+
+// String is what to show of a handshake in place of the armored body of its message: its kind and note
+func (h *Handshake) String() string {
+	result := "Contact request"
+	switch h.Kind {
+	case HandshakeAccept:
+		result = "Contact request accepted"
+	case HandshakeDecline:
+		result = "Contact request declined"
+	}
+	if len(h.Note) > 0 {
+		result += "\n" + h.Note
+	}
+	return result
+}
+
+// Serialize writes the handshake as the body of a message, with only the public half of Key
+func (h *Handshake) Serialize(w io.Writer) error {
+	encode, err := armor.Encode(w, HandshakeEncoding, make(map[string]string))
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(encode, handshakeVersion)
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(encode, int64(h.Kind))
+	if err != nil {
+		return err
+	}
+	err = util.WriteString(encode, h.Note)
+	if err != nil {
+		return err
+	}
+	err = h.Key.Serialize(encode)
+	if err != nil {
+		return err
+	}
+	if h.Bundle != nil {
+		err = h.Bundle.Serialize(encode)
+		if err != nil {
+			return err
+		}
+	}
+	if h.Profile.Defined() {
+		err = SerializeProfileLink(encode, h.Profile)
+		if err != nil {
+			return err
+		}
+	}
+	return encode.Close()
+}
+
+// ReadHandshake reads the body of a message, returning nil without an error if it isn't a handshake
+func ReadHandshake(body io.Reader) (*Handshake, error) {
+	r := bufio.NewReader(body)
+	prefix, err := r.Peek(len(handshakePrefix))
+	if err != nil || !bytes.Equal(prefix, []byte(handshakePrefix)) {
+		return nil, nil
+	}
+	decode, err := armor.Decode(io.LimitReader(r, maxHandshakeSize))
+	if err != nil {
+		return nil, err
+	}
+	if decode.Type != HandshakeEncoding {
+		return nil, errors.New("data not encoded as a handshake")
+	}
+	b, err := ioutil.ReadAll(decode.Body)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(b)
+	version, err := util.ReadInt64(buf)
+	if err != nil {
+		return nil, err
+	}
+	if version != handshakeVersion {
+		return nil, errors.New("unsupported handshake version")
+	}
+	result := &Handshake{}
+	kind, err := util.ReadInt64(buf)
+	if err != nil {
+		return nil, err
+	}
+	result.Kind = HandshakeKind(kind)
+	if result.Kind < HandshakeRequest || result.Kind > HandshakeDecline {
+		return nil, errors.New("unknown handshake kind")
+	}
+	note, err := readUntrustedBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	result.Note = string(note)
+	keys := buf.Bytes()
+	result.Key, err = gpg.ReadEntity(packet.NewReader(bytes.NewBuffer(keys)))
+	if err != nil {
+		return nil, err
+	}
+	result.Bundle, err = ReadPrekeyBundle(bytes.NewBuffer(keys))
+	if err != nil {
+		result.Bundle = nil // sent without a bundle, or one this version doesn't understand
+	}
+	result.Profile, err = ReadProfileLink(bytes.NewBuffer(keys))
+	if err != nil {
+		result.Profile = cid.Undef
+	}
+	return result, nil
+}
@@ -0,0 +1,158 @@
+package crypto
+
+import (
+	"bytes"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/armor"
+	"github.com/ipfs/go-cid"
+	"ipmail/libipmail/util"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T) SelfIdentity {
+	identity, err := NewSelfIdentity("test", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func handshakeBody(t *testing.T, handshake *Handshake) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := handshake.Serialize(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encryptTest encrypts body from from to to the way messages are sent
+func encryptTest(t *testing.T, body []byte, from *gpg.Entity, to *gpg.Entity) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	armored, err := armor.Encode(buf, MessageEncoding, make(map[string]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := gpg.Encrypt(armored, gpg.EntityList{to}, from, nil, util.DefaultEncryptionConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write(body)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = armored.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadHandshake(t *testing.T) {
+	alice := newTestIdentity(t).DefaultIdentity()
+	bundle, err := NewSessionStore().Bundle(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := util.ContentCid([]byte("alice's profile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		body       []byte
+		want       *Handshake
+		wantBundle bool
+	}{
+		{"Request", handshakeBody(t, &Handshake{Kind: HandshakeRequest, Note: "hi, it's alice", Key: alice, Bundle: bundle}),
+			&Handshake{Kind: HandshakeRequest, Note: "hi, it's alice", Key: alice}, true},
+		{"Accept With Profile", handshakeBody(t, &Handshake{Kind: HandshakeAccept, Key: alice, Bundle: bundle, Profile: profile}),
+			&Handshake{Kind: HandshakeAccept, Key: alice, Profile: profile}, true},
+		{"Decline Without Bundle", handshakeBody(t, &Handshake{Kind: HandshakeDecline, Key: alice}),
+			&Handshake{Kind: HandshakeDecline, Key: alice}, false},
+		{"Message", []byte("hi alice"), nil, false},
+		{"Entity Locator", []byte("file:/etc/passwd"), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadHandshake(bytes.NewBuffer(tt.body))
+			if err != nil {
+				t.Fatalf("ReadHandshake() error = %v", err)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("ReadHandshake() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Kind != tt.want.Kind || got.Note != tt.want.Note ||
+				got.Key.PrimaryKey.KeyId != tt.want.Key.PrimaryKey.KeyId || got.Key.PrivateKey != nil {
+				t.Fatalf("ReadHandshake() = %v, want %v", got, tt.want)
+			}
+			if got.Profile != tt.want.Profile {
+				t.Errorf("ReadHandshake() profile = %s, want %s", got.Profile, tt.want.Profile)
+			}
+			if (got.Bundle != nil) != tt.wantBundle {
+				t.Errorf("ReadHandshake() bundle = %v, want one %v", got.Bundle, tt.wantBundle)
+			}
+		})
+	}
+}
+
+func TestNewMessage_handshake(t *testing.T) {
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t).DefaultIdentity()
+	carol := newTestIdentity(t).DefaultIdentity()
+	contacts := NewContactsIdentityList(gpg.EntityList{})
+	tests := []struct {
+		name     string
+		body     []byte
+		from     *gpg.Entity
+		wantFrom *gpg.Entity
+	}{
+		{"Request", handshakeBody(t, &Handshake{Kind: HandshakeRequest, Key: bob}), bob, bob},
+		{"Unknown Sender", []byte("hi alice"), bob, nil},
+		{"Entity Locator", []byte("file:/etc/passwd"), bob, nil},
+		{"Forged Key", handshakeBody(t, &Handshake{Kind: HandshakeRequest, Key: carol}), bob, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted := encryptTest(t, tt.body, tt.from, alice.DefaultIdentity())
+			got := NewMessage(encrypted, cid.Undef, "", nil, alice, contacts, nil)
+			if tt.wantFrom == nil {
+				if got != nil {
+					t.Errorf("NewMessage() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.From() == nil || got.From().PrimaryKey.KeyId != tt.wantFrom.PrimaryKey.KeyId {
+				t.Fatalf("NewMessage() = %v, want a message from the handshake key", got)
+			}
+			body, err := got.Body()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			if handshake, err := ReadHandshake(body); err != nil || handshake == nil {
+				t.Errorf("ReadHandshake() of the body = %v, %v", handshake, err)
+			}
+		})
+	}
+}
+
+func TestHandshake_String(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake Handshake
+		want      string
+	}{
+		{"Request", Handshake{Kind: HandshakeRequest, Note: "hi, it's alice"}, "Contact request\nhi, it's alice"},
+		{"Accept", Handshake{Kind: HandshakeAccept}, "Contact request accepted"},
+		{"Decline", Handshake{Kind: HandshakeDecline, Note: "who are you?"}, "Contact request declined\nwho are you?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.handshake.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
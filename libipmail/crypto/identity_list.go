@@ -14,6 +14,8 @@ type IdentityList interface {
 	GetByPublicKey(key packet.PublicKey) (IdentityList, error)
 	GetAny() *gpg.Entity
 	Add(entities ...*gpg.Entity)
+	// Remove takes out the identities with the same primary key as any of entities
+	Remove(entities ...*gpg.Entity)
 	AddFromKeyRing(ring gpg.KeyRing)
 	ToArray() []*gpg.Entity
 	ForEach(do func(entity *gpg.Entity))
@@ -50,6 +52,21 @@ func (i *identityList) Add(entities ...*gpg.Entity) {
 	}
 }
 
+func (i *identityList) Remove(entities ...*gpg.Entity) {
+	for _, entity := range entities {
+		if entity == nil {
+			continue
+		}
+		for elm := i.list.Front(); elm != nil; {
+			next := elm.Next()
+			if elm.Value.(*gpg.Entity).PrimaryKey.Fingerprint == entity.PrimaryKey.Fingerprint {
+				i.list.Remove(elm)
+			}
+			elm = next
+		}
+	}
+}
+
 func (i *identityList) AddFromKeyRing(ring gpg.KeyRing) {
 	keys := ring.DecryptionKeys()
 	for _, key := range keys {
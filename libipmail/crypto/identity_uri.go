@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"ipmail/libipmail/util"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// IdentityUriScheme starts the links and QR codes identities are shared with
+const IdentityUriScheme = "ipmail"
+
+// IdentityUri is an identity shared as ipmail:<content ID>?fingerprint=<hex>&name=<display name>. The
+// fingerprint lets whoever adds the identity check that IPFS gave them the key that was shared
+type IdentityUri struct {
+	Cid         cid.Cid
+	Fingerprint []byte
+	// Name is only shown before the identity is fetched, it isn't verified
+	Name string
+}
+
+// NewIdentityUri shares entity, which was added to IPFS as c
+func NewIdentityUri(c cid.Cid, entity *gpg.Entity) IdentityUri {
+	name := ""
+	mapRange := reflect.ValueOf(entity.Identities).MapRange()
+	if mapRange.Next() {
+		name = mapRange.Value().Interface().(*gpg.Identity).UserId.Name
+	}
+	return IdentityUri{Cid: c, Fingerprint: entity.PrimaryKey.Fingerprint[:], Name: name}
+}
+
+// ParseIdentityUri reads an ipmail: URI, which must have a fingerprint
+func ParseIdentityUri(str string) (IdentityUri, error) {
+	parsed, err := url.Parse(strings.TrimSpace(str))
+	if err != nil {
+		return IdentityUri{}, err
+	}
+	if parsed.Scheme != IdentityUriScheme {
+		return IdentityUri{}, fmt.Errorf("%q is not an %s: link", str, IdentityUriScheme)
+	}
+	result := IdentityUri{}
+	result.Cid, err = cid.Decode(parsed.Opaque)
+	if err != nil {
+		return IdentityUri{}, err
+	}
+	query := parsed.Query()
+	result.Fingerprint, err = hex.DecodeString(query.Get("fingerprint"))
+	if err != nil {
+		return IdentityUri{}, err
+	}
+	if len(result.Fingerprint) != 20 {
+		return IdentityUri{}, errors.New("link has no fingerprint to verify the identity with")
+	}
+	result.Name = query.Get("name")
+	return result, nil
+}
+
+func (u IdentityUri) String() string {
+	query := url.Values{}
+	query.Set("fingerprint", hex.EncodeToString(u.Fingerprint))
+	if len(u.Name) > 0 {
+		query.Set("name", u.Name)
+	}
+	return (&url.URL{Scheme: IdentityUriScheme, Opaque: u.Cid.String(), RawQuery: query.Encode()}).String()
+}
+
+// Verify checks that entity is the identity that was shared
+func (u IdentityUri) Verify(entity *gpg.Entity) error {
+	if !bytes.Equal(entity.PrimaryKey.Fingerprint[:], u.Fingerprint) {
+		return fmt.Errorf("the identity at %s has fingerprint %X, not the %X that was shared",
+			u.Cid, entity.PrimaryKey.Fingerprint, u.Fingerprint)
+	}
+	return nil
+}
+
+// Fetch is ParseContact for the shared identity, failing if its fingerprint doesn't match
+func (u IdentityUri) Fetch(ctx context.Context, ipfs util.Cat) (*gpg.Entity, *PrekeyBundle, error) {
+	contact, err := u.FetchContact(ctx, ipfs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contact.Entity, contact.Bundle, nil
+}
+
+// FetchContact is Fetch also returning the link to the profile of the shared identity
+func (u IdentityUri) FetchContact(ctx context.Context, ipfs util.Cat) (*Contact, error) {
+	contact, err := ReadContact(ctx, "ipfs:"+string(u.Cid.Bytes()), ipfs)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Verify(contact.Entity)
+	if err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
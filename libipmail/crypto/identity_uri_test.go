@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"ipmail/libipmail/util"
+	"strings"
+	"testing"
+)
+
+// publishedCat holds the identities which were added to IPFS
+type publishedCat map[string][]byte
+
+func (p publishedCat) Cat(resolved path.Resolved) ([]byte, error) {
+	if b, ok := p[resolved.Cid().String()]; ok {
+		return b, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestIdentityUri(t *testing.T) {
+	alice := newTestIdentity(t).DefaultIdentity()
+	bob := newTestIdentity(t).DefaultIdentity()
+	published := bytes.NewBuffer(make([]byte, 0))
+	if err := alice.Serialize(published); err != nil {
+		t.Fatal(err)
+	}
+	c, err := util.ContentCid(published.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipfs := publishedCat{c.String(): published.Bytes()}
+	shared := NewIdentityUri(c, alice).String()
+	if !strings.HasPrefix(shared, "ipmail:"+c.String()+"?") || !strings.Contains(shared, "name=test") {
+		t.Fatalf("String() = %q, want the content ID and name", shared)
+	}
+	forged := NewIdentityUri(c, bob).String()
+
+	tests := []struct {
+		name         string
+		uri          string
+		wantParseErr bool
+		wantFetchErr bool
+	}{
+		{"Shared", shared, false, false},
+		{"Pasted With Spaces", " " + shared + "\n", false, false},
+		{"Other Fingerprint", forged, false, true},
+		{"No Fingerprint", "ipmail:" + c.String() + "?name=alice", true, false},
+		{"Bare Content ID", c.String(), true, false},
+		{"Other Scheme", strings.Replace(shared, "ipmail:", "ipfs:", 1), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uri, err := ParseIdentityUri(tt.uri)
+			if (err != nil) != tt.wantParseErr {
+				t.Fatalf("ParseIdentityUri() error = %v, wantErr %v", err, tt.wantParseErr)
+			}
+			if tt.wantParseErr {
+				return
+			}
+			if uri.String() != strings.TrimSpace(tt.uri) {
+				t.Errorf("String() = %q, want %q", uri.String(), strings.TrimSpace(tt.uri))
+			}
+			entity, _, err := ParseContact(context.Background(), tt.uri, ipfs)
+			if (err != nil) != tt.wantFetchErr {
+				t.Fatalf("ParseContact() error = %v, wantErr %v", err, tt.wantFetchErr)
+			}
+			if !tt.wantFetchErr && entity.PrimaryKey.KeyId != alice.PrimaryKey.KeyId {
+				t.Error("ParseContact() returned another identity")
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package crypto
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	gpg "github.com/Geo25rey/crypto/openpgp"
 	"github.com/Geo25rey/crypto/openpgp/armor"
 	"github.com/Geo25rey/crypto/openpgp/packet"
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"io"
 	"io/ioutil"
@@ -19,11 +21,23 @@ type Message interface {
 	From() *gpg.Entity
 	FromName() string
 	FromEmail() string
+	// Data decrypts the whole message. Use Body for messages which may be too big to hold in memory
 	Data() []byte
+	// Body decrypts the message while it is read
+	Body() (io.ReadCloser, error)
+	// Encrypted reads the OpenPGP message the message is decrypted from. For a message sealed in a session
+	// that is the message inside, which any device with your identity can decrypt
+	Encrypted() (io.ReadCloser, error)
 	String() string
+	// Cid identifies the message by the content ID of its encrypted data, which is the same for every recipient
+	Cid() cid.Cid
+	// Id is a short local number for showing to the user, assigned when the message is first added to a MessageList
 	Id() uint64
+	SetId(id uint64)
 	Serialize(writer io.Writer) error
 	IsFrom(entity *gpg.Entity) bool
+	// Handshake is the contact request, accept or decline the message is, nil for other messages
+	Handshake() *Handshake
 }
 
 const (
@@ -33,24 +47,58 @@ const (
 
 	MessageCidPrefix  = "2jf9viv549cjksdfjo932"
 	MessageCidPostfix = "0anrnLKj34kvlPWnx1as"
+
+	// MessageAckPrefix announces that a recipient fetched the message with the CID after it. The CID is
+	// followed by MessageCidPostfix and the recipient's signature of the ack, see SignAck
+	MessageAckPrefix = "k3mv8Qpz72hdnaLw0ceR5"
 )
 
+// signedAck is what the signature of an ack of the message c covers
+func signedAck(c cid.Cid) []byte {
+	return append([]byte(MessageAckPrefix), c.Bytes()...)
+}
+
+// SignAck signs an ack of the message c, so its sender knows which of its recipients fetched it
+func SignAck(c cid.Cid, signer *gpg.Entity) ([]byte, error) {
+	signature := bytes.NewBuffer(make([]byte, 0))
+	err := gpg.DetachSign(signature, signer, bytes.NewBuffer(signedAck(c)), util.DefaultEncryptionConfig())
+	if err != nil {
+		return nil, err
+	}
+	return signature.Bytes(), nil
+}
+
+// CheckAck returns who in keyring signed an ack of the message c, or an error if nobody in it did
+func CheckAck(c cid.Cid, signature []byte, keyring gpg.EntityList) (*gpg.Entity, error) {
+	return gpg.CheckDetachedSignature(keyring, bytes.NewBuffer(signedAck(c)), bytes.NewBuffer(signature))
+}
+
 type message struct {
+	// encryptedData is nil when the body is kept in store instead of in memory
 	encryptedData []byte
-	decryptedData []byte
+	store         BodyStore
+	identity      SelfIdentity
+	contacts      ContactsIdentityList
+	prompt        gpg.PromptFunction
 	from          *packet.UserId
 	fromEntity    *gpg.Entity
-	id            uint64
-	origin        peer.ID
+	// savedFrom is the key a saved message was verified with, which its sender may no longer be a contact by
+	savedFrom *gpg.Entity
+	handshake *Handshake
+	cid       cid.Cid
+	id        uint64
+	legacyId  uint64
+	origin    peer.ID
 }
 
-func NewMessage(encryptedData []byte, id uint64, origin peer.ID,
+// NewMessage decrypts encryptedData to find its sender. Only the encrypted data is kept in memory,
+// the message is decrypted again whenever it is read
+func NewMessage(encryptedData []byte, cid cid.Cid, origin peer.ID,
 	ipfs util.Cat, identity SelfIdentity, contacts ContactsIdentityList, prompt gpg.PromptFunction) Message {
 	result := message{
 		encryptedData: encryptedData,
-		decryptedData: nil,
 		from:          nil,
-		id:            id,
+		cid:           cid,
 		origin:        origin,
 	}
 	err := result.decrypt(ipfs, identity, contacts, prompt)
@@ -61,49 +109,162 @@ func NewMessage(encryptedData []byte, id uint64, origin peer.ID,
 	return &result
 }
 
+// NewMessageFromStore is NewMessage for a message whose encrypted body is already in store.
+// Nothing of the body is kept in memory
+func NewMessageFromStore(store BodyStore, cid cid.Cid, origin peer.ID,
+	ipfs util.Cat, identity SelfIdentity, contacts ContactsIdentityList, prompt gpg.PromptFunction) Message {
+	result := message{
+		store:  store,
+		cid:    cid,
+		origin: origin,
+	}
+	err := result.decrypt(ipfs, identity, contacts, prompt)
+	if err != nil {
+		println(err.Error())
+		return nil
+	}
+	return &result
+}
+
+func (m *message) open() (io.ReadCloser, error) {
+	if m.store != nil {
+		return m.store.Open(m.cid)
+	}
+	return ioutil.NopCloser(bytes.NewReader(m.encryptedData)), nil
+}
+
+func (m *message) Encrypted() (io.ReadCloser, error) {
+	return m.open()
+}
+
+// read starts decrypting encrypted, with the body decrypted as it is read. Signatures are checked with
+// the identity, the contacts and introduced
+func (m *message) read(encrypted io.Reader, prompt gpg.PromptFunction, introduced ...*gpg.Entity) (*gpg.MessageDetails, error) {
+	decode, err := armor.Decode(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Compare(decode.Type, MessageEncoding) != 0 {
+		return nil, errors.New("data not encrypted as a message")
+	}
+	keyring := append(append(gpg.EntityList{}, m.identity.EntityList()...), m.contacts.ToArray()...)
+	keyring = append(keyring, introduced...)
+	return gpg.ReadMessage(decode.Body, keyring, prompt, util.DefaultEncryptionConfig())
+}
+
 func (m *message) decrypt(ipfs util.Cat, identity SelfIdentity, contacts ContactsIdentityList, prompt gpg.PromptFunction) error {
-	if m.decryptedData == nil {
-		buf := bytes.NewBuffer(m.encryptedData)
-		decode, err := armor.Decode(buf)
+	m.identity = identity
+	m.contacts = contacts
+	m.prompt = prompt
+	readMessage, err := m.verify()
+	if err != nil {
+		return err
+	}
+	if readMessage.IsSigned && readMessage.SignedBy == nil && m.savedFrom != nil &&
+		len(gpg.EntityList{m.savedFrom}.KeysById(readMessage.SignedByKeyId)) > 0 {
+		// a saved message from someone who was removed from the contacts since
+		readMessage, err = m.verify(m.savedFrom)
 		if err != nil {
 			return err
 		}
-		if strings.Compare(decode.Type, MessageEncoding) != 0 {
-			return errors.New("data not encrypted as a message")
+	}
+	if readMessage.IsSigned && readMessage.SignedBy == nil {
+		// only a handshake introduces its sender, and only if its key made the signature
+		if m.handshake == nil {
+			return errors.New("message is signed by an unknown key and has no handshake...ignoring it")
+		}
+		if len(gpg.EntityList{m.handshake.Key}.KeysById(readMessage.SignedByKeyId)) == 0 {
+			return errors.New("handshake key doesn't match signed key id...ignoring contact request")
 		}
-		var keyring gpg.KeyRing = append(identity.EntityList(), contacts.ToArray()...)
-		readMessage, err := gpg.ReadMessage(decode.Body, keyring, prompt, util.DefaultEncryptionConfig())
+		readMessage, err = m.verify(m.handshake.Key)
 		if err != nil {
 			return err
 		}
-		body := readMessage.UnverifiedBody
-		m.decryptedData, err = ioutil.ReadAll(body)
+		if readMessage.SignedBy == nil {
+			return errors.New("handshake key doesn't match signed key id...ignoring contact request")
+		}
+	}
+	if readMessage.IsSigned {
+		m.fromEntity = readMessage.SignedBy.Entity
+		mapRange := reflect.ValueOf(m.fromEntity.Identities).MapRange()
+		mapRange.Next()
+		m.from = mapRange.Value().Interface().(*gpg.Identity).UserId
+	}
+	return nil
+}
+
+// onceReader stops at the first error, since reading a signed body again after its end checks the signature again
+type onceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (o *onceReader) Read(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	n, err := o.r.Read(p)
+	o.err = err
+	return n, err
+}
+
+// verify reads the whole message, so a corrupt message fails now instead of when it is shown, keeping
+// the handshake it is. The signature is checked if it was made by a key in the keyring of read
+func (m *message) verify(introduced ...*gpg.Entity) (*gpg.MessageDetails, error) {
+	encrypted, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer encrypted.Close()
+	readMessage, err := m.read(encrypted, m.prompt, introduced...)
+	if err != nil {
+		return nil, err
+	}
+	body := bufio.NewReader(&onceReader{r: readMessage.UnverifiedBody})
+	m.handshake, err = ReadHandshake(body)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return nil, err
+	}
+	if readMessage.SignedBy != nil && readMessage.SignatureError != nil {
+		return nil, readMessage.SignatureError
+	}
+	return readMessage, nil
+}
+
+// RecipientKeyIds returns the ids of the keys a message is encrypted to without decrypting it. Only the start of
+// the message is read
+func RecipientKeyIds(encrypted io.Reader) ([]uint64, error) {
+	decode, err := armor.Decode(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Compare(decode.Type, MessageEncoding) != 0 {
+		return nil, errors.New("data not encrypted as a message")
+	}
+	result := make([]uint64, 0)
+	packets := packet.NewReader(decode.Body)
+	for {
+		p, err := packets.Next()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if readMessage.IsSigned {
-			if readMessage.SignedBy == nil {
-				entity, err := util.ParseEntity(string(m.decryptedData), ipfs)
-				if err != nil {
-					return err
-				}
-				if entity.PrimaryKey.KeyId != readMessage.SignedByKeyId {
-					return errors.New("parsed key id doesn't match signed key id...ignoring contact request")
-				}
-				m.fromEntity = entity
-			} else {
-				m.fromEntity = readMessage.SignedBy.Entity
-			}
-			mapRange := reflect.ValueOf(m.fromEntity.Identities).MapRange()
-			mapRange.Next()
-			m.from = mapRange.Value().Interface().(*gpg.Identity).UserId
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			result = append(result, p.KeyId)
+		case *packet.SymmetricallyEncrypted:
+			return result, nil // the encrypted keys always come first
 		}
-		return nil
 	}
-	return errors.New("already decrypted message")
 }
 
 func (m *message) From() *gpg.Entity {
+	if m.fromEntity == nil {
+		return nil // not signed
+	}
 	buf := bytes.NewBuffer(make([]byte, 0))
 	err := m.fromEntity.Serialize(buf)
 	if err != nil {
@@ -131,8 +292,35 @@ func (m *message) IsFrom(entity *gpg.Entity) bool {
 	return util.EntitiesEqual(m.fromEntity, entity)
 }
 
+type messageBody struct {
+	io.Reader
+	io.Closer
+}
+
+func (m *message) Body() (io.ReadCloser, error) {
+	encrypted, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	readMessage, err := m.read(encrypted, m.prompt)
+	if err != nil {
+		_ = encrypted.Close()
+		return nil, err
+	}
+	return &messageBody{Reader: readMessage.UnverifiedBody, Closer: encrypted}, nil
+}
+
 func (m *message) Data() []byte {
-	return append(make([]byte, len(m.decryptedData)), m.decryptedData...)
+	body, err := m.Body()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+	result, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil
+	}
+	return result
 }
 
 func (m *message) String() string {
@@ -143,89 +331,176 @@ func (m *message) String() string {
 	return string(result)
 }
 
+func (m *message) Handshake() *Handshake {
+	return m.handshake
+}
+
+func (m *message) Cid() cid.Cid {
+	return m.cid
+}
+
 func (m *message) Id() uint64 {
 	return m.id
 }
 
+func (m *message) SetId(id uint64) {
+	m.id = id
+}
+
+// LegacyId returns the pubsub sequence number a message read from an old save was identified by
+func (m *message) LegacyId() (uint64, bool) {
+	return m.legacyId, m.legacyId != 0
+}
+
+// messageVersion is written where a legacy message starts with its data length, which is never negative
+const messageVersion = -4
+
+// storedMessageVersion is written instead of messageVersion for a message whose data is in a BodyStore
+const storedMessageVersion = -5
+
+// Messages saved before the key of their sender was saved with them, which can't be read once the sender is no
+// longer a contact
+const (
+	unkeyedMessageVersion       = -2
+	unkeyedStoredMessageVersion = -3
+)
+
 func (m *message) Serialize(w io.Writer) error {
-	_, err := w.Write(util.Int64ToBytes(int64(len(m.encryptedData))))
-	if err != nil {
-		return err
+	if m.store != nil {
+		err := util.WriteInt64(w, storedMessageVersion)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := util.WriteInt64(w, messageVersion)
+		if err != nil {
+			return err
+		}
+		err = util.WriteBytes(w, m.encryptedData)
+		if err != nil {
+			return err
+		}
 	}
-	_, err = w.Write(m.encryptedData)
+	// written raw, no origin is written as no bytes
+	err := util.WriteBytes(w, []byte(m.origin))
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(util.Int64ToBytes(int64(m.origin.Size())))
+	err = util.WriteUint64(w, m.id)
 	if err != nil {
 		return err
 	}
-	marshal, err := m.origin.Marshal()
+	err = util.WriteBytes(w, m.cid.Bytes())
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(marshal)
-	if err != nil {
-		return err
+	from := bytes.NewBuffer(make([]byte, 0)) // empty if the message isn't signed
+	if m.fromEntity != nil {
+		err = m.fromEntity.Serialize(from)
+		if err != nil {
+			return err
+		}
 	}
-	_, err = w.Write(util.Uint64ToBytes(m.id))
-	return err
+	return util.WriteBytes(w, from.Bytes())
+}
+
+// UnreadableMessageError is returned by ReadMessage for a message which was read whole but couldn't be decrypted or
+// verified, so the messages saved after it can still be read
+type UnreadableMessageError struct {
+	Cid cid.Cid
+	Err error
 }
 
+func (e *UnreadableMessageError) Error() string {
+	return "message " + e.Cid.String() + " can't be read: " + e.Err.Error()
+}
+
+func (e *UnreadableMessageError) Unwrap() error {
+	return e.Err
+}
+
+// ReadMessage reads a message written by Serialize. Messages saved before they were identified by their CID
+// get their CID computed from their data, and their old ID is kept as LegacyId with Id left to be reassigned.
 func ReadMessage(r io.Reader, ipfs util.Cat, identity SelfIdentity, contacts ContactsIdentityList) (Message, error) {
+	return ReadMessageWithStore(r, nil, ipfs, identity, contacts)
+}
+
+// ReadMessageWithStore is ReadMessage for messages whose data may be in store. The data of a message saved
+// with it is moved to store, so it is saved without the data next time.
+func ReadMessageWithStore(r io.Reader, store BodyStore, ipfs util.Cat, identity SelfIdentity,
+	contacts ContactsIdentityList) (Message, error) {
 	if contacts == nil {
 		return nil, errors.New("contacts may not be nil")
 	}
 	result := message{}
-	intBuf := make([]byte, 8)
-	read, err := r.Read(intBuf)
+	version, err := util.ReadInt64(r)
 	if err != nil {
 		return nil, err
 	}
-	if read < len(intBuf) {
-		return nil, errors.New("unexpected EOF")
+	stored := version == storedMessageVersion || version == unkeyedStoredMessageVersion
+	if version == messageVersion || version == unkeyedMessageVersion {
+		result.encryptedData, err = util.ReadBytes(r)
+	} else if version >= 0 {
+		result.encryptedData = make([]byte, version)
+		_, err = io.ReadFull(r, result.encryptedData)
+	} else if stored && store == nil {
+		return nil, errors.New("message data is in a body store")
+	} else if !stored {
+		return nil, errors.New("unknown message version " + strconv.FormatInt(version, 10))
 	}
-	dataSize, _ := util.BytesToInt64(intBuf)
-	dataBuf := make([]byte, dataSize)
-	read, err = r.Read(dataBuf)
 	if err != nil {
 		return nil, err
 	}
-	if read < len(dataBuf) {
-		return nil, errors.New("unexpected EOF")
-	}
-	result.encryptedData = dataBuf
-	read, err = r.Read(intBuf)
+	marshal, err := util.ReadBytes(r)
 	if err != nil {
 		return nil, err
 	}
-	if read < len(intBuf) {
-		return nil, errors.New("unexpected EOF")
-	}
-	marshalSize, _ := util.BytesToInt64(intBuf)
-	marshalBuf := make([]byte, marshalSize)
-	read, err = r.Read(marshalBuf)
+	// empty for a message synced by a device whose node id wasn't known, it is only ever shown
+	result.origin = peer.ID(marshal)
+	id, err := util.ReadUint64(r)
 	if err != nil {
 		return nil, err
 	}
-	if read < len(marshalBuf) {
-		return nil, errors.New("unexpected EOF")
-	}
-	err = (&result.origin).Unmarshal(marshalBuf)
-	if err != nil {
-		return nil, err
+	if version < 0 {
+		result.id = id
+		cidBytes, err := util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		result.cid, err = cid.Cast(cidBytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		result.legacyId = id
+		result.cid, err = util.ContentCid(result.encryptedData)
+		if err != nil {
+			return nil, err
+		}
 	}
-	read, err = r.Read(intBuf)
-	if err != nil {
-		return nil, err
+	if version == messageVersion || version == storedMessageVersion {
+		from, err := util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(from) > 0 {
+			result.savedFrom, err = gpg.ReadEntity(packet.NewReader(bytes.NewBuffer(from)))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
-	if read < len(intBuf) {
-		return nil, errors.New("unexpected EOF")
+	if store != nil && result.encryptedData != nil {
+		err = store.Put(result.cid, bytes.NewReader(result.encryptedData))
+		if err != nil {
+			return nil, err
+		}
+		result.encryptedData = nil
 	}
-	result.id, _ = util.BytesToUint64(intBuf)
+	result.store = store
 	err = result.decrypt(ipfs, identity, contacts, nil)
 	if err != nil {
-		return nil, err
+		return nil, &UnreadableMessageError{Cid: result.cid, Err: err}
 	}
 	return &result, nil
 }
@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/Geo25rey/crypto/curve25519"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/packet"
+	"github.com/ipfs/go-cid"
+	"io"
+	"ipmail/libipmail/util"
+	"strings"
+	"time"
+)
+
+// prekeyBundleTag is the private OpenPGP packet type a PrekeyBundle is published as after an identity,
+// which other OpenPGP implementations skip
+const prekeyBundleTag = 60
+
+const prekeyBundleVersion = 1
+
+var ErrNoPrekeyBundle = errors.New("identity has no prekey bundle")
+
+// PrekeyBundle is the signed X25519 prekey sessions with an identity are started with
+type PrekeyBundle struct {
+	Prekey  []byte
+	Created time.Time
+	// Signature is a detached OpenPGP signature of the identity over Prekey and Created
+	Signature []byte
+}
+
+// prekey is the private half of a PrekeyBundle
+type prekey struct {
+	private []byte
+	public  []byte
+	created time.Time
+	// signature is kept so the published identity stays the same
+	signature []byte
+}
+
+func newX25519Key() (private []byte, public []byte, err error) {
+	private = make([]byte, 32)
+	_, err = rand.Read(private)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	return private, public, err
+}
+
+func newPrekey() (*prekey, error) {
+	private, public, err := newX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	return &prekey{private: private, public: public, created: time.Now()}, nil
+}
+
+func (b *PrekeyBundle) signed() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	_ = util.WriteBytes(buf, b.Prekey)
+	_ = util.WriteInt64(buf, b.Created.Unix())
+	return buf.Bytes()
+}
+
+// bundle signs the public half of k with identity the first time
+func (k *prekey) bundle(identity *gpg.Entity) (*PrekeyBundle, error) {
+	result := &PrekeyBundle{Prekey: k.public, Created: time.Unix(k.created.Unix(), 0), Signature: k.signature}
+	if k.signature != nil {
+		return result, nil
+	}
+	signature := bytes.NewBuffer(make([]byte, 0))
+	err := gpg.DetachSign(signature, identity, bytes.NewBuffer(result.signed()), util.DefaultEncryptionConfig())
+	if err != nil {
+		return nil, err
+	}
+	k.signature = signature.Bytes()
+	result.Signature = k.signature
+	return result, nil
+}
+
+// Verify checks that the bundle was signed by identity
+func (b *PrekeyBundle) Verify(identity *gpg.Entity) error {
+	_, err := gpg.CheckDetachedSignature(gpg.EntityList{identity}, bytes.NewBuffer(b.signed()), bytes.NewBuffer(b.Signature))
+	return err
+}
+
+func (b *PrekeyBundle) serializeContents(w io.Writer) error {
+	err := util.WriteInt64(w, prekeyBundleVersion)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b.signed())
+	if err != nil {
+		return err
+	}
+	return util.WriteBytes(w, b.Signature)
+}
+
+// Serialize writes the bundle as an OpenPGP packet, to be published after the serialized identity
+func (b *PrekeyBundle) Serialize(w io.Writer) error {
+	contents := bytes.NewBuffer(make([]byte, 0))
+	err := b.serializeContents(contents)
+	if err != nil {
+		return err
+	}
+	return (&packet.OpaquePacket{Tag: prekeyBundleTag, Contents: contents.Bytes()}).Serialize(w)
+}
+
+// ReadPrekeyBundle finds the bundle published after an identity, failing with ErrNoPrekeyBundle if there is none
+func ReadPrekeyBundle(r io.Reader) (*PrekeyBundle, error) {
+	packets := packet.NewOpaqueReader(r)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return nil, ErrNoPrekeyBundle
+		} else if err != nil {
+			return nil, err
+		}
+		if p.Tag == prekeyBundleTag {
+			return parsePrekeyBundle(bytes.NewBuffer(p.Contents))
+		}
+	}
+}
+
+// Contact is an identity with what was published after it
+type Contact struct {
+	Entity *gpg.Entity
+	// Bundle is nil if the identity was published without a prekey bundle
+	Bundle *PrekeyBundle
+	// Profile is the content ID of the profile of the identity, cid.Undef if it has none
+	Profile cid.Cid
+}
+
+// ParseContact is util.ParseEntityContext also returning the prekey bundle published after the entity,
+// which is nil if there is none. str can also be an IdentityUri, whose fingerprint the entity must have
+func ParseContact(ctx context.Context, str string, ipfs util.Cat) (*gpg.Entity, *PrekeyBundle, error) {
+	contact, err := ReadContact(ctx, str, ipfs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contact.Entity, contact.Bundle, nil
+}
+
+// ReadContact is ParseContact also returning the link to the profile published after the entity
+func ReadContact(ctx context.Context, str string, ipfs util.Cat) (*Contact, error) {
+	if strings.HasPrefix(strings.TrimSpace(str), IdentityUriScheme+":") {
+		uri, err := ParseIdentityUri(str)
+		if err != nil {
+			return nil, err
+		}
+		return uri.FetchContact(ctx, ipfs)
+	}
+	b, err := util.ReadEntityData(ctx, str, ipfs)
+	if err != nil {
+		return nil, err
+	}
+	entity, err := gpg.ReadEntity(packet.NewReader(bytes.NewBuffer(b)))
+	if err != nil {
+		return nil, err
+	}
+	result := &Contact{Entity: entity}
+	result.Bundle, err = ReadPrekeyBundle(bytes.NewBuffer(b))
+	if err != nil {
+		result.Bundle = nil // published without a bundle, or one this version doesn't understand
+	}
+	result.Profile, err = ReadProfileLink(bytes.NewBuffer(b))
+	if err != nil {
+		result.Profile = cid.Undef
+	}
+	return result, nil
+}
+
+func parsePrekeyBundle(r io.Reader) (*PrekeyBundle, error) {
+	version, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != prekeyBundleVersion {
+		return nil, errors.New("unsupported prekey bundle version")
+	}
+	result := &PrekeyBundle{}
+	result.Prekey, err = util.ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Prekey) != 32 {
+		return nil, errors.New("prekey is not an X25519 key")
+	}
+	created, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Created = time.Unix(created, 0)
+	result.Signature, err = util.ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,267 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/packet"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"ipmail/libipmail/util"
+	"time"
+)
+
+// profileTag is the private OpenPGP packet type a Profile is published as
+const profileTag = 61
+
+// profileLinkTag is the private OpenPGP packet type the content ID of a Profile is published as after an
+// identity, next to its prekey bundle
+const profileLinkTag = 62
+
+const profileVersion = 1
+
+const (
+	// MaxAvatarSize bounds the avatar image of a profile
+	MaxAvatarSize = 256 << 10
+	// MaxAvatarDimension bounds the width and height of the avatar, since a small image can decode to a huge one
+	MaxAvatarDimension = 1024
+	// MaxProfileText bounds the display name, bio and every language of a profile
+	MaxProfileText = 4 << 10
+	// MaxLanguages bounds how many preferred languages a profile lists
+	MaxLanguages = 16
+	// maxProfileSize bounds a serialized profile: its avatar, texts and their lengths, plus room for the packet
+	// header, the version, the update time and the signature
+	maxProfileSize = MaxAvatarSize + (2+MaxLanguages)*(MaxProfileText+8) + 16<<10
+)
+
+var ErrNoProfile = errors.New("identity has no profile")
+
+// Profile is what an identity shows about itself besides its user ID. It is published on its own and linked
+// from the identity, so it can change without the key changing
+type Profile struct {
+	DisplayName string
+	Bio         string
+	// Languages are the preferred languages as BCP 47 tags like en-US, most preferred first
+	Languages []string
+	// Avatar is a PNG or JPEG image, empty without one
+	Avatar []byte
+	// Updated is when the profile was signed, so an older profile never replaces a newer one
+	Updated time.Time
+	// Signature is a detached OpenPGP signature of the identity over everything else
+	Signature []byte
+}
+
+func (p *Profile) signed() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	_ = util.WriteString(buf, p.DisplayName)
+	_ = util.WriteString(buf, p.Bio)
+	_ = util.WriteInt64(buf, int64(len(p.Languages)))
+	for _, language := range p.Languages {
+		_ = util.WriteString(buf, language)
+	}
+	_ = util.WriteBytes(buf, p.Avatar)
+	_ = util.WriteInt64(buf, p.Updated.Unix())
+	return buf.Bytes()
+}
+
+// CheckAvatar makes sure avatar is a PNG or JPEG image within MaxAvatarSize and MaxAvatarDimension, so it can be
+// decoded safely
+func CheckAvatar(avatar []byte) error {
+	if len(avatar) > MaxAvatarSize {
+		return errors.New("avatar is too large")
+	}
+	config, format, err := image.DecodeConfig(bytes.NewBuffer(avatar))
+	if err != nil || format != "png" && format != "jpeg" {
+		return errors.New("avatar is not a PNG or JPEG image")
+	}
+	if config.Width > MaxAvatarDimension || config.Height > MaxAvatarDimension {
+		return fmt.Errorf("avatar is %dx%d, larger than %dx%d", config.Width, config.Height, MaxAvatarDimension,
+			MaxAvatarDimension)
+	}
+	return nil
+}
+
+func (p *Profile) check() error {
+	if len(p.Avatar) > 0 {
+		err := CheckAvatar(p.Avatar)
+		if err != nil {
+			return err
+		}
+	}
+	if len(p.Languages) > MaxLanguages {
+		return errors.New("profile lists too many languages")
+	}
+	for _, text := range append([]string{p.DisplayName, p.Bio}, p.Languages...) {
+		if len(text) > MaxProfileText {
+			return errors.New("profile text is too long")
+		}
+	}
+	return nil
+}
+
+// Sign updates the profile and signs it with identity
+func (p *Profile) Sign(identity *gpg.Entity) error {
+	err := p.check()
+	if err != nil {
+		return err
+	}
+	p.Updated = time.Unix(time.Now().Unix(), 0)
+	signature := bytes.NewBuffer(make([]byte, 0))
+	err = gpg.DetachSign(signature, identity, bytes.NewBuffer(p.signed()), util.DefaultEncryptionConfig())
+	if err != nil {
+		return err
+	}
+	p.Signature = signature.Bytes()
+	return nil
+}
+
+// Verify checks that the profile was signed by identity
+func (p *Profile) Verify(identity *gpg.Entity) error {
+	_, err := gpg.CheckDetachedSignature(gpg.EntityList{identity}, bytes.NewBuffer(p.signed()), bytes.NewBuffer(p.Signature))
+	return err
+}
+
+// Serialize writes the profile as an OpenPGP packet
+func (p *Profile) Serialize(w io.Writer) error {
+	contents := bytes.NewBuffer(make([]byte, 0))
+	err := util.WriteInt64(contents, profileVersion)
+	if err != nil {
+		return err
+	}
+	_, err = contents.Write(p.signed())
+	if err != nil {
+		return err
+	}
+	err = util.WriteBytes(contents, p.Signature)
+	if err != nil {
+		return err
+	}
+	return (&packet.OpaquePacket{Tag: profileTag, Contents: contents.Bytes()}).Serialize(w)
+}
+
+// ReadProfile reads a profile written by Profile.Serialize, which isn't verified yet
+func ReadProfile(r io.Reader) (*Profile, error) {
+	p, err := packet.NewOpaqueReader(r).Next()
+	if err != nil {
+		return nil, err
+	}
+	if p.Tag != profileTag {
+		return nil, errors.New("data is not a profile")
+	}
+	buf := bytes.NewBuffer(p.Contents)
+	version, err := util.ReadInt64(buf)
+	if err != nil {
+		return nil, err
+	}
+	if version != profileVersion {
+		return nil, errors.New("unsupported profile version")
+	}
+	result := &Profile{}
+	texts := []*string{&result.DisplayName, &result.Bio}
+	for _, text := range texts {
+		b, err := readUntrustedBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		*text = string(b)
+	}
+	languages, err := util.ReadInt64(buf)
+	if err != nil {
+		return nil, err
+	}
+	if languages < 0 || languages > MaxLanguages {
+		return nil, errors.New("profile lists too many languages")
+	}
+	for i := int64(0); i < languages; i++ {
+		b, err := readUntrustedBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		result.Languages = append(result.Languages, string(b))
+	}
+	result.Avatar, err = readUntrustedBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Avatar) == 0 {
+		result.Avatar = nil
+	}
+	updated, err := util.ReadInt64(buf)
+	if err != nil {
+		return nil, err
+	}
+	result.Updated = time.Unix(updated, 0)
+	result.Signature, err = readUntrustedBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	return result, result.check()
+}
+
+// SerializeProfileLink writes the content ID of a profile, to be published after the serialized identity
+func SerializeProfileLink(w io.Writer, profile cid.Cid) error {
+	contents := bytes.NewBuffer(make([]byte, 0))
+	err := util.WriteInt64(contents, profileVersion)
+	if err != nil {
+		return err
+	}
+	err = util.WriteBytes(contents, profile.Bytes())
+	if err != nil {
+		return err
+	}
+	return (&packet.OpaquePacket{Tag: profileLinkTag, Contents: contents.Bytes()}).Serialize(w)
+}
+
+// ReadProfileLink finds the content ID of the profile published after an identity, failing with ErrNoProfile
+// if there is none
+func ReadProfileLink(r io.Reader) (cid.Cid, error) {
+	packets := packet.NewOpaqueReader(r)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return cid.Undef, ErrNoProfile
+		} else if err != nil {
+			return cid.Undef, err
+		}
+		if p.Tag != profileLinkTag {
+			continue
+		}
+		buf := bytes.NewBuffer(p.Contents)
+		version, err := util.ReadInt64(buf)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if version != profileVersion {
+			return cid.Undef, errors.New("unsupported profile version")
+		}
+		b, err := readUntrustedBytes(buf)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return cid.Cast(b)
+	}
+}
+
+// FetchProfile gets the profile of identity published as c, failing if identity didn't sign it
+func FetchProfile(ctx context.Context, identity *gpg.Entity, c cid.Cid, ipfs util.Cat) (*Profile, error) {
+	r, err := util.CatStream(ctx, ipfs, path.IpfsPath(c))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	result, err := ReadProfile(util.BoundedReader(r, maxProfileSize))
+	if err != nil {
+		return nil, err
+	}
+	err = result.Verify(identity)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
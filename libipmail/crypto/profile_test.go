@@ -0,0 +1,181 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/packet"
+	"image"
+	"image/png"
+	"ipmail/libipmail/util"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	alice := newTestIdentity(t).DefaultIdentity()
+	bob := newTestIdentity(t).DefaultIdentity()
+	avatar := bytes.NewBuffer(make([]byte, 0))
+	if err := png.Encode(avatar, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	profile := &Profile{DisplayName: "Alice", Bio: "Writes ipmail", Languages: []string{"en-US", "de"},
+		Avatar: avatar.Bytes()}
+	if err := profile.Sign(alice); err != nil {
+		t.Fatal(err)
+	}
+	published := bytes.NewBuffer(make([]byte, 0))
+	if err := profile.Serialize(published); err != nil {
+		t.Fatal(err)
+	}
+	c, err := util.ContentCid(published.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := *profile
+	tampered.DisplayName = "Mallory"
+	forged := bytes.NewBuffer(make([]byte, 0))
+	if err = tampered.Serialize(forged); err != nil {
+		t.Fatal(err)
+	}
+	forgedCid, err := util.ContentCid(forged.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipfs := publishedCat{c.String(): published.Bytes(), forgedCid.String(): forged.Bytes()}
+
+	tests := []struct {
+		name     string
+		identity *gpg.Entity
+		wantErr  bool
+	}{
+		{"Signer", alice, false},
+		{"Someone Else", bob, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FetchProfile(context.Background(), tt.identity, c, ipfs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FetchProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, profile) {
+				t.Errorf("FetchProfile() = %v, want %v", got, profile)
+			}
+		})
+	}
+	if _, err = FetchProfile(context.Background(), alice, forgedCid, ipfs); err == nil {
+		t.Error("FetchProfile() of a changed profile succeeded")
+	}
+	if err = (&Profile{Avatar: make([]byte, MaxAvatarSize+1)}).Sign(alice); err == nil {
+		t.Error("Sign() of a profile with a too large avatar succeeded")
+	}
+	if err = (&Profile{Avatar: []byte("not an image")}).Sign(alice); err == nil {
+		t.Error("Sign() of a profile with an avatar which isn't an image succeeded")
+	}
+	wide := bytes.NewBuffer(make([]byte, 0))
+	if err = png.Encode(wide, image.NewGray(image.Rect(0, 0, MaxAvatarDimension+1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Profile{Avatar: wide.Bytes()}).Sign(alice); err == nil {
+		t.Error("Sign() of a profile with an avatar wider than MaxAvatarDimension succeeded")
+	}
+}
+
+func TestFetchProfile_size(t *testing.T) {
+	alice := newTestIdentity(t).DefaultIdentity()
+	avatar := bytes.NewBuffer(make([]byte, 0))
+	if err := png.Encode(avatar, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	text := strings.Repeat("a", MaxProfileText)
+	largest := &Profile{DisplayName: text, Bio: text, Languages: make([]string, MaxLanguages),
+		Avatar: append(avatar.Bytes(), make([]byte, MaxAvatarSize-avatar.Len())...)}
+	for i := range largest.Languages {
+		largest.Languages[i] = text
+	}
+	if err := largest.Sign(alice); err != nil {
+		t.Fatal(err)
+	}
+	published := bytes.NewBuffer(make([]byte, 0))
+	if err := largest.Serialize(published); err != nil {
+		t.Fatal(err)
+	}
+	tooLarge := bytes.NewBuffer(make([]byte, 0))
+	err := (&packet.OpaquePacket{Tag: profileTag, Contents: make([]byte, maxProfileSize)}).Serialize(tooLarge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipfs := publishedCat{}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"Largest", published.Bytes(), nil},
+		{"Too Large", tooLarge.Bytes(), util.ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := util.ContentCid(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipfs[c.String()] = tt.data
+			_, err = FetchProfile(context.Background(), alice, c, ipfs)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("FetchProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadContact(t *testing.T) {
+	alice := newTestIdentity(t).DefaultIdentity()
+	bundle, err := NewSessionStore().Bundle(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := util.ContentCid([]byte("alice's profile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(link bool) string {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err := alice.Serialize(buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := bundle.Serialize(buf); err != nil {
+			t.Fatal(err)
+		}
+		if link {
+			if err := SerializeProfileLink(buf, profile); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return "bin:" + buf.String()
+	}
+	tests := []struct {
+		name    string
+		locator string
+		want    bool
+	}{
+		{"Linked Profile", publish(true), true},
+		{"No Profile", publish(false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadContact(context.Background(), tt.locator, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Bundle == nil || got.Entity.PrimaryKey.KeyId != alice.PrimaryKey.KeyId {
+				t.Errorf("ReadContact() = %v, want alice with her bundle", got)
+			}
+			if got.Profile.Defined() != tt.want || tt.want && got.Profile != profile {
+				t.Errorf("ReadContact() profile = %s, want %s %v", got.Profile, profile, tt.want)
+			}
+		})
+	}
+}
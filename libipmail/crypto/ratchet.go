@@ -0,0 +1,532 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/Geo25rey/crypto/chacha20poly1305"
+	"github.com/Geo25rey/crypto/curve25519"
+	"github.com/Geo25rey/crypto/hkdf"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io"
+	"ipmail/libipmail/util"
+	"strconv"
+	"time"
+)
+
+// maxSkippedKeys bounds how many message keys a session keeps for messages which haven't arrived yet,
+// and for its own messages which haven't echoed back yet
+const maxSkippedKeys = 1000
+
+// messageKeyTtl is how long those keys are kept, since a message which didn't arrive by then likely never will
+// and every kept key is one more message a leak of the sessions exposes
+const messageKeyTtl = 30 * 24 * time.Hour
+
+// ownKeyTtl is how long the key of a message we sent is kept for its echo, which arrives as soon as it is
+// announced. A message which echoes later than that isn't added to the sent messages
+const ownKeyTtl = 24 * time.Hour
+
+// messageKeys are kept message keys by ratchet key and message number, dropping the oldest past maxSkippedKeys
+type messageKeys struct {
+	keys  map[string][]byte
+	added map[string]time.Time
+	order []string
+}
+
+func newMessageKeys() *messageKeys {
+	return &messageKeys{keys: make(map[string][]byte), added: make(map[string]time.Time), order: make([]string, 0)}
+}
+
+func messageKeyName(ratchet []byte, n uint64) string {
+	return hex.EncodeToString(ratchet) + ":" + strconv.FormatUint(n, 10)
+}
+
+func (k *messageKeys) add(name string, key []byte) {
+	k.addAt(name, key, time.Now())
+}
+
+func (k *messageKeys) addAt(name string, key []byte, added time.Time) {
+	k.keys[name] = key
+	k.added[name] = added
+	k.order = append(k.order, name)
+	for len(k.order) > maxSkippedKeys {
+		delete(k.keys, k.order[0])
+		delete(k.added, k.order[0])
+		k.order = k.order[1:]
+	}
+}
+
+// take removes the key so it can only be used once
+func (k *messageKeys) take(name string) ([]byte, bool) {
+	key, ok := k.keys[name]
+	if !ok {
+		return nil, false
+	}
+	delete(k.keys, name)
+	delete(k.added, name)
+	for i, compare := range k.order {
+		if compare == name {
+			k.order = append(k.order[:i], k.order[i+1:]...)
+			break
+		}
+	}
+	return key, true
+}
+
+// expire drops the keys added before, which are the first in order
+func (k *messageKeys) expire(before time.Time) {
+	for len(k.order) > 0 && k.added[k.order[0]].Before(before) {
+		delete(k.keys, k.order[0])
+		delete(k.added, k.order[0])
+		k.order = k.order[1:]
+	}
+}
+
+func (k *messageKeys) copy() *messageKeys {
+	result := newMessageKeys()
+	for _, name := range k.order {
+		result.addAt(name, k.keys[name], k.added[name])
+	}
+	return result
+}
+
+func (k *messageKeys) serialize(w io.Writer) error {
+	err := util.WriteInt64(w, int64(len(k.order)))
+	if err != nil {
+		return err
+	}
+	for _, name := range k.order {
+		err = util.WriteString(w, name)
+		if err != nil {
+			return err
+		}
+		err = util.WriteBytes(w, k.keys[name])
+		if err != nil {
+			return err
+		}
+		err = util.WriteInt64(w, k.added[name].Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMessageKeys reads keys saved in a sessions file of version, where keys saved before they expired count as
+// added when they are read
+func readMessageKeys(r io.Reader, version int64) (*messageKeys, error) {
+	count, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result := newMessageKeys()
+	for i := int64(0); i < count; i++ {
+		name, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		key, err := util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		added := time.Now()
+		if version >= sessionStoreExpiringVersion {
+			unix, err := util.ReadInt64(r)
+			if err != nil {
+				return nil, err
+			}
+			added = time.Unix(unix, 0)
+		}
+		result.addAt(name, key, added)
+	}
+	return result, nil
+}
+
+// sessionHeader goes in front of every sealed message. It is authenticated but not encrypted
+type sessionHeader struct {
+	session  []byte
+	ratchet  []byte // current ratchet public key of the sender
+	previous uint64 // number of messages in the sender's previous sending chain
+	n        uint64
+	// init is the sender's ephemeral key and the recipient's prekey, which start the session on the recipient's
+	// side, followed by the sender's signature over them and the session id
+	init []byte
+}
+
+func (h *sessionHeader) serialize(w io.Writer) error {
+	for _, b := range [][]byte{h.session, h.ratchet} {
+		err := util.WriteBytes(w, b)
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range []uint64{h.previous, h.n} {
+		err := util.WriteUint64(w, n)
+		if err != nil {
+			return err
+		}
+	}
+	return util.WriteBytes(w, h.init)
+}
+
+// readUntrustedBytes is util.ReadBytes for data from the network, which can't claim more bytes than are left
+func readUntrustedBytes(r *bytes.Buffer) ([]byte, error) {
+	size, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > int64(r.Len()) {
+		return nil, errors.New("sealed message is corrupt")
+	}
+	return append([]byte{}, r.Next(int(size))...), nil
+}
+
+// maxHeaderField bounds the fields of a session header, whose init is the biggest with a signature in it
+const maxHeaderField = 16 * 1024
+
+// readHeaderBytes is util.ReadBytes for a header from the network, which can't claim more than maxHeaderField
+func readHeaderBytes(r io.Reader) ([]byte, error) {
+	size, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxHeaderField {
+		return nil, errors.New("sealed message is corrupt")
+	}
+	result := make([]byte, size)
+	_, err = io.ReadFull(r, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func readSessionHeader(r io.Reader) (*sessionHeader, error) {
+	result := &sessionHeader{}
+	var err error
+	for _, b := range []*[]byte{&result.session, &result.ratchet} {
+		*b, err = readHeaderBytes(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range []*uint64{&result.previous, &result.n} {
+		*n, err = util.ReadUint64(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.init, err = readHeaderBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.ratchet) != 32 || (len(result.init) != 0 && len(result.init) <= 64) {
+		return nil, errors.New("session header has keys of the wrong size")
+	}
+	return result, nil
+}
+
+// session is one side of a double ratchet between two identities. Every message is encrypted with its
+// own key, which is deleted once used, and every reply brings new Diffie-Hellman keys into the chain
+type session struct {
+	id             []byte
+	contact        string // fingerprint of the contact, empty until their first signed message
+	rootKey        []byte
+	sendingChain   []byte // nil until the contact sent a message, for the side which didn't start the session
+	receivingChain []byte // nil until the contact sent a message
+	ratchetPrivate []byte
+	ratchetPublic  []byte
+	remoteRatchet  []byte
+	sent           uint64
+	received       uint64
+	previous       uint64
+	init           []byte // sent in every header until the contact answers
+	accepted       []byte // the init of a session the contact started, which tells who they are
+	skipped        *messageKeys
+	own            *messageKeys // keys of sent messages until they echo back to us
+}
+
+func dh(private []byte, public []byte) ([]byte, error) {
+	return curve25519.X25519(private, public)
+}
+
+func kdf(secret []byte, salt []byte, info string, size int) ([]byte, error) {
+	result := make([]byte, size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), result)
+	return result, err
+}
+
+// kdfRoot mixes a Diffie-Hellman output into the root key, returning the next root key and a new chain key
+func kdfRoot(rootKey []byte, dhOut []byte) ([]byte, []byte, error) {
+	keys, err := kdf(dhOut, rootKey, "ipmail ratchet", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// kdfChain returns the message key of chainKey and the next chain key
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	messageKey := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{2})
+	return messageKey, mac.Sum(nil)
+}
+
+func signedInit(id []byte, init []byte) []byte {
+	return append(append([]byte{}, id...), init[:64]...)
+}
+
+// startSession starts a session of from with the owner of bundle, who is told how to start their side in init
+func startSession(from *gpg.Entity, bundle *PrekeyBundle) (*session, error) {
+	ephemeralPrivate, ephemeralPublic, err := newX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := dh(ephemeralPrivate, bundle.Prekey)
+	if err != nil {
+		return nil, err
+	}
+	result := &session{
+		id:            make([]byte, 16),
+		remoteRatchet: bundle.Prekey,
+		init:          append(append([]byte{}, ephemeralPublic...), bundle.Prekey...),
+		skipped:       newMessageKeys(),
+		own:           newMessageKeys(),
+	}
+	_, err = rand.Read(result.id)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := kdf(shared, nil, "ipmail session", 32)
+	if err != nil {
+		return nil, err
+	}
+	result.ratchetPrivate, result.ratchetPublic, err = newX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	shared, err = dh(result.ratchetPrivate, result.remoteRatchet)
+	if err != nil {
+		return nil, err
+	}
+	result.rootKey, result.sendingChain, err = kdfRoot(secret, shared)
+	if err != nil {
+		return nil, err
+	}
+	signature := bytes.NewBuffer(make([]byte, 0))
+	err = gpg.DetachSign(signature, from, bytes.NewBuffer(signedInit(result.id, result.init)), util.DefaultEncryptionConfig())
+	if err != nil {
+		return nil, err
+	}
+	result.init = append(result.init, signature.Bytes()...)
+	return result, nil
+}
+
+// startedBy tells if contact signed the init of a session they started
+func (s *session) startedBy(contact *gpg.Entity) bool {
+	if len(s.accepted) <= 64 {
+		return false
+	}
+	_, err := gpg.CheckDetachedSignature(gpg.EntityList{contact},
+		bytes.NewBuffer(signedInit(s.id, s.accepted)), bytes.NewBuffer(s.accepted[64:]))
+	return err == nil
+}
+
+// acceptSession starts the side of a session whose first message had header, made with the bundle of key
+func acceptSession(header *sessionHeader, key *prekey) (*session, error) {
+	shared, err := dh(key.private, header.init[:32])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := kdf(shared, nil, "ipmail session", 32)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		id:             header.session,
+		rootKey:        secret,
+		ratchetPrivate: key.private,
+		ratchetPublic:  key.public,
+		accepted:       header.init,
+		skipped:        newMessageKeys(),
+		own:            newMessageKeys(),
+	}, nil
+}
+
+func (s *session) copy() *session {
+	result := *s
+	result.skipped = s.skipped.copy()
+	result.own = s.own.copy()
+	return &result
+}
+
+func sessionAead(messageKey []byte) (cipher.AEAD, []byte, error) {
+	aead, err := chacha20poly1305.New(messageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, make([]byte, aead.NonceSize()), nil // every message key is only used once
+}
+
+// nextSendingKey moves the sending chain forward, returning the header of the message and the key to encrypt it with
+func (s *session) nextSendingKey() ([]byte, []byte, error) {
+	if s.sendingChain == nil {
+		return nil, nil, errors.New("session can't send before the contact answers")
+	}
+	header := &sessionHeader{
+		session:  s.id,
+		ratchet:  s.ratchetPublic,
+		previous: s.previous,
+		n:        s.sent,
+		init:     s.init,
+	}
+	headerBytes := bytes.NewBuffer(make([]byte, 0))
+	err := header.serialize(headerBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	messageKey, next := kdfChain(s.sendingChain)
+	s.sendingChain = next
+	s.own.add(messageKeyName(s.ratchetPublic, s.sent), messageKey)
+	s.sent++
+	return headerBytes.Bytes(), messageKey, nil
+}
+
+// skip keeps the receiving keys up to message until for messages which arrive later
+func (s *session) skip(until uint64) error {
+	if s.receivingChain == nil {
+		return nil
+	}
+	if until > s.received+maxSkippedKeys {
+		return errors.New("too many messages of the session are missing")
+	}
+	for s.received < until {
+		var messageKey []byte
+		messageKey, s.receivingChain = kdfChain(s.receivingChain)
+		s.skipped.add(messageKeyName(s.remoteRatchet, s.received), messageKey)
+		s.received++
+	}
+	return nil
+}
+
+// step moves the ratchet forward when the contact sent a new ratchet key
+func (s *session) step(remoteRatchet []byte) error {
+	s.previous = s.sent
+	s.sent = 0
+	s.received = 0
+	s.remoteRatchet = remoteRatchet
+	shared, err := dh(s.ratchetPrivate, remoteRatchet)
+	if err != nil {
+		return err
+	}
+	s.rootKey, s.receivingChain, err = kdfRoot(s.rootKey, shared)
+	if err != nil {
+		return err
+	}
+	s.ratchetPrivate, s.ratchetPublic, err = newX25519Key()
+	if err != nil {
+		return err
+	}
+	shared, err = dh(s.ratchetPrivate, remoteRatchet)
+	if err != nil {
+		return err
+	}
+	s.rootKey, s.sendingChain, err = kdfRoot(s.rootKey, shared)
+	return err
+}
+
+// receivingKey finds the key of the message with header, returning it and the session as it is once the message is
+// read. The session itself is left unchanged so a message which can't be decrypted doesn't move it forward
+func (s *session) receivingKey(header *sessionHeader) ([]byte, *session, error) {
+	name := messageKeyName(header.ratchet, header.n)
+	if _, ok := s.own.keys[name]; ok {
+		next := s.copy()
+		messageKey, _ := next.own.take(name)
+		return messageKey, next, nil
+	}
+	if _, ok := s.skipped.keys[name]; ok {
+		next := s.copy()
+		messageKey, _ := next.skipped.take(name)
+		return messageKey, next, nil
+	}
+	next := s.copy()
+	if !bytes.Equal(header.ratchet, next.remoteRatchet) || next.receivingChain == nil {
+		err := next.skip(header.previous)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = next.step(header.ratchet)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err := next.skip(header.n)
+	if err != nil {
+		return nil, nil, err
+	}
+	var messageKey []byte
+	messageKey, next.receivingChain = kdfChain(next.receivingChain)
+	next.received++
+	next.init = nil // the contact started their side
+	return messageKey, next, nil
+}
+
+func (s *session) serialize(w io.Writer) error {
+	for _, b := range [][]byte{s.id, []byte(s.contact), s.rootKey, s.sendingChain, s.receivingChain,
+		s.ratchetPrivate, s.ratchetPublic, s.remoteRatchet, s.init, s.accepted} {
+		err := util.WriteBytes(w, b)
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range []uint64{s.sent, s.received, s.previous} {
+		err := util.WriteUint64(w, n)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.skipped.serialize(w)
+	if err != nil {
+		return err
+	}
+	return s.own.serialize(w)
+}
+
+func readSession(r io.Reader, version int64) (*session, error) {
+	result := &session{}
+	var contact []byte
+	var err error
+	for _, b := range []*[]byte{&result.id, &contact, &result.rootKey, &result.sendingChain, &result.receivingChain,
+		&result.ratchetPrivate, &result.ratchetPublic, &result.remoteRatchet, &result.init, &result.accepted} {
+		*b, err = util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(*b) == 0 {
+			*b = nil
+		}
+	}
+	result.contact = string(contact)
+	for _, n := range []*uint64{&result.sent, &result.received, &result.previous} {
+		*n, err = util.ReadUint64(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.skipped, err = readMessageKeys(r, version)
+	if err != nil {
+		return nil, err
+	}
+	result.own, err = readMessageKeys(r, version)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/armor"
+	"io"
+	"ipmail/libipmail/util"
+	"strings"
+)
+
+type selfEncryptionWriter struct {
+	armored   io.WriteCloser
+	encrypted io.WriteCloser
+}
+
+func (s *selfEncryptionWriter) Write(p []byte) (int, error) {
+	return s.encrypted.Write(p)
+}
+
+func (s *selfEncryptionWriter) Close() error {
+	err := s.encrypted.Close()
+	if err != nil {
+		return err
+	}
+	return s.armored.Close()
+}
+
+// EncryptToSelf returns a writer which encrypts and signs everything written to it so
+// that only identity can read it back. The writer must be closed to flush the data.
+func EncryptToSelf(w io.Writer, encoding string, identity SelfIdentity) (io.WriteCloser, error) {
+	if identity == nil {
+		return nil, errors.New("identity may not be nil")
+	}
+	armored, err := armor.Encode(w, encoding, make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := gpg.Encrypt(armored, identity.EntityList(), identity.DefaultIdentity(),
+		nil, util.DefaultEncryptionConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &selfEncryptionWriter{
+		armored:   armored,
+		encrypted: encrypted,
+	}, nil
+}
+
+// DecryptFromSelf reads data written by EncryptToSelf
+func DecryptFromSelf(r io.Reader, encoding string, identity SelfIdentity) (io.Reader, error) {
+	if identity == nil {
+		return nil, errors.New("identity may not be nil")
+	}
+	decode, err := armor.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Compare(decode.Type, encoding) != 0 {
+		return nil, errors.New("data not encrypted as " + encoding)
+	}
+	readMessage, err := gpg.ReadMessage(decode.Body, identity.EntityList(), nil, util.DefaultEncryptionConfig())
+	if err != nil {
+		return nil, err
+	}
+	if !readMessage.IsSigned || readMessage.SignedBy == nil {
+		return nil, errors.New("data was not signed by your identity")
+	}
+	return &verifyingReader{readMessage}, nil
+}
+
+// verifyingReader reports a bad signature once the body has been fully read
+type verifyingReader struct {
+	details *gpg.MessageDetails
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.details.UnverifiedBody.Read(p)
+	if err == io.EOF && v.details.SignatureError != nil {
+		return n, v.details.SignatureError
+	}
+	return n, err
+}
@@ -1,15 +1,16 @@
 package crypto
 
 import (
+	"bytes"
 	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io"
 	"ipmail/libipmail/util"
-	"os"
 )
 
 type SelfIdentity interface {
 	DefaultIdentity() *gpg.Entity
 	EntityList() gpg.EntityList
-	SaveToFile(file string) error
+	SaveToFile(file string, sealer util.Sealer) error
 }
 
 type selfIdentity struct {
@@ -39,12 +40,12 @@ func (s *selfIdentity) EntityList() gpg.EntityList {
 	return s.identities.ToArray()
 }
 
-func NewSelfIdentityFromFile(path string) SelfIdentity {
-	file, err := os.Open(path)
+func NewSelfIdentityFromFile(path string, sealer util.Sealer) SelfIdentity {
+	b, err := util.ReadSealedFile(path, sealer)
 	if err != nil {
 		return nil
 	}
-	entities, err := util.LoadEntities(file)
+	entities, err := util.LoadEntities(bytes.NewBuffer(b))
 	if err != nil {
 		return nil
 	}
@@ -54,10 +55,8 @@ func NewSelfIdentityFromFile(path string) SelfIdentity {
 	}
 }
 
-func (s *selfIdentity) SaveToFile(path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	return util.SaveEntitiesPrivate(file, append(s.EntityList(), s.defaultIdentity)...)
+func (s *selfIdentity) SaveToFile(path string, sealer util.Sealer) error {
+	return util.WriteSealedFile(path, sealer, func(w io.Writer) error {
+		return util.SaveEntitiesPrivate(w, append(s.EntityList(), s.defaultIdentity)...)
+	})
 }
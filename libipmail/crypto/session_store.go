@@ -0,0 +1,578 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/armor"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionEncoding is the armor type of a message sealed by a SessionStore, which has a whole
+// OpenPGP message inside
+const SessionEncoding = "x7Rb0qLm2Wzv8KdnT5ea"
+
+// sessionFormatHeader is the armor header of messages sealed in chunks, see util.SealStream. Messages sealed before
+// don't have it and hold their whole ciphertext at once
+const (
+	sessionFormatHeader  = "Format"
+	sessionFormatChunked = "chunked"
+)
+
+const sessionStoreVersion = 2
+
+// sessionStoreExpiringVersion is the first version which keeps when keys were made, so they can expire
+const sessionStoreExpiringVersion = 2
+
+// prekeyRotation is how long Bundle returns the same prekey before it makes a new one
+const prekeyRotation = 7 * 24 * time.Hour
+
+// prekeyGrace is how long a rotated prekey still starts sessions, for contacts who haven't fetched the new bundle
+const prekeyGrace = 30 * 24 * time.Hour
+
+// SessionStore gives messages between contacts forward secrecy. A message to a contact who published a
+// PrekeyBundle is sealed again with keys which are deleted once used, so leaking the identity later
+// doesn't expose the messages kept on IPFS
+type SessionStore interface {
+	// Bundle returns the signed prekey bundle of identity to publish with it. It makes a new prekey the first time
+	// and once the prekey is older than a week, keeping the old one for a grace period of 30 days
+	Bundle(identity *gpg.Entity) (*PrekeyBundle, error)
+	// AddBundle keeps the bundle of contact to start a session with, if it is signed by them
+	AddBundle(contact *gpg.Entity, bundle *PrekeyBundle) error
+	// CanSeal tells if messages to contact can be sealed, which needs their bundle or a session they started
+	CanSeal(contact *gpg.Entity) bool
+	// Seal encrypts an OpenPGP message from identity to contact with the next key of their session as it is
+	// written to the returned writer, which writes the sealed message to w. It is only complete once closed
+	Seal(identity *gpg.Entity, contact *gpg.Entity, w io.Writer) (io.WriteCloser, error)
+	// Open decrypts a sealed message, including our own ones, returning the OpenPGP message in it and the
+	// session it came through. The message is decrypted as it is read, and its key is only used up once it is
+	// read to the end, since only then is all of it authenticated
+	Open(sealed io.Reader) (message io.Reader, session string, err error)
+	// Bind ties a session started by contact to them so replies use it. It does nothing if they didn't start it
+	Bind(session string, contact *gpg.Entity)
+	// Recipient returns the fingerprint of the contact a message we sealed is to, empty if it's unknown.
+	// Only the header of the message is read
+	Recipient(sealed io.Reader) string
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type sessionStore struct {
+	mtx sync.Mutex
+	// prekeys are ours by identity fingerprint
+	prekeys map[string]*prekey
+	// retired are our rotated prekeys by when they were, deleted after prekeyGrace
+	retired map[*prekey]time.Time
+	// bundles are the contacts' by fingerprint
+	bundles  map[string]*PrekeyBundle
+	sessions map[string]*session
+	// bound is the session messages to a contact are sealed with by fingerprint
+	bound map[string]string
+}
+
+func NewSessionStore() SessionStore {
+	return &sessionStore{
+		prekeys:  make(map[string]*prekey),
+		retired:  make(map[*prekey]time.Time),
+		bundles:  make(map[string]*PrekeyBundle),
+		sessions: make(map[string]*session),
+		bound:    make(map[string]string),
+	}
+}
+
+func fingerprint(entity *gpg.Entity) string {
+	return hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])
+}
+
+// IsSealed tells if data is a message sealed by a SessionStore
+func IsSealed(data []byte) bool {
+	decode, err := armor.Decode(bytes.NewBuffer(data))
+	return err == nil && decode.Type == SessionEncoding
+}
+
+func (s *sessionStore) Bundle(identity *gpg.Entity) (*PrekeyBundle, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.expire(time.Now())
+	key, ok := s.prekeys[fingerprint(identity)]
+	if !ok || time.Since(key.created) > prekeyRotation {
+		created, err := newPrekey()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			s.retired[key] = time.Now()
+		}
+		key = created
+		s.prekeys[fingerprint(identity)] = key
+	}
+	return key.bundle(identity)
+}
+
+// expire deletes the prekeys retired more than prekeyGrace ago, the keys of messages we sent older than ownKeyTtl
+// and the other message keys older than messageKeyTtl
+func (s *sessionStore) expire(now time.Time) {
+	for key, retired := range s.retired {
+		if now.Sub(retired) > prekeyGrace {
+			delete(s.retired, key)
+		}
+	}
+	for _, current := range s.sessions {
+		current.own.expire(now.Add(-ownKeyTtl))
+		current.skipped.expire(now.Add(-messageKeyTtl))
+	}
+}
+
+func (s *sessionStore) AddBundle(contact *gpg.Entity, bundle *PrekeyBundle) error {
+	err := bundle.Verify(contact)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	name := fingerprint(contact)
+	if old, ok := s.bundles[name]; ok && !bytes.Equal(old.Prekey, bundle.Prekey) {
+		delete(s.bound, name) // they may have lost their sessions, so the next message starts a new one
+	}
+	s.bundles[name] = bundle
+	return nil
+}
+
+func (s *sessionStore) CanSeal(contact *gpg.Entity) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	name := fingerprint(contact)
+	_, bound := s.bound[name]
+	_, hasBundle := s.bundles[name]
+	return bound || hasBundle
+}
+
+func (s *sessionStore) Seal(identity *gpg.Entity, contact *gpg.Entity, w io.Writer) (io.WriteCloser, error) {
+	header, messageKey, err := s.nextSendingKey(identity, contact)
+	if err != nil {
+		return nil, err
+	}
+	aead, _, err := sessionAead(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	armored, err := armor.Encode(w, SessionEncoding, map[string]string{sessionFormatHeader: sessionFormatChunked})
+	if err != nil {
+		return nil, err
+	}
+	_, err = armored.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedMessage{WriteCloser: util.SealStream(armored, aead, header), armored: armored}, nil
+}
+
+// nextSendingKey returns the header and key of the next message to contact, starting a session if needed
+func (s *sessionStore) nextSendingKey(identity *gpg.Entity, contact *gpg.Entity) ([]byte, []byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.expire(time.Now())
+	name := fingerprint(contact)
+	current, ok := s.sessions[s.bound[name]]
+	if !ok || current.sendingChain == nil {
+		bundle, ok := s.bundles[name]
+		if !ok {
+			return nil, nil, errors.New("contact has no prekey bundle to start a session with")
+		}
+		var err error
+		current, err = startSession(identity, bundle)
+		if err != nil {
+			return nil, nil, err
+		}
+		current.contact = name
+		s.sessions[hex.EncodeToString(current.id)] = current
+		s.bound[name] = hex.EncodeToString(current.id)
+	}
+	return current.nextSendingKey()
+}
+
+// sealedMessage closes the armor around a sealed stream once the stream is closed
+type sealedMessage struct {
+	io.WriteCloser
+	armored io.WriteCloser
+}
+
+func (m *sealedMessage) Close() error {
+	err := m.WriteCloser.Close()
+	if err != nil {
+		return err
+	}
+	return m.armored.Close()
+}
+
+// decodeSealed reads the armor and header of a sealed message, returning the header and the rest of the message
+func decodeSealed(sealed io.Reader) (*sessionHeader, []byte, *armor.Block, error) {
+	decode, err := armor.Decode(sealed)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if decode.Type != SessionEncoding {
+		return nil, nil, nil, errors.New("data not sealed as a session message")
+	}
+	headerBytes := bytes.NewBuffer(make([]byte, 0))
+	header, err := readSessionHeader(io.TeeReader(decode.Body, headerBytes))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return header, headerBytes.Bytes(), decode, nil
+}
+
+func (s *sessionStore) Open(sealed io.Reader) (io.Reader, string, error) {
+	header, headerBytes, decode, err := decodeSealed(sealed)
+	if err != nil {
+		return nil, "", err
+	}
+	id := hex.EncodeToString(header.session)
+	messageKey, err := s.receivingKey(id, header)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, nonce, err := sessionAead(messageKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if decode.Header[sessionFormatHeader] != sessionFormatChunked {
+		ciphertext, err := readLegacyCiphertext(decode.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		message, err := aead.Open(nil, nonce, ciphertext, headerBytes)
+		if err != nil {
+			return nil, "", err
+		}
+		s.commit(id, header, messageKey)
+		return bytes.NewBuffer(message), id, nil
+	}
+	return &openedMessage{
+		Reader: util.OpenStream(decode.Body, aead, headerBytes),
+		commit: func() { s.commit(id, header, messageKey) },
+	}, id, nil
+}
+
+// readLegacyCiphertext reads the ciphertext of a message sealed before they were sealed in chunks
+func readLegacyCiphertext(r io.Reader) ([]byte, error) {
+	size, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(result)) != size {
+		return nil, errors.New("sealed message is corrupt")
+	}
+	return result, nil
+}
+
+// receivingKey returns the key of a message of the session id without using it up
+func (s *sessionStore) receivingKey(id string, header *sessionHeader) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	current, ok := s.sessions[id]
+	if !ok {
+		var err error
+		current, err = s.accept(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	messageKey, _, err := current.receivingKey(header)
+	return messageKey, err
+}
+
+// commit uses up the key of a message once it is decrypted. The session may have moved on while the message was
+// read, so the key is found again and the session only changes if it is still the same key
+func (s *sessionStore) commit(id string, header *sessionHeader, messageKey []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.expire(time.Now())
+	current, ok := s.sessions[id]
+	if !ok {
+		var err error
+		current, err = s.accept(header)
+		if err != nil {
+			return
+		}
+	}
+	key, next, err := current.receivingKey(header)
+	if err != nil || !bytes.Equal(key, messageKey) {
+		return
+	}
+	s.sessions[id] = next
+}
+
+// openedMessage commits its key once it is read to the end, which util.OpenStream only reports once every chunk
+// is authenticated
+type openedMessage struct {
+	io.Reader
+	commit func()
+}
+
+func (m *openedMessage) Read(p []byte) (int, error) {
+	n, err := m.Reader.Read(p)
+	if err == io.EOF && m.commit != nil {
+		m.commit()
+		m.commit = nil
+	}
+	return n, err
+}
+
+// accept starts our side of a session someone started with one of our prekeys
+func (s *sessionStore) accept(header *sessionHeader) (*session, error) {
+	if len(header.init) == 0 {
+		return nil, errors.New("message is from an unknown session")
+	}
+	for _, key := range s.prekeys {
+		if bytes.Equal(key.public, header.init[32:64]) {
+			return acceptSession(header, key)
+		}
+	}
+	for key := range s.retired {
+		if bytes.Equal(key.public, header.init[32:64]) {
+			return acceptSession(header, key)
+		}
+	}
+	return nil, errors.New("message was sealed for a prekey which isn't ours")
+}
+
+func (s *sessionStore) Bind(session string, contact *gpg.Entity) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	current, ok := s.sessions[session]
+	if !ok || len(current.contact) > 0 || !current.startedBy(contact) {
+		return
+	}
+	name := fingerprint(contact)
+	current.contact = name
+	// when both sides start a session at the same time, both keep the one with the smaller id
+	if bound, ok := s.sessions[s.bound[name]]; !ok || bound.sendingChain == nil || strings.Compare(session, s.bound[name]) < 0 {
+		s.bound[name] = session
+	}
+}
+
+func (s *sessionStore) Recipient(sealed io.Reader) string {
+	header, _, _, err := decodeSealed(sealed)
+	if err != nil {
+		return ""
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	current, ok := s.sessions[hex.EncodeToString(header.session)]
+	if !ok {
+		return ""
+	}
+	return current.contact
+}
+
+func NewSessionStoreFromFile(file string, sealer util.Sealer) (SessionStore, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewBuffer(b)
+	version, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if version < 1 || version > sessionStoreVersion {
+		return nil, errors.New("unsupported sessions version")
+	}
+	result := NewSessionStore().(*sessionStore)
+	count, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		name, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		key := &prekey{}
+		key.private, err = util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		key.public, err = util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		created, err := util.ReadInt64(r)
+		if err != nil {
+			return nil, err
+		}
+		key.created = time.Unix(created, 0)
+		key.signature, err = util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(key.signature) == 0 {
+			key.signature = nil
+		}
+		result.prekeys[name] = key
+	}
+	if version >= sessionStoreExpiringVersion {
+		count, err = util.ReadInt64(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < count; i++ {
+			key := &prekey{}
+			key.private, err = util.ReadBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			key.public, err = util.ReadBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			retired, err := util.ReadInt64(r)
+			if err != nil {
+				return nil, err
+			}
+			result.retired[key] = time.Unix(retired, 0)
+		}
+	}
+	count, err = util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		name, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		result.bundles[name], err = parsePrekeyBundle(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	count, err = util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		session, err := readSession(r, version)
+		if err != nil {
+			return nil, err
+		}
+		result.sessions[hex.EncodeToString(session.id)] = session
+	}
+	count, err = util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		name, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		result.bound[name], err = util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *sessionStore) SaveToFile(file string, sealer util.Sealer) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		err := util.WriteInt64(w, sessionStoreVersion)
+		if err != nil {
+			return err
+		}
+		err = util.WriteInt64(w, int64(len(s.prekeys)))
+		if err != nil {
+			return err
+		}
+		for name, key := range s.prekeys {
+			err = util.WriteString(w, name)
+			if err != nil {
+				return err
+			}
+			err = util.WriteBytes(w, key.private)
+			if err != nil {
+				return err
+			}
+			err = util.WriteBytes(w, key.public)
+			if err != nil {
+				return err
+			}
+			err = util.WriteInt64(w, key.created.Unix())
+			if err != nil {
+				return err
+			}
+			err = util.WriteBytes(w, key.signature)
+			if err != nil {
+				return err
+			}
+		}
+		err = util.WriteInt64(w, int64(len(s.retired)))
+		if err != nil {
+			return err
+		}
+		for key, retired := range s.retired {
+			for _, b := range [][]byte{key.private, key.public} {
+				err = util.WriteBytes(w, b)
+				if err != nil {
+					return err
+				}
+			}
+			err = util.WriteInt64(w, retired.Unix())
+			if err != nil {
+				return err
+			}
+		}
+		err = util.WriteInt64(w, int64(len(s.bundles)))
+		if err != nil {
+			return err
+		}
+		for name, bundle := range s.bundles {
+			err = util.WriteString(w, name)
+			if err != nil {
+				return err
+			}
+			err = bundle.serializeContents(w)
+			if err != nil {
+				return err
+			}
+		}
+		err = util.WriteInt64(w, int64(len(s.sessions)))
+		if err != nil {
+			return err
+		}
+		for _, session := range s.sessions {
+			err = session.serialize(w)
+			if err != nil {
+				return err
+			}
+		}
+		err = util.WriteInt64(w, int64(len(s.bound)))
+		if err != nil {
+			return err
+		}
+		for name, session := range s.bound {
+			err = util.WriteString(w, name)
+			if err != nil {
+				return err
+			}
+			err = util.WriteString(w, session)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
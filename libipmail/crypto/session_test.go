@@ -0,0 +1,296 @@
+package crypto
+
+import (
+	"bytes"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/armor"
+	"github.com/Geo25rey/crypto/openpgp/packet"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSessions(t *testing.T) (alice *gpg.Entity, bob *gpg.Entity, aliceSessions SessionStore, bobSessions SessionStore) {
+	for _, entity := range []**gpg.Entity{&alice, &bob} {
+		identity, err := NewSelfIdentity("test", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		*entity = identity.DefaultIdentity()
+	}
+	aliceSessions, bobSessions = NewSessionStore(), NewSessionStore()
+	bundle, err := bobSessions.Bundle(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = aliceSessions.AddBundle(bob, bundle); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func sealTest(t *testing.T, sessions SessionStore, from *gpg.Entity, to *gpg.Entity, message string) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	w, err := sessions.Seal(from, to, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(buf.Bytes()) || bytes.Contains(buf.Bytes(), []byte(message)) {
+		t.Fatalf("Seal() didn't seal %q", message)
+	}
+	return buf.Bytes()
+}
+
+func openSealed(sessions SessionStore, sealed []byte) ([]byte, string, error) {
+	r, session, err := sessions.Open(bytes.NewBuffer(sealed))
+	if err != nil {
+		return nil, "", err
+	}
+	message, err := ioutil.ReadAll(r)
+	return message, session, err
+}
+
+func openTest(t *testing.T, sessions SessionStore, sealed []byte, want string) string {
+	got, session, err := openSealed(sessions, sealed)
+	if err != nil {
+		t.Fatalf("Open() of %q error = %v", want, err)
+	}
+	if string(got) != want {
+		t.Fatalf("Open() = %q, want %q", got, want)
+	}
+	return session
+}
+
+func TestSessionStore(t *testing.T) {
+	alice, bob, aliceSessions, bobSessions := newTestSessions(t)
+	if !aliceSessions.CanSeal(bob) || bobSessions.CanSeal(alice) {
+		t.Fatal("CanSeal() should only be true with a bundle")
+	}
+	first := sealTest(t, aliceSessions, alice, bob, "first")
+	second := sealTest(t, aliceSessions, alice, bob, "second")
+	third := sealTest(t, aliceSessions, alice, bob, "third")
+
+	openTest(t, aliceSessions, second, "second") // our own echo
+	session := openTest(t, bobSessions, third, "third")
+	openTest(t, bobSessions, first, "first")
+	if _, _, err := openSealed(bobSessions, first); err == nil {
+		t.Error("Open() of a replayed message succeeded")
+	}
+	bobSessions.Bind(session, bob)
+	if bobSessions.CanSeal(alice) {
+		t.Fatal("Bind() to someone who didn't start the session succeeded")
+	}
+	bobSessions.Bind(session, alice)
+	if !bobSessions.CanSeal(alice) {
+		t.Fatal("Bind() didn't let replies be sealed")
+	}
+	openTest(t, bobSessions, second, "second")
+
+	reply := sealTest(t, bobSessions, bob, alice, "reply")
+	if got := openTest(t, aliceSessions, reply, "reply"); got != session {
+		t.Errorf("reply came through session %s, want %s", got, session)
+	}
+	dir, err := ioutil.TempDir("", "ipmail-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sessions")
+	if err = aliceSessions.SaveToFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	aliceSessions, err = NewSessionStoreFromFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"fourth", "fifth"} {
+		openTest(t, bobSessions, sealTest(t, aliceSessions, alice, bob, message), message)
+	}
+	openTest(t, aliceSessions, sealTest(t, bobSessions, bob, alice, "sixth"), "sixth")
+}
+
+func TestSessionStore_streamed(t *testing.T) {
+	alice, bob, aliceSessions, bobSessions := newTestSessions(t)
+	big := strings.Repeat("a long message ", 10000) // more than one chunk
+	sealed := sealTest(t, aliceSessions, alice, bob, big)
+	if got := bobSessions.Recipient(bytes.NewBuffer(sealed)); got != "" {
+		t.Errorf("Recipient() = %q for a message we didn't seal, want none", got)
+	}
+	if got := aliceSessions.Recipient(bytes.NewBuffer(sealed)); got != fingerprint(bob) {
+		t.Errorf("Recipient() = %q, want %q", got, fingerprint(bob))
+	}
+
+	if _, _, err := openSealed(bobSessions, sealed[:len(sealed)/2]); err == nil {
+		t.Error("Open() of a truncated message succeeded")
+	}
+	r, _, err := bobSessions.Open(bytes.NewBuffer(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	openTest(t, bobSessions, sealed, big) // the key is only used up once a message is read to the end
+	if _, _, err := openSealed(bobSessions, sealed); err == nil {
+		t.Error("Open() of a replayed message succeeded")
+	}
+}
+
+func TestSessionStore_legacy(t *testing.T) {
+	alice, bob, aliceSessions, bobSessions := newTestSessions(t)
+	header, messageKey, err := aliceSessions.(*sessionStore).nextSendingKey(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, nonce, err := sessionAead(messageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	w, err := armor.Encode(buf, SessionEncoding, make(map[string]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write(header)
+	_ = util.WriteBytes(w, aead.Seal(nil, nonce, []byte("sealed whole"), header))
+	_ = w.Close()
+	openTest(t, bobSessions, buf.Bytes(), "sealed whole")
+}
+
+func TestSessionStore_expire(t *testing.T) {
+	alice, bob, aliceSessions, bobSessions := newTestSessions(t)
+	old, err := bobSessions.Bundle(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := bobSessions.(*sessionStore)
+	store.prekeys[fingerprint(bob)].created = time.Now().Add(-prekeyRotation - time.Hour)
+	rotated, err := bobSessions.Bundle(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rotated.Prekey, old.Prekey) || rotated.Verify(bob) != nil {
+		t.Fatal("Bundle() didn't rotate a prekey older than a week")
+	}
+	// alice still has the old bundle, which works during the grace period
+	toOld := sealTest(t, aliceSessions, alice, bob, "to the old prekey")
+	openTest(t, bobSessions, toOld, "to the old prekey")
+
+	carol, _, carolSessions, _ := newTestSessions(t)
+	if err = carolSessions.AddBundle(bob, old); err != nil {
+		t.Fatal(err)
+	}
+	for key := range store.retired {
+		store.retired[key] = time.Now().Add(-prekeyGrace - time.Hour)
+	}
+	if _, err = bobSessions.Bundle(bob); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.retired) != 0 {
+		t.Errorf("Bundle() kept %d prekeys past their grace period", len(store.retired))
+	}
+	late := sealTest(t, carolSessions, carol, bob, "too late")
+	if _, _, err = openSealed(bobSessions, late); err == nil {
+		t.Error("Open() of a message to a deleted prekey succeeded")
+	}
+
+	unechoed := sealTest(t, aliceSessions, alice, bob, "never echoed")
+	for _, current := range aliceSessions.(*sessionStore).sessions {
+		for name := range current.own.added {
+			current.own.added[name] = time.Now().Add(-ownKeyTtl - time.Minute) // long before messageKeyTtl
+		}
+	}
+	sealTest(t, aliceSessions, alice, bob, "expires the old keys")
+	if _, _, err = openSealed(aliceSessions, unechoed); err == nil {
+		t.Error("Open() of our own message with an expired key succeeded")
+	}
+
+	dir, err := ioutil.TempDir("", "ipmail-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sessions")
+	store.retired[&prekey{private: []byte("private"), public: []byte("public")}] = time.Now().Round(time.Second)
+	if err = bobSessions.SaveToFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewSessionStoreFromFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.(*sessionStore).retired; len(got) != 1 {
+		t.Errorf("NewSessionStoreFromFile() read %d retired prekeys, want 1", len(got))
+	}
+}
+
+func TestSessionStore_concurrentStart(t *testing.T) {
+	alice, bob, aliceSessions, bobSessions := newTestSessions(t)
+	bundle, err := aliceSessions.Bundle(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bobSessions.AddBundle(alice, bundle); err != nil {
+		t.Fatal(err)
+	}
+	fromAlice := sealTest(t, aliceSessions, alice, bob, "from alice")
+	fromBob := sealTest(t, bobSessions, bob, alice, "from bob")
+	aliceSessions.Bind(openTest(t, aliceSessions, fromBob, "from bob"), bob)
+	bobSessions.Bind(openTest(t, bobSessions, fromAlice, "from alice"), alice)
+
+	openTest(t, bobSessions, sealTest(t, aliceSessions, alice, bob, "again from alice"), "again from alice")
+	openTest(t, aliceSessions, sealTest(t, bobSessions, bob, alice, "again from bob"), "again from bob")
+}
+
+func TestSessionStore_AddBundle(t *testing.T) {
+	alice, bob, aliceSessions, _ := newTestSessions(t)
+	bundle, err := aliceSessions.Bundle(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = aliceSessions.AddBundle(bob, bundle); err == nil {
+		t.Error("AddBundle() with a bundle signed by someone else succeeded")
+	}
+}
+
+func TestReadPrekeyBundle(t *testing.T) {
+	alice, _, aliceSessions, _ := newTestSessions(t)
+	bundle, err := aliceSessions.Bundle(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := aliceSessions.Bundle(alice); err != nil || !bytes.Equal(again.Signature, bundle.Signature) {
+		t.Error("Bundle() signed the prekey again, which changes the published identity")
+	}
+	published := bytes.NewBuffer(make([]byte, 0))
+	if err = alice.Serialize(published); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadPrekeyBundle(bytes.NewBuffer(published.Bytes())); err != ErrNoPrekeyBundle {
+		t.Errorf("ReadPrekeyBundle() without a bundle error = %v, want %v", err, ErrNoPrekeyBundle)
+	}
+	if err = bundle.Serialize(published); err != nil {
+		t.Fatal(err)
+	}
+	entity, err := gpg.ReadEntity(packet.NewReader(bytes.NewBuffer(published.Bytes())))
+	if err != nil {
+		t.Fatalf("ReadEntity() with a bundle error = %v", err)
+	}
+	got, err := ReadPrekeyBundle(bytes.NewBuffer(published.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = got.Verify(entity); err != nil || !bytes.Equal(got.Prekey, bundle.Prekey) {
+		t.Errorf("ReadPrekeyBundle() = %v, %v, want the published bundle", got, err)
+	}
+}
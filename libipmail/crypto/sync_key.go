@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"ipmail/libipmail/util"
+)
+
+// syncKeySize is the size of an AES-256 key
+const syncKeySize = 32
+
+// SyncKey encrypts the log the devices of one account sync through. Every linked device has the same key
+type SyncKey []byte
+
+func NewSyncKey() (SyncKey, error) {
+	result := make(SyncKey, syncKeySize)
+	_, err := rand.Read(result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Seal encrypts and authenticates plaintext with the key
+func (k SyncKey) Seal(plaintext []byte) ([]byte, error) {
+	if len(k) != syncKeySize {
+		return nil, errors.New("sync key has the wrong size")
+	}
+	aead, err := newAead(k)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, plaintext)
+}
+
+// Open decrypts what Seal encrypted with the same key
+func (k SyncKey) Open(sealed []byte) ([]byte, error) {
+	if len(k) != syncKeySize {
+		return nil, errors.New("sync key has the wrong size")
+	}
+	aead, err := newAead(k)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, sealed)
+}
+
+// SealStream is Seal for what is too big to hold in memory, like a synced message. Each stream is encrypted with a
+// new key, which is written sealed with k in front of it. Close writes the end of the stream
+func (k SyncKey) SealStream(w io.Writer) (io.WriteCloser, error) {
+	key := make([]byte, syncKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	sealedKey, err := k.Seal(key)
+	if err != nil {
+		return nil, err
+	}
+	err = util.WriteBytes(w, sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	return util.SealStream(w, aead, nil), nil
+}
+
+// OpenStream decrypts what SealStream encrypted with the same key, failing on a read if the stream was changed
+func (k SyncKey) OpenStream(r io.Reader) (io.Reader, error) {
+	sealedKey, err := util.ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := k.Open(sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	return util.OpenStream(r, aead, nil), nil
+}
+
+// Topic is the pubsub topic the devices with the key announce the newest entries of their log on. It is
+// derived from the key so it doesn't give the key away
+func (k SyncKey) Topic() string {
+	hash := sha256.Sum256(append([]byte("ipmail sync topic "), k...))
+	return "ipmail-sync-" + hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,244 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"github.com/Geo25rey/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"sync"
+)
+
+// Vault keeps the key local files are sealed with. The key is random and stored encrypted with a key derived
+// from the passphrase of the local files, so changing it doesn't have to seal every file again. The identity has
+// no passphrase of its own, its private keys are kept safe by being in one of the files the vault seals
+type Vault interface {
+	util.Sealer
+	Locked() bool
+	// Unlock decrypts the key with passphrase, failing with ErrWrongPassphrase if it isn't the vault's
+	Unlock(passphrase []byte) error
+	// ChangePassphrase encrypts the key with a new passphrase. The vault must be unlocked
+	ChangePassphrase(passphrase []byte) error
+	SaveToFile(file string) error
+}
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// vaultVersion starts the vault file so the key derivation can change later
+const vaultVersion = 1
+
+const vaultKeySize = 32
+
+// the scrypt parameters recommended for interactive logins
+const (
+	vaultScryptN = 1 << 15
+	vaultScryptR = 8
+	vaultScryptP = 1
+)
+
+// the bounds of the scrypt parameters read from a vault file, so a changed one can neither weaken the key
+// derivation much nor make unlocking use up the memory and time of the computer
+const (
+	minVaultScryptN      = 1 << 14
+	maxVaultScryptMemory = 256 << 20 // scrypt uses 128 * n * r bytes
+	maxVaultScryptP      = 16
+)
+
+func checkScryptParams(n, r, p int64) error {
+	err := errors.New("vault key derivation parameters are out of bounds")
+	if n < minVaultScryptN || n > maxVaultScryptMemory/128 || n&(n-1) != 0 {
+		return err
+	}
+	if r < 1 || r > maxVaultScryptMemory/(128*n) || p < 1 || p > maxVaultScryptP {
+		return err
+	}
+	return nil
+}
+
+type vault struct {
+	mtx        sync.RWMutex
+	n, r, p    int64
+	salt       []byte
+	wrappedKey []byte
+	key        []byte      // nil while locked
+	aead       cipher.AEAD // seals with key
+}
+
+// NewVault makes an unlocked vault with a new key for passphrase
+func NewVault(passphrase []byte) (Vault, error) {
+	key := make([]byte, vaultKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	result := &vault{key: key}
+	err = result.wrap(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	result.aead, err = newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// NewVaultFromFile reads a locked vault, which is nil if file is not found
+func NewVaultFromFile(file string) (Vault, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewBuffer(b)
+	version, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != vaultVersion {
+		return nil, errors.New("unsupported vault version")
+	}
+	result := &vault{}
+	for _, param := range []*int64{&result.n, &result.r, &result.p} {
+		*param, err = util.ReadInt64(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = checkScryptParams(result.n, result.r, result.p)
+	if err != nil {
+		return nil, err
+	}
+	result.salt, err = util.ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	result.wrappedKey, err = util.ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+}
+
+// passphraseAead derives the key which encrypts the vault's key
+func (v *vault) passphraseAead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, v.salt, int(v.n), int(v.r), int(v.p), vaultKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newAead(key)
+}
+
+// wrap encrypts the key with passphrase and a new salt
+func (v *vault) wrap(passphrase []byte) error {
+	v.n, v.r, v.p = vaultScryptN, vaultScryptR, vaultScryptP
+	v.salt = make([]byte, 32)
+	_, err := rand.Read(v.salt)
+	if err != nil {
+		return err
+	}
+	aead, err := v.passphraseAead(passphrase)
+	if err != nil {
+		return err
+	}
+	v.wrappedKey, err = seal(aead, v.key)
+	return err
+}
+
+func (v *vault) Locked() bool {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	return v.key == nil
+}
+
+func (v *vault) Unlock(passphrase []byte) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	aead, err := v.passphraseAead(passphrase)
+	if err != nil {
+		return err
+	}
+	key, err := open(aead, v.wrappedKey)
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	v.aead, err = newAead(key)
+	if err != nil {
+		return err
+	}
+	v.key = key
+	return nil
+}
+
+func (v *vault) ChangePassphrase(passphrase []byte) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if v.key == nil {
+		return util.ErrLocked
+	}
+	return v.wrap(passphrase)
+}
+
+func (v *vault) Seal(plaintext []byte) ([]byte, error) {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	if v.key == nil {
+		return nil, util.ErrLocked
+	}
+	return seal(v.aead, plaintext)
+}
+
+func (v *vault) Open(sealed []byte) ([]byte, error) {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	if v.key == nil {
+		return nil, util.ErrLocked
+	}
+	return open(v.aead, sealed)
+}
+
+func (v *vault) SaveToFile(file string) error {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	return util.WriteFileAtomic(file, func(w io.Writer) error {
+		for _, val := range []int64{vaultVersion, v.n, v.r, v.p} {
+			err := util.WriteInt64(w, val)
+			if err != nil {
+				return err
+			}
+		}
+		err := util.WriteBytes(w, v.salt)
+		if err != nil {
+			return err
+		}
+		return util.WriteBytes(w, v.wrappedKey)
+	})
+}
@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "vault")
+	created, err := NewVault([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := created.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = created.SaveToFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if err = created.ChangePassphrase([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	changed := filepath.Join(dir, "changed")
+	if err = created.SaveToFile(changed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		passphrase string
+		wantErr    error
+	}{
+		{"Right Passphrase", file, "first", nil},
+		{"Wrong Passphrase", file, "second", ErrWrongPassphrase},
+		{"Changed Passphrase", changed, "second", nil},
+		{"Old Passphrase", changed, "first", ErrWrongPassphrase},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewVaultFromFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !v.Locked() {
+				t.Fatal("a vault read from a file isn't locked")
+			}
+			if _, err := v.Open(sealed); err != util.ErrLocked {
+				t.Errorf("Open() while locked error = %v, want %v", err, util.ErrLocked)
+			}
+			err = v.Unlock([]byte(tt.passphrase))
+			if err != tt.wantErr {
+				t.Fatalf("Unlock() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := v.Open(sealed)
+			if err != nil || string(got) != "secret" {
+				t.Errorf("Open() = %q, %v, want \"secret\"", got, err)
+			}
+		})
+	}
+}
+
+func TestSelfIdentity_sealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "identity")
+	v, err := NewVault([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := &selfIdentity{identities: NewIdentityList(entity1), defaultIdentity: entity1}
+	if err = self.SaveToFile(file, v); err != nil {
+		t.Fatal(err)
+	}
+	if !util.IsSealedFile(file) {
+		t.Fatal("the identity was saved in plaintext")
+	}
+	if got := NewSelfIdentityFromFile(file, v); got == nil || got.DefaultIdentity().PrimaryKey.KeyId != entity1.PrimaryKey.KeyId {
+		t.Errorf("NewSelfIdentityFromFile() = %v, want the saved identity", got)
+	}
+	if got := NewSelfIdentityFromFile(file, nil); got != nil {
+		t.Error("NewSelfIdentityFromFile() read a sealed identity while locked")
+	}
+}
+
+func TestNewVaultFromFile_scryptParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "vault")
+	tests := []struct {
+		name    string
+		n, r, p int64
+		wantErr bool
+	}{
+		{"Default", vaultScryptN, vaultScryptR, vaultScryptP, false},
+		{"Largest", maxVaultScryptMemory / 128 / 8, 8, maxVaultScryptP, false},
+		{"Weak", 1 << 10, vaultScryptR, vaultScryptP, true},
+		{"Not A Power Of Two", vaultScryptN + 1, vaultScryptR, vaultScryptP, true},
+		{"Too Much Memory", vaultScryptN, 1 << 20, vaultScryptP, true},
+		{"Overflowing", 1 << 62, vaultScryptR, vaultScryptP, true},
+		{"No Block Size", vaultScryptN, 0, vaultScryptP, true},
+		{"Too Parallel", vaultScryptN, vaultScryptR, 1 << 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := util.WriteFileAtomic(file, func(w io.Writer) error {
+				for _, val := range []int64{vaultVersion, tt.n, tt.r, tt.p} {
+					if err := util.WriteInt64(w, val); err != nil {
+						return err
+					}
+				}
+				if err := util.WriteBytes(w, make([]byte, 32)); err != nil {
+					return err
+				}
+				return util.WriteBytes(w, make([]byte, 60))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = NewVaultFromFile(file); (err != nil) != tt.wantErr {
+				t.Errorf("NewVaultFromFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+)
+
+// ShareDeviceKey adds the public key of device to ipfs and returns the ipmail: link to show the device already
+// using your account, which links this one with Mailbox.LinkDevice
+func ShareDeviceKey(ipfs Transport, device *gpg.Entity) (string, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err := device.Serialize(buf)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := ipfs.AddFromReader(buf)
+	if err != nil {
+		return "", err
+	}
+	return crypto.NewIdentityUri(resolved.Cid(), device).String(), nil
+}
+
+// FetchDeviceKey fetches the key of a new device from the ipmail: link ShareDeviceKey made on it, checking it has
+// the fingerprint in the link. Have the user compare the fingerprint with the one the device shows before
+// Mailbox.LinkDevice sends it your identity
+func FetchDeviceKey(ctx context.Context, ipfs util.Cat, link string) (*gpg.Entity, error) {
+	uri, err := crypto.ParseIdentityUri(strings.TrimSpace(link))
+	if err != nil {
+		return nil, err
+	}
+	device, _, err := uri.Fetch(ctx, ipfs)
+	if err != nil {
+		return nil, err
+	}
+	if !crypto.IsDeviceKey(device) {
+		return nil, errors.New("the link is to the identity of someone, not to a device")
+	}
+	return device, nil
+}
+
+// WaitForDeviceLink waits for a link sealed to device to be announced to receiver, returning it once it is
+// opened or an error when ctx is done. Check that the identity in it is your account before using it
+func WaitForDeviceLink(ctx context.Context, receiver Receiver, ipfs util.Cat, device *gpg.Entity) (*crypto.DeviceLink, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	links := make(chan *crypto.DeviceLink, 1)
+	receiver.OnMessage(ctx, func(message iface.PubSubMessage) {
+		c, ok := ParseAnnouncement(message)
+		if !ok {
+			return
+		}
+		b, err := util.CatWithContext(ctx, ipfs, path.IpfsPath(c))
+		if err != nil {
+			return
+		}
+		link, err := crypto.OpenDeviceLink(bytes.NewBuffer(b), device)
+		if err != nil {
+			return // mail for someone else
+		}
+		select {
+		case links <- link:
+		default:
+		}
+	}, true)
+	select {
+	case link := <-links:
+		return link, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
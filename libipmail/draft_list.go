@@ -0,0 +1,262 @@
+package ipmail
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DraftEncoding = "kd82nvQpa01mzXbe7Ut"
+
+type Draft struct {
+	Id       uint64
+	To       []string
+	Subject  string
+	Body     string
+	Modified time.Time
+}
+
+// Content returns the draft formatted the same way as messages written in the composer
+func (d *Draft) Content() io.Reader {
+	return bytes.NewBufferString("subject:" + d.Subject + "\n" + d.Body)
+}
+
+func (d *Draft) String() string {
+	subject := d.Subject
+	if len(subject) == 0 {
+		subject = "(no subject)"
+	}
+	return "ID: " + strconv.FormatUint(d.Id, 10) + " To: " + strings.Join(d.To, ", ") + " Subject: " + subject
+}
+
+func (d *Draft) copy() *Draft {
+	result := *d
+	result.To = append(make([]string, 0, len(d.To)), d.To...)
+	return &result
+}
+
+func (d *Draft) serialize(w io.Writer) error {
+	err := util.WriteUint64(w, d.Id)
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(w, d.Modified.UnixNano())
+	if err != nil {
+		return err
+	}
+	err = util.WriteString(w, strings.Join(d.To, "\n"))
+	if err != nil {
+		return err
+	}
+	err = util.WriteString(w, d.Subject)
+	if err != nil {
+		return err
+	}
+	return util.WriteString(w, d.Body)
+}
+
+func readDraft(r io.Reader) (*Draft, error) {
+	result := Draft{}
+	var err error
+	result.Id, err = util.ReadUint64(r)
+	if err != nil {
+		return nil, err
+	}
+	modified, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Modified = time.Unix(0, modified)
+	to, err := util.ReadString(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(to) > 0 {
+		result.To = strings.Split(to, "\n")
+	}
+	result.Subject, err = util.ReadString(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Body, err = util.ReadString(r)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type DraftList interface {
+	// New creates an empty draft with a unique id and adds it to the list
+	New() *Draft
+	// Update replaces the stored draft with the same id and marks it as modified
+	Update(draft *Draft)
+	Remove(id uint64)
+	ForEach(do func(draft *Draft))
+	FromId(id uint64) *Draft
+	FromIndex(idx int) *Draft
+	Len() int
+	SaveToFile(file string, sealer util.Sealer, identity crypto.SelfIdentity) error
+}
+
+type draftList struct {
+	mtx    sync.Mutex
+	list   *list.List
+	nextId uint64
+}
+
+func NewDraftList() DraftList {
+	result := draftList{
+		mtx:    sync.Mutex{},
+		list:   list.New(),
+		nextId: 1,
+	}
+	return &result
+}
+
+func NewDraftListFromFile(file string, sealer util.Sealer, identity crypto.SelfIdentity) DraftList {
+	if identity == nil {
+		return nil
+	}
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil
+	}
+	decrypted, err := crypto.DecryptFromSelf(bytes.NewBuffer(b), DraftEncoding, identity)
+	if err != nil {
+		return nil
+	}
+	buf, err := ioutil.ReadAll(decrypted)
+	if err != nil {
+		return nil
+	}
+	result := NewDraftList().(*draftList)
+	buffer := bytes.NewBuffer(buf)
+	for buffer.Len() > 0 {
+		draft, err := readDraft(buffer)
+		if err != nil {
+			return nil
+		}
+		result.list.PushBack(draft)
+		if draft.Id >= result.nextId {
+			result.nextId = draft.Id + 1
+		}
+	}
+	return result
+}
+
+func (d *draftList) New() *Draft {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	draft := &Draft{
+		Id:       d.nextId,
+		Modified: time.Now(),
+	}
+	d.nextId++
+	d.list.PushBack(draft)
+	return draft.copy()
+}
+
+func (d *draftList) Update(draft *Draft) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	updated := draft.copy()
+	updated.Modified = time.Now()
+	for elm := d.list.Front(); elm != nil; elm = elm.Next() {
+		if elm.Value.(*Draft).Id == draft.Id {
+			elm.Value = updated
+			return
+		}
+	}
+	d.list.PushBack(updated)
+	if updated.Id >= d.nextId {
+		d.nextId = updated.Id + 1
+	}
+}
+
+func (d *draftList) Remove(id uint64) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for elm := d.list.Front(); elm != nil; elm = elm.Next() {
+		if elm.Value.(*Draft).Id == id {
+			d.list.Remove(elm)
+			break
+		}
+	}
+}
+
+func (d *draftList) ForEach(do func(draft *Draft)) {
+	d.mtx.Lock()
+	drafts := make([]*Draft, 0, d.list.Len())
+	for elm := d.list.Front(); elm != nil; elm = elm.Next() {
+		drafts = append(drafts, elm.Value.(*Draft).copy())
+	}
+	d.mtx.Unlock()
+	for _, draft := range drafts {
+		do(draft)
+	}
+}
+
+func (d *draftList) FromId(id uint64) *Draft {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for elm := d.list.Front(); elm != nil; elm = elm.Next() {
+		draft := elm.Value.(*Draft)
+		if draft.Id == id {
+			return draft.copy()
+		}
+	}
+	return nil
+}
+
+func (d *draftList) FromIndex(idx int) *Draft {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for i, elm := 0, d.list.Front(); elm != nil; i, elm = i+1, elm.Next() {
+		if i == idx {
+			return elm.Value.(*Draft).copy()
+		}
+	}
+	return nil
+}
+
+func (d *draftList) Len() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.list.Len()
+}
+
+func (d *draftList) SaveToFile(file string, sealer util.Sealer, identity crypto.SelfIdentity) error {
+	if identity == nil {
+		return errors.New("drafts can't be saved without an identity")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	var err error
+	d.ForEach(func(draft *Draft) {
+		if err != nil {
+			return
+		}
+		err = draft.serialize(buf)
+	})
+	if err != nil {
+		return err
+	}
+	return util.WriteSealedFile(file, sealer, func(f io.Writer) error {
+		w, err := crypto.EncryptToSelf(f, DraftEncoding, identity)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, buf)
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
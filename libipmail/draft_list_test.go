@@ -0,0 +1,79 @@
+package ipmail
+
+import (
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDraftList(t *testing.T) {
+	drafts := NewDraftList()
+	first, second := drafts.New(), drafts.New()
+	if first.Id == second.Id {
+		t.Fatalf("New() gave both drafts id %d", first.Id)
+	}
+	first.Subject = "changed"
+	if got := drafts.FromId(first.Id); got.Subject != "" {
+		t.Errorf("FromId() = %q, want the change kept out of the list until Update()", got.Subject)
+	}
+	drafts.Update(first)
+	if got := drafts.FromId(first.Id); got.Subject != "changed" || !got.Modified.After(second.Modified) {
+		t.Errorf("FromId() = %+v, want the updated draft", got)
+	}
+	drafts.Remove(first.Id)
+	if drafts.Len() != 1 || drafts.FromIndex(0).Id != second.Id || drafts.FromId(first.Id) != nil {
+		t.Errorf("Remove() left %d drafts", drafts.Len())
+	}
+	if third := drafts.New(); third.Id <= second.Id {
+		t.Errorf("New() = id %d, want a new one after %d", third.Id, second.Id)
+	}
+}
+
+func TestDraftList_persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-drafts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "drafts")
+	identity, err := crypto.NewSelfIdentity("self", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drafts := NewDraftList()
+	draft := drafts.New()
+	draft.To = []string{"alice", "bob"}
+	draft.Subject = "plans"
+	draft.Body = "see you\non friday"
+	drafts.Update(draft)
+	drafts.New() // empty
+	if err := drafts.SaveToFile(file, nil, identity); err != nil {
+		t.Fatalf("SaveToFile() error = %v", err)
+	}
+
+	got := NewDraftListFromFile(file, nil, identity)
+	if got == nil || got.Len() != 2 {
+		t.Fatalf("NewDraftListFromFile() = %v, want 2 drafts", got)
+	}
+	saved := drafts.FromId(draft.Id)
+	loaded := got.FromId(draft.Id)
+	if loaded == nil || !reflect.DeepEqual(loaded.To, saved.To) || loaded.Subject != saved.Subject ||
+		loaded.Body != saved.Body || !loaded.Modified.Equal(saved.Modified) {
+		t.Errorf("FromId() = %+v, want %+v", loaded, saved)
+	}
+	if empty := got.FromIndex(1); len(empty.To) != 0 || empty.Subject != "" || empty.Body != "" {
+		t.Errorf("FromIndex(1) = %+v, want the empty draft", empty)
+	}
+	if next := got.New(); next.Id <= drafts.FromIndex(1).Id {
+		t.Errorf("New() = id %d, want ids after the loaded drafts", next.Id)
+	}
+
+	other, _ := crypto.NewSelfIdentity("other", "", "")
+	if NewDraftListFromFile(file, nil, other) != nil {
+		t.Error("NewDraftListFromFile() opened drafts saved by another identity")
+	}
+}
@@ -0,0 +1,133 @@
+package ipmail
+
+import (
+	"context"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"ipmail/libipmail/crypto"
+	"sync"
+)
+
+type EventType int
+
+const (
+	// MessageReceived is a message from one of your contacts
+	MessageReceived EventType = iota
+	// ContactRequest is a message from someone who isn't in your contacts yet
+	ContactRequest
+	// SentEcho is a message you sent coming back to you through pubsub
+	SentEcho
+	// DecryptFailed is an announced message which could not be decrypted, usually because it isn't for you
+	DecryptFailed
+	// ContactAccepted is someone accepting a contact request, which makes them a contact if you sent it to them
+	ContactAccepted
+	// ContactDeclined is someone declining a contact request
+	ContactDeclined
+)
+
+func (t EventType) String() string {
+	switch t {
+	case MessageReceived:
+		return "MessageReceived"
+	case ContactRequest:
+		return "ContactRequest"
+	case SentEcho:
+		return "SentEcho"
+	case DecryptFailed:
+		return "DecryptFailed"
+	case ContactAccepted:
+		return "ContactAccepted"
+	case ContactDeclined:
+		return "ContactDeclined"
+	}
+	return "Unknown"
+}
+
+type Event struct {
+	Type   EventType
+	Cid    cid.Cid
+	Origin peer.ID
+	// Message is nil for DecryptFailed events
+	Message crypto.Message
+	// Err is why a DecryptFailed event could not be decrypted
+	Err error
+}
+
+type EventHandler func(event Event)
+
+// EventBus delivers Events to any number of subscribers in the order they subscribed
+type EventBus interface {
+	// Subscribe calls handler for every published event of one of types, or of every type if none are given,
+	// until ctx is done or the returned function is called
+	Subscribe(ctx context.Context, handler EventHandler, types ...EventType) (unsubscribe func())
+	Publish(event Event)
+}
+
+type subscriber struct {
+	handler EventHandler
+	types   []EventType
+}
+
+func (s *subscriber) wants(t EventType) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, want := range s.types {
+		if want == t {
+			return true
+		}
+	}
+	return false
+}
+
+type eventBus struct {
+	mtx         sync.Mutex
+	subscribers []*subscriber
+}
+
+func NewEventBus() EventBus {
+	return &eventBus{
+		subscribers: make([]*subscriber, 0),
+	}
+}
+
+func (b *eventBus) Subscribe(ctx context.Context, handler EventHandler, types ...EventType) func() {
+	s := &subscriber{handler, types}
+	b.mtx.Lock()
+	b.subscribers = append(b.subscribers, s)
+	b.mtx.Unlock()
+	stop := make(chan struct{})
+	once := sync.Once{}
+	unsubscribe := func() {
+		once.Do(func() {
+			close(stop)
+			b.mtx.Lock()
+			defer b.mtx.Unlock()
+			for i, compare := range b.subscribers {
+				if compare == s {
+					b.subscribers = append(b.subscribers[:i:i], b.subscribers[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			unsubscribe()
+		case <-stop:
+		}
+	}()
+	return unsubscribe
+}
+
+func (b *eventBus) Publish(event Event) {
+	b.mtx.Lock()
+	subscribers := append(make([]*subscriber, 0, len(b.subscribers)), b.subscribers...)
+	b.mtx.Unlock()
+	for _, s := range subscribers {
+		if s.wants(event.Type) {
+			s.handler(event)
+		}
+	}
+}
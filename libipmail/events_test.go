@@ -0,0 +1,64 @@
+package ipmail
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	tests := []struct {
+		name  string
+		types []EventType
+		want  []EventType
+	}{
+		{"Every Type", nil, []EventType{MessageReceived, SentEcho, DecryptFailed}},
+		{"Filtered", []EventType{SentEcho, DecryptFailed}, []EventType{SentEcho, DecryptFailed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewEventBus()
+			got := make([]EventType, 0)
+			bus.Subscribe(context.Background(), func(event Event) {
+				got = append(got, event.Type)
+			}, tt.types...)
+			for _, eventType := range []EventType{MessageReceived, SentEcho, DecryptFailed} {
+				bus.Publish(Event{Type: eventType})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventBus_unsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	byContext := 0
+	byFunction := 0
+	bus.Subscribe(ctx, func(event Event) { byContext++ })
+	unsubscribe := bus.Subscribe(context.Background(), func(event Event) { byFunction++ })
+	bus.Publish(Event{})
+	cancel()
+	unsubscribe()
+	unsubscribe()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bus.(*eventBus).mtx.Lock()
+		remaining := len(bus.(*eventBus).subscribers)
+		bus.(*eventBus).mtx.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers left after unsubscribing", remaining)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bus.Publish(Event{})
+	if byContext != 1 || byFunction != 1 {
+		t.Errorf("handlers called %d and %d times, want 1 each", byContext, byFunction)
+	}
+}
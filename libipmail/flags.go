@@ -0,0 +1,202 @@
+package ipmail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MessageFlag is a set of states a message can be in, combined with |
+type MessageFlag uint64
+
+const (
+	FlagSeen MessageFlag = 1 << iota
+	FlagStarred
+	FlagAnswered
+	FlagForwarded
+)
+
+var flagNames = []struct {
+	flag MessageFlag
+	name string
+	mark string
+}{
+	{FlagSeen, "seen", ""},
+	{FlagStarred, "starred", "*"},
+	{FlagAnswered, "answered", "A"},
+	{FlagForwarded, "forwarded", "F"},
+}
+
+// ParseMessageFlag returns the flag called name, where "read" is accepted for seen and "star" for starred
+func ParseMessageFlag(name string) (MessageFlag, error) {
+	switch strings.ToLower(name) {
+	case "read":
+		return FlagSeen, nil
+	case "star":
+		return FlagStarred, nil
+	}
+	for _, f := range flagNames {
+		if strings.EqualFold(f.name, name) {
+			return f.flag, nil
+		}
+	}
+	return 0, errors.New("there is no flag named \"" + name + "\"")
+}
+
+func (f MessageFlag) String() string {
+	result := make([]string, 0)
+	for _, name := range flagNames {
+		if f&name.flag != 0 {
+			result = append(result, name.name)
+		}
+	}
+	return strings.Join(result, ",")
+}
+
+// Marks returns a short summary of f for message listings, such as "N*" for an unread starred message
+func (f MessageFlag) Marks() string {
+	result := ""
+	if f&FlagSeen == 0 {
+		result += "N"
+	}
+	for _, name := range flagNames {
+		if f&name.flag != 0 {
+			result += name.mark
+		}
+	}
+	return result
+}
+
+// MessageFlags keeps track of the flags set on each message, identified by MessageKey
+type MessageFlags interface {
+	Flags(key string) MessageFlag
+	Has(key string, flag MessageFlag) bool
+	Set(key string, flag MessageFlag)
+	Clear(key string, flag MessageFlag)
+	// Forget drops the flags of a message once it has been permanently deleted
+	Forget(key string)
+	// Rekey moves the flags stored under old to new, unless new already has flags
+	Rekey(old string, new string)
+	// Unseen counts the messages in list which have not been seen
+	Unseen(list MessageList) int
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type messageFlags struct {
+	mtx   sync.Mutex
+	flags map[string]MessageFlag
+}
+
+func NewMessageFlags() MessageFlags {
+	return &messageFlags{
+		flags: make(map[string]MessageFlag),
+	}
+}
+
+func NewMessageFlagsFromFile(file string, sealer util.Sealer) (MessageFlags, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := NewMessageFlags().(*messageFlags)
+	r := bytes.NewBuffer(b)
+	for r.Len() > 0 {
+		key, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := util.ReadUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		result.flags[key] = MessageFlag(flags)
+	}
+	return result, nil
+}
+
+func (m *messageFlags) SaveToFile(file string, sealer util.Sealer) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	keys := make([]string, 0, len(m.flags))
+	for key := range m.flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		for _, key := range keys {
+			err := util.WriteString(w, key)
+			if err != nil {
+				return err
+			}
+			err = util.WriteUint64(w, uint64(m.flags[key]))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *messageFlags) Flags(key string) MessageFlag {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.flags[key]
+}
+
+func (m *messageFlags) Has(key string, flag MessageFlag) bool {
+	return m.Flags(key)&flag == flag
+}
+
+func (m *messageFlags) Set(key string, flag MessageFlag) {
+	m.mtx.Lock()
+	m.flags[key] |= flag
+	m.mtx.Unlock()
+}
+
+func (m *messageFlags) Clear(key string, flag MessageFlag) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.flags[key] &^= flag
+	if m.flags[key] == 0 {
+		delete(m.flags, key)
+	}
+}
+
+func (m *messageFlags) Forget(key string) {
+	m.mtx.Lock()
+	delete(m.flags, key)
+	m.mtx.Unlock()
+}
+
+func (m *messageFlags) Rekey(old string, new string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	flags, ok := m.flags[old]
+	if _, exists := m.flags[new]; !ok || exists {
+		return
+	}
+	delete(m.flags, old)
+	m.flags[new] = flags
+}
+
+func (m *messageFlags) Unseen(list MessageList) int {
+	result := 0
+	list.ForEach(func(message crypto.Message) {
+		if !m.Has(MessageKey(message), FlagSeen) {
+			result++
+		}
+	})
+	return result
+}
+
+// WithFlag returns a filter for NewMessageListView which matches messages with flag set
+func WithFlag(flags MessageFlags, flag MessageFlag) func(message crypto.Message) bool {
+	return func(message crypto.Message) bool {
+		return flags.Has(MessageKey(message), flag)
+	}
+}
@@ -0,0 +1,80 @@
+package ipmail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMessageFlag_Marks(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags MessageFlag
+		want  string
+	}{
+		{"Unread", 0, "N"},
+		{"Read", FlagSeen, ""},
+		{"Unread Starred", FlagStarred, "N*"},
+		{"Answered And Forwarded", FlagSeen | FlagAnswered | FlagForwarded, "AF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.flags.Marks(); got != tt.want {
+				t.Errorf("Marks() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMessageFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    MessageFlag
+		wantErr bool
+	}{
+		{"seen", FlagSeen, false},
+		{"read", FlagSeen, false},
+		{"Starred", FlagStarred, false},
+		{"forwarded", FlagForwarded, false},
+		{"urgent", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMessageFlag(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseMessageFlag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseMessageFlag() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageFlags_persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "flags")
+
+	flags := NewMessageFlags()
+	flags.Set("1", FlagSeen|FlagStarred)
+	flags.Set("2", FlagAnswered)
+	flags.Clear("2", FlagAnswered)
+	if err := flags.SaveToFile(file, nil); err != nil {
+		t.Fatalf("SaveToFile() error = %v", err)
+	}
+	got, err := NewMessageFlagsFromFile(file, nil)
+	if err != nil {
+		t.Fatalf("NewMessageFlagsFromFile() error = %v", err)
+	}
+	if got.Flags("1") != FlagSeen|FlagStarred {
+		t.Errorf("Flags(1) got = %v", got.Flags("1"))
+	}
+	if got.Flags("2") != 0 {
+		t.Errorf("Flags(2) got = %v, want none", got.Flags("2"))
+	}
+}
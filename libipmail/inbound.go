@@ -0,0 +1,323 @@
+package ipmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sealedPrefix starts the armor of a message sealed in a session
+const sealedPrefix = "-----BEGIN " + crypto.SessionEncoding
+
+// MaxMessageSize bounds how much of a message body is fetched, whether it was announced or synced
+const MaxMessageSize = 16 << 20
+
+func parseCid(message iface.PubSubMessage, prefix string) (cid.Cid, bool) {
+	hash := message.Data()
+	topics := strings.Join(message.Topics(), "")
+	if !strings.Contains(topics, crypto.MessageTopicName) ||
+		!bytes.HasPrefix(hash, []byte(prefix)) ||
+		!bytes.HasSuffix(hash, []byte(crypto.MessageCidPostfix)) {
+		return cid.Undef, false
+	}
+	hash = bytes.TrimPrefix(hash, []byte(prefix))
+	hash = bytes.TrimSuffix(hash, []byte(crypto.MessageCidPostfix))
+	parse, err := cid.Parse(hash)
+	if err != nil {
+		return cid.Undef, false
+	}
+	return parse, true
+}
+
+// ParseAnnouncement returns the CID a pubsub message on MessageTopicName announces
+func ParseAnnouncement(message iface.PubSubMessage) (cid.Cid, bool) {
+	return parseCid(message, crypto.MessageCidPrefix)
+}
+
+// ParseAck returns the CID of the message a pubsub message on MessageTopicName acknowledges and the signature
+// of the ack, see crypto.CheckAck
+func ParseAck(message iface.PubSubMessage) (cid.Cid, []byte, bool) {
+	data := message.Data()
+	if !strings.Contains(strings.Join(message.Topics(), ""), crypto.MessageTopicName) ||
+		!bytes.HasPrefix(data, []byte(crypto.MessageAckPrefix)) {
+		return cid.Undef, nil, false
+	}
+	data = bytes.TrimPrefix(data, []byte(crypto.MessageAckPrefix))
+	n, parsed, err := cid.CidFromBytes(data)
+	if err != nil || !bytes.HasPrefix(data[n:], []byte(crypto.MessageCidPostfix)) {
+		return cid.Undef, nil, false
+	}
+	signature := data[n+len(crypto.MessageCidPostfix):]
+	if len(signature) == 0 {
+		return cid.Undef, nil, false
+	}
+	return parsed, signature, true
+}
+
+type mailPipeline struct {
+	bus      EventBus
+	ipfs     util.Cat
+	identity crypto.SelfIdentity
+	contacts crypto.ContactsIdentityList
+	seen     SeenCache
+	prompt   gpg.PromptFunction
+	// bodies keeps the data of the messages out of memory when ipfs can stream it there
+	bodies  crypto.BodyStore
+	ctx     context.Context
+	timeout time.Duration
+	// sessions opens sealed messages, which are kept as the OpenPGP message inside since their keys are used up
+	sessions     crypto.SessionStore
+	saveSessions func()
+	// fetching are the CIDs being fetched, so a message announced twice at once is only opened once
+	fetchingMtx sync.Mutex
+	fetching    map[cid.Cid]bool
+}
+
+// startFetching returns false if id is already being fetched
+func (p *mailPipeline) startFetching(id cid.Cid) bool {
+	p.fetchingMtx.Lock()
+	defer p.fetchingMtx.Unlock()
+	if p.fetching == nil {
+		p.fetching = make(map[cid.Cid]bool)
+	}
+	if p.fetching[id] {
+		return false
+	}
+	p.fetching[id] = true
+	return true
+}
+
+func (p *mailPipeline) doneFetching(id cid.Cid) {
+	p.fetchingMtx.Lock()
+	defer p.fetchingMtx.Unlock()
+	delete(p.fetching, id)
+}
+
+type catReader interface {
+	CatReader(ctx context.Context, resolved path.Resolved) (io.ReadCloser, error)
+}
+
+// fetch returns a function making the message id once it is fetched, the OpenPGP message to store for it if it
+// isn't stored yet, and the session it was sealed in if it was. The body is only stored once its sender is known,
+// see handle
+func (p *mailPipeline) fetch(id cid.Cid, origin peer.ID) (func() crypto.Message, []byte, string, error) {
+	if p.bodies != nil && p.bodies.Has(id) { // fetched by an earlier run which stopped before marking it seen
+		session, err := p.openStored(id)
+		if err == errUnopened {
+			return undecryptable, nil, "", nil
+		} else if err != nil {
+			return nil, nil, "", err
+		}
+		return func() crypto.Message {
+			return crypto.NewMessageFromStore(p.bodies, id, origin, p.ipfs, p.identity, p.contacts, p.prompt)
+		}, nil, session, nil
+	}
+	encrypted, err := p.download(id)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	session := ""
+	if crypto.IsSealed(encrypted) {
+		encrypted, session, err = p.open(bytes.NewBuffer(encrypted))
+		if err != nil {
+			return undecryptable, nil, "", nil
+		}
+	}
+	return func() crypto.Message {
+		return crypto.NewMessage(encrypted, id, origin, p.ipfs, p.identity, p.contacts, p.prompt)
+	}, encrypted, session, nil
+}
+
+// download reads the body of id, failing with util.ErrTooLarge once it is larger than MaxMessageSize
+func (p *mailPipeline) download(id cid.Cid) ([]byte, error) {
+	reader, ok := p.ipfs.(catReader)
+	if !ok {
+		encrypted, err := p.ipfs.Cat(path.IpfsPath(id))
+		if err == nil && len(encrypted) > MaxMessageSize {
+			return nil, util.ErrTooLarge
+		}
+		return encrypted, err
+	}
+	ctx, cancel := p.ctx, context.CancelFunc(func() {})
+	if p.ctx == nil {
+		ctx = context.Background()
+	}
+	if p.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+	}
+	defer cancel()
+	body, err := reader.CatReader(ctx, path.IpfsPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(util.BoundedReader(body, MaxMessageSize))
+}
+
+// store moves the body of message into the body store, returning message unchanged if it can't be
+func (p *mailPipeline) store(message crypto.Message, id cid.Cid, body []byte, origin peer.ID) crypto.Message {
+	if p.bodies == nil || body == nil {
+		return message
+	}
+	err := p.bodies.Put(id, bytes.NewReader(body))
+	if err != nil {
+		println("warning: keeping the message in memory:", err.Error())
+		return message
+	}
+	stored := crypto.NewMessageFromStore(p.bodies, id, origin, p.ipfs, p.identity, p.contacts, p.prompt)
+	if stored == nil {
+		return message
+	}
+	return stored
+}
+
+var errUnopened = errors.New("sealed message could not be opened")
+
+// undecryptable makes the message of a sealed message which couldn't be opened, which is a DecryptFailed event
+func undecryptable() crypto.Message {
+	return nil
+}
+
+// open reads the OpenPGP message in a sealed message
+func (p *mailPipeline) open(sealed io.Reader) ([]byte, string, error) {
+	if p.sessions == nil {
+		return nil, "", errors.New("message is sealed in a session but sessions aren't enabled")
+	}
+	opened, session, err := p.sessions.Open(sealed)
+	if err != nil {
+		return nil, "", err
+	}
+	message, err := ioutil.ReadAll(opened)
+	if err != nil {
+		return nil, "", err
+	}
+	p.saveSessions() // the message keys are gone now
+	return message, session, nil
+}
+
+// openStored replaces the stored body of id with the OpenPGP message inside if it is sealed. The message is only
+// stored once all of it is decrypted, which uses up its key
+func (p *mailPipeline) openStored(id cid.Cid) (string, error) {
+	body, err := p.bodies.Open(id)
+	if err != nil {
+		return "", err
+	}
+	r := bufio.NewReader(body)
+	prefix, _ := r.Peek(len(sealedPrefix))
+	if string(prefix) != sealedPrefix {
+		_ = body.Close()
+		return "", nil // too short to be sealed, or not sealed
+	}
+	if p.sessions == nil {
+		_ = body.Close()
+		return "", errUnopened
+	}
+	message, session, err := p.sessions.Open(r)
+	if err == nil {
+		err = p.bodies.Replace(id, message)
+	}
+	_ = body.Close()
+	if err != nil {
+		return "", errUnopened // removed by handle along with the message
+	}
+	p.saveSessions() // the message keys are gone now
+	return session, nil
+}
+
+func isFromAny(message crypto.Message, entities gpg.EntityList) bool {
+	for _, entity := range entities {
+		if message.IsFrom(entity) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHandshake(message crypto.Message, kind crypto.HandshakeKind) bool {
+	return message.Handshake() != nil && message.Handshake().Kind == kind
+}
+
+func (p *mailPipeline) handle(message iface.PubSubMessage) {
+	id, ok := ParseAnnouncement(message)
+	if !ok || p.seen.Contains(id) || !p.startFetching(id) {
+		return
+	}
+	defer p.doneFetching(id)
+	newMessage, body, session, err := p.fetch(id, message.From())
+	tooLarge := errors.Is(err, util.ErrTooLarge)
+	if tooLarge {
+		newMessage = undecryptable // discarded for good, fetching it again would only be as large
+	} else if err != nil {
+		return // not marked as seen so the next announcement tries again
+	}
+	if !p.seen.Add(id) { // another announcement of the same message got here first
+		return
+	}
+	event := Event{Cid: id, Origin: message.From()}
+	event.Message = newMessage()
+	switch {
+	case tooLarge:
+		event.Type = DecryptFailed
+		event.Err = errors.New("message is larger than MaxMessageSize")
+	case event.Message == nil:
+		event.Type = DecryptFailed
+		event.Err = errors.New("message could not be decrypted with your keys")
+	case isFromAny(event.Message, p.identity.EntityList()):
+		event.Type = SentEcho
+	case event.Message.From() == nil:
+		// only signed mail has a sender to accept, decline or ask to become a contact
+		event.Type = DecryptFailed
+		event.Err = errors.New("message isn't signed so its sender can't be known")
+	case isHandshake(event.Message, crypto.HandshakeAccept):
+		event.Type = ContactAccepted
+	case isHandshake(event.Message, crypto.HandshakeDecline):
+		event.Type = ContactDeclined
+	case isFromAny(event.Message, p.contacts.ToArray()):
+		event.Type = MessageReceived
+	default:
+		event.Type = ContactRequest
+	}
+	if event.Type == DecryptFailed {
+		event.Message = nil
+		if p.bodies != nil {
+			_ = p.bodies.Remove(id) // only stored by an earlier run, since bodies from unknown senders aren't
+		}
+	} else {
+		event.Message = p.store(event.Message, id, body, message.From())
+	}
+	if len(session) > 0 && event.Message != nil && event.Message.From() != nil && event.Type != SentEcho {
+		p.sessions.Bind(session, event.Message.From()) // so replies are sealed in the session they started
+		p.saveSessions()
+	}
+	p.bus.Publish(event)
+}
+
+// ReceiveMail publishes the mail announced to receiver on bus until ctx is done, so subscribe to bus first.
+// Each announced CID is fetched and decrypted once, skipping anything already in seen, then published as a
+// SentEcho, MessageReceived, ContactRequest, ContactAccepted, ContactDeclined or DecryptFailed event.
+// Every CID added to seen produces one event.
+func ReceiveMail(ctx context.Context, bus EventBus, receiver Receiver, ipfs util.Cat, identity crypto.SelfIdentity,
+	contacts crypto.ContactsIdentityList, seen SeenCache, prompt gpg.PromptFunction) {
+	p := &mailPipeline{
+		bus:      bus,
+		ipfs:     ipfs,
+		identity: identity,
+		contacts: contacts,
+		seen:     seen,
+		prompt:   prompt,
+	}
+	receiver.OnMessage(ctx, p.handle, true)
+}
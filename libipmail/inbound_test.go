@@ -0,0 +1,213 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+type fakeAnnouncement struct {
+	data   []byte
+	topics []string
+}
+
+func (f *fakeAnnouncement) From() peer.ID    { return "" }
+func (f *fakeAnnouncement) Data() []byte     { return f.data }
+func (f *fakeAnnouncement) Seq() []byte      { return nil }
+func (f *fakeAnnouncement) Topics() []string { return f.topics }
+
+type fakeCat map[string][]byte
+
+func (f fakeCat) Cat(resolved path.Resolved) ([]byte, error) {
+	if b, ok := f[resolved.Cid().String()]; ok {
+		return b, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func announce(c cid.Cid) *fakeAnnouncement {
+	return &fakeAnnouncement{
+		data:   append(append([]byte(crypto.MessageCidPrefix), c.Bytes()...), crypto.MessageCidPostfix...),
+		topics: []string{crypto.MessageTopicName},
+	}
+}
+
+func TestMailPipeline(t *testing.T) {
+	self, err := crypto.NewSelfIdentity("self", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	friend, _ := gpg.NewEntity("friend", "", "", util.DefaultEncryptionConfig())
+	stranger, _ := gpg.NewEntity("stranger", "", "", util.DefaultEncryptionConfig())
+	contacts := crypto.NewContactsIdentityList(self.EntityList())
+	contacts.Add(friend)
+	strangerKey := bytes.NewBuffer(make([]byte, 0))
+	_ = stranger.Serialize(strangerKey)
+	handshake := func(kind crypto.HandshakeKind, key *gpg.Entity) string {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		if err := (&crypto.Handshake{Kind: kind, Key: key}).Serialize(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	store := fakeCat{}
+	encryptSigned := func(sign bool, content string, from *gpg.Entity, to ...*gpg.Entity) cid.Cid {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		err := NewSender(nil).Encrypt(buf, bytes.NewBufferString(content), sign, from, to...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := util.ContentCid(buf.Bytes())
+		store[c.String()] = buf.Bytes()
+		return c
+	}
+	encrypt := func(content string, from *gpg.Entity, to ...*gpg.Entity) cid.Cid {
+		return encryptSigned(true, content, from, to...)
+	}
+	missing, _ := util.ContentCid([]byte("never added"))
+
+	tests := []struct {
+		name      string
+		announced cid.Cid
+		topic     string
+		want      []EventType
+	}{
+		{"Sent Echo", encrypt("hi", self.DefaultIdentity(), friend, self.DefaultIdentity()), crypto.MessageTopicName,
+			[]EventType{SentEcho}},
+		{"From Contact", encrypt("hi", friend, self.DefaultIdentity()), crypto.MessageTopicName,
+			[]EventType{MessageReceived}},
+		{"Contact Request", encrypt(handshake(crypto.HandshakeRequest, stranger), stranger, self.DefaultIdentity()),
+			crypto.MessageTopicName, []EventType{ContactRequest}},
+		{"Contact Accepted", encrypt(handshake(crypto.HandshakeAccept, stranger), stranger, self.DefaultIdentity()),
+			crypto.MessageTopicName, []EventType{ContactAccepted}},
+		{"Contact Declined", encrypt(handshake(crypto.HandshakeDecline, friend), friend, self.DefaultIdentity()),
+			crypto.MessageTopicName, []EventType{ContactDeclined}},
+		{"Unsigned Accept", encryptSigned(false, handshake(crypto.HandshakeAccept, stranger), stranger,
+			self.DefaultIdentity()), crypto.MessageTopicName, []EventType{DecryptFailed}},
+		{"Unsigned Decline", encryptSigned(false, handshake(crypto.HandshakeDecline, friend), friend,
+			self.DefaultIdentity()), crypto.MessageTopicName, []EventType{DecryptFailed}},
+		{"Unsigned Request", encryptSigned(false, handshake(crypto.HandshakeRequest, stranger), stranger,
+			self.DefaultIdentity()), crypto.MessageTopicName, []EventType{DecryptFailed}},
+		{"Key In Body", encrypt("bin:"+strangerKey.String(), stranger, self.DefaultIdentity()),
+			crypto.MessageTopicName, []EventType{DecryptFailed}},
+		{"Not For You", encrypt("hi", friend, stranger), crypto.MessageTopicName, []EventType{DecryptFailed}},
+		{"Not Fetched", missing, crypto.MessageTopicName, []EventType{}},
+		{"Other Topic", encrypt("hi", friend, self.DefaultIdentity()), "Other", []EventType{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := NewSeenCache(DefaultSeenCacheSize)
+			bus := NewEventBus()
+			got := make([]EventType, 0)
+			bus.Subscribe(context.Background(), func(event Event) {
+				if !event.Cid.Equals(tt.announced) {
+					t.Errorf("event for %v, want %v", event.Cid, tt.announced)
+				}
+				got = append(got, event.Type)
+			})
+			p := &mailPipeline{bus: bus, ipfs: store, identity: self, contacts: contacts, seen: seen}
+			announcement := announce(tt.announced)
+			announcement.topics = []string{tt.topic}
+			p.handle(announcement)
+			p.handle(announcement) // announced again, which should be dropped
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("got events %v, want %v", got, tt.want)
+			}
+			if seen.Contains(tt.announced) != (len(tt.want) > 0) {
+				t.Errorf("seen.Contains() = %v", seen.Contains(tt.announced))
+			}
+		})
+	}
+}
+
+func TestMailPipeline_bodies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	self, err := crypto.NewSelfIdentity("self", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	friend, _ := gpg.NewEntity("friend", "", "", util.DefaultEncryptionConfig())
+	stranger, _ := gpg.NewEntity("stranger", "", "", util.DefaultEncryptionConfig())
+	contacts := crypto.NewContactsIdentityList(self.EntityList())
+	contacts.Add(friend)
+
+	store := fakeCat{}
+	add := func(data []byte) cid.Cid {
+		c, _ := util.ContentCid(data)
+		store[c.String()] = data
+		return c
+	}
+	encryptSigned := func(sign bool, from *gpg.Entity, to ...*gpg.Entity) cid.Cid {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		err := NewSender(nil).Encrypt(buf, bytes.NewBufferString("hi"), sign, from, to...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return add(buf.Bytes())
+	}
+
+	tests := []struct {
+		name      string
+		announced cid.Cid
+		// stored is whether the body is in the store before it is announced
+		stored bool
+		want   EventType
+		kept   bool
+	}{
+		{"From Contact", encryptSigned(true, friend, self.DefaultIdentity()), false, MessageReceived, true},
+		{"Stored From Contact", encryptSigned(true, friend, self.DefaultIdentity()), true, MessageReceived, true},
+		{"Unsigned", encryptSigned(false, friend, self.DefaultIdentity()), false, DecryptFailed, false},
+		{"Unknown Sender", encryptSigned(true, stranger, self.DefaultIdentity()), false, DecryptFailed, false},
+		{"Not For You", encryptSigned(true, friend, stranger), false, DecryptFailed, false},
+		{"Stored Not For You", encryptSigned(true, friend, stranger), true, DecryptFailed, false},
+		{"Too Large", add(make([]byte, MaxMessageSize+1)), false, DecryptFailed, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies, err := crypto.NewBodyStore(filepath.Join(dir, strconv.Itoa(i)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.stored {
+				_ = bodies.Put(tt.announced, bytes.NewReader(store[tt.announced.String()]))
+			}
+			bus := NewEventBus()
+			var got *Event
+			bus.Subscribe(context.Background(), func(event Event) {
+				got = &event
+			})
+			p := &mailPipeline{bus: bus, ipfs: store, identity: self, contacts: contacts,
+				seen: NewSeenCache(DefaultSeenCacheSize), bodies: bodies}
+			p.handle(announce(tt.announced))
+			if got == nil || got.Type != tt.want {
+				t.Fatalf("got event %v, want %v", got, tt.want)
+			}
+			if bodies.Has(tt.announced) != tt.kept {
+				t.Errorf("bodies.Has() = %v, want %v", bodies.Has(tt.announced), tt.kept)
+			}
+			if tt.kept {
+				if body, err := got.Message.Body(); err != nil {
+					t.Error(err)
+				} else {
+					_ = body.Close()
+				}
+			}
+		})
+	}
+}
@@ -2,26 +2,31 @@ package ipmail
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ipfs/interface-go-ipfs-core/options"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sync"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	config "github.com/ipfs/go-ipfs-config"
 	files "github.com/ipfs/go-ipfs-files"
-	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
 	icore "github.com/ipfs/interface-go-ipfs-core"
 	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
 	ma "github.com/multiformats/go-multiaddr"
 
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/corerepo"
 	"github.com/ipfs/go-ipfs/plugin/loader" // This package is needed so that all the preloaded plugins are loaded automatically
+	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	migrations "github.com/ipfs/go-ipfs/repo/fsrepo/migrations"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
@@ -46,13 +51,17 @@ func setupPlugins(externalPluginsPath string) error {
 	return nil
 }
 
-func createTempRepo(repoPath *string) (*string, error) {
+// createRepo initializes a repo at repoPath, or at a temp dir if it is nil. An existing repo is reused
+// so the node keeps its peer ID and doesn't generate a new key on every start.
+func createRepo(repoPath *string) (*string, error) {
 	if repoPath == nil {
 		path, err := ioutil.TempDir("", "ipfs-shell")
 		if err != nil {
 			return nil, fmt.Errorf("failed to get temp dir: %s", err)
 		}
 		repoPath = &path
+	} else if fsrepo.IsInitialized(*repoPath) {
+		return repoPath, nil
 	}
 
 	// Create a config with default options and a 2048 bit key
@@ -70,43 +79,125 @@ func createTempRepo(repoPath *string) (*string, error) {
 	return repoPath, nil
 }
 
+// migrateRepo upgrades the repo at repoPath to the version this node uses with the fs-repo-migrations tool,
+// which is downloaded if it isn't installed. The tool finds the repo through IPFS_PATH, so the environment of
+// the whole process points at repoPath until the migration is done and nothing else may read IPFS_PATH meanwhile
+func migrateRepo(repoPath string) error {
+	old, hadOld := os.LookupEnv("IPFS_PATH")
+	defer func() {
+		if hadOld {
+			_ = os.Setenv("IPFS_PATH", old)
+		} else {
+			_ = os.Unsetenv("IPFS_PATH")
+		}
+	}()
+	err := os.Setenv("IPFS_PATH", repoPath)
+	if err != nil {
+		return err
+	}
+	return migrations.RunMigration(fsrepo.RepoVersion)
+}
+
+// openRepo opens the repo at repoPath, migrating it first if nodeConfig allows it. A shared repo, like the one
+// of an IPFS installation, is left for that installation to migrate
+func openRepo(repoPath string, nodeConfig NodeConfig, shared bool) (repo.Repo, error) {
+	result, err := fsrepo.Open(repoPath)
+	if err != fsrepo.ErrNeedMigration {
+		return result, err
+	} else if shared {
+		return nil, fmt.Errorf("%w, which the IPFS installation of %s has to do", err, repoPath)
+	} else if !nodeConfig.Migrate {
+		return nil, fmt.Errorf("%w, which is only done when NodeConfig.Migrate is set", err)
+	}
+	err = migrateRepo(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate repo: %s", err)
+	}
+	return fsrepo.Open(repoPath)
+}
+
+// runningRepo is a repo whose config and swarm key are what the node runs with, which aren't saved to the repo
+type runningRepo struct {
+	repo.Repo
+	config   *config.Config
+	swarmKey []byte
+}
+
+func (r *runningRepo) Config() (*config.Config, error) {
+	return r.config, nil
+}
+
+func (r *runningRepo) SwarmKey() ([]byte, error) {
+	if r.swarmKey == nil {
+		return r.Repo.SwarmKey()
+	}
+	return r.swarmKey, nil
+}
+
 /// ------ Spawning the node
 
-// Creates an IPFS node and returns its coreAPI
-func createNode(ctx context.Context, repoPath string) (icore.CoreAPI, error) {
+// Creates an IPFS node and returns its coreAPI. Nothing is written to a shared repo, which another IPFS
+// installation owns, so nodeConfig only applies while the node runs
+func createNode(ctx context.Context, repoPath string, nodeConfig NodeConfig, shared bool) (icore.CoreAPI, *core.IpfsNode, error) {
+	swarmKey, err := nodeConfig.swarmKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if swarmKey == nil && !shared {
+		// older versions copied the swarm key into the repo, where it would keep the node off the public network
+		err = os.Remove(filepath.Join(repoPath, "swarm.key"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+
 	// Open the repo
-	repo, err := fsrepo.Open(repoPath)
+	repo, err := openRepo(repoPath, nodeConfig, shared)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	cfg, err := repo.Config()
-
-	// Sets swarm ports to random - helps with port conflicts
-	maxTries := 3
-	err = config.Profiles["randomports"].Transform(cfg)
-	for i := 0; i < maxTries; i++ {
-		if err == nil {
-			break
-		}
-		err = config.Profiles["randomports"].Transform(cfg)
+	if err == nil {
+		cfg, err = cfg.Clone()
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	err = repo.SetConfig(cfg)
+	if nodeConfig.usesRandomPorts() {
+		// Sets swarm ports to random - helps with port conflicts
+		maxTries := 3
+		err = config.Profiles["randomports"].Transform(cfg)
+		for i := 0; i < maxTries; i++ {
+			if err == nil {
+				break
+			}
+			err = config.Profiles["randomports"].Transform(cfg)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	nodeConfig.apply(cfg)
+
+	if !shared {
+		err = repo.SetConfig(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	running, err := nodeConfig.running(cfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Construct the node
 
 	nodeOptions := &core.BuildCfg{
 		Online:  true,
-		Routing: libp2p.DHTOption, // This option sets the node to be a full DHT node (both fetching and storing DHT Records)
-		// Routing: libp2p.DHTClientOption, // This option sets the node to be a client DHT node (only fetching records)
-		Repo: repo,
+		Routing: nodeConfig.Routing.option(),
+		Repo:    &runningRepo{Repo: repo, config: running, swarmKey: swarmKey},
 		ExtraOpts: map[string]bool{
 			"pubsub": true,
 		},
@@ -114,42 +205,43 @@ func createNode(ctx context.Context, repoPath string) (icore.CoreAPI, error) {
 
 	node, err := core.NewNode(ctx, nodeOptions)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Attach the Core API to the constructed node
-	return coreapi.NewCoreAPI(node)
+	api, err := coreapi.NewCoreAPI(node)
+	return api, node, err
 }
 
 // Spawns a node on the default repo location, if the repo exists
-func spawnDefault(ctx context.Context) (icore.CoreAPI, error) {
+func spawnDefault(ctx context.Context, nodeConfig NodeConfig) (icore.CoreAPI, *core.IpfsNode, error) {
 	defaultPath, err := config.PathRoot()
 	if err != nil {
 		// shouldn't be possible
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := setupPlugins(defaultPath); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return createNode(ctx, defaultPath)
+	return createNode(ctx, defaultPath, nodeConfig, true)
 }
 
-// Spawns a node to be used just for this run (i.e. creates a tmp repo)
-func spawnEphemeral(ctx context.Context, repoPath *string) (icore.CoreAPI, error) {
+// Spawns a node on repoPath, creating the repo the first time, or just for this run on a tmp repo if it is nil
+func spawnEphemeral(ctx context.Context, repoPath *string, nodeConfig NodeConfig) (icore.CoreAPI, *core.IpfsNode, error) {
 	if err := setupPlugins(""); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Create a Temporary Repo
-	repoPath, err := createTempRepo(repoPath)
+	// Create or reuse the Repo
+	repoPath, err := createRepo(repoPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create repo: %s", err)
+		return nil, nil, fmt.Errorf("failed to create repo: %s", err)
 	}
 
-	// Spawning an ephemeral IPFS node
-	return createNode(ctx, *repoPath)
+	// Spawning the IPFS node
+	return createNode(ctx, *repoPath, nodeConfig, false)
 }
 
 //
@@ -202,35 +294,19 @@ func getUnixfsNode(path string) (files.Node, error) {
 	return f, nil
 }
 
-var bootstrapNodes = []string{
-	// IPFS Bootstrapper nodes.
-	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
-	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
-	"/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
-	"/ip4/104.131.131.82/udp/4001/quic/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
-
-	// IPFS Cluster Pinning nodes
-	"/ip4/138.201.67.219/tcp/4001/p2p/QmUd6zHcbkbcs7SMxwLs48qZVX3vpcM8errYS7xEczwRMA",
-	"/ip4/138.201.67.219/udp/4001/quic/p2p/QmUd6zHcbkbcs7SMxwLs48qZVX3vpcM8errYS7xEczwRMA",
-	"/ip4/138.201.67.220/tcp/4001/p2p/QmNSYxZAiJHeLdkBg38roksAR9So7Y5eojks1yjEcUtZ7i",
-	"/ip4/138.201.67.220/udp/4001/quic/p2p/QmNSYxZAiJHeLdkBg38roksAR9So7Y5eojks1yjEcUtZ7i",
-	"/ip4/138.201.68.74/tcp/4001/p2p/QmdnXwLrC8p1ueiq2Qya8joNvk3TVVDAut7PrikmZwubtR",
-	"/ip4/138.201.68.74/udp/4001/quic/p2p/QmdnXwLrC8p1ueiq2Qya8joNvk3TVVDAut7PrikmZwubtR",
-	"/ip4/94.130.135.167/tcp/4001/p2p/QmUEMvxS2e7iDrereVYc5SWPauXPyNwxcy9BXZrC1QTcHE",
-	"/ip4/94.130.135.167/udp/4001/quic/p2p/QmUEMvxS2e7iDrereVYc5SWPauXPyNwxcy9BXZrC1QTcHE",
-
-	// You can add more nodes here, for example, another IPFS node you might have running locally, mine was:
-	"/ip4/127.0.0.1/tcp/4001/p2p/QmQQtheqZouh43hfV4E9woribXBGi6yLdefrrpvsCk7RxB",
-	"/ip4/127.0.0.1/udp/4001/quic/p2p/QmQQtheqZouh43hfV4E9woribXBGi6yLdefrrpvsCk7RxB",
-}
-
 type Ipfs struct {
-	api icore.CoreAPI
-	ctx context.Context
+	api      icore.CoreAPI
+	node     *core.IpfsNode
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timeout  time.Duration
+	identity config.Identity
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
+// Context is done once the node is closed
 func (this *Ipfs) Context() context.Context {
 	return this.ctx
 }
@@ -240,42 +316,98 @@ func NewIpfs(useLocalNode bool) (*Ipfs, error) {
 }
 
 func NewIpfsWithRepo(useLocalNode bool, path *string) (*Ipfs, error) {
-	var result Ipfs
+	return NewIpfsWithConfig(useLocalNode, path, DefaultNodeConfig())
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	runtime.SetFinalizer(&result, func(ipfs *Ipfs) {
-		cancel()
-	})
-	result.ctx = ctx
+// NewIpfsWithConfig is NewIpfsWithRepo for a node joining the network as described by nodeConfig
+func NewIpfsWithConfig(useLocalNode bool, path *string, nodeConfig NodeConfig) (*Ipfs, error) {
+	result := &Ipfs{
+		timeout: nodeConfig.Timeout,
+	}
+	result.ctx, result.cancel = context.WithCancel(context.Background())
+	ctx := result.ctx
 
 	if useLocalNode {
 		// Spawn a node using the default path (~/.ipfs), assuming that a repo exists there already
-		ipfs, err := spawnDefault(ctx)
+		ipfs, node, err := spawnDefault(ctx, nodeConfig)
 		if err != nil {
+			result.cancel()
 			return nil, err
 		}
 		result.api = ipfs
+		result.node = node
 	} else {
 		// Spawn a node using a temporary path, creating a temporary repo for the run
-		ipfs, err := spawnEphemeral(ctx, path)
+		ipfs, node, err := spawnEphemeral(ctx, path, nodeConfig)
 		if err != nil {
+			result.cancel()
 			return nil, fmt.Errorf("failed to spawn ephemeral node: %s", err)
 		}
 		result.api = ipfs
+		result.node = node
+	}
+	cfg, err := result.node.Repo.Config()
+	if err != nil {
+		_ = result.Close()
+		return nil, err
 	}
+	result.identity = cfg.Identity
 
-	go connectToPeers(ctx, result.api, bootstrapNodes)
+	go connectToPeers(ctx, result.api, nodeConfig.bootstrap())
 
 	//fmt.Println("IPFS node is running")
 
-	return &result, nil
+	return result, nil
+}
+
+// Close cancels everything still running on the node, then shuts it down and closes its repo
+func (this *Ipfs) Close() error {
+	this.closeOnce.Do(func() {
+		if this.cancel != nil {
+			this.cancel()
+		}
+		if this.node != nil {
+			this.closeErr = this.node.Close()
+		}
+	})
+	return this.closeErr
+}
+
+// withTimeout bounds an operation which wasn't given a context by the node's timeout
+func (this *Ipfs) withTimeout() (context.Context, context.CancelFunc) {
+	if this.timeout <= 0 {
+		return context.WithCancel(this.ctx)
+	}
+	return context.WithTimeout(this.ctx, this.timeout)
+}
+
+// PeerId is the node's peer ID, which stays the same for as long as its repo is kept
+func (this *Ipfs) PeerId() (peer.ID, error) {
+	return peer.Decode(this.identity.PeerID)
+}
+
+// ExportIdentity writes the node's peer ID and private key in the Identity format of an IPFS config file,
+// so the same peer ID can be used by another node. Keep it secret.
+func (this *Ipfs) ExportIdentity(w io.Writer) error {
+	if len(this.identity.PeerID) == 0 {
+		return errors.New("the node has no identity")
+	}
+	b, err := json.MarshalIndent(this.identity, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
 }
 
 func (this *Ipfs) Add(node files.Node) (icorepath.Resolved, error) {
-	var ipfs = this.api
-	var ctx = this.ctx
+	ctx, cancel := this.withTimeout()
+	defer cancel()
+	return this.AddContext(ctx, node)
+}
 
-	cidFile, err := ipfs.Unixfs().Add(ctx, node)
+func (this *Ipfs) AddContext(ctx context.Context, node files.Node) (icorepath.Resolved, error) {
+	cidFile, err := this.api.Unixfs().Add(ctx, node)
 	if err != nil {
 		return nil, fmt.Errorf("Could not add Node: %s", err)
 	}
@@ -300,11 +432,25 @@ func (this *Ipfs) AddFromBytes(b []byte) (icorepath.Resolved, error) {
 	return this.Add(files.NewBytesFile(b))
 }
 
+// Cat gives up after the node's timeout, so a CID nobody provides doesn't block forever
 func (this *Ipfs) Cat(cidFile icorepath.Resolved) ([]byte, error) {
-	var ipfs = this.api
-	var ctx = this.ctx
+	ctx, cancel := this.withTimeout()
+	defer cancel()
+	return this.CatContext(ctx, cidFile)
+}
 
-	rootNodeFile, err := ipfs.Unixfs().Get(ctx, cidFile)
+func (this *Ipfs) CatContext(ctx context.Context, cidFile icorepath.Resolved) ([]byte, error) {
+	file, err := this.CatReader(ctx, cidFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// CatReader fetches the blocks of the file as it is read
+func (this *Ipfs) CatReader(ctx context.Context, cidFile icorepath.Resolved) (io.ReadCloser, error) {
+	rootNodeFile, err := this.api.Unixfs().Get(ctx, cidFile)
 	if err != nil {
 		return nil, fmt.Errorf("Could not get file with CID: %s", err)
 	}
@@ -312,17 +458,21 @@ func (this *Ipfs) Cat(cidFile icorepath.Resolved) ([]byte, error) {
 	switch rootNodeFile.(type) {
 	case files.File:
 	default:
+		_ = rootNodeFile.Close()
 		return nil, fmt.Errorf("%s is not a file", cidFile.String())
 	}
 
-	return ioutil.ReadAll(rootNodeFile.(files.File))
+	return rootNodeFile.(files.File), nil
 }
 
 func (this *Ipfs) Ls(cidFile icorepath.Resolved) ([]files.Node, error) {
-	var ipfs = this.api
-	var ctx = this.ctx
+	ctx, cancel := this.withTimeout()
+	defer cancel()
+	return this.LsContext(ctx, cidFile)
+}
 
-	rootNodeDir, err := ipfs.Unixfs().Get(ctx, cidFile)
+func (this *Ipfs) LsContext(ctx context.Context, cidFile icorepath.Resolved) ([]files.Node, error) {
+	rootNodeDir, err := this.api.Unixfs().Get(ctx, cidFile)
 	if err != nil {
 		return nil, fmt.Errorf("Could not get directory with CID: %s", err)
 	}
@@ -341,9 +491,67 @@ func (this *Ipfs) Ls(cidFile icorepath.Resolved) ([]files.Node, error) {
 }
 
 func (this *Ipfs) Publish(topic string, toSend []byte) error {
-	return this.api.PubSub().Publish(this.ctx, topic, toSend)
+	ctx, cancel := this.withTimeout()
+	defer cancel()
+	return this.PublishContext(ctx, topic, toSend)
+}
+
+func (this *Ipfs) PublishContext(ctx context.Context, topic string, toSend []byte) error {
+	return this.api.PubSub().Publish(ctx, topic, toSend)
 }
 
 func (this *Ipfs) Subscribe(topic string, options ...options.PubSubSubscribeOption) (icore.PubSubSubscription, error) {
 	return this.api.PubSub().Subscribe(this.ctx, topic, options...)
 }
+
+func (this *Ipfs) Pin(c cid.Cid) error {
+	ctx, cancel := this.withTimeout() // pinning fetches what isn't on the node yet
+	defer cancel()
+	return this.api.Pin().Add(ctx, icorepath.IpfsPath(c))
+}
+
+func (this *Ipfs) Unpin(c cid.Cid) error {
+	return this.api.Pin().Rm(this.ctx, icorepath.IpfsPath(c))
+}
+
+func (this *Ipfs) PublishName(ctx context.Context, key string, p icorepath.Path) (string, error) {
+	keys, err := this.api.Key().List(ctx)
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, k := range keys {
+		found = found || k.Name() == key
+	}
+	if !found {
+		_, err = this.api.Key().Generate(ctx, key, options.Key.Type(options.Ed25519Key))
+		if err != nil {
+			return "", err
+		}
+	}
+	entry, err := this.api.Name().Publish(ctx, p, options.Name.Key(key))
+	if err != nil {
+		return "", err
+	}
+	return "/ipns/" + entry.Name(), nil
+}
+
+func (this *Ipfs) ResolveName(ctx context.Context, name string) (icorepath.Path, error) {
+	return this.api.Name().Resolve(ctx, name)
+}
+
+func (this *Ipfs) CollectGarbage() (uint64, error) {
+	before, err := corerepo.RepoSize(this.ctx, this.node)
+	if err != nil {
+		return 0, err
+	}
+	err = corerepo.GarbageCollect(this.node, this.ctx)
+	if err != nil {
+		return 0, err
+	}
+	after, err := corerepo.RepoSize(this.ctx, this.node)
+	if err != nil || after.RepoSize > before.RepoSize {
+		return 0, err
+	}
+	return before.RepoSize - after.RepoSize, nil
+}
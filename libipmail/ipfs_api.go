@@ -0,0 +1,474 @@
+package ipmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multibase"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrDaemonGcOff is returned by CollectGarbage of a daemon which it wasn't allowed to collect
+var ErrDaemonGcOff = errors.New("the IPFS daemon isn't garbage collected since other applications may share it")
+
+// ipfsApi talks to a running IPFS daemon (Kubo 0.11 or newer) over its HTTP RPC API
+type ipfsApi struct {
+	url     string
+	client  *http.Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	// collectGarbage allows repo/gc, which deletes everything unpinned on the daemon and not only our mail
+	collectGarbage bool
+}
+
+// NewIpfsApi connects to the HTTP RPC API of a running IPFS daemon so several tools can share one node.
+// address is either a URL like http://127.0.0.1:5001 or a multiaddr like /ip4/127.0.0.1/tcp/5001.
+// Calls which aren't given a context give up after timeout, or never if it is 0. Unpinned mail is only
+// deleted from the daemon if collectGarbage is set, since that also deletes what other applications didn't pin.
+func NewIpfsApi(address string, timeout time.Duration, collectGarbage bool) (Transport, error) {
+	apiUrl, err := parseApiAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	result := &ipfsApi{
+		url:            apiUrl,
+		client:         &http.Client{},
+		timeout:        timeout,
+		collectGarbage: collectGarbage,
+	}
+	result.ctx, result.cancel = context.WithCancel(context.Background())
+	return result, nil
+}
+
+func parseApiAddress(address string) (string, error) {
+	if !strings.HasPrefix(address, "/") {
+		if !strings.Contains(address, "://") {
+			address = "http://" + address
+		}
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(parsed.String(), "/"), nil
+	}
+	addr, err := ma.NewMultiaddr(address)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	for _, protocol := range []int{ma.P_IP4, ma.P_IP6, ma.P_DNS, ma.P_DNS4, ma.P_DNS6} {
+		if host, err = addr.ValueForProtocol(protocol); err == nil {
+			break
+		}
+	}
+	if len(host) == 0 {
+		return "", fmt.Errorf("%s has no host", address)
+	}
+	port, err := addr.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		return "", fmt.Errorf("%s has no tcp port", address)
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+// apiError is the body of a failed RPC call
+type apiError struct {
+	Message string
+}
+
+// call posts to an RPC command, streaming body as the multipart file argument if it isn't nil
+func (this *ipfsApi) call(ctx context.Context, command string, body io.Reader, args ...string) (*http.Response, error) {
+	query := url.Values{}
+	for _, arg := range args {
+		query.Add("arg", arg)
+	}
+	return this.callWithQuery(ctx, command, body, query)
+}
+
+// callWithQuery is call for commands which also take options, given in query with the arguments
+func (this *ipfsApi) callWithQuery(ctx context.Context, command string, body io.Reader, query url.Values) (*http.Response, error) {
+	var content io.Reader = nil
+	contentType := ""
+	if body != nil {
+		pipeReader, pipeWriter := io.Pipe()
+		writer := multipart.NewWriter(pipeWriter)
+		go func() {
+			part, err := writer.CreateFormFile("file", "file")
+			if err == nil {
+				_, err = io.Copy(part, body)
+			}
+			if err == nil {
+				err = writer.Close()
+			}
+			_ = pipeWriter.CloseWithError(err)
+		}()
+		defer pipeReader.Close() // stops the copy if the request fails before reading everything
+		content = pipeReader
+		contentType = writer.FormDataContentType()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		this.url+"/api/v0/"+command+"?"+query.Encode(), content)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := this.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		var failed apiError
+		b, _ := ioutil.ReadAll(response.Body)
+		if json.Unmarshal(b, &failed) != nil || len(failed.Message) == 0 {
+			failed.Message = strings.TrimSpace(string(b))
+		}
+		return nil, fmt.Errorf("ipfs %s failed with %s: %s", command, response.Status, failed.Message)
+	}
+	return response, nil
+}
+
+func (this *ipfsApi) Context() context.Context {
+	return this.ctx
+}
+
+// Close cancels every call still waiting on the daemon, which keeps running
+func (this *ipfsApi) Close() error {
+	this.cancel()
+	return nil
+}
+
+// withTimeout bounds a call which wasn't given a context by the timeout
+func (this *ipfsApi) withTimeout() (context.Context, context.CancelFunc) {
+	if this.timeout <= 0 {
+		return context.WithCancel(this.ctx)
+	}
+	return context.WithTimeout(this.ctx, this.timeout)
+}
+
+func (this *ipfsApi) Cat(resolved path.Resolved) ([]byte, error) {
+	ctx, cancel := this.withTimeout()
+	defer cancel()
+	return this.CatContext(ctx, resolved)
+}
+
+func (this *ipfsApi) CatContext(ctx context.Context, resolved path.Resolved) ([]byte, error) {
+	body, err := this.CatReader(ctx, resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func (this *ipfsApi) CatReader(ctx context.Context, resolved path.Resolved) (io.ReadCloser, error) {
+	response, err := this.call(ctx, "cat", nil, resolved.String())
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (this *ipfsApi) AddFromBytes(b []byte) (path.Resolved, error) {
+	return this.AddFromReader(bytes.NewReader(b))
+}
+
+func (this *ipfsApi) AddFromReader(reader io.Reader) (path.Resolved, error) {
+	ctx, cancel := this.withTimeout()
+	defer cancel()
+	response, err := this.call(ctx, "add", reader)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var added struct {
+		Hash string
+	}
+	err = json.NewDecoder(response.Body).Decode(&added)
+	if err != nil {
+		return nil, fmt.Errorf("Could not add Node: %s", err)
+	}
+	parsed, err := cid.Decode(added.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("Could not add Node: %s", err)
+	}
+	return path.IpfsPath(parsed), nil
+}
+
+func (this *ipfsApi) Pin(c cid.Cid) error {
+	ctx, cancel := this.withTimeout() // pinning fetches what isn't on the daemon yet
+	defer cancel()
+	response, err := this.call(ctx, "pin/add", nil, path.IpfsPath(c).String())
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (this *ipfsApi) Unpin(c cid.Cid) error {
+	response, err := this.call(this.ctx, "pin/rm", nil, path.IpfsPath(c).String())
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (this *ipfsApi) repoSize() (uint64, error) {
+	response, err := this.call(this.ctx, "repo/stat", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	var stat struct {
+		RepoSize uint64
+	}
+	err = json.NewDecoder(response.Body).Decode(&stat)
+	return stat.RepoSize, err
+}
+
+// CollectGarbage returns ErrDaemonGcOff unless the daemon was allowed to be collected
+func (this *ipfsApi) CollectGarbage() (uint64, error) {
+	if !this.collectGarbage {
+		return 0, ErrDaemonGcOff
+	}
+	before, err := this.repoSize()
+	if err != nil {
+		return 0, err
+	}
+	response, err := this.call(this.ctx, "repo/gc", nil)
+	if err != nil {
+		return 0, err
+	}
+	// the removed CIDs are streamed while the daemon collects, with any error as the last line
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var removed struct {
+			Error string
+		}
+		err = decoder.Decode(&removed)
+		if err != nil {
+			break
+		}
+		if len(removed.Error) > 0 {
+			_ = response.Body.Close()
+			return 0, errors.New(removed.Error)
+		}
+	}
+	_ = response.Body.Close()
+	if err != io.EOF {
+		return 0, err
+	}
+	after, err := this.repoSize()
+	if err != nil || after > before {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+func (this *ipfsApi) PublishName(ctx context.Context, key string, p path.Path) (string, error) {
+	response, err := this.call(ctx, "key/list", nil)
+	if err != nil {
+		return "", err
+	}
+	var list struct {
+		Keys []struct {
+			Name string
+		}
+	}
+	err = json.NewDecoder(response.Body).Decode(&list)
+	_ = response.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, k := range list.Keys {
+		found = found || k.Name == key
+	}
+	if !found {
+		response, err = this.callWithQuery(ctx, "key/gen", nil, url.Values{"arg": {key}, "type": {"ed25519"}})
+		if err != nil {
+			return "", err
+		}
+		_ = response.Body.Close()
+	}
+	response, err = this.callWithQuery(ctx, "name/publish", nil, url.Values{"arg": {p.String()}, "key": {key}})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var published struct {
+		Name string
+	}
+	err = json.NewDecoder(response.Body).Decode(&published)
+	if err != nil {
+		return "", err
+	}
+	return "/ipns/" + published.Name, nil
+}
+
+func (this *ipfsApi) ResolveName(ctx context.Context, name string) (path.Path, error) {
+	response, err := this.call(ctx, "name/resolve", nil, name)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var resolved struct {
+		Path string
+	}
+	err = json.NewDecoder(response.Body).Decode(&resolved)
+	if err != nil {
+		return nil, err
+	}
+	return path.New(resolved.Path), nil
+}
+
+// encodeTopic encodes a topic the way the pubsub RPC commands expect it
+func encodeTopic(topic string) string {
+	encoded, _ := multibase.Encode(multibase.Base64url, []byte(topic))
+	return encoded
+}
+
+func (this *ipfsApi) Publish(topic string, toSend []byte) error {
+	ctx, cancel := this.withTimeout()
+	defer cancel()
+	return this.PublishContext(ctx, topic, toSend)
+}
+
+func (this *ipfsApi) PublishContext(ctx context.Context, topic string, toSend []byte) error {
+	response, err := this.call(ctx, "pubsub/pub", bytes.NewReader(toSend), encodeTopic(topic))
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (this *ipfsApi) Subscribe(topic string, options ...options.PubSubSubscribeOption) (iface.PubSubSubscription, error) {
+	ctx, cancel := context.WithCancel(this.ctx)
+	response, err := this.call(ctx, "pubsub/sub", nil, encodeTopic(topic))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024) // pubsub messages can be up to 1MiB before encoding
+	return &apiSubscription{
+		body:    response.Body,
+		scanner: scanner,
+		cancel:  cancel,
+	}, nil
+}
+
+// apiSubscription reads the newline separated messages streamed by pubsub/sub
+type apiSubscription struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	cancel  context.CancelFunc
+}
+
+// apiWireMessage is a pubsub message as the daemon sends it, with multibase encoded bytes
+type apiWireMessage struct {
+	From     string   `json:"from"`
+	Data     string   `json:"data"`
+	Seqno    string   `json:"seqno"`
+	TopicIDs []string `json:"topicIDs"`
+}
+
+type apiMessage struct {
+	from   peer.ID
+	data   []byte
+	seq    []byte
+	topics []string
+}
+
+func (m *apiMessage) From() peer.ID    { return m.from }
+func (m *apiMessage) Data() []byte     { return m.data }
+func (m *apiMessage) Seq() []byte      { return m.seq }
+func (m *apiMessage) Topics() []string { return m.topics }
+
+func (w *apiWireMessage) decode() (*apiMessage, error) {
+	var err error
+	result := &apiMessage{}
+	result.from, err = peer.Decode(w.From)
+	if err != nil {
+		return nil, err
+	}
+	_, result.data, err = multibase.Decode(w.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.Seqno) > 0 {
+		_, result.seq, err = multibase.Decode(w.Seqno)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.topics = make([]string, len(w.TopicIDs))
+	for i, encoded := range w.TopicIDs {
+		_, topic, err := multibase.Decode(encoded)
+		if err != nil {
+			return nil, err
+		}
+		result.topics[i] = string(topic)
+	}
+	return result, nil
+}
+
+// Next waits for the next message. The stream can't be resumed, so a done ctx also ends the subscription.
+func (s *apiSubscription) Next(ctx context.Context) (iface.PubSubMessage, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancel() // unblocks the scanner
+		case <-stop:
+		}
+	}()
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 || bytes.Equal(line, []byte("{}")) { // the daemon sends {} when the subscription starts
+			continue
+		}
+		var wire apiWireMessage
+		var message *apiMessage
+		err := json.Unmarshal(line, &wire)
+		if err == nil {
+			message, err = wire.decode()
+		}
+		if err != nil {
+			continue // anyone on the topic can send a malformed message, which mustn't end the subscription
+		}
+		return message, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("subscription closed")
+}
+
+func (s *apiSubscription) Close() error {
+	s.cancel()
+	return s.body.Close()
+}
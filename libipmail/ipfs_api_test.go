@@ -0,0 +1,471 @@
+package ipmail
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/multiformats/go-multibase"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const standInPeer = "QmQQtheqZouh43hfV4E9woribXBGi6yLdefrrpvsCk7RxB"
+
+// standInDaemon answers the RPC commands ipfsApi uses the way a Kubo daemon does
+type standInDaemon struct {
+	mtx         sync.Mutex
+	blocks      map[string][]byte
+	pins        map[string]bool
+	subscribers map[string][]chan []byte
+	// keys are the IPNS key hashes by name, names the paths published under them by key hash
+	keys  map[string]string
+	names map[string]string
+}
+
+func newStandInDaemon(t *testing.T) *httptest.Server {
+	d := &standInDaemon{
+		blocks:      make(map[string][]byte),
+		pins:        make(map[string]bool),
+		subscribers: make(map[string][]chan []byte),
+		keys:        make(map[string]string),
+		names:       make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/add", d.add)
+	mux.HandleFunc("/api/v0/cat", d.cat)
+	mux.HandleFunc("/api/v0/pin/add", d.pin)
+	mux.HandleFunc("/api/v0/pin/rm", d.unpin)
+	mux.HandleFunc("/api/v0/repo/stat", d.stat)
+	mux.HandleFunc("/api/v0/repo/gc", d.gc)
+	mux.HandleFunc("/api/v0/pubsub/pub", d.pub)
+	mux.HandleFunc("/api/v0/pubsub/sub", d.sub)
+	mux.HandleFunc("/api/v0/key/list", d.keyList)
+	mux.HandleFunc("/api/v0/key/gen", d.keyGen)
+	mux.HandleFunc("/api/v0/name/publish", d.namePublish)
+	mux.HandleFunc("/api/v0/name/resolve", d.nameResolve)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func fail(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Message": message, "Code": 0, "Type": "error"})
+}
+
+func readFile(r *http.Request) ([]byte, error) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func (d *standInDaemon) add(w http.ResponseWriter, r *http.Request) {
+	b, err := readFile(r)
+	if err != nil {
+		fail(w, err.Error())
+		return
+	}
+	c, _ := util.ContentCid(b)
+	d.mtx.Lock()
+	d.blocks[c.String()] = b
+	d.pins[c.String()] = true // add pins by default
+	d.mtx.Unlock()
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Name": c.String(), "Hash": c.String(), "Size": "20"})
+}
+
+func (d *standInDaemon) cat(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	b, ok := d.blocks[strings.TrimPrefix(r.URL.Query().Get("arg"), "/ipfs/")]
+	d.mtx.Unlock()
+	if !ok {
+		fail(w, "block was not found locally (offline)")
+		return
+	}
+	_, _ = w.Write(b)
+}
+
+func (d *standInDaemon) pin(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Query().Get("arg"), "/ipfs/")
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.blocks[key]; !ok {
+		fail(w, "block was not found locally (offline)")
+		return
+	}
+	d.pins[key] = true
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Pins": []string{key}})
+}
+
+func (d *standInDaemon) unpin(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Query().Get("arg"), "/ipfs/")
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if !d.pins[key] {
+		fail(w, "not pinned or pinned indirectly")
+		return
+	}
+	delete(d.pins, key)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Pins": []string{key}})
+}
+
+func (d *standInDaemon) stat(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	size := 0
+	for _, b := range d.blocks {
+		size += len(b)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"RepoSize": size, "NumObjects": len(d.blocks)})
+}
+
+func (d *standInDaemon) gc(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for key := range d.blocks {
+		if !d.pins[key] {
+			delete(d.blocks, key)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"Key": map[string]string{"/": key}})
+		}
+	}
+}
+
+func (d *standInDaemon) pub(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("arg")
+	b, err := readFile(r)
+	if err != nil {
+		fail(w, err.Error())
+		return
+	}
+	data, _ := multibase.Encode(multibase.Base64url, b)
+	line, _ := json.Marshal(map[string]interface{}{
+		"from": standInPeer, "data": data, "seqno": "uAQ", "topicIDs": []string{topic},
+	})
+	d.mtx.Lock()
+	for _, subscriber := range d.subscribers[topic] {
+		subscriber <- line
+	}
+	d.mtx.Unlock()
+}
+
+func (d *standInDaemon) sub(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("arg")
+	messages := make(chan []byte, 16)
+	d.mtx.Lock()
+	d.subscribers[topic] = append(d.subscribers[topic], messages)
+	d.mtx.Unlock()
+	_, _ = w.Write([]byte("{}\n"))
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case line := <-messages:
+			_, _ = w.Write(append(line, '\n'))
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (d *standInDaemon) keyList(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	keys := []map[string]string{{"Name": "self", "Id": standInPeer}}
+	for name, id := range d.keys {
+		keys = append(keys, map[string]string{"Name": name, "Id": id})
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Keys": keys})
+}
+
+func (d *standInDaemon) keyGen(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("arg")
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.keys[name]; ok {
+		fail(w, "key with name '"+name+"' already exists")
+		return
+	}
+	id, _ := util.ContentCid([]byte(name))
+	d.keys[name] = id.String()
+	_ = json.NewEncoder(w).Encode(map[string]string{"Name": name, "Id": id.String()})
+}
+
+func (d *standInDaemon) namePublish(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	id, ok := d.keys[r.URL.Query().Get("key")]
+	if !ok {
+		fail(w, "no key by the given name was found")
+		return
+	}
+	d.names[id] = r.URL.Query().Get("arg")
+	_ = json.NewEncoder(w).Encode(map[string]string{"Name": id, "Value": d.names[id]})
+}
+
+func (d *standInDaemon) nameResolve(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	resolved, ok := d.names[strings.TrimPrefix(r.URL.Query().Get("arg"), "/ipns/")]
+	if !ok {
+		fail(w, "could not resolve name")
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"Path": resolved})
+}
+
+func TestParseApiAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{"http://127.0.0.1:5001", "http://127.0.0.1:5001", false},
+		{"http://127.0.0.1:5001/", "http://127.0.0.1:5001", false},
+		{"localhost:5001", "http://localhost:5001", false},
+		{"/ip4/127.0.0.1/tcp/5001", "http://127.0.0.1:5001", false},
+		{"/ip6/::1/tcp/5001", "http://[::1]:5001", false},
+		{"/dns4/ipfs.example.com/tcp/5001", "http://ipfs.example.com:5001", false},
+		{"/ip4/127.0.0.1/udp/5001", "", true},
+		{"/not/a/multiaddr", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := parseApiAddress(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseApiAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseApiAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIpfsApi_addAndCat(t *testing.T) {
+	server := newStandInDaemon(t)
+	ipfs, err := NewIpfsApi(server.URL, DefaultTimeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := ipfs.AddFromBytes([]byte("hello world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, _ := util.ContentCid([]byte("never added"))
+
+	tests := []struct {
+		name    string
+		cid     cid.Cid
+		want    string
+		wantErr bool
+	}{
+		{"Added", added.Cid(), "hello world\n", false},
+		{"Missing", missing, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ipfs.Cat(path.IpfsPath(tt.cid))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Cat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Cat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIpfsApi_pins(t *testing.T) {
+	server := newStandInDaemon(t)
+	ipfs, err := NewIpfsApi(server.URL, DefaultTimeout, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinner := ipfs.(Pinner)
+	kept, _ := ipfs.AddFromBytes([]byte("kept"))
+	dropped, _ := ipfs.AddFromBytes([]byte("dropped"))
+	if err := pinner.Unpin(dropped.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pinner.Unpin(dropped.Cid()); err == nil {
+		t.Error("Unpin() of content which isn't pinned should fail")
+	}
+	shared, _ := NewIpfsApi(server.URL, DefaultTimeout, false)
+	if freed, err := shared.(Pinner).CollectGarbage(); err != ErrDaemonGcOff || freed != 0 {
+		t.Fatalf("CollectGarbage() = %d, %v without being allowed, want ErrDaemonGcOff", freed, err)
+	}
+	if _, err := ipfs.Cat(dropped); err != nil {
+		t.Fatal("unpinned content was collected without being allowed")
+	}
+	freed, err := pinner.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != uint64(len("dropped")) {
+		t.Errorf("CollectGarbage() = %d, want %d", freed, len("dropped"))
+	}
+	if _, err := ipfs.Cat(kept); err != nil {
+		t.Errorf("pinned content was collected: %v", err)
+	}
+	if _, err := ipfs.Cat(dropped); err == nil {
+		t.Error("unpinned content was not collected")
+	}
+}
+
+func TestIpfsApi_names(t *testing.T) {
+	server := newStandInDaemon(t)
+	ipfs, err := NewIpfsApi(server.URL, DefaultTimeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := ipfs.(NameSystem)
+	first, _ := ipfs.AddFromBytes([]byte("first identity"))
+	second, _ := ipfs.AddFromBytes([]byte("second identity"))
+	tests := []struct {
+		name      string
+		published path.Path
+	}{
+		{"New Key", first},
+		{"Republished", second},
+	}
+	published := ""
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := names.PublishName(context.Background(), IdentityKeyName, tt.published)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(published) > 0 && name != published {
+				t.Errorf("PublishName() = %s, want the name stays %s", name, published)
+			}
+			published = name
+			got, err := names.ResolveName(context.Background(), name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.published.String() {
+				t.Errorf("ResolveName() = %s, want %s", got, tt.published)
+			}
+		})
+	}
+	if _, err := names.ResolveName(context.Background(), "/ipns/unknown"); err == nil {
+		t.Error("ResolveName() of a name nobody published succeeded")
+	}
+}
+
+func TestIpfsApi_pubsub(t *testing.T) {
+	server := newStandInDaemon(t)
+	ipfs, err := NewIpfsApi(server.URL, DefaultTimeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := ipfs.Subscribe("ipmail topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+	if err := ipfs.Publish("ipmail topic", []byte("announcement")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	message, err := subscription.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message.Data()) != "announcement" {
+		t.Errorf("Data() = %q, want %q", message.Data(), "announcement")
+	}
+	if message.From().Pretty() != standInPeer {
+		t.Errorf("From() = %s, want %s", message.From(), standInPeer)
+	}
+	if len(message.Topics()) != 1 || message.Topics()[0] != "ipmail topic" {
+		t.Errorf("Topics() = %v, want [ipmail topic]", message.Topics())
+	}
+
+	_ = subscription.Close()
+	if _, err := subscription.Next(ctx); err == nil {
+		t.Error("Next() on a closed subscription should fail")
+	}
+}
+
+func TestApiSubscription_malformed(t *testing.T) {
+	data, _ := multibase.Encode(multibase.Base64url, []byte("announcement"))
+	topic, _ := multibase.Encode(multibase.Base64url, []byte("ipmail topic"))
+	valid, _ := json.Marshal(map[string]interface{}{"from": standInPeer, "data": data, "topicIDs": []string{topic}})
+	invalidPeer, _ := json.Marshal(map[string]interface{}{"from": "nobody", "data": data})
+	invalidData, _ := json.Marshal(map[string]interface{}{"from": standInPeer, "data": "not multibase"})
+	stream := strings.Join([]string{"{}", "not json", string(invalidPeer), string(invalidData), string(valid)}, "\n")
+	body := ioutil.NopCloser(strings.NewReader(stream))
+	subscription := &apiSubscription{body: body, scanner: bufio.NewScanner(body), cancel: func() {}}
+	message, err := subscription.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next() error = %v, want the malformed messages skipped", err)
+	}
+	if string(message.Data()) != "announcement" {
+		t.Errorf("Data() = %q, want %q", message.Data(), "announcement")
+	}
+	if _, err := subscription.Next(context.Background()); err == nil {
+		t.Error("Next() at the end of the stream should fail")
+	}
+}
+
+func TestIpfsApi_timeout(t *testing.T) {
+	// a daemon which never finds anything
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	missing, _ := util.ContentCid([]byte("never added"))
+
+	tests := []struct {
+		name string
+		cat  func(ipfs Transport) error
+	}{
+		{"Timeout", func(ipfs Transport) error {
+			_, err := ipfs.Cat(path.IpfsPath(missing))
+			return err
+		}},
+		{"Context", func(ipfs Transport) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := ipfs.CatContext(ctx, path.IpfsPath(missing))
+			return err
+		}},
+		{"Close", func(ipfs Transport) error {
+			time.AfterFunc(50*time.Millisecond, func() { _ = ipfs.Close() })
+			_, err := ipfs.CatContext(ipfs.Context(), path.IpfsPath(missing))
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipfs, err := NewIpfsApi(server.URL, 50*time.Millisecond, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- tt.cat(ipfs)
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("Cat() of a CID nobody has succeeded")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Cat() is still waiting")
+			}
+		})
+	}
+}
@@ -3,12 +3,16 @@ package ipmail
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"github.com/ipfs/go-cid"
+	config "github.com/ipfs/go-ipfs-config"
 	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	"io"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
@@ -436,3 +440,68 @@ func TestNewIpfsWithRepo(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := setupPlugins(""); err != nil {
+		t.Fatal(err)
+	}
+	peerIds := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		_, err := createRepo(&dir)
+		if err != nil {
+			t.Fatalf("createRepo() run %d error = %v", i+1, err)
+		}
+		cfg, err := fsrepo.ConfigAt(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerIds = append(peerIds, cfg.Identity.PeerID)
+	}
+	if peerIds[0] != peerIds[1] {
+		t.Errorf("peer ID changed from %s to %s when the repo was reused", peerIds[0], peerIds[1])
+	}
+}
+
+func TestIpfs_ExportIdentity(t *testing.T) {
+	identity := config.Identity{
+		PeerID:  "QmQQtheqZouh43hfV4E9woribXBGi6yLdefrrpvsCk7RxB",
+		PrivKey: "CAASqAkwggSkAgEAAoIBAQ",
+	}
+	tests := []struct {
+		name     string
+		identity config.Identity
+		wantErr  bool
+	}{
+		{"Identity", identity, false},
+		{"No Identity", config.Identity{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			this := &Ipfs{identity: tt.identity}
+			buf := bytes.NewBuffer(make([]byte, 0))
+			err := this.ExportIdentity(buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExportIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got config.Identity
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.identity {
+				t.Errorf("ExportIdentity() = %v, want %v", got, tt.identity)
+			}
+			id, err := this.PeerId()
+			if err != nil || id.Pretty() != tt.identity.PeerID {
+				t.Errorf("PeerId() = %v, %v, want %s", id, err, tt.identity.PeerID)
+			}
+		})
+	}
+}
@@ -0,0 +1,525 @@
+package ipmail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// InboxFolder is the folder messages are in until they are moved somewhere else
+	InboxFolder   = ""
+	ArchiveFolder = "Archive"
+	TrashFolder   = "Trash"
+)
+
+// MessageKey identifies a message in a MessageLabels or MessageFlags store
+func MessageKey(message crypto.Message) string {
+	return message.Cid().String()
+}
+
+type legacyMessage interface {
+	LegacyId() (uint64, bool)
+}
+
+type rekeyer interface {
+	Rekey(old string, new string)
+}
+
+// MigrateLegacyKeys moves what is stored under the pubsub sequence numbers messages were identified by
+// before they had CIDs over to their MessageKey. It returns whether any message in lists was read from
+// an old save, in which case the lists should be saved again. Stores may be nil.
+func MigrateLegacyKeys(labels MessageLabels, flags MessageFlags, lists ...MessageList) bool {
+	stores := make([]rekeyer, 0)
+	if labels != nil {
+		stores = append(stores, labels)
+	}
+	if flags != nil {
+		stores = append(stores, flags)
+	}
+	migrated := false
+	for _, l := range lists {
+		if l == nil {
+			continue
+		}
+		l.ForEach(func(message crypto.Message) {
+			legacy, ok := message.(legacyMessage)
+			if !ok {
+				return
+			}
+			if id, ok := legacy.LegacyId(); ok {
+				migrated = true
+				for _, store := range stores {
+					store.Rekey(strconv.FormatUint(id, 10), MessageKey(message))
+				}
+			}
+		})
+	}
+	return migrated
+}
+
+// MessageLabels keeps track of which folder each message is in and which labels it has.
+// A message is in exactly one folder but can have any number of labels.
+type MessageLabels interface {
+	Folder(key string) string
+	// Move puts a message in folder, which must be InboxFolder, ArchiveFolder, TrashFolder or a user folder
+	Move(key string, folder string) error
+	// TrashedAt returns when a message was moved to the trash
+	TrashedAt(key string) (time.Time, bool)
+	Labels(key string) []string
+	HasLabel(key string, label string) bool
+	AddLabel(key string, label string) error
+	RemoveLabel(key string, label string)
+	// Forget drops everything stored about a message once it has been permanently deleted
+	Forget(key string)
+	// Rekey moves everything stored about a message under old to new, unless new already has something stored
+	Rekey(old string, new string)
+
+	Folders() []string
+	CreateFolder(name string) error
+	DeleteFolder(name string) error
+	LabelNames() []string
+	CreateLabel(name string) error
+	DeleteLabel(name string) error
+
+	// ExpiredTrash returns the keys of messages which have been in the trash for longer than retention
+	ExpiredTrash(retention time.Duration, now time.Time) []string
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type messageState struct {
+	folder    string
+	trashedAt time.Time
+	labels    []string
+}
+
+type messageLabels struct {
+	mtx      sync.Mutex
+	messages map[string]*messageState
+	folders  []string
+	labels   []string
+}
+
+func NewMessageLabels() MessageLabels {
+	return &messageLabels{
+		messages: make(map[string]*messageState),
+		folders:  make([]string, 0),
+		labels:   make([]string, 0),
+	}
+}
+
+func NewMessageLabelsFromFile(file string, sealer util.Sealer) (MessageLabels, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := NewMessageLabels().(*messageLabels)
+	r := bytes.NewBuffer(b)
+	result.folders, err = readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	result.labels, err = readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	for r.Len() > 0 {
+		key, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		state := messageState{}
+		state.folder, err = util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		trashedAt, err := util.ReadInt64(r)
+		if err != nil {
+			return nil, err
+		}
+		if trashedAt != 0 {
+			state.trashedAt = time.Unix(0, trashedAt)
+		}
+		state.labels, err = readStrings(r)
+		if err != nil {
+			return nil, err
+		}
+		result.messages[key] = &state
+	}
+	return result, nil
+}
+
+func writeStrings(w io.Writer, strs []string) error {
+	err := util.WriteInt64(w, int64(len(strs)))
+	if err != nil {
+		return err
+	}
+	for _, str := range strs {
+		err = util.WriteString(w, str)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readStrings(r io.Reader) ([]string, error) {
+	count, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0)
+	for i := int64(0); i < count; i++ {
+		str, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, str)
+	}
+	return result, nil
+}
+
+func (m *messageLabels) SaveToFile(file string, sealer util.Sealer) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	keys := make([]string, 0, len(m.messages))
+	for key := range m.messages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		err := writeStrings(w, m.folders)
+		if err != nil {
+			return err
+		}
+		err = writeStrings(w, m.labels)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			state := m.messages[key]
+			err = util.WriteString(w, key)
+			if err != nil {
+				return err
+			}
+			err = util.WriteString(w, state.folder)
+			if err != nil {
+				return err
+			}
+			trashedAt := int64(0)
+			if !state.trashedAt.IsZero() {
+				trashedAt = state.trashedAt.UnixNano()
+			}
+			err = util.WriteInt64(w, trashedAt)
+			if err != nil {
+				return err
+			}
+			err = writeStrings(w, state.labels)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func indexOf(strs []string, str string) int {
+	for i, s := range strs {
+		if strings.EqualFold(s, str) {
+			return i
+		}
+	}
+	return -1
+}
+
+// state must be called with mtx held
+func (m *messageLabels) state(key string, create bool) *messageState {
+	state, ok := m.messages[key]
+	if !ok && create {
+		state = &messageState{
+			folder: InboxFolder,
+			labels: make([]string, 0),
+		}
+		m.messages[key] = state
+	}
+	return state
+}
+
+// cleanup must be called with mtx held
+func (m *messageLabels) cleanup(key string) {
+	if state, ok := m.messages[key]; ok && state.folder == InboxFolder && len(state.labels) == 0 {
+		delete(m.messages, key)
+	}
+}
+
+func (m *messageLabels) Folder(key string) string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if state := m.state(key, false); state != nil {
+		return state.folder
+	}
+	return InboxFolder
+}
+
+// folderName returns the stored spelling of folder, or an error if it doesn't exist
+func (m *messageLabels) folderName(folder string) (string, error) {
+	switch {
+	case folder == InboxFolder:
+		return InboxFolder, nil
+	case strings.EqualFold(folder, "Inbox"):
+		return InboxFolder, nil
+	case strings.EqualFold(folder, ArchiveFolder):
+		return ArchiveFolder, nil
+	case strings.EqualFold(folder, TrashFolder):
+		return TrashFolder, nil
+	}
+	if i := indexOf(m.folders, folder); i >= 0 {
+		return m.folders[i], nil
+	}
+	return "", errors.New("there is no folder named \"" + folder + "\"")
+}
+
+func (m *messageLabels) Move(key string, folder string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	folder, err := m.folderName(folder)
+	if err != nil {
+		return err
+	}
+	state := m.state(key, true)
+	if folder == TrashFolder && state.folder != TrashFolder {
+		state.trashedAt = time.Now()
+	} else if folder != TrashFolder {
+		state.trashedAt = time.Time{}
+	}
+	state.folder = folder
+	m.cleanup(key)
+	return nil
+}
+
+func (m *messageLabels) TrashedAt(key string) (time.Time, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if state := m.state(key, false); state != nil && state.folder == TrashFolder {
+		return state.trashedAt, true
+	}
+	return time.Time{}, false
+}
+
+func (m *messageLabels) Labels(key string) []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if state := m.state(key, false); state != nil {
+		return append(make([]string, 0, len(state.labels)), state.labels...)
+	}
+	return make([]string, 0)
+}
+
+func (m *messageLabels) HasLabel(key string, label string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if state := m.state(key, false); state != nil {
+		return indexOf(state.labels, label) >= 0
+	}
+	return false
+}
+
+func (m *messageLabels) AddLabel(key string, label string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	i := indexOf(m.labels, label)
+	if i < 0 {
+		return errors.New("there is no label named \"" + label + "\"")
+	}
+	state := m.state(key, true)
+	if indexOf(state.labels, label) < 0 {
+		state.labels = append(state.labels, m.labels[i])
+	}
+	return nil
+}
+
+func (m *messageLabels) RemoveLabel(key string, label string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	state := m.state(key, false)
+	if state == nil {
+		return
+	}
+	if i := indexOf(state.labels, label); i >= 0 {
+		state.labels = append(state.labels[:i], state.labels[i+1:]...)
+	}
+	m.cleanup(key)
+}
+
+func (m *messageLabels) Forget(key string) {
+	m.mtx.Lock()
+	delete(m.messages, key)
+	m.mtx.Unlock()
+}
+
+func (m *messageLabels) Rekey(old string, new string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	state, ok := m.messages[old]
+	if _, exists := m.messages[new]; !ok || exists {
+		return
+	}
+	delete(m.messages, old)
+	m.messages[new] = state
+}
+
+func (m *messageLabels) Folders() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append(make([]string, 0, len(m.folders)), m.folders...)
+}
+
+func validName(name string, reserved ...string) error {
+	if len(strings.TrimSpace(name)) == 0 || strings.TrimSpace(name) != name {
+		return errors.New("names can't be empty or start or end with spaces")
+	}
+	for _, r := range reserved {
+		if strings.EqualFold(name, r) {
+			return errors.New("\"" + name + "\" is reserved")
+		}
+	}
+	return nil
+}
+
+func (m *messageLabels) CreateFolder(name string) error {
+	err := validName(name, "Inbox", "Sent", "Drafts", "Outbox", "Requests", ArchiveFolder, TrashFolder)
+	if err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if indexOf(m.folders, name) >= 0 {
+		return errors.New("folder \"" + name + "\" already exists")
+	}
+	m.folders = append(m.folders, name)
+	return nil
+}
+
+// DeleteFolder removes a user folder, moving its messages back to the inbox
+func (m *messageLabels) DeleteFolder(name string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	i := indexOf(m.folders, name)
+	if i < 0 {
+		return errors.New("there is no folder named \"" + name + "\"")
+	}
+	name = m.folders[i]
+	m.folders = append(m.folders[:i], m.folders[i+1:]...)
+	for key, state := range m.messages {
+		if state.folder == name {
+			state.folder = InboxFolder
+			m.cleanup(key)
+		}
+	}
+	return nil
+}
+
+func (m *messageLabels) LabelNames() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append(make([]string, 0, len(m.labels)), m.labels...)
+}
+
+func (m *messageLabels) CreateLabel(name string) error {
+	err := validName(name)
+	if err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if indexOf(m.labels, name) >= 0 {
+		return errors.New("label \"" + name + "\" already exists")
+	}
+	m.labels = append(m.labels, name)
+	return nil
+}
+
+func (m *messageLabels) DeleteLabel(name string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	i := indexOf(m.labels, name)
+	if i < 0 {
+		return errors.New("there is no label named \"" + name + "\"")
+	}
+	m.labels = append(m.labels[:i], m.labels[i+1:]...)
+	for key, state := range m.messages {
+		if j := indexOf(state.labels, name); j >= 0 {
+			state.labels = append(state.labels[:j], state.labels[j+1:]...)
+			m.cleanup(key)
+		}
+	}
+	return nil
+}
+
+func (m *messageLabels) ExpiredTrash(retention time.Duration, now time.Time) []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	result := make([]string, 0)
+	for key, state := range m.messages {
+		if state.folder == TrashFolder && now.Sub(state.trashedAt) > retention {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// InFolder returns a filter for NewMessageListView which matches messages in folder
+func InFolder(labels MessageLabels, folder string) func(message crypto.Message) bool {
+	return func(message crypto.Message) bool {
+		return strings.EqualFold(labels.Folder(MessageKey(message)), folder)
+	}
+}
+
+// WithLabel returns a filter for NewMessageListView which matches messages with label outside of the trash
+func WithLabel(labels MessageLabels, label string) func(message crypto.Message) bool {
+	return func(message crypto.Message) bool {
+		key := MessageKey(message)
+		return labels.HasLabel(key, label) && labels.Folder(key) != TrashFolder
+	}
+}
+
+// NotInTrash is a filter for NewMessageListView which hides deleted messages
+func NotInTrash(labels MessageLabels) func(message crypto.Message) bool {
+	return func(message crypto.Message) bool {
+		return labels.Folder(MessageKey(message)) != TrashFolder
+	}
+}
+
+// PurgeTrash permanently deletes messages which have been in the trash for longer than retention
+// from lists, returning the keys of the deleted messages. The caller is responsible for saving lists and labels.
+func PurgeTrash(labels MessageLabels, retention time.Duration, lists ...MessageList) []string {
+	expired := labels.ExpiredTrash(retention, time.Now())
+	for _, key := range expired {
+		DeleteForever(labels, key, lists...)
+	}
+	return expired
+}
+
+// DeleteForever removes the message identified by key from lists and labels
+func DeleteForever(labels MessageLabels, key string, lists ...MessageList) {
+	for _, l := range lists {
+		toRemove := make([]crypto.Message, 0)
+		l.ForEach(func(message crypto.Message) {
+			if MessageKey(message) == key {
+				toRemove = append(toRemove, message)
+			}
+		})
+		for _, message := range toRemove {
+			l.Remove(message)
+		}
+	}
+	labels.Forget(key)
+}
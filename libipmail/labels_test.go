@@ -0,0 +1,97 @@
+package ipmail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessageLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		folder     string
+		label      string
+		wantFolder string
+		wantErr    bool
+		wantTrash  bool
+	}{
+		{"Archive", ArchiveFolder, "", ArchiveFolder, false, false},
+		{"Trash", TrashFolder, "", TrashFolder, false, true},
+		{"User Folder", "work", "", "Work", false, false},
+		{"Unknown Folder", "nowhere", "", InboxFolder, true, false},
+		{"Label In Inbox", InboxFolder, "Important", InboxFolder, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := NewMessageLabels()
+			if err := labels.CreateFolder("Work"); err != nil {
+				t.Fatalf("CreateFolder() error = %v", err)
+			}
+			if err := labels.CreateLabel("Important"); err != nil {
+				t.Fatalf("CreateLabel() error = %v", err)
+			}
+			err := labels.Move("1", tt.folder)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Move() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.label != "" {
+				if err := labels.AddLabel("1", tt.label); err != nil {
+					t.Errorf("AddLabel() error = %v", err)
+				}
+			}
+			if got := labels.Folder("1"); got != tt.wantFolder {
+				t.Errorf("Folder() got = %q, want %q", got, tt.wantFolder)
+			}
+			if _, trashed := labels.TrashedAt("1"); trashed != tt.wantTrash {
+				t.Errorf("TrashedAt() trashed = %v, want %v", trashed, tt.wantTrash)
+			}
+			expired := labels.ExpiredTrash(time.Hour, time.Now().Add(2*time.Hour))
+			if (len(expired) == 1) != tt.wantTrash {
+				t.Errorf("ExpiredTrash() got = %v, want trashed %v", expired, tt.wantTrash)
+			}
+			if tt.label != "" && !labels.HasLabel("1", tt.label) {
+				t.Errorf("HasLabel() = false, want true")
+			}
+		})
+	}
+}
+
+func TestMessageLabels_persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "labels")
+
+	labels := NewMessageLabels()
+	_ = labels.CreateFolder("Work")
+	_ = labels.CreateLabel("Important")
+	_ = labels.Move("1", "Work")
+	_ = labels.AddLabel("1", "Important")
+	_ = labels.Move("2", TrashFolder)
+	trashedAt, _ := labels.TrashedAt("2")
+	if err := labels.SaveToFile(file, nil); err != nil {
+		t.Fatalf("SaveToFile() error = %v", err)
+	}
+
+	got, err := NewMessageLabelsFromFile(file, nil)
+	if err != nil {
+		t.Fatalf("NewMessageLabelsFromFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Folders(), []string{"Work"}) {
+		t.Errorf("Folders() got = %v", got.Folders())
+	}
+	if got.Folder("1") != "Work" || !got.HasLabel("1", "Important") {
+		t.Errorf("message 1 got folder %q and labels %v", got.Folder("1"), got.Labels("1"))
+	}
+	if at, ok := got.TrashedAt("2"); !ok || !at.Equal(trashedAt) {
+		t.Errorf("TrashedAt() got = %v, want %v", at, trashedAt)
+	}
+	if err := got.DeleteFolder("Work"); err != nil || got.Folder("1") != InboxFolder {
+		t.Errorf("DeleteFolder() error = %v, message 1 left in %q", err, got.Folder("1"))
+	}
+}
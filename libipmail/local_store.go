@@ -0,0 +1,299 @@
+package ipmail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LocalFiles are the files everything ipmail keeps on this computer is saved in
+type LocalFiles struct {
+	// Vault keeps the key the other files are sealed with once a passphrase is set
+	Vault    string
+	Identity string
+	Contacts string
+	Messages string
+	Sent     string
+	Requests string
+	Drafts   string
+	Outbox   string
+	Labels   string
+	Flags    string
+	Seen     string
+	Pins     string
+	Sessions string
+	Pending  string
+	Names    string
+	Profiles string
+	Details  string
+	Sync     string
+}
+
+// sealed are the files which hold local data. Message bodies and the messages spooled by the outbox are kept
+// apart since they are too big to be sealed at once
+func (f LocalFiles) sealed() []string {
+	return []string{f.Identity, f.Contacts, f.Messages, f.Sent, f.Requests, f.Drafts, f.Outbox,
+		f.Labels, f.Flags, f.Seen, f.Pins, f.Sessions, f.Pending, f.Names, f.Profiles, f.Details, f.Sync}
+}
+
+// LocalData is what a LocalStore loads. Like with the FromFile constructors, a field is nil if its file is not found
+type LocalData struct {
+	Identity crypto.SelfIdentity
+	Contacts crypto.ContactsIdentityList
+	Messages MessageList
+	Sent     MessageList
+	Requests MessageList
+	Drafts   DraftList
+	Outbox   Outbox
+	Labels   MessageLabels
+	Flags    MessageFlags
+	Seen     SeenCache
+	Pins     PinStore
+	Sessions crypto.SessionStore
+	Pending  PendingRequests
+	Names    ContactNames
+	Profiles ProfileCache
+	Details  ContactDetails
+	Sync     SyncLog
+}
+
+// LocalStore loads the LocalData, which is sealed with a key derived from the passphrase once one is set
+type LocalStore interface {
+	// Locked tells if the local files are sealed and the passphrase hasn't been entered yet
+	Locked() bool
+	// Unlock fails with crypto.ErrWrongPassphrase if passphrase isn't the one set
+	Unlock(passphrase []byte) error
+	// Load reads every local file and starts the outbox. While the store is locked it fails with
+	// util.ErrLocked, so nothing is decrypted before the user unlocks it, and with util.ErrNotSealed if a
+	// passphrase is set but a file is in plaintext
+	Load() (LocalData, error)
+	// SetPassphrase seals every local file with a key derived from passphrase,
+	// or changes the passphrase if the files are already sealed
+	SetPassphrase(passphrase []byte) error
+	// Close stops the outbox if it was loaded
+	Close() error
+}
+
+type localStore struct {
+	mtx    sync.Mutex
+	files  LocalFiles
+	vault  crypto.Vault // nil until a passphrase is set
+	outbox Outbox
+	sealer util.SealerSwitch
+	sender Sender
+	bodies crypto.BodyStore
+	ipfs   util.Cat
+}
+
+// sealingMarker is next to the vault while the files saved before the passphrase was set are sealed. Until it is
+// removed those files may still be in plaintext, which is refused otherwise
+func sealingMarker(vault string) string {
+	return vault + "-sealing"
+}
+
+// NewLocalStore reads the vault in files, if there is one, which leaves the store locked. sealer is switched to
+// the vault, so it should be the one bodies seals with. sender, bodies and ipfs are used to load the outbox and
+// the message lists
+func NewLocalStore(files LocalFiles, sealer util.SealerSwitch, sender Sender, bodies crypto.BodyStore,
+	ipfs util.Cat) (LocalStore, error) {
+	vault, err := crypto.NewVaultFromFile(files.Vault)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if vault == nil {
+		for _, file := range files.sealed() {
+			if util.IsSealedFile(file) {
+				return nil, fmt.Errorf("%s is encrypted but its vault %s is missing", file, files.Vault)
+			}
+		}
+	} else {
+		sealer.Switch(vault) // so files in plaintext are refused even before it is unlocked
+	}
+	return &localStore{
+		files:  files,
+		vault:  vault,
+		sealer: sealer,
+		sender: sender,
+		bodies: bodies,
+		ipfs:   ipfs,
+	}, nil
+}
+
+func (s *localStore) Locked() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.vault != nil && s.vault.Locked()
+}
+
+func (s *localStore) Unlock(passphrase []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.vault == nil {
+		return nil
+	}
+	err := s.vault.Unlock(passphrase)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(sealingMarker(s.files.Vault)); err == nil {
+		return s.sealAll() // the last run stopped before every file was sealed
+	}
+	return nil
+}
+
+func (s *localStore) Load() (LocalData, error) {
+	if s.Locked() {
+		return LocalData{}, util.ErrLocked
+	}
+	if s.sealer.Sealing() {
+		for _, file := range s.files.sealed() {
+			if _, err := os.Stat(file); err == nil && !util.IsSealedFile(file) {
+				return LocalData{}, fmt.Errorf("%s: %w", file, util.ErrNotSealed)
+			}
+		}
+	}
+	result := LocalData{}
+	result.Identity = crypto.NewSelfIdentityFromFile(s.files.Identity, s.sealer)
+	result.Contacts, _ = crypto.NewContactsIdentityListFromFile(s.files.Contacts, s.sealer)
+	result.Messages = s.loadMessageList(s.files.Messages, result.Identity, result.Contacts)
+	result.Sent = s.loadMessageList(s.files.Sent, result.Identity, result.Contacts)
+	result.Requests = s.loadMessageList(s.files.Requests, result.Identity, result.Contacts)
+	result.Drafts = NewDraftListFromFile(s.files.Drafts, s.sealer, result.Identity)
+	result.Labels, _ = NewMessageLabelsFromFile(s.files.Labels, s.sealer)
+	result.Flags, _ = NewMessageFlagsFromFile(s.files.Flags, s.sealer)
+	result.Seen, _ = NewSeenCacheFromFile(s.files.Seen, s.sealer, DefaultSeenCacheSize)
+	result.Pins, _ = NewPinStoreFromFile(s.files.Pins, s.sealer)
+	result.Sessions, _ = crypto.NewSessionStoreFromFile(s.files.Sessions, s.sealer)
+	result.Pending, _ = NewPendingRequestsFromFile(s.files.Pending, s.sealer)
+	result.Names, _ = NewContactNamesFromFile(s.files.Names, s.sealer)
+	result.Profiles, _ = NewProfileCacheFromFile(s.files.Profiles, s.sealer)
+	result.Details, _ = NewContactDetailsFromFile(s.files.Details, s.sealer)
+	result.Sync, _ = NewSyncLogFromFile(s.files.Sync, s.sealer)
+	if MigrateLegacyKeys(result.Labels, result.Flags, result.Messages, result.Sent, result.Requests) {
+		s.saveMigrated(result)
+	}
+	var err error
+	result.Outbox, err = NewOutbox(s.sender, s.files.Outbox, s.sealer)
+	if err != nil {
+		return result, err
+	}
+	s.mtx.Lock()
+	s.outbox = result.Outbox
+	s.mtx.Unlock()
+	return result, nil
+}
+
+func (s *localStore) loadMessageList(file string, identity crypto.SelfIdentity, contacts crypto.ContactsIdentityList) MessageList {
+	return NewMessageListFromFile(file, s.sealer, s.bodies, s.ipfs, identity, contacts)
+}
+
+// saveMigrated saves everything MigrateLegacyKeys touched so old saves are only migrated once
+func (s *localStore) saveMigrated(data LocalData) {
+	lists := map[string]MessageList{s.files.Messages: data.Messages, s.files.Sent: data.Sent, s.files.Requests: data.Requests}
+	for file, list := range lists {
+		if list == nil {
+			continue
+		}
+		err := list.SaveToFile(file, s.sealer)
+		if err != nil {
+			println("warning: migrated", file, "could not be saved to file due to:", err.Error())
+		}
+	}
+	if data.Labels != nil {
+		err := data.Labels.SaveToFile(s.files.Labels, s.sealer)
+		if err != nil {
+			println("warning: migrated labels could not be saved to file due to:", err.Error())
+		}
+	}
+	if data.Flags != nil {
+		err := data.Flags.SaveToFile(s.files.Flags, s.sealer)
+		if err != nil {
+			println("warning: migrated flags could not be saved to file due to:", err.Error())
+		}
+	}
+}
+
+func (s *localStore) SetPassphrase(passphrase []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.vault != nil {
+		err := s.vault.ChangePassphrase(passphrase)
+		if err != nil {
+			return err
+		}
+		return s.vault.SaveToFile(s.files.Vault)
+	}
+	vault, err := crypto.NewVault(passphrase)
+	if err != nil {
+		return err
+	}
+	// the marker and the vault are saved first so a crash can't leave sealed files without their key, or files
+	// in plaintext which are never sealed
+	err = ioutil.WriteFile(sealingMarker(s.files.Vault), nil, 0600)
+	if err != nil {
+		return err
+	}
+	err = vault.SaveToFile(s.files.Vault)
+	if err != nil {
+		return err
+	}
+	s.vault = vault
+	s.sealer.Switch(vault)
+	return s.sealAll()
+}
+
+// sealAll seals every local file once the vault is made, then removes the sealing marker. It is the only time
+// files in plaintext are read with the vault, and is done again if it didn't finish
+func (s *localStore) sealAll() error {
+	for _, file := range s.files.sealed() {
+		err := util.SealFile(file, s.sealer)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.sealOutboxBodies()
+	if err != nil {
+		return err
+	}
+	if s.bodies != nil {
+		err = s.bodies.Reseal()
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(sealingMarker(s.files.Vault))
+}
+
+// sealOutboxBodies seals the messages spooled by the outbox, which are too big for SealFile
+func (s *localStore) sealOutboxBodies() error {
+	if len(s.files.Outbox) == 0 {
+		return nil
+	}
+	dir := outboxBodies(s.files.Outbox)
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		err = util.SealStreamFile(filepath.Join(dir, info.Name()), s.sealer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *localStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.outbox == nil {
+		return nil
+	}
+	return s.outbox.Close()
+}
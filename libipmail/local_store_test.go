@@ -0,0 +1,210 @@
+package ipmail
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestLocalFiles(t *testing.T) LocalFiles {
+	dir, err := ioutil.TempDir("", "ipmail-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	return LocalFiles{
+		Vault:    file("vault"),
+		Identity: file("identity"),
+		Contacts: file("contacts"),
+		Messages: file("messages"),
+		Sent:     file("sent"),
+		Requests: file("requests"),
+		Drafts:   file("drafts"),
+		Outbox:   file("outbox"),
+		Labels:   file("labels"),
+		Flags:    file("flags"),
+		Seen:     file("seen"),
+		Pins:     file("pins"),
+		Sessions: file("sessions"),
+		Pending:  file("pending"),
+		Names:    file("names"),
+		Profiles: file("profiles"),
+		Details:  file("contact-details"),
+		Sync:     file("sync"),
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	files := newTestLocalFiles(t)
+	sender := NewSender(NewLoopbackNetwork().Join("alice"))
+	identity, err := crypto.NewSelfIdentity("alice", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = identity.SaveToFile(files.Identity, nil); err != nil {
+		t.Fatal(err)
+	}
+	labels := NewMessageLabels()
+	if err = labels.CreateFolder("Secret Project"); err != nil {
+		t.Fatal(err)
+	}
+	if err = labels.SaveToFile(files.Labels, nil); err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := NewOutbox(sender, files.Outbox, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := enqueueTest(t, outbox, "Secret Project plans", time.Now().Add(time.Hour))
+	_ = outbox.Close()
+
+	store, err := NewLocalStore(files, util.NewSealerSwitch(), sender, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Locked() {
+		t.Fatal("a store without a passphrase is locked")
+	}
+	if err = store.SetPassphrase([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetPassphrase([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+	spooled := filepath.Join(outboxBodies(files.Outbox), strconv.FormatUint(queued.Id, 10))
+	for _, file := range []string{files.Identity, files.Labels, spooled} {
+		b, _ := ioutil.ReadFile(file)
+		if !util.IsSealedFile(file) || bytes.Contains(b, []byte("Secret Project")) {
+			t.Errorf("%s wasn't sealed", filepath.Base(file))
+		}
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		wantErr    error
+	}{
+		{"Old Passphrase", "first", crypto.ErrWrongPassphrase},
+		{"Passphrase", "second", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewLocalStore(files, util.NewSealerSwitch(), sender, nil, nil) // like a new run
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if !store.Locked() {
+				t.Fatal("a store with a passphrase isn't locked")
+			}
+			if _, err = store.Load(); err != util.ErrLocked {
+				t.Fatalf("Load() while locked error = %v, want %v", err, util.ErrLocked)
+			}
+			err = store.Unlock([]byte(tt.passphrase))
+			if err != tt.wantErr {
+				t.Fatalf("Unlock() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			data, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Identity == nil || data.Identity.DefaultIdentity().PrimaryKey.KeyId != identity.DefaultIdentity().PrimaryKey.KeyId {
+				t.Error("Load() didn't read the sealed identity")
+			}
+			if data.Labels == nil || len(data.Labels.Folders()) != 1 {
+				t.Error("Load() didn't read the sealed labels")
+			}
+			if entry, ok := data.Outbox.FromIndex(0); !ok || readOutboxBody(t, entry) != "Secret Project plans" {
+				t.Error("Load() didn't read the sealed outbox")
+			}
+		})
+	}
+}
+
+func TestNewLocalStore_missingVault(t *testing.T) {
+	files := newTestLocalFiles(t)
+	store, err := NewLocalStore(files, util.NewSealerSwitch(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = NewMessageFlags().SaveToFile(files.Flags, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetPassphrase([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(files.Vault); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewLocalStore(files, util.NewSealerSwitch(), nil, nil, nil); err == nil {
+		t.Error("NewLocalStore() with sealed files but no vault succeeded")
+	}
+}
+
+func TestLocalStore_plaintext(t *testing.T) {
+	files := newTestLocalFiles(t)
+	store, err := NewLocalStore(files, util.NewSealerSwitch(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetPassphrase([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(sealingMarker(files.Vault)); !os.IsNotExist(err) {
+		t.Errorf("the sealing marker is left after sealing every file, error = %v", err)
+	}
+	labels := NewMessageLabels()
+	if err = labels.CreateFolder("Planted"); err != nil {
+		t.Fatal(err)
+	}
+	if err = labels.SaveToFile(files.Labels, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		interrupt bool
+		wantErr   error
+	}{
+		{"Plaintext", false, util.ErrNotSealed},
+		{"Sealing Interrupted", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.interrupt {
+				if err := ioutil.WriteFile(sealingMarker(files.Vault), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store, err := NewLocalStore(files, util.NewSealerSwitch(), nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Unlock([]byte("passphrase")); err != nil {
+				t.Fatal(err)
+			}
+			data, err := store.Load()
+			defer store.Close()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Load() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (data.Labels == nil || len(data.Labels.Folders()) != 1 || !util.IsSealedFile(files.Labels)) {
+				t.Error("the labels in plaintext weren't sealed when sealing was finished")
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"strings"
+	"sync"
+)
+
+// LoopbackNetwork connects Transports in memory. Everything added by one peer can be read by every other peer
+// and everything published is delivered to every subscriber on the topic, including the publisher.
+type LoopbackNetwork interface {
+	// Join adds a peer with the given id to the network. The transport is also a Pinner and a NameSystem
+	Join(id peer.ID) Transport
+	// SetDNSLink points the DNSLink of domain at p, which can be another /ipns/ name
+	SetDNSLink(domain string, p path.Path)
+}
+
+type loopbackNetwork struct {
+	mtx           sync.Mutex
+	blocks        map[string][]byte
+	pins          map[string]map[peer.ID]bool
+	subscriptions map[string][]*loopbackSubscription
+	// names are what IPNS names and DNSLink domains point at, without /ipns/
+	names map[string]path.Path
+	seq   uint64
+}
+
+func NewLoopbackNetwork() LoopbackNetwork {
+	return &loopbackNetwork{
+		blocks:        make(map[string][]byte),
+		pins:          make(map[string]map[peer.ID]bool),
+		subscriptions: make(map[string][]*loopbackSubscription),
+		names:         make(map[string]path.Path),
+	}
+}
+
+func (n *loopbackNetwork) Join(id peer.ID) Transport {
+	result := &loopbackTransport{
+		network: n,
+		id:      id,
+	}
+	result.ctx, result.cancel = context.WithCancel(context.Background())
+	return result
+}
+
+func (n *loopbackNetwork) SetDNSLink(domain string, p path.Path) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.names[strings.ToLower(domain)] = p
+}
+
+func (n *loopbackNetwork) remove(s *loopbackSubscription) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	subscriptions := n.subscriptions[s.topic]
+	for i, compare := range subscriptions {
+		if compare == s {
+			n.subscriptions[s.topic] = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+type loopbackTransport struct {
+	network *loopbackNetwork
+	id      peer.ID
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (t *loopbackTransport) Cat(resolved path.Resolved) ([]byte, error) {
+	return t.CatContext(t.ctx, resolved)
+}
+
+// CatContext never waits, the block is either on the network or it isn't
+func (t *loopbackTransport) CatContext(ctx context.Context, resolved path.Resolved) ([]byte, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	b, ok := t.network.blocks[resolved.Cid().String()]
+	if !ok {
+		return nil, fmt.Errorf("Could not get file with CID: %s", resolved.Cid())
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (t *loopbackTransport) CatReader(ctx context.Context, resolved path.Resolved) (io.ReadCloser, error) {
+	b, err := t.CatContext(ctx, resolved)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (t *loopbackTransport) AddFromBytes(b []byte) (path.Resolved, error) {
+	c, err := util.ContentCid(b)
+	if err != nil {
+		return nil, err
+	}
+	t.network.mtx.Lock()
+	t.network.blocks[c.String()] = append([]byte(nil), b...)
+	t.network.mtx.Unlock()
+	return path.IpfsPath(c), nil
+}
+
+func (t *loopbackTransport) AddFromReader(reader io.Reader) (path.Resolved, error) {
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return t.AddFromBytes(b)
+}
+
+func (t *loopbackTransport) Publish(topic string, toSend []byte) error {
+	return t.PublishContext(t.ctx, topic, toSend)
+}
+
+func (t *loopbackTransport) PublishContext(ctx context.Context, topic string, toSend []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	n := t.network
+	n.mtx.Lock()
+	n.seq++
+	message := &loopbackMessage{
+		from:   t.id,
+		data:   append([]byte(nil), toSend...),
+		seq:    []byte(fmt.Sprint(n.seq)),
+		topics: []string{topic},
+	}
+	subscriptions := append([]*loopbackSubscription(nil), n.subscriptions[topic]...)
+	n.mtx.Unlock()
+	for _, s := range subscriptions {
+		s.deliver(message)
+	}
+	return nil
+}
+
+func (t *loopbackTransport) Subscribe(topic string, options ...options.PubSubSubscribeOption) (iface.PubSubSubscription, error) {
+	s := &loopbackSubscription{
+		network: t.network,
+		topic:   topic,
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	t.network.mtx.Lock()
+	t.network.subscriptions[topic] = append(t.network.subscriptions[topic], s)
+	t.network.mtx.Unlock()
+	return s, nil
+}
+
+func (t *loopbackTransport) Pin(c cid.Cid) error {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	if _, ok := t.network.blocks[c.String()]; !ok {
+		return fmt.Errorf("Could not get file with CID: %s", c)
+	}
+	if t.network.pins[c.String()] == nil {
+		t.network.pins[c.String()] = make(map[peer.ID]bool)
+	}
+	t.network.pins[c.String()][t.id] = true
+	return nil
+}
+
+func (t *loopbackTransport) Unpin(c cid.Cid) error {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	if !t.network.pins[c.String()][t.id] {
+		return errors.New("not pinned")
+	}
+	delete(t.network.pins[c.String()], t.id)
+	return nil
+}
+
+// CollectGarbage deletes the blocks no peer on the network has pinned
+func (t *loopbackTransport) CollectGarbage() (uint64, error) {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	var freed uint64 = 0
+	for key, b := range t.network.blocks {
+		if len(t.network.pins[key]) == 0 {
+			freed += uint64(len(b))
+			delete(t.network.blocks, key)
+			delete(t.network.pins, key)
+		}
+	}
+	return freed, nil
+}
+
+// PublishName names the key after the peer and the key name, so every peer's keys have their own names
+func (t *loopbackTransport) PublishName(ctx context.Context, key string, p path.Path) (string, error) {
+	name, err := util.ContentCid([]byte(t.id.String() + "/" + key))
+	if err != nil {
+		return "", err
+	}
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	t.network.names[name.String()] = p
+	return "/ipns/" + name.String(), nil
+}
+
+// ResolveName follows names pointing at other names like IPFS does
+func (t *loopbackTransport) ResolveName(ctx context.Context, name string) (path.Path, error) {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	resolved := path.New(name)
+	for depth := 0; depth < 32 && resolved.Namespace() == "ipns"; depth++ {
+		p, ok := t.network.names[strings.TrimPrefix(resolved.String(), "/ipns/")]
+		if !ok {
+			return nil, fmt.Errorf("could not resolve name: %s", name)
+		}
+		resolved = p
+	}
+	if resolved.Namespace() == "ipns" {
+		return nil, fmt.Errorf("could not resolve name: %s", name)
+	}
+	return resolved, nil
+}
+
+func (t *loopbackTransport) Context() context.Context {
+	return t.ctx
+}
+
+// Close leaves the network. The blocks added stay on it for the other peers
+func (t *loopbackTransport) Close() error {
+	t.cancel()
+	return nil
+}
+
+type loopbackMessage struct {
+	from   peer.ID
+	data   []byte
+	seq    []byte
+	topics []string
+}
+
+func (m *loopbackMessage) From() peer.ID    { return m.from }
+func (m *loopbackMessage) Data() []byte     { return m.data }
+func (m *loopbackMessage) Seq() []byte      { return m.seq }
+func (m *loopbackMessage) Topics() []string { return m.topics }
+
+// loopbackSubscription queues every message so a slow reader never blocks a publisher
+type loopbackSubscription struct {
+	network   *loopbackNetwork
+	topic     string
+	mtx       sync.Mutex
+	queue     []iface.PubSubMessage
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *loopbackSubscription) deliver(message iface.PubSubMessage) {
+	s.mtx.Lock()
+	s.queue = append(s.queue, message)
+	s.mtx.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *loopbackSubscription) Next(ctx context.Context) (iface.PubSubMessage, error) {
+	for {
+		s.mtx.Lock()
+		if len(s.queue) > 0 {
+			message := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mtx.Unlock()
+			return message, nil
+		}
+		s.mtx.Unlock()
+		select {
+		case <-s.wake:
+		case <-s.closed:
+			return nil, errors.New("subscription closed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *loopbackSubscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.network.remove(s)
+		close(s.closed)
+	})
+	return nil
+}
@@ -0,0 +1,521 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoopbackTransport(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice, bob := network.Join("alice"), network.Join("bob")
+
+	added, err := alice.AddFromBytes([]byte("hello world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Cid().String() != "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o" {
+		t.Errorf("AddFromBytes() = %s, want the same CID as IPFS", added.Cid())
+	}
+	got, err := bob.Cat(added)
+	if err != nil || string(got) != "hello world\n" {
+		t.Errorf("Cat() = %q, %v", got, err)
+	}
+
+	aliceSub, _ := alice.Subscribe("topic")
+	bobSub, _ := bob.Subscribe("topic")
+	otherSub, _ := bob.Subscribe("other")
+	closedSub, _ := alice.Subscribe("topic")
+	_ = closedSub.Close()
+	if err := bob.Publish("topic", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sub     iface.PubSubSubscription
+		wantErr bool
+	}{
+		{"Subscriber", aliceSub, false},
+		{"Publisher", bobSub, false},
+		{"Other Topic", otherSub, true},
+		{"Closed", closedSub, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			message, err := tt.sub.Next(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (message.From() != "bob" || string(message.Data()) != "hi") {
+				t.Errorf("Next() = %s %q, want bob \"hi\"", message.From(), message.Data())
+			}
+		})
+	}
+}
+
+type loopbackUser struct {
+	identity crypto.SelfIdentity
+	mailbox  Mailbox
+	events   chan Event
+}
+
+// newLoopbackUser joins network with a new identity. configure changes the defaults of the mailbox
+func newLoopbackUser(t *testing.T, network LoopbackNetwork, name string, configure ...func(config *MailboxConfig)) *loopbackUser {
+	transport := network.Join(peer.ID(name))
+	identity, err := crypto.NewSelfIdentity(name, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSender(transport)
+	outbox, err := NewOutbox(sender, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewReceiver(crypto.MessageTopicName, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		_ = outbox.Close()
+		_ = receiver.Close()
+	})
+	config := MailboxConfig{
+		Ipfs:     transport,
+		Sender:   sender,
+		Outbox:   outbox,
+		Identity: identity,
+		Contacts: crypto.NewContactsIdentityList(identity.EntityList()),
+	}
+	for _, c := range configure {
+		c(&config)
+	}
+	result := &loopbackUser{
+		identity: identity,
+		mailbox:  NewMailbox(config),
+		events:   make(chan Event, 16),
+	}
+	result.mailbox.Events().Subscribe(ctx, func(event Event) {
+		result.events <- event
+	})
+	result.mailbox.Receive(ctx, receiver, nil)
+	return result
+}
+
+func (u *loopbackUser) send(t *testing.T, content string, to *loopbackUser) {
+	_, err := u.mailbox.Queue(bytes.NewBufferString(content), time.Now(), to.identity.DefaultIdentity())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (u *loopbackUser) expect(t *testing.T, want EventType) Event {
+	select {
+	case event := <-u.events:
+		if event.Type != want {
+			t.Fatalf("got a %s event, want %s", event.Type, want)
+		}
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for a %s event", want)
+	}
+	return Event{}
+}
+
+// skip waits for the next event whatever its type
+func (u *loopbackUser) skip(t *testing.T) {
+	select {
+	case <-u.events:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+}
+
+func TestLoopbackTransport_Close(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice, bob := network.Join("alice"), network.Join("bob")
+	added, err := alice.AddFromBytes([]byte("hello world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := alice.Subscribe("topic")
+	if err := alice.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := alice.Cat(added); err == nil {
+		t.Error("Cat() after Close() succeeded")
+	}
+	if err := alice.Publish("topic", []byte("hi")); err == nil {
+		t.Error("Publish() after Close() succeeded")
+	}
+	if _, err := sub.Next(alice.Context()); err == nil {
+		t.Error("Next() after Close() got a message")
+	}
+	if got, err := bob.Cat(added); err != nil || string(got) != "hello world\n" {
+		t.Errorf("Cat() by another peer = %q, %v", got, err)
+	}
+}
+
+func TestLoopback_endToEnd(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice")
+	bob := newLoopbackUser(t, network, "bob")
+	carol := newLoopbackUser(t, network, "carol")
+
+	if _, err := alice.mailbox.SendRequest("hi, it's alice", time.Now(), bob.identity.DefaultIdentity()); err != nil {
+		t.Fatal(err)
+	}
+	alice.expect(t, SentEcho)
+	request := bob.expect(t, ContactRequest).Message
+	carol.expect(t, DecryptFailed)
+	if handshake := request.Handshake(); handshake == nil || handshake.Note != "hi, it's alice" {
+		t.Fatalf("Handshake() = %v, want the request with its note", handshake)
+	}
+	if err := bob.mailbox.AcceptRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect(t, SentEcho)
+	alice.expect(t, ContactAccepted)
+	carol.expect(t, DecryptFailed)
+	if found, err := alice.mailbox.Contacts().GetByPublicKey(*bob.identity.DefaultIdentity().PrimaryKey); err != nil || len(found.ToArray()) != 1 {
+		t.Fatal("the accept didn't add bob to the contacts of alice")
+	}
+
+	bob.send(t, "hi alice", alice)
+	bob.expect(t, SentEcho)
+	alice.expect(t, MessageReceived)
+	carol.expect(t, DecryptFailed)
+
+	tests := []struct {
+		name    string
+		user    *loopbackUser
+		list    func(m Mailbox) MessageList
+		wantLen int
+	}{
+		{"Alice Sent", alice, Mailbox.Sent, 1},
+		{"Alice Inbox", alice, Mailbox.Messages, 2},
+		{"Alice Requests", alice, Mailbox.Requests, 0},
+		{"Bob Sent", bob, Mailbox.Sent, 2},
+		{"Bob Inbox", bob, Mailbox.Messages, 1},
+		{"Bob Requests", bob, Mailbox.Requests, 0},
+		{"Carol Inbox", carol, Mailbox.Messages, 0},
+		{"Carol Requests", carol, Mailbox.Requests, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.list(tt.user.mailbox).Len(); got != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestLoopback_handshakes(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice")
+	bob := newLoopbackUser(t, network, "bob")
+
+	if _, err := alice.mailbox.SendRequest("", time.Now(), bob.identity.DefaultIdentity()); err != nil {
+		t.Fatal(err)
+	}
+	alice.expect(t, SentEcho)
+	if err := bob.mailbox.DenyRequest(bob.expect(t, ContactRequest).Message); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect(t, SentEcho)
+	alice.expect(t, ContactDeclined)
+
+	// nobody asked for these answers, so the accept needs consent and the decline is dropped
+	answers := []struct {
+		kind crypto.HandshakeKind
+		want EventType
+	}{
+		{crypto.HandshakeAccept, ContactAccepted},
+		{crypto.HandshakeDecline, ContactDeclined},
+	}
+	for _, answer := range answers {
+		content := bytes.NewBuffer(make([]byte, 0))
+		handshake := &crypto.Handshake{Kind: answer.kind, Key: bob.identity.DefaultIdentity()}
+		if err := handshake.Serialize(content); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.mailbox.Queue(content, time.Now(), alice.identity.DefaultIdentity()); err != nil {
+			t.Fatal(err)
+		}
+		bob.expect(t, SentEcho)
+		alice.expect(t, answer.want) // before the next answer, which could arrive first otherwise
+	}
+
+	tests := []struct {
+		name    string
+		got     func() int
+		wantLen int
+	}{
+		{"Inbox", alice.mailbox.Messages().Len, 1}, // only the decline of her request
+		{"Requests", alice.mailbox.Requests().Len, 1},
+		{"Contacts", func() int { return len(alice.mailbox.Contacts().ToArray()) }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got(); got != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestLoopback_pins(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice")
+	bob := newLoopbackUser(t, network, "bob")
+	alice.mailbox.Contacts().Add(bob.identity.DefaultIdentity())
+	bob.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+
+	alice.send(t, "hi bob", bob)
+	sent := alice.expect(t, SentEcho).Cid
+	bob.expect(t, MessageReceived)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		entry, ok := alice.mailbox.Pins().Get(sent)
+		if ok && entry.Outgoing && entry.Waiting == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bob never acknowledged the message, pin is %v", entry)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("Forged Acks", func(t *testing.T) {
+		mallory, _ := gpg.NewEntity("mallory", "", "", util.DefaultEncryptionConfig())
+		waiting, _ := util.ContentCid([]byte("waiting for bob"))
+		alice.mailbox.Pins().PinOutgoing(waiting, []string{entityFingerprint(bob.identity.DefaultIdentity())}, time.Hour)
+		ack := func(signer *gpg.Entity) *fakeAnnouncement {
+			data := append(append([]byte(crypto.MessageAckPrefix), waiting.Bytes()...), crypto.MessageCidPostfix...)
+			if signer != nil {
+				signature, err := crypto.SignAck(waiting, signer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = append(data, signature...)
+			}
+			return &fakeAnnouncement{data: data, topics: []string{crypto.MessageTopicName}}
+		}
+		for _, forged := range []*gpg.Entity{nil, mallory, alice.identity.DefaultIdentity()} {
+			alice.mailbox.(*mailbox).handleAck(ack(forged))
+		}
+		if entry, _ := alice.mailbox.Pins().Get(waiting); entry.Waiting != 1 {
+			t.Fatalf("Waiting = %d after acks nobody it was sent to signed, want 1", entry.Waiting)
+		}
+		alice.mailbox.(*mailbox).handleAck(ack(bob.identity.DefaultIdentity()))
+		if entry, _ := alice.mailbox.Pins().Get(waiting); entry.Waiting != 0 {
+			t.Errorf("Waiting = %d after bob signed the ack, want 0", entry.Waiting)
+		}
+		alice.mailbox.Pins().Remove(waiting)
+	})
+
+	tests := []struct {
+		name         string
+		user         *loopbackUser
+		before       func()
+		wantUnpinned int
+		wantFreed    bool
+	}{
+		{"Sender After Ack", alice, func() {}, 1, false}, // bob still pins it
+		{"Recipient Keeps Listed", bob, func() {}, 0, false},
+		{"Recipient After Delete", bob, func() {
+			bob.mailbox.Messages().Remove(bob.mailbox.Messages().FromCid(sent))
+		}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.before()
+			got, err := tt.user.mailbox.CollectGarbage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Unpinned != tt.wantUnpinned || (got.Freed > 0) != tt.wantFreed {
+				t.Errorf("CollectGarbage() = %+v, want %d unpinned and freed %v", got, tt.wantUnpinned, tt.wantFreed)
+			}
+		})
+	}
+}
+
+func TestLoopback_bodies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-bodies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bodies, err := crypto.NewBodyStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBodies, err := crypto.NewBodyStore(filepath.Join(dir, "carol"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice")
+	bob := newLoopbackUser(t, network, "bob", func(config *MailboxConfig) {
+		config.Bodies = bodies
+	})
+	carol := newLoopbackUser(t, network, "carol", func(config *MailboxConfig) {
+		config.Bodies = otherBodies
+	})
+	alice.mailbox.Contacts().Add(bob.identity.DefaultIdentity())
+	bob.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+
+	content := strings.Repeat("a long message ", 10000)
+	alice.send(t, content, bob)
+	received := bob.expect(t, MessageReceived)
+	if !bodies.Has(received.Cid) {
+		t.Fatal("the received message isn't in the body store")
+	}
+	if failed := carol.expect(t, DecryptFailed); otherBodies.Has(failed.Cid) {
+		t.Error("the body of a message for someone else was kept")
+	}
+	body, err := received.Message.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(body)
+	_ = body.Close()
+	if string(got) != content {
+		t.Errorf("Body() = %d bytes, want the %d bytes sent", len(got), len(content))
+	}
+
+	bob.mailbox.Messages().Remove(received.Message)
+	result, _ := bob.mailbox.CollectGarbage()
+	if result.Bodies != 1 || bodies.Has(received.Cid) {
+		t.Errorf("CollectGarbage() = %+v, want the body of the deleted message removed", result)
+	}
+}
+
+func TestLoopback_sessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-bodies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bodies, err := crypto.NewBodyStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice", func(config *MailboxConfig) {
+		config.Sessions = crypto.NewSessionStore()
+	})
+	bob := newLoopbackUser(t, network, "bob", func(config *MailboxConfig) {
+		config.Sessions = crypto.NewSessionStore()
+		config.Bodies = bodies
+	})
+	carol := newLoopbackUser(t, network, "carol")
+	bob.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+	carol.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+	if err = alice.mailbox.AddContact(carol.identity.DefaultIdentity(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request and the accept carry the prekey bundles, so both sides can seal
+	if _, err = bob.mailbox.SendRequest("", time.Now(), alice.identity.DefaultIdentity()); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect(t, SentEcho)
+	if err = alice.mailbox.AcceptRequest(alice.expect(t, ContactRequest).Message); err != nil {
+		t.Fatal(err)
+	}
+	carol.skip(t)
+	alice.expect(t, SentEcho)
+	bob.expect(t, ContactAccepted)
+	carol.skip(t)
+	transport := network.Join("bob")
+
+	tests := []struct {
+		name       string
+		from       *loopbackUser
+		to         *loopbackUser
+		wantSealed bool
+	}{
+		{"Sealed", alice, bob, true},
+		{"Sealed Reply", bob, alice, true},
+		{"Sealed Again", alice, bob, true},
+		{"Recipient Without Sessions", alice, carol, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.from.send(t, tt.name, tt.to)
+			echo := tt.from.expect(t, SentEcho)
+			received := tt.to.expect(t, MessageReceived)
+			for _, user := range []*loopbackUser{alice, bob, carol} {
+				if user != tt.from && user != tt.to {
+					user.skip(t) // every announcement reaches everyone
+				}
+			}
+			if got := string(received.Message.Data()); got != tt.name || string(echo.Message.Data()) != tt.name {
+				t.Errorf("Data() = %q, want %q", got, tt.name)
+			}
+			data, err := transport.Cat(path.IpfsPath(received.Cid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := crypto.IsSealed(data); got != tt.wantSealed {
+				t.Errorf("IsSealed() = %v, want %v", got, tt.wantSealed)
+			}
+		})
+	}
+}
+
+func TestSender_Send(t *testing.T) {
+	network := NewLoopbackNetwork()
+	bob := newLoopbackUser(t, network, "bob")
+	alice, err := crypto.NewSelfIdentity("alice", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.mailbox.Contacts().Add(alice.DefaultIdentity())
+	sender := NewSender(network.Join("alice"))
+
+	tests := []struct {
+		name    string
+		content string
+		to      *gpg.Entity
+		wantErr bool
+	}{
+		{"Short", "hi bob", bob.identity.DefaultIdentity(), false},
+		{"Streamed", strings.Repeat("a long message ", 100000), bob.identity.DefaultIdentity(), false},
+		{"Not A Contact", "hi", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, err := sender.Send(bytes.NewBufferString(tt.content), true, alice.DefaultIdentity(), tt.to)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			event := bob.expect(t, MessageReceived)
+			if !event.Cid.Equals(sent) || string(event.Message.Data()) != tt.content {
+				t.Errorf("received %v with %d bytes, want %v with %d bytes",
+					event.Cid, len(event.Message.Data()), sent, len(tt.content))
+			}
+		})
+	}
+}
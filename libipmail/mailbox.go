@@ -0,0 +1,813 @@
+package ipmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"io"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"sync"
+	"time"
+)
+
+// MailboxFiles are where a Mailbox saves what it changes. Empty names are not saved.
+type MailboxFiles struct {
+	Contacts string
+	Messages string
+	Sent     string
+	Requests string
+	Seen     string
+	Pins     string
+	Sessions string
+	Pending  string
+	Names    string
+	Profiles string
+	Details  string
+	Labels   string
+	Flags    string
+	Sync     string
+}
+
+type MailboxConfig struct {
+	Ipfs     util.Cat
+	Sender   Sender
+	Outbox   Outbox
+	Identity crypto.SelfIdentity
+	Contacts crypto.ContactsIdentityList
+	// Messages, Sent, Requests and Seen are created empty if they are nil
+	Messages MessageList
+	Sent     MessageList
+	Requests MessageList
+	Seen     SeenCache
+	// Pins is created empty if it is nil. Nothing is pinned unless Ipfs is also a Pinner
+	Pins PinStore
+	// Pending are the contact requests you sent which haven't been answered, created empty if it is nil
+	Pending PendingRequests
+	// Names are the addresses contacts were added by, created empty if it is nil. Addresses can only be
+	// resolved and your identity published under a name if Ipfs is also a NameSystem
+	Names ContactNames
+	// Profiles are the profiles of your contacts and your own, created empty if it is nil. Your profile is
+	// only published if Ipfs is also a Transport
+	Profiles ProfileCache
+	// Details are the nicknames and notes of contacts, created empty if it is nil
+	Details ContactDetails
+	// Labels and Flags are the folders, labels and flags of messages, created empty if they are nil. The mailbox
+	// only changes them to apply what your other devices synced
+	Labels MessageLabels
+	Flags  MessageFlags
+	// Sync is the log your devices share their contacts, messages, folders and flags through. Nothing is synced
+	// while it is nil, until LinkDevice starts it
+	Sync SyncLog
+	// PinTtl is how long sent messages stay pinned waiting for acks, DefaultPinTtl if it is 0
+	PinTtl time.Duration
+	// RemotePins also pin sent messages and the published identity so they can be fetched while we are offline
+	RemotePins []RemotePinService
+	// Bodies keeps the data of received messages on disk instead of in memory. It needs Ipfs to be a Transport
+	Bodies crypto.BodyStore
+	// FetchTimeout bounds fetching a received message into Bodies, DefaultTimeout if it is 0
+	FetchTimeout time.Duration
+	// Sessions seals messages to a single contact who published a prekey bundle and opens sealed messages.
+	// Without it every message is plain OpenPGP and sealed messages can't be read
+	Sessions crypto.SessionStore
+	Files    MailboxFiles
+	// Sealer seals the Files, which are written in plaintext if it is nil
+	Sealer util.Sealer
+}
+
+// GcResult is what Mailbox.CollectGarbage cleaned up
+type GcResult struct {
+	Unpinned int
+	Freed    uint64
+	// Bodies is how many message bodies were deleted because their message is in no list
+	Bodies int
+}
+
+// Mailbox sends mail from an identity and sorts the mail it receives into the inbox, sent and requests lists.
+// Received messages are routed before any other subscriber to Events sees them.
+type Mailbox interface {
+	Identity() crypto.SelfIdentity
+	Contacts() crypto.ContactsIdentityList
+	Messages() MessageList
+	Sent() MessageList
+	Requests() MessageList
+	Events() EventBus
+	// Queue encrypts content to the recipients and yourself and puts it in the outbox to be sent at sendAt
+	Queue(content io.Reader, sendAt time.Time, to ...*gpg.Entity) (OutboxEntry, error)
+	// Receive routes the mail announced to receiver until ctx is done, using prompt to unlock your keys
+	Receive(ctx context.Context, receiver Receiver, prompt gpg.PromptFunction)
+	// SendRequest queues a contact request with your key and an introduction note to be sent at sendAt.
+	// Only the people you sent a request to become contacts when they accept
+	SendRequest(note string, sendAt time.Time, to *gpg.Entity) (OutboxEntry, error)
+	// AcceptRequest adds the sender of a contact request to your contacts, moves it to the inbox and sends
+	// them your key back. Their prekey bundle is kept so messages to them are sealed
+	AcceptRequest(message crypto.Message) error
+	// AddContact adds entity to your contacts. Messages to them are sealed in a session if bundle isn't nil
+	AddContact(entity *gpg.Entity, bundle *crypto.PrekeyBundle) error
+	// RemoveContact removes entity from your contacts with their address, profile and detail. Their
+	// messages are kept, but new ones from them are contact requests again
+	RemoveContact(entity *gpg.Entity) error
+	Details() ContactDetails
+	// SetContactDetail sets the nickname and note of a contact
+	SetContactDetail(entity *gpg.Entity, detail ContactDetail) error
+	// PrekeyBundle returns the bundle to publish after identity so contacts can seal messages to it,
+	// which is nil without Sessions
+	PrekeyBundle(identity *gpg.Entity) (*crypto.PrekeyBundle, error)
+	// DenyRequest removes a contact request, telling its sender it was declined
+	DenyRequest(message crypto.Message) error
+	// Pins keeps sent messages pinned until their recipients acknowledge them and received messages pinned
+	// while they are in the inbox, sent or requests lists
+	Pins() PinStore
+	// CollectGarbage unpins everything Pins no longer needs, also on remote pinning services, and deletes
+	// what isn't pinned from the node
+	CollectGarbage() (GcResult, error)
+	// PinRemotely keeps c pinned on every remote pinning service in the background. It is never unpinned,
+	// which is meant for content like the published identity
+	PinRemotely(c cid.Cid, name string)
+	// PublishName points your IPNS name at identity, the content ID your identity was published as, and
+	// returns the name
+	PublishName(ctx context.Context, identity cid.Cid) (string, error)
+	// AddContactByName adds the identity an IPNS name or name@domain address points to, returning it and its
+	// content ID. The address is kept so RefreshContacts follows its key changes
+	AddContactByName(ctx context.Context, address string) (*gpg.Entity, cid.Cid, error)
+	// RefreshContacts resolves the addresses contacts were added by again, replacing the contacts whose
+	// address now points to another key which their old key certified. Other key changes are held until
+	// AcceptContactChange, since anyone who can answer for the address can point it elsewhere, and only returned
+	// the first time they are seen
+	RefreshContacts(ctx context.Context) ([]ContactChange, error)
+	// HeldContactChanges are the key changes RefreshContacts held since the old key didn't certify the new one
+	HeldContactChanges() []ContactChange
+	// AcceptContactChange replaces the contact of a held key change with its new key, which you checked yourself
+	AcceptContactChange(ctx context.Context, change ContactChange) error
+	// RefreshContactsEvery calls RefreshContacts every interval until ctx is done, passing each change to onChange
+	RefreshContactsEvery(ctx context.Context, interval time.Duration, onChange func(change ContactChange))
+	Profiles() ProfileCache
+	// SetProfile signs profile with your default identity and caches it. Contacts see it once your identity
+	// is published again with SerializeIdentity
+	SetProfile(profile crypto.Profile) (*crypto.Profile, error)
+	// SerializeIdentity writes identity the way it is published: its public key followed by its prekey bundle
+	// and a link to its profile, which is added to IPFS
+	SerializeIdentity(w io.Writer, identity *gpg.Entity) error
+	// UpdateProfile fetches the profile of contact published as profile and caches it if contact signed it
+	UpdateProfile(ctx context.Context, contact *gpg.Entity, profile cid.Cid) error
+	// LinkDevice sends a link to your account to device, the key FetchDeviceKey fetched from the link a new device
+	// showed you, with your private identity and the sync key. Only call it once the user confirmed the fingerprint
+	// of the device. The sync log is started if this is the first device linked
+	LinkDevice(ctx context.Context, device *gpg.Entity) error
+	// Devices are the devices linked to your account from any of its devices
+	Devices() []LinkedDevice
+	// Sync merges the entries of the sync log which heads point to, then appends what changed on this device and
+	// announces it to your other devices. Without heads the newest entries are announced again for the devices
+	// which were offline
+	Sync(ctx context.Context, heads ...cid.Cid) (SyncResult, error)
+	// SyncEvery syncs whenever another device announces a change and every interval until ctx is done, passing
+	// each sync which changed something to onSynced
+	SyncEvery(ctx context.Context, interval time.Duration, onSynced func(result SyncResult))
+}
+
+type mailbox struct {
+	config  MailboxConfig
+	events  EventBus
+	pinner  Pinner
+	names   NameSystem
+	saveMtx sync.Mutex
+	// refreshMtx keeps two refreshes from replacing the same contact twice and guards held
+	refreshMtx sync.Mutex
+	// held are the key changes waiting for AcceptContactChange by the fingerprint of the old key
+	held map[string]heldChange
+	// syncMtx keeps two syncs from merging the same entries, logMtx guards config.Sync which LinkDevice starts
+	syncMtx sync.Mutex
+	logMtx  sync.Mutex
+}
+
+func NewMailbox(config MailboxConfig) Mailbox {
+	if config.Messages == nil {
+		config.Messages = NewMessageList()
+	}
+	if config.Sent == nil {
+		config.Sent = NewMessageList()
+	}
+	if config.Requests == nil {
+		config.Requests = NewMessageList()
+	}
+	if config.Seen == nil {
+		config.Seen = NewSeenCache(DefaultSeenCacheSize)
+	}
+	if config.Pins == nil {
+		config.Pins = NewPinStore()
+	}
+	if config.Pending == nil {
+		config.Pending = NewPendingRequests()
+	}
+	if config.Names == nil {
+		config.Names = NewContactNames()
+	}
+	if config.Profiles == nil {
+		config.Profiles = NewProfileCache()
+	}
+	if config.Details == nil {
+		config.Details = NewContactDetails()
+	}
+	if config.Labels == nil {
+		config.Labels = NewMessageLabels()
+	}
+	if config.Flags == nil {
+		config.Flags = NewMessageFlags()
+	}
+	if config.PinTtl == 0 {
+		config.PinTtl = DefaultPinTtl
+	}
+	if config.FetchTimeout == 0 {
+		config.FetchTimeout = DefaultTimeout
+	}
+	config.Seen.AddMessages(config.Messages, config.Sent, config.Requests)
+	result := &mailbox{
+		config: config,
+		events: NewEventBus(),
+		held:   make(map[string]heldChange),
+	}
+	result.pinner, _ = config.Ipfs.(Pinner)
+	result.names, _ = config.Ipfs.(NameSystem)
+	result.events.Subscribe(context.Background(), result.route)
+	if config.Outbox != nil {
+		config.Outbox.OnChange(result.pinSent)
+	}
+	return result
+}
+
+func (m *mailbox) Identity() crypto.SelfIdentity {
+	return m.config.Identity
+}
+
+func (m *mailbox) Contacts() crypto.ContactsIdentityList {
+	return m.config.Contacts
+}
+
+func (m *mailbox) Messages() MessageList {
+	return m.config.Messages
+}
+
+func (m *mailbox) Sent() MessageList {
+	return m.config.Sent
+}
+
+func (m *mailbox) Requests() MessageList {
+	return m.config.Requests
+}
+
+func (m *mailbox) Events() EventBus {
+	return m.events
+}
+
+func (m *mailbox) Pins() PinStore {
+	return m.config.Pins
+}
+
+type saver interface {
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+func (m *mailbox) save(what string, s saver, file string) {
+	if len(file) == 0 {
+		return
+	}
+	m.saveMtx.Lock() // remote pins are saved from other goroutines
+	defer m.saveMtx.Unlock()
+	err := s.SaveToFile(file, m.config.Sealer)
+	if err != nil {
+		println("warning:", what, "could not be saved to file due to:", err.Error())
+	}
+}
+
+// route is the one place received mail is sorted: your own messages go to sent, messages from contacts
+// go to the inbox and messages from anyone else wait in requests until they are accepted
+func (m *mailbox) route(event Event) {
+	files := m.config.Files
+	m.save("seen messages", m.config.Seen, files.Seen)
+	switch event.Type {
+	case SentEcho:
+		m.config.Sent.Add(event.Message)
+		m.save("sent messages", m.config.Sent, files.Sent)
+	case MessageReceived:
+		m.receive(event)
+	case ContactRequest:
+		m.request(event)
+	case ContactAccepted:
+		from := event.Message.From()
+		if !m.config.Pending.Answered(from) && !containsEntity(from, m.config.Contacts.ToArray()) {
+			m.request(event) // nobody asked them, so they need to be accepted like a request
+			return
+		}
+		m.config.Contacts.Add(from)
+		m.addBundle(event.Message)
+		m.addProfile(event.Message)
+		m.save("pending requests", m.config.Pending, files.Pending)
+		m.save("contacts", m.config.Contacts, files.Contacts)
+		m.receive(event)
+	case ContactDeclined:
+		if m.config.Pending.Answered(event.Message.From()) {
+			m.save("pending requests", m.config.Pending, files.Pending)
+			m.receive(event) // so you see the note, declines nobody asked for are dropped
+		}
+	}
+}
+
+func (m *mailbox) receive(event Event) {
+	m.pinReceived(event)
+	m.config.Messages.Add(event.Message)
+	m.save("received messages", m.config.Messages, m.config.Files.Messages)
+}
+
+func (m *mailbox) request(event Event) {
+	m.pinReceived(event)
+	m.config.Requests.Add(event.Message)
+	m.save("contact requests", m.config.Requests, m.config.Files.Requests)
+}
+
+func (m *mailbox) Queue(content io.Reader, sendAt time.Time, to ...*gpg.Entity) (OutboxEntry, error) {
+	self := m.config.Identity.DefaultIdentity()
+	recipients := append(make([]*gpg.Entity, 0, len(to)+1), to...)
+	if !containsEntity(self, to) {
+		recipients = append(recipients, self) // so it comes back as a SentEcho
+	}
+	// sessions are between two identities, so only messages to one contact are sealed
+	seal := m.config.Sessions != nil && len(to) == 1 && !containsEntity(self, to) && m.config.Sessions.CanSeal(to[0])
+	return m.config.Outbox.Enqueue(func(w io.Writer) error {
+		if !seal {
+			return m.config.Sender.Encrypt(w, content, true, self, recipients...)
+		}
+		sealed, err := m.config.Sessions.Seal(self, to[0], w)
+		if err != nil {
+			return err
+		}
+		m.save("sessions", m.config.Sessions, m.config.Files.Sessions)
+		err = m.config.Sender.Encrypt(sealed, content, true, self, recipients...)
+		if err != nil {
+			return err
+		}
+		return sealed.Close()
+	}, sendAt)
+}
+
+func containsEntity(entity *gpg.Entity, entities []*gpg.Entity) bool {
+	for _, compare := range entities {
+		if util.EntitiesEqual(entity, compare) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mailbox) Receive(ctx context.Context, receiver Receiver, prompt gpg.PromptFunction) {
+	receiver.OnMessage(ctx, m.handleAck, true)
+	p := &mailPipeline{
+		bus:      m.events,
+		ipfs:     m.config.Ipfs,
+		identity: m.config.Identity,
+		contacts: m.config.Contacts,
+		seen:     m.config.Seen,
+		prompt:   prompt,
+		bodies:   m.config.Bodies,
+		ctx:      ctx,
+		timeout:  m.config.FetchTimeout,
+		sessions: m.config.Sessions,
+		saveSessions: func() {
+			m.save("sessions", m.config.Sessions, m.config.Files.Sessions)
+		},
+	}
+	receiver.OnMessage(ctx, p.handle, true)
+}
+
+// pinReceived keeps a received message on our node and tells its sender they can stop pinning it
+func (m *mailbox) pinReceived(event Event) {
+	if m.pinner != nil {
+		err := m.pinner.Pin(event.Cid)
+		if err != nil {
+			println("warning: message", event.Cid.String(), "could not be pinned due to:", err.Error())
+			return
+		}
+		m.config.Pins.PinReceived(event.Cid)
+		m.save("pins", m.config.Pins, m.config.Files.Pins)
+	}
+	if m.config.Sender != nil {
+		err := m.config.Sender.Acknowledge(event.Cid, m.config.Identity.DefaultIdentity())
+		if err != nil {
+			println("warning: message", event.Cid.String(), "could not be acknowledged due to:", err.Error())
+		}
+	}
+}
+
+// pinSent keeps a sent message on our node and any remote pinning services until every recipient but us
+// acknowledges it
+func (m *mailbox) pinSent(entry OutboxEntry) {
+	if entry.State != OutboxSent || (m.pinner == nil && len(m.config.RemotePins) == 0) {
+		return
+	}
+	recipients := m.recipients(entry)
+	if m.pinner != nil {
+		err := m.pinner.Pin(entry.Cid)
+		if err != nil {
+			println("warning: message", entry.Cid.String(), "could not be pinned due to:", err.Error())
+			return
+		}
+	}
+	m.config.Pins.PinOutgoing(entry.Cid, recipients, m.config.PinTtl)
+	m.save("pins", m.config.Pins, m.config.Files.Pins)
+	for _, service := range m.config.RemotePins {
+		go m.pinRemote(service, entry.Cid) // don't hold up the outbox while the service responds
+	}
+}
+
+// recipients returns the fingerprints of who a sent message is encrypted to apart from us, which are the only
+// ones whose acks count. Recipients who aren't contacts, like those of contact requests, are empty
+func (m *mailbox) recipients(entry OutboxEntry) []string {
+	recipients := make([]string, 0)
+	body, err := entry.open()
+	if err != nil {
+		println("warning: recipients of message", entry.Cid.String(), "are unknown due to:", err.Error())
+		return recipients
+	}
+	defer body.Close()
+	r := bufio.NewReader(body)
+	if prefix, _ := r.Peek(len(sealedPrefix)); string(prefix) == sealedPrefix {
+		// only messages to one contact are sealed, and only the session knows who it is
+		if m.config.Sessions == nil {
+			return []string{""}
+		}
+		return []string{m.config.Sessions.Recipient(r)}
+	}
+	keyIds, err := crypto.RecipientKeyIds(r)
+	if err != nil {
+		println("warning: recipients of message", entry.Cid.String(), "are unknown due to:", err.Error())
+	}
+	contacts := gpg.EntityList(m.config.Contacts.ToArray())
+	for _, id := range keyIds {
+		if len(m.config.Identity.EntityList().KeysById(id)) > 0 {
+			continue
+		}
+		fingerprint := ""
+		if keys := contacts.KeysById(id); len(keys) > 0 {
+			fingerprint = entityFingerprint(keys[0].Entity)
+		}
+		recipients = append(recipients, fingerprint)
+	}
+	return recipients
+}
+
+func (m *mailbox) pinRemote(service RemotePinService, c cid.Cid) {
+	pin, err := service.Pin(c, "ipmail message")
+	if err != nil {
+		println("warning: message", c.String(), "could not be pinned on", service.Name(), "due to:", err.Error())
+		return
+	}
+	if m.config.Pins.SetRemote(c, service.Name(), pin.RequestId) {
+		m.save("pins", m.config.Pins, m.config.Files.Pins)
+		return
+	}
+	// the message was unpinned while the request was made
+	m.unpinRemote(service, c, pin.RequestId)
+}
+
+func (m *mailbox) unpinRemote(service RemotePinService, c cid.Cid, requestId string) {
+	err := service.Unpin(requestId)
+	if err != nil {
+		println("warning: message", c.String(), "could not be unpinned on", service.Name(), "due to:", err.Error())
+	}
+}
+
+func (m *mailbox) remotePinService(name string) RemotePinService {
+	for _, service := range m.config.RemotePins {
+		if service.Name() == name {
+			return service
+		}
+	}
+	return nil
+}
+
+func (m *mailbox) PinRemotely(c cid.Cid, name string) {
+	for _, service := range m.config.RemotePins {
+		go func(service RemotePinService) {
+			_, err := EnsureRemotePin(service, c, name)
+			if err != nil {
+				println("warning:", c.String(), "could not be pinned on", service.Name(), "due to:", err.Error())
+			}
+		}(service)
+	}
+}
+
+// handleAck counts an ack of a message we sent if it is signed by one of the contacts it was sent to
+func (m *mailbox) handleAck(message iface.PubSubMessage) {
+	id, signature, ok := ParseAck(message)
+	if !ok {
+		return
+	}
+	if entry, ok := m.config.Pins.Get(id); !ok || !entry.Outgoing {
+		return // checking the signature is only worth it for messages still waiting for acks
+	}
+	signer, err := crypto.CheckAck(id, signature, m.config.Contacts.ToArray())
+	if err != nil {
+		return
+	}
+	if m.config.Pins.Acknowledge(id, entityFingerprint(signer)) {
+		m.save("pins", m.config.Pins, m.config.Files.Pins)
+	}
+}
+
+func (m *mailbox) CollectGarbage() (GcResult, error) {
+	result := GcResult{}
+	if m.pinner == nil && len(m.config.RemotePins) == 0 {
+		return result, errors.New("the IPFS node can't pin content")
+	}
+	expired := m.config.Pins.Expired(time.Now(), m.config.Messages, m.config.Sent, m.config.Requests)
+	for _, entry := range expired {
+		if m.pinner != nil {
+			err := m.pinner.Unpin(entry.Cid)
+			if err != nil {
+				println("warning: message", entry.Cid.String(), "could not be unpinned due to:", err.Error())
+			}
+		}
+		for name, requestId := range entry.Remote {
+			service := m.remotePinService(name)
+			if service == nil {
+				println("warning: message", entry.Cid.String(), "stays pinned on", name, "which is no longer configured")
+				continue
+			}
+			m.unpinRemote(service, entry.Cid, requestId)
+		}
+		m.config.Pins.Remove(entry.Cid)
+		result.Unpinned++
+	}
+	m.save("pins", m.config.Pins, m.config.Files.Pins)
+	result.Bodies = m.removeUnlistedBodies()
+	if m.pinner == nil {
+		return result, nil
+	}
+	freed, err := m.pinner.CollectGarbage()
+	result.Freed = freed
+	return result, err
+}
+
+// removeUnlistedBodies deletes the bodies of messages which were deleted or denied
+func (m *mailbox) removeUnlistedBodies() int {
+	if m.config.Bodies == nil {
+		return 0
+	}
+	listed := make(map[string]bool)
+	for _, l := range []MessageList{m.config.Messages, m.config.Sent, m.config.Requests} {
+		l.ForEach(func(message crypto.Message) {
+			listed[message.Cid().KeyString()] = true
+		})
+	}
+	removed := 0
+	err := m.config.Bodies.ForEach(func(c cid.Cid) {
+		if listed[c.KeyString()] {
+			return
+		}
+		err := m.config.Bodies.Remove(c)
+		if err != nil {
+			println("warning: message body", c.String(), "could not be deleted due to:", err.Error())
+			return
+		}
+		removed++
+	})
+	if err != nil {
+		println("warning: message bodies could not be listed due to:", err.Error())
+	}
+	return removed
+}
+
+func (m *mailbox) AcceptRequest(message crypto.Message) error {
+	if m.config.Requests.FromCid(message.Cid()) == nil {
+		return errors.New("message is not a contact request")
+	}
+	from := message.From()
+	if from == nil {
+		return errors.New("contact request has no sender")
+	}
+	m.config.Contacts.Add(from)
+	m.addBundle(message)
+	m.addProfile(message)
+	m.config.Requests.Remove(message)
+	m.config.Messages.Add(message)
+	files := m.config.Files
+	m.save("contacts", m.config.Contacts, files.Contacts)
+	m.save("contact requests", m.config.Requests, files.Requests)
+	m.save("received messages", m.config.Messages, files.Messages)
+	return m.answer(crypto.HandshakeAccept, from)
+}
+
+func (m *mailbox) AddContact(entity *gpg.Entity, bundle *crypto.PrekeyBundle) error {
+	if bundle != nil && m.config.Sessions != nil {
+		err := m.config.Sessions.AddBundle(entity, bundle)
+		if err != nil {
+			return err
+		}
+		m.save("sessions", m.config.Sessions, m.config.Files.Sessions)
+	}
+	m.config.Contacts.Add(entity)
+	m.save("contacts", m.config.Contacts, m.config.Files.Contacts)
+	return nil
+}
+
+func (m *mailbox) RemoveContact(entity *gpg.Entity) error {
+	if !containsEntity(entity, m.config.Contacts.ToArray()) {
+		return errors.New("not a contact")
+	}
+	if self := m.config.Identity.DefaultIdentity(); entity.PrimaryKey.Fingerprint == self.PrimaryKey.Fingerprint {
+		return errors.New("your own identity can't be removed from your contacts")
+	}
+	m.config.Contacts.Remove(entity)
+	m.config.Names.Remove(entity)
+	m.config.Profiles.Remove(entity)
+	m.config.Details.Remove(entity)
+	files := m.config.Files
+	m.save("contacts", m.config.Contacts, files.Contacts)
+	m.save("contact names", m.config.Names, files.Names)
+	m.save("profiles", m.config.Profiles, files.Profiles)
+	m.save("contact details", m.config.Details, files.Details)
+	return nil
+}
+
+func (m *mailbox) Details() ContactDetails {
+	return m.config.Details
+}
+
+func (m *mailbox) SetContactDetail(entity *gpg.Entity, detail ContactDetail) error {
+	if !containsEntity(entity, m.config.Contacts.ToArray()) {
+		return errors.New("not a contact")
+	}
+	m.config.Details.Set(entity, detail)
+	m.save("contact details", m.config.Details, m.config.Files.Details)
+	return nil
+}
+
+func (m *mailbox) PrekeyBundle(identity *gpg.Entity) (*crypto.PrekeyBundle, error) {
+	if m.config.Sessions == nil {
+		return nil, nil
+	}
+	bundle, err := m.config.Sessions.Bundle(identity)
+	if err != nil {
+		return nil, err
+	}
+	m.save("sessions", m.config.Sessions, m.config.Files.Sessions) // the prekey is made the first time and rotated
+	return bundle, nil
+}
+
+// handshake makes the body of a handshake message with your key
+func (m *mailbox) handshake(kind crypto.HandshakeKind, note string) (io.Reader, error) {
+	self := m.config.Identity.DefaultIdentity()
+	bundle, err := m.PrekeyBundle(self)
+	if err != nil {
+		println("warning: prekey bundle could not be sent due to:", err.Error())
+	}
+	handshake := &crypto.Handshake{Kind: kind, Note: note, Key: self, Bundle: bundle, Profile: m.publishProfile(self)}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err = handshake.Serialize(buf)
+	return buf, err
+}
+
+func (m *mailbox) SendRequest(note string, sendAt time.Time, to *gpg.Entity) (OutboxEntry, error) {
+	content, err := m.handshake(crypto.HandshakeRequest, note)
+	if err != nil {
+		return OutboxEntry{}, err
+	}
+	entry, err := m.Queue(content, sendAt, to)
+	if err != nil {
+		return entry, err
+	}
+	m.config.Pending.Add(to, time.Now())
+	m.save("pending requests", m.config.Pending, m.config.Files.Pending)
+	return entry, nil
+}
+
+// answer sends an accept or decline of a contact request from to
+func (m *mailbox) answer(kind crypto.HandshakeKind, to *gpg.Entity) error {
+	content, err := m.handshake(kind, "")
+	if err != nil {
+		return err
+	}
+	_, err = m.Queue(content, time.Now(), to)
+	return err
+}
+
+// addBundle keeps the prekey bundle a handshake came with, if there is one
+func (m *mailbox) addBundle(message crypto.Message) {
+	handshake := message.Handshake()
+	if m.config.Sessions == nil || handshake == nil || handshake.Bundle == nil {
+		return
+	}
+	err := m.config.Sessions.AddBundle(message.From(), handshake.Bundle)
+	if err != nil {
+		println("warning: prekey bundle of", util.EntityToString(message.From()), "is invalid:", err.Error())
+		return
+	}
+	m.save("sessions", m.config.Sessions, m.config.Files.Sessions)
+}
+
+func (m *mailbox) Profiles() ProfileCache {
+	return m.config.Profiles
+}
+
+func (m *mailbox) SetProfile(profile crypto.Profile) (*crypto.Profile, error) {
+	self := m.config.Identity.DefaultIdentity()
+	err := profile.Sign(self)
+	if err != nil {
+		return nil, err
+	}
+	m.config.Profiles.Set(self, &profile)
+	m.save("profiles", m.config.Profiles, m.config.Files.Profiles)
+	return &profile, nil
+}
+
+// publishProfile adds the cached profile of identity to IPFS, returning cid.Undef if it can't be published
+func (m *mailbox) publishProfile(identity *gpg.Entity) cid.Cid {
+	profile := m.config.Profiles.Get(identity)
+	ipfs, ok := m.config.Ipfs.(Transport)
+	if profile == nil || !ok {
+		return cid.Undef
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err := profile.Serialize(buf)
+	if err != nil {
+		println("warning: profile could not be published due to:", err.Error())
+		return cid.Undef
+	}
+	resolved, err := ipfs.AddFromReader(buf)
+	if err != nil {
+		println("warning: profile could not be published due to:", err.Error())
+		return cid.Undef
+	}
+	if m.pinner != nil {
+		_ = m.pinner.Pin(resolved.Cid()) // like the identity linking to it
+	}
+	return resolved.Cid()
+}
+
+func (m *mailbox) SerializeIdentity(w io.Writer, identity *gpg.Entity) error {
+	err := identity.Serialize(w)
+	if err != nil {
+		return err
+	}
+	bundle, err := m.PrekeyBundle(identity)
+	if err == nil && bundle != nil {
+		err = bundle.Serialize(w)
+	}
+	if err != nil {
+		println("warning: prekey bundle could not be published due to:", err.Error())
+	}
+	if profile := m.publishProfile(identity); profile.Defined() {
+		return crypto.SerializeProfileLink(w, profile)
+	}
+	return nil
+}
+
+func (m *mailbox) UpdateProfile(ctx context.Context, contact *gpg.Entity, profile cid.Cid) error {
+	fetched, err := crypto.FetchProfile(ctx, contact, profile, m.config.Ipfs)
+	if err != nil {
+		return err
+	}
+	if m.config.Profiles.Set(contact, fetched) {
+		m.save("profiles", m.config.Profiles, m.config.Files.Profiles)
+	}
+	return nil
+}
+
+// updateProfile is UpdateProfile for contacts which may have no profile, only warning when it can't be fetched
+func (m *mailbox) updateProfile(ctx context.Context, contact *gpg.Entity, profile cid.Cid) {
+	if !profile.Defined() {
+		return
+	}
+	err := m.UpdateProfile(ctx, contact, profile)
+	if err != nil {
+		println("warning: profile of", util.EntityToString(contact), "could not be fetched due to:", err.Error())
+	}
+}
+
+// addProfile fetches the profile a handshake links to in the background
+func (m *mailbox) addProfile(message crypto.Message) {
+	handshake := message.Handshake()
+	if handshake == nil || !handshake.Profile.Defined() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.FetchTimeout)
+		defer cancel()
+		m.updateProfile(ctx, message.From(), handshake.Profile)
+	}()
+}
+
+func (m *mailbox) DenyRequest(message crypto.Message) error {
+	if m.config.Requests.FromCid(message.Cid()) == nil {
+		return errors.New("message is not a contact request")
+	}
+	m.config.Requests.Remove(message)
+	m.save("contact requests", m.config.Requests, m.config.Files.Requests)
+	if !isHandshake(message, crypto.HandshakeRequest) || message.From() == nil {
+		return nil
+	}
+	return m.answer(crypto.HandshakeDecline, message.From())
+}
@@ -0,0 +1,65 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+)
+
+// LinkedDevice is a device LinkDevice sent a link to your account to
+type LinkedDevice struct {
+	Fingerprint string
+	Name        string
+}
+
+func (m *mailbox) LinkDevice(ctx context.Context, device *gpg.Entity) error {
+	if !crypto.IsDeviceKey(device) {
+		return errors.New("your identity is only sent to the key of a device")
+	}
+	if _, ok := m.config.Ipfs.(Transport); !ok || m.config.Sender == nil {
+		return errors.New("devices can't be linked without a transport")
+	}
+	m.logMtx.Lock()
+	if m.config.Sync == nil {
+		key, err := crypto.NewSyncKey()
+		if err == nil {
+			m.config.Sync, err = NewSyncLog(key)
+		}
+		if err != nil {
+			m.logMtx.Unlock()
+			return err
+		}
+	}
+	log := m.config.Sync
+	m.logMtx.Unlock()
+	op := log.Set("device/"+entityFingerprint(device), []byte(util.EntityToString(device)))
+	result, err := m.sync(ctx, nil, op)
+	if err != nil {
+		return err
+	}
+	link := &crypto.DeviceLink{Identity: m.config.Identity, SyncKey: log.Key(), Head: result.Head}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err = link.Seal(buf, device)
+	if err != nil {
+		return err
+	}
+	_, err = m.config.Sender.Publish(buf)
+	return err
+}
+
+func (m *mailbox) Devices() []LinkedDevice {
+	result := make([]LinkedDevice, 0)
+	log := m.syncLog()
+	if log == nil {
+		return result
+	}
+	for _, key := range log.Keys("device/") {
+		name, _ := log.Value(key)
+		result = append(result, LinkedDevice{Fingerprint: strings.TrimPrefix(key, "device/"), Name: string(name)})
+	}
+	return result
+}
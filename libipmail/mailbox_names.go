@@ -0,0 +1,253 @@
+package ipmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"ipmail/libipmail/crypto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ContactChange is a contact whose address now points to another key
+type ContactChange struct {
+	Address string
+	Old     *gpg.Entity
+	New     *gpg.Entity
+	// Cid is the content ID of the new identity
+	Cid cid.Cid
+	// Held is whether the contact still has the old key, since it didn't certify the new one
+	Held bool
+}
+
+// heldChange is a key change RefreshContacts held with the identity it was resolved to
+type heldChange struct {
+	change  ContactChange
+	contact *crypto.Contact
+}
+
+// ErrNoNameSystem is returned for names when the transport is not a NameSystem
+var ErrNoNameSystem = errors.New("names can't be resolved without IPNS")
+
+func (m *mailbox) PublishName(ctx context.Context, identity cid.Cid) (string, error) {
+	if m.names == nil {
+		return "", ErrNoNameSystem
+	}
+	return m.names.PublishName(ctx, IdentityKeyName, path.IpfsPath(identity))
+}
+
+// resolveIdentity fetches the identity the IPNS name points to
+func (m *mailbox) resolveIdentity(ctx context.Context, name string) (*crypto.Contact, cid.Cid, error) {
+	resolved, err := m.names.ResolveName(ctx, name)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	if resolved.Namespace() != "ipfs" {
+		return nil, cid.Undef, fmt.Errorf("%s points to %s, not an identity on IPFS", name, resolved)
+	}
+	c, err := cid.Decode(strings.TrimPrefix(resolved.String(), "/ipfs/"))
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	contact, err := crypto.ReadContact(ctx, "ipfs:"+string(c.Bytes()), m.config.Ipfs)
+	return contact, c, err
+}
+
+func (m *mailbox) AddContactByName(ctx context.Context, address string) (*gpg.Entity, cid.Cid, error) {
+	if m.names == nil {
+		return nil, cid.Undef, ErrNoNameSystem
+	}
+	name, err := NameOfAddress(address)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	contact, c, err := m.resolveIdentity(ctx, name)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	entity := contact.Entity
+	err = m.AddContact(entity, contact.Bundle)
+	if err != nil {
+		println("warning: prekey bundle of the contact is invalid:", err.Error())
+		_ = m.AddContact(entity, nil)
+	}
+	m.config.Names.Set(entity, strings.TrimSpace(address))
+	m.save("contact names", m.config.Names, m.config.Files.Names)
+	m.updateProfile(ctx, entity, contact.Profile)
+	return entity, c, nil
+}
+
+// resolvedName is the identity the address of a contact pointed to when RefreshContacts resolved it
+type resolvedName struct {
+	fingerprint string
+	address     string
+	old         *gpg.Entity
+	contact     *crypto.Contact
+	cid         cid.Cid
+}
+
+// resolveNames resolves the address of every contact added by address, warning about those which can't be
+func (m *mailbox) resolveNames(ctx context.Context) []resolvedName {
+	contacts := make(map[string]*gpg.Entity)
+	m.config.Contacts.ForEach(func(entity *gpg.Entity) {
+		contacts[entityFingerprint(entity)] = entity
+	})
+	named := make([]resolvedName, 0)
+	m.config.Names.ForEach(func(fingerprint string, address string) {
+		named = append(named, resolvedName{fingerprint: fingerprint, address: address})
+	})
+	result := make([]resolvedName, 0, len(named))
+	for _, r := range named {
+		old, ok := contacts[r.fingerprint]
+		if !ok {
+			continue // removed from the contacts since
+		}
+		name, err := NameOfAddress(r.address)
+		if err != nil {
+			continue
+		}
+		r.old = old
+		r.contact, r.cid, err = m.resolveIdentity(ctx, name)
+		if err != nil {
+			println("warning:", r.address, "could not be resolved due to:", err.Error())
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func (m *mailbox) RefreshContacts(ctx context.Context) ([]ContactChange, error) {
+	if m.names == nil {
+		return nil, ErrNoNameSystem
+	}
+	// names are resolved and profiles fetched without holding refreshMtx, which would hold up the other calls
+	resolved := m.resolveNames(ctx)
+	updated := make([]resolvedName, 0)
+	m.refreshMtx.Lock()
+	changes, replaced := make([]ContactChange, 0), false
+	for _, r := range resolved {
+		entity, bundle := r.contact.Entity, r.contact.Bundle
+		if !containsEntity(r.old, m.config.Contacts.ToArray()) {
+			continue // removed while resolving, or replaced by another refresh
+		}
+		if entity.PrimaryKey.Fingerprint == r.old.PrimaryKey.Fingerprint {
+			delete(m.held, r.fingerprint) // pointed back at the old key
+			if bundle != nil {
+				_ = m.AddContact(r.old, bundle) // a new prekey was published
+			}
+			updated = append(updated, r)
+			continue
+		}
+		change := ContactChange{Address: r.address, Old: r.old, New: entity, Cid: r.cid}
+		if !certifiedBy(entity, r.old) {
+			held, ok := m.held[r.fingerprint]
+			if ok && held.change.New.PrimaryKey.Fingerprint == entity.PrimaryKey.Fingerprint {
+				continue // already returned
+			}
+			change.Held = true
+			m.held[r.fingerprint] = heldChange{change: change, contact: r.contact}
+			changes = append(changes, change)
+			continue
+		}
+		delete(m.held, r.fingerprint)
+		m.replaceContact(r.old, r.contact, r.address)
+		updated = append(updated, resolvedName{old: entity, contact: r.contact})
+		changes = append(changes, change)
+		replaced = true
+	}
+	if replaced {
+		m.save("contact names", m.config.Names, m.config.Files.Names)
+		m.save("profiles", m.config.Profiles, m.config.Files.Profiles)
+		m.save("contact details", m.config.Details, m.config.Files.Details)
+	}
+	m.refreshMtx.Unlock()
+	for _, r := range updated {
+		m.updateProfile(ctx, r.old, r.contact.Profile)
+	}
+	return changes, nil
+}
+
+// replaceContact replaces the contact old, which was added by address, with the identity address now points to.
+// Its profile is left for the caller to fetch, since that needs the network
+func (m *mailbox) replaceContact(old *gpg.Entity, contact *crypto.Contact, address string) {
+	entity := contact.Entity
+	m.config.Contacts.Remove(old)
+	m.config.Names.Remove(old)
+	m.config.Profiles.Remove(old)
+	m.config.Details.Set(entity, m.config.Details.Get(old)) // the nickname is still theirs
+	m.config.Details.Remove(old)
+	err := m.AddContact(entity, contact.Bundle)
+	if err != nil {
+		println("warning: prekey bundle of", address, "is invalid:", err.Error())
+		_ = m.AddContact(entity, nil)
+	}
+	m.config.Names.Set(entity, address)
+}
+
+func (m *mailbox) HeldContactChanges() []ContactChange {
+	m.refreshMtx.Lock()
+	defer m.refreshMtx.Unlock()
+	result := make([]ContactChange, 0, len(m.held))
+	for _, held := range m.held {
+		result = append(result, held.change)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+func (m *mailbox) AcceptContactChange(ctx context.Context, change ContactChange) error {
+	held, err := m.acceptContactChange(change)
+	if err != nil {
+		return err
+	}
+	m.updateProfile(ctx, held.change.New, held.contact.Profile)
+	return nil
+}
+
+// acceptContactChange is AcceptContactChange up to fetching the new profile, which isn't done holding refreshMtx
+func (m *mailbox) acceptContactChange(change ContactChange) (heldChange, error) {
+	m.refreshMtx.Lock()
+	defer m.refreshMtx.Unlock()
+	fingerprint := entityFingerprint(change.Old)
+	held, ok := m.held[fingerprint]
+	if !ok || held.change.New.PrimaryKey.Fingerprint != change.New.PrimaryKey.Fingerprint {
+		return heldChange{}, errors.New("the key change is no longer held")
+	}
+	delete(m.held, fingerprint)
+	if !containsEntity(held.change.Old, m.config.Contacts.ToArray()) {
+		return heldChange{}, errors.New("the contact was removed")
+	}
+	m.replaceContact(held.change.Old, held.contact, held.change.Address)
+	m.save("contact names", m.config.Names, m.config.Files.Names)
+	m.save("profiles", m.config.Profiles, m.config.Files.Profiles)
+	m.save("contact details", m.config.Details, m.config.Files.Details)
+	return held, nil
+}
+
+func (m *mailbox) RefreshContactsEvery(ctx context.Context, interval time.Duration, onChange func(change ContactChange)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			changes, err := m.RefreshContacts(ctx)
+			if err != nil {
+				return
+			}
+			for _, change := range changes {
+				onChange(change)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,483 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/Geo25rey/crypto/openpgp/packet"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"strings"
+	"time"
+)
+
+// SyncResult is what Mailbox.Sync changed
+type SyncResult struct {
+	// Merged is how many changes from other devices were applied here
+	Merged int
+	// Recorded is how many changes made here were appended to the sync log
+	Recorded int
+	// Pending is how many changes from other devices can't be applied yet, like messages which couldn't be fetched
+	Pending int
+	// Head is the entry appended to the sync log, cid.Undef if nothing changed here
+	Head cid.Cid
+}
+
+// ErrNotSyncing is returned by Sync before a device was linked to your account
+var ErrNotSyncing = errors.New("no other device is linked to your account")
+
+// syncPrefixes are the registers Sync records the state of this device in
+var syncPrefixes = []string{"contact/", "detail/", "folders/", "labels/", "message/", "folder/", "label/", "flag/"}
+
+// syncLists are the message lists by the name they are synced as
+func (m *mailbox) syncLists() map[string]MessageList {
+	return map[string]MessageList{"inbox": m.config.Messages, "sent": m.config.Sent, "requests": m.config.Requests}
+}
+
+func (m *mailbox) syncLog() SyncLog {
+	m.logMtx.Lock()
+	defer m.logMtx.Unlock()
+	return m.config.Sync
+}
+
+func (m *mailbox) Sync(ctx context.Context, heads ...cid.Cid) (SyncResult, error) {
+	return m.sync(ctx, heads)
+}
+
+// sync is Sync appending ops to the log with what changed on this device
+func (m *mailbox) sync(ctx context.Context, heads []cid.Cid, ops ...SyncOp) (SyncResult, error) {
+	result := SyncResult{}
+	log := m.syncLog()
+	if log == nil {
+		return result, ErrNotSyncing
+	}
+	ipfs, ok := m.config.Ipfs.(Transport)
+	if !ok {
+		return result, errors.New("nothing can be synced without a transport")
+	}
+	m.syncMtx.Lock()
+	defer m.syncMtx.Unlock()
+	var mergeErr error
+	for _, head := range heads {
+		merged, err := log.Merge(ctx, head, ipfs, m.applySynced)
+		result.Merged += merged
+		if err != nil && mergeErr == nil {
+			mergeErr = err // what changed here is still recorded
+		}
+	}
+	result.Merged += log.Retry(m.applySynced)
+	if result.Merged > 0 {
+		m.saveSynced()
+	}
+	ops = append(ops, log.Record(m.syncState(ipfs), syncPrefixes...)...)
+	result.Recorded = len(ops)
+	head, err := log.Append(ops, ipfs)
+	if err != nil {
+		return result, err
+	}
+	result.Head = head
+	result.Pending = len(log.Pending(""))
+	m.save("sync log", log, m.config.Files.Sync)
+	if head.Defined() {
+		m.PinRemotely(head, "ipmail sync")
+	}
+	if head.Defined() || len(heads) == 0 {
+		for _, c := range log.Heads() {
+			err = ipfs.PublishContext(ctx, log.Key().Topic(), c.Bytes())
+			if err != nil {
+				println("warning: sync log", c.String(), "could not be announced due to:", err.Error())
+			}
+		}
+	}
+	return result, mergeErr
+}
+
+func (m *mailbox) SyncEvery(ctx context.Context, interval time.Duration, onSynced func(result SyncResult)) {
+	ipfs, ok := m.config.Ipfs.(Transport)
+	if !ok {
+		return
+	}
+	syncNow := func(heads ...cid.Cid) {
+		if m.syncLog() == nil {
+			return
+		}
+		result, err := m.Sync(ctx, heads...)
+		if err != nil && ctx.Err() == nil {
+			println("warning: your devices could not be synced due to:", err.Error())
+		}
+		if result.Merged > 0 || result.Recorded > 0 {
+			onSynced(result)
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var receiver Receiver
+		defer func() {
+			if receiver != nil {
+				_ = receiver.Close()
+			}
+		}()
+		for {
+			// a device which isn't syncing yet starts listening once LinkDevice starts the log
+			if log := m.syncLog(); receiver == nil && log != nil {
+				var err error
+				receiver, err = NewReceiver(log.Key().Topic(), ipfs)
+				if err != nil {
+					println("warning: your devices could not be synced due to:", err.Error())
+					return
+				}
+				receiver.OnMessage(ctx, func(message iface.PubSubMessage) {
+					if head, err := cid.Cast(message.Data()); err == nil {
+						syncNow(head)
+					}
+				}, true)
+			}
+			syncNow()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// saveSynced saves everything applySynced changes
+func (m *mailbox) saveSynced() {
+	files := m.config.Files
+	m.save("contacts", m.config.Contacts, files.Contacts)
+	m.save("contact details", m.config.Details, files.Details)
+	m.save("labels", m.config.Labels, files.Labels)
+	m.save("flags", m.config.Flags, files.Flags)
+	m.save("received messages", m.config.Messages, files.Messages)
+	m.save("sent messages", m.config.Sent, files.Sent)
+	m.save("contact requests", m.config.Requests, files.Requests)
+	m.save("seen messages", m.config.Seen, files.Seen)
+}
+
+// syncState is the state of this device in the registers of the sync log
+func (m *mailbox) syncState(ipfs Transport) map[string][]byte {
+	log := m.syncLog()
+	result := make(map[string][]byte)
+	self := m.config.Identity.EntityList()
+	for _, entity := range m.config.Contacts.ToArray() {
+		if containsEntity(entity, self) {
+			continue // every device has its own identity among its contacts
+		}
+		fingerprint := entityFingerprint(entity)
+		// the key of a contact is what was synced first, since serializing it again may order its user IDs differently
+		if value, ok := log.Value("contact/" + fingerprint); ok {
+			result["contact/"+fingerprint] = value
+		} else if buf := bytes.NewBuffer(make([]byte, 0)); entity.Serialize(buf) == nil {
+			result["contact/"+fingerprint] = buf.Bytes()
+		}
+		if detail := m.config.Details.Get(entity); detail != (ContactDetail{}) {
+			buf := bytes.NewBuffer(make([]byte, 0))
+			_ = util.WriteString(buf, detail.Nickname)
+			_ = util.WriteString(buf, detail.Note)
+			result["detail/"+fingerprint] = buf.Bytes()
+		}
+	}
+	for _, folder := range m.config.Labels.Folders() {
+		result["folders/"+folder] = []byte{}
+	}
+	for _, label := range m.config.Labels.LabelNames() {
+		result["labels/"+label] = []byte{}
+	}
+	keys := make(map[string]bool)
+	for name, l := range m.syncLists() {
+		listed := make([]crypto.Message, 0)
+		l.ForEach(func(message crypto.Message) {
+			listed = append(listed, message)
+		})
+		for _, message := range listed {
+			key := MessageKey(message)
+			keys[key] = true
+			body, err := m.syncedBody(ipfs, message)
+			if err != nil {
+				println("warning: message", key, "could not be synced due to:", err.Error())
+				continue
+			}
+			result["message/"+key] = []byte(name + " " + body.String())
+		}
+	}
+	for _, key := range log.Pending("message/") {
+		keys[strings.TrimPrefix(key, "message/")] = true // its folder and flags were synced before it could be fetched
+	}
+	for key := range keys {
+		if folder := m.config.Labels.Folder(key); folder != InboxFolder {
+			result["folder/"+key] = []byte(folder)
+		}
+		for _, label := range m.config.Labels.Labels(key) {
+			result["label/"+key+"/"+label] = []byte{}
+		}
+		for _, name := range flagNames {
+			if m.config.Flags.Has(key, name.flag) {
+				result["flag/"+key+"/"+name.name] = []byte{}
+			}
+		}
+	}
+	return result
+}
+
+// syncedBody returns the content ID your other devices fetch message from. The OpenPGP message is sealed with the
+// sync key, since the keys of a session it came in are only on the device that received it and publishing the
+// message inside would let anyone who ever gets your identity key read it
+func (m *mailbox) syncedBody(ipfs Transport, message crypto.Message) (cid.Cid, error) {
+	log := m.syncLog()
+	if value, ok := log.Value("message/" + MessageKey(message)); ok {
+		split := strings.SplitN(string(value), " ", 2)
+		if len(split) == 2 {
+			return cid.Decode(split[1])
+		}
+	}
+	encrypted, err := message.Encrypted()
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer encrypted.Close()
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(func() error {
+			sealing, err := log.Key().SealStream(writer)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(sealing, encrypted)
+			if err != nil {
+				return err
+			}
+			return sealing.Close()
+		}())
+	}()
+	resolved, err := ipfs.AddFromReader(reader)
+	_ = reader.Close() // stops the sealing if adding failed
+	if err != nil {
+		return cid.Undef, err
+	}
+	if m.pinner != nil {
+		_ = m.pinner.Pin(resolved.Cid()) // like the entries of the sync log, so devices linked later can fetch it
+	}
+	return resolved.Cid(), nil
+}
+
+// findContact returns the contact with fingerprint, or nil if there is none
+func (m *mailbox) findContact(fingerprint string) *gpg.Entity {
+	for _, entity := range m.config.Contacts.ToArray() {
+		if entityFingerprint(entity) == fingerprint {
+			return entity
+		}
+	}
+	return nil
+}
+
+// applySynced changes this device the way op from another device says
+func (m *mailbox) applySynced(op SyncOp) error {
+	split := strings.SplitN(op.Key, "/", 2)
+	if len(split) != 2 {
+		return nil
+	}
+	key, labels := split[1], m.config.Labels
+	switch split[0] + "/" {
+	case "contact/":
+		return m.applyContact(key, op.Value)
+	case "detail/":
+		contact := m.findContact(key)
+		if op.Value == nil {
+			if contact != nil {
+				m.config.Details.Remove(contact)
+			}
+			return nil
+		}
+		if contact == nil {
+			return errors.New("not a contact")
+		}
+		r := bytes.NewBuffer(op.Value)
+		detail := ContactDetail{}
+		var err error
+		detail.Nickname, err = util.ReadString(r)
+		if err == nil {
+			detail.Note, err = util.ReadString(r)
+		}
+		if err != nil {
+			return err
+		}
+		m.config.Details.Set(contact, detail)
+	case "folders/":
+		if op.Value == nil {
+			_ = labels.DeleteFolder(key)
+		} else if indexOf(labels.Folders(), key) < 0 {
+			return labels.CreateFolder(key)
+		}
+	case "labels/":
+		if op.Value == nil {
+			_ = labels.DeleteLabel(key)
+		} else if indexOf(labels.LabelNames(), key) < 0 {
+			return labels.CreateLabel(key)
+		}
+	case "message/":
+		return m.applyMessage(key, op.Value)
+	case "folder/":
+		folder := InboxFolder
+		if op.Value != nil {
+			folder = string(op.Value)
+		}
+		if labels.Folder(key) != folder {
+			return labels.Move(key, folder)
+		}
+	case "label/":
+		split = strings.SplitN(key, "/", 2)
+		if len(split) != 2 {
+			return nil
+		}
+		if op.Value == nil {
+			labels.RemoveLabel(split[0], split[1])
+		} else if !labels.HasLabel(split[0], split[1]) {
+			return labels.AddLabel(split[0], split[1])
+		}
+	case "flag/":
+		split = strings.SplitN(key, "/", 2)
+		if len(split) != 2 {
+			return nil
+		}
+		flag, err := ParseMessageFlag(split[1])
+		if err != nil {
+			return err
+		}
+		if op.Value == nil {
+			m.config.Flags.Clear(split[0], flag)
+		} else {
+			m.config.Flags.Set(split[0], flag)
+		}
+	}
+	return nil
+}
+
+func (m *mailbox) applyContact(fingerprint string, value []byte) error {
+	contact := m.findContact(fingerprint)
+	if value == nil {
+		if contact != nil {
+			_ = m.RemoveContact(contact) // fails for your own identity, which is never synced
+		}
+		return nil
+	}
+	if contact != nil {
+		return nil
+	}
+	entity, err := gpg.ReadEntity(packet.NewReader(bytes.NewBuffer(value)))
+	if err != nil {
+		return err
+	}
+	if entityFingerprint(entity) != fingerprint {
+		return errors.New("synced key has another fingerprint")
+	}
+	m.config.Contacts.Add(entity)
+	return nil
+}
+
+// applyMessage puts the message with key in the list value names, fetching it if it isn't on this device yet,
+// or deletes it forever if value is nil
+func (m *mailbox) applyMessage(key string, value []byte) error {
+	c, err := cid.Decode(key)
+	if err != nil {
+		return err
+	}
+	lists := m.syncLists()
+	var found crypto.Message
+	foundIn := ""
+	for name, l := range lists {
+		if message := l.FromCid(c); message != nil {
+			found, foundIn = message, name
+		}
+	}
+	if value == nil {
+		if found != nil {
+			DeleteForever(m.config.Labels, key, m.config.Messages, m.config.Sent, m.config.Requests)
+			m.config.Flags.Forget(key)
+		}
+		return nil
+	}
+	split := strings.SplitN(string(value), " ", 2)
+	list, ok := lists[split[0]]
+	if !ok || len(split) != 2 {
+		return errors.New("synced message is in an unknown list")
+	}
+	if found != nil {
+		if foundIn != split[0] {
+			lists[foundIn].Remove(found)
+			list.Add(found)
+		}
+		return nil
+	}
+	body, err := cid.Decode(split[1])
+	if err != nil {
+		return err
+	}
+	message, err := m.fetchSynced(c, body)
+	if err != nil {
+		return err
+	}
+	list.Add(message)
+	m.config.Seen.Add(c)
+	return nil
+}
+
+// fetchSynced fetches body, the message c as one of your other devices synced it
+func (m *mailbox) fetchSynced(c cid.Cid, body cid.Cid) (crypto.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.FetchTimeout)
+	defer cancel()
+	var sealed io.Reader
+	if reader, ok := m.config.Ipfs.(catReader); ok {
+		closer, err := reader.CatReader(ctx, path.IpfsPath(body))
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		sealed = closer
+	} else {
+		data, err := util.CatWithContext(ctx, m.config.Ipfs, path.IpfsPath(body))
+		if err != nil {
+			return nil, err
+		}
+		sealed = bytes.NewReader(data)
+	}
+	opened, err := m.syncLog().Key().OpenStream(util.BoundedReader(sealed, MaxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	// the message came from your own node as far as this device knows
+	origin := peer.ID("")
+	if node, ok := m.config.Ipfs.(NodeIdentity); ok {
+		origin, _ = node.PeerId()
+	}
+	identity, contacts := m.config.Identity, m.config.Contacts
+	var result crypto.Message
+	if m.config.Bodies != nil {
+		err = m.config.Bodies.Put(c, opened) // nothing is stored if it was cut off, too large or changed on the way
+		if err != nil {
+			return nil, err
+		}
+		result = crypto.NewMessageFromStore(m.config.Bodies, c, origin, m.config.Ipfs, identity, contacts, nil)
+		if result == nil {
+			_ = m.config.Bodies.Remove(c)
+		}
+	} else {
+		data, err := ioutil.ReadAll(opened)
+		if err != nil {
+			return nil, err
+		}
+		result = crypto.NewMessage(data, c, origin, m.config.Ipfs, identity, contacts, nil)
+	}
+	if result == nil {
+		return nil, errors.New("synced message could not be decrypted")
+	}
+	return result, nil
+}
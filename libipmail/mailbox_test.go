@@ -0,0 +1,153 @@
+package ipmail
+
+import (
+	"bytes"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeRequest struct {
+	*fakeMessage
+	from      *gpg.Entity
+	handshake *crypto.Handshake
+}
+
+func (f *fakeRequest) From() *gpg.Entity            { return f.from }
+func (f *fakeRequest) Handshake() *crypto.Handshake { return f.handshake }
+
+// newTestMailbox makes a mailbox for a new identity. configure changes the defaults of the mailbox
+func newTestMailbox(t *testing.T, configure ...func(config *MailboxConfig)) Mailbox {
+	self, err := crypto.NewSelfIdentity("self", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := MailboxConfig{
+		Identity: self,
+		Contacts: crypto.NewContactsIdentityList(self.EntityList()),
+	}
+	for _, c := range configure {
+		c(&config)
+	}
+	return NewMailbox(config)
+}
+
+// waitForHandshake waits for the sender to publish a handshake, which the fakeSender doesn't encrypt
+func waitForHandshake(t *testing.T, sender *fakeSender) *crypto.Handshake {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sender.mtx.Lock()
+		published := sender.published
+		sender.mtx.Unlock()
+		if len(published) > 0 {
+			handshake, err := crypto.ReadHandshake(bytes.NewBuffer(published[0]))
+			if err != nil || handshake == nil {
+				t.Fatalf("published %q, want a handshake", published[0])
+			}
+			return handshake
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for a handshake to be published")
+	return nil
+}
+
+func TestMailbox_route(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType EventType
+		want      func(m Mailbox) MessageList
+	}{
+		{"Sent Echo", SentEcho, Mailbox.Sent},
+		{"Message Received", MessageReceived, Mailbox.Messages},
+		{"Contact Request", ContactRequest, Mailbox.Requests},
+		{"Decrypt Failed", DecryptFailed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMailbox(t)
+			msg := newFakeMessage(t, tt.name, 0)
+			event := Event{Type: tt.eventType, Cid: msg.Cid()}
+			if tt.eventType != DecryptFailed {
+				event.Message = msg
+			}
+			m.Events().Publish(event)
+			for _, list := range []MessageList{m.Sent(), m.Messages(), m.Requests()} {
+				want := tt.want != nil && list == tt.want(m)
+				if got := list.FromCid(msg.Cid()) != nil; got != want {
+					t.Errorf("message in list = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMailbox_requests(t *testing.T) {
+	stranger, _ := gpg.NewEntity("stranger", "", "", util.DefaultEncryptionConfig())
+	tests := []struct {
+		name        string
+		accept      bool
+		wantContact bool
+		wantInbox   bool
+		wantAnswer  crypto.HandshakeKind
+	}{
+		{"Accept", true, true, true, crypto.HandshakeAccept},
+		{"Deny", false, false, false, crypto.HandshakeDecline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{}
+			outbox, err := NewOutbox(sender, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer outbox.Close()
+			dir, err := ioutil.TempDir("", "ipmail-requests")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			contactsFile := filepath.Join(dir, "contacts")
+			m := newTestMailbox(t, func(config *MailboxConfig) {
+				config.Sender = sender
+				config.Outbox = outbox
+				config.Files.Contacts = contactsFile
+			})
+			msg := &fakeRequest{newFakeMessage(t, tt.name, 0), stranger,
+				&crypto.Handshake{Kind: crypto.HandshakeRequest, Key: stranger}}
+			m.Events().Publish(Event{Type: ContactRequest, Cid: msg.Cid(), Message: msg})
+			if tt.accept {
+				err = m.AcceptRequest(msg)
+			} else {
+				err = m.DenyRequest(msg)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Requests().FromCid(msg.Cid()) != nil {
+				t.Error("message is still a contact request")
+			}
+			if got := m.Messages().FromCid(msg.Cid()) != nil; got != tt.wantInbox {
+				t.Errorf("message in inbox = %v, want %v", got, tt.wantInbox)
+			}
+			if got := containsEntity(stranger, m.Contacts().ToArray()); got != tt.wantContact {
+				t.Errorf("sender in contacts = %v, want %v", got, tt.wantContact)
+			}
+			if saved, err := crypto.NewContactsIdentityListFromFile(contactsFile, nil); tt.wantContact &&
+				(err != nil || !containsEntity(stranger, saved.ToArray())) {
+				t.Errorf("sender not saved to the contacts file, error = %v", err)
+			}
+			if m.AcceptRequest(msg) == nil || m.DenyRequest(msg) == nil {
+				t.Error("a handled request can be handled again")
+			}
+			if got := waitForHandshake(t, sender); got.Kind != tt.wantAnswer || got.Key.PrivateKey != nil {
+				t.Errorf("answered with a %s, want a %s with the public key", got.Kind, tt.wantAnswer)
+			}
+		})
+	}
+}
@@ -3,10 +3,11 @@ package ipmail
 import (
 	"bytes"
 	"container/list"
-	"io/ioutil"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"io"
 	"ipmail/libipmail/crypto"
 	"ipmail/libipmail/util"
-	"os"
 	"sync"
 )
 
@@ -14,8 +15,10 @@ type MessageList interface {
 	Add(message crypto.Message)
 	Remove(message crypto.Message)
 	ForEach(do func(message crypto.Message))
+	// FromId finds a message by its short local ID
 	FromId(id uint64) crypto.Message
-	SaveToFile(file string) error
+	FromCid(c cid.Cid) crypto.Message
+	SaveToFile(file string, sealer util.Sealer) error
 	Len() int
 	FromIndex(idx int) crypto.Message
 }
@@ -23,6 +26,8 @@ type MessageList interface {
 type messageList struct {
 	mtx  sync.Mutex
 	list *list.List
+	// lastId is the highest local ID in the list, which is restored from the messages when it is loaded
+	lastId uint64
 }
 
 func NewMessageList() MessageList {
@@ -33,46 +38,75 @@ func NewMessageList() MessageList {
 	return &result
 }
 
-func NewMessageListFromFile(file string,
+// NewMessageListFromFile reads a list saved by SaveToFile. With bodies the message data is kept there
+// instead of in memory, including the data of messages saved before bodies was used. A message which can't
+// be decrypted any more is left out with a warning instead of failing the list
+func NewMessageListFromFile(file string, sealer util.Sealer, bodies crypto.BodyStore,
 	ipfs util.Cat, identity crypto.SelfIdentity, contacts crypto.ContactsIdentityList,
 ) MessageList {
 	if identity == nil || contacts == nil {
 		return nil
 	}
-	f, err := os.Open(file)
+	buf, err := util.ReadSealedFile(file, sealer)
 	if err != nil {
 		return nil
 	}
-	defer f.Close()
-	result := NewMessageList()
-	buf, err := ioutil.ReadAll(f)
+	messages := make([]crypto.Message, 0)
 	buffer := bytes.NewBuffer(buf)
 	for buffer.Len() > 0 {
 		var msg crypto.Message
-		msg, err = crypto.ReadMessage(buffer, ipfs, identity, contacts)
+		msg, err = crypto.ReadMessageWithStore(buffer, bodies, ipfs, identity, contacts)
+		var unreadable *crypto.UnreadableMessageError
+		if errors.As(err, &unreadable) {
+			println("warning:", unreadable.Error()) // the messages after it are still read
+			err = nil
+			continue
+		}
 		if err != nil {
 			break
 		}
-		result.Add(msg)
+		messages = append(messages, msg)
 	}
-	if buffer.Len() == 0 && err == nil {
-		return result
-	} else {
+	if buffer.Len() != 0 || err != nil {
 		return nil
 	}
+	result := NewMessageList().(*messageList)
+	for _, msg := range messages {
+		if msg.Id() > result.lastId {
+			result.lastId = msg.Id() // before adding, so messages saved without an ID don't get one which is taken
+		}
+	}
+	for _, msg := range messages {
+		result.Add(msg)
+	}
+	return result
 }
 
 func (m *messageList) Add(message crypto.Message) {
 	m.mtx.Lock()
+	m.assignId(message)
 	m.list.PushBack(message)
 	m.mtx.Unlock()
 }
 
+// assignId gives message the next local ID of the list if it has none yet, or if another message in the list
+// has its ID, like a message moved here from another list. IDs are only unique within a list
+func (m *messageList) assignId(message crypto.Message) {
+	if id := message.Id(); id != 0 && m.fromId(id) == nil {
+		if id > m.lastId {
+			m.lastId = id
+		}
+		return
+	}
+	m.lastId++
+	message.SetId(m.lastId)
+}
+
 func (m *messageList) Remove(message crypto.Message) {
 	m.mtx.Lock()
 	for elm := m.list.Back(); elm != nil; elm = elm.Prev() {
 		compare := elm.Value.(crypto.Message)
-		if compare.Id() == message.Id() {
+		if compare.Cid().Equals(message.Cid()) {
 			m.list.Remove(elm)
 			break
 		}
@@ -110,30 +144,122 @@ func (m *messageList) FromIndex(idx int) crypto.Message {
 }
 
 func (m *messageList) FromId(id uint64) crypto.Message {
-	var result crypto.Message = nil
 	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.fromId(id)
+}
+
+func (m *messageList) fromId(id uint64) crypto.Message {
 	for elm := m.list.Front(); elm != nil; elm = elm.Next() {
 		msg := elm.Value.(crypto.Message)
 		if msg.Id() == id {
-			result = msg
-			break
+			return msg
 		}
 	}
-	m.mtx.Unlock()
+	return nil
+}
+
+func (m *messageList) FromCid(c cid.Cid) crypto.Message {
+	var result crypto.Message = nil
+	m.ForEach(func(message crypto.Message) {
+		if result == nil && message.Cid().Equals(c) {
+			result = message
+		}
+	})
 	return result
 }
 
-func (m *messageList) SaveToFile(file string) error {
-	f, err := os.Create(file)
-	if err != nil {
+func (m *messageList) SaveToFile(file string, sealer util.Sealer) error {
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		var err error
+		m.ForEach(func(message crypto.Message) {
+			if err != nil {
+				return
+			}
+			err = message.Serialize(w)
+		})
 		return err
+	})
+}
+
+type messageListView struct {
+	sources []MessageList
+	filter  func(message crypto.Message) bool
+}
+
+// NewMessageListView returns a live view of the messages in sources which match filter.
+// Adding to the view adds to the first source and removing removes from every source.
+func NewMessageListView(filter func(message crypto.Message) bool, sources ...MessageList) MessageList {
+	return &messageListView{
+		sources: sources,
+		filter:  filter,
 	}
-	defer f.Close()
-	m.ForEach(func(message crypto.Message) {
-		if err != nil {
-			return
+}
+
+func (v *messageListView) Add(message crypto.Message) {
+	if len(v.sources) > 0 {
+		v.sources[0].Add(message)
+	}
+}
+
+func (v *messageListView) Remove(message crypto.Message) {
+	for _, source := range v.sources {
+		source.Remove(message)
+	}
+}
+
+func (v *messageListView) ForEach(do func(message crypto.Message)) {
+	for _, source := range v.sources {
+		source.ForEach(func(message crypto.Message) {
+			if v.filter(message) {
+				do(message)
+			}
+		})
+	}
+}
+
+func (v *messageListView) FromId(id uint64) crypto.Message {
+	var result crypto.Message = nil
+	v.ForEach(func(message crypto.Message) {
+		if result == nil && message.Id() == id {
+			result = message
+		}
+	})
+	return result
+}
+
+func (v *messageListView) FromCid(c cid.Cid) crypto.Message {
+	var result crypto.Message = nil
+	v.ForEach(func(message crypto.Message) {
+		if result == nil && message.Cid().Equals(c) {
+			result = message
 		}
-		err = message.Serialize(f)
 	})
-	return err
+	return result
+}
+
+func (v *messageListView) SaveToFile(file string, sealer util.Sealer) error {
+	result := NewMessageList()
+	v.ForEach(result.Add)
+	return result.SaveToFile(file, sealer)
+}
+
+func (v *messageListView) Len() int {
+	result := 0
+	v.ForEach(func(message crypto.Message) {
+		result++
+	})
+	return result
+}
+
+func (v *messageListView) FromIndex(idx int) crypto.Message {
+	var result crypto.Message = nil
+	i := 0
+	v.ForEach(func(message crypto.Message) {
+		if i == idx {
+			result = message
+		}
+		i++
+	})
+	return result
 }
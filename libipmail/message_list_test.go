@@ -0,0 +1,144 @@
+package ipmail
+
+import (
+	"bytes"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeMessage struct {
+	cid      cid.Cid
+	id       uint64
+	legacyId uint64
+}
+
+func newFakeMessage(t *testing.T, data string, legacyId uint64) *fakeMessage {
+	c, err := util.ContentCid([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeMessage{cid: c, legacyId: legacyId}
+}
+
+func (f *fakeMessage) From() *gpg.Entity { return nil }
+func (f *fakeMessage) FromName() string  { return "Unknown" }
+func (f *fakeMessage) FromEmail() string { return "Unknown" }
+func (f *fakeMessage) Data() []byte      { return nil }
+func (f *fakeMessage) Body() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(nil)), nil
+}
+func (f *fakeMessage) Encrypted() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(nil)), nil
+}
+func (f *fakeMessage) String() string                   { return f.cid.String() }
+func (f *fakeMessage) Cid() cid.Cid                     { return f.cid }
+func (f *fakeMessage) Id() uint64                       { return f.id }
+func (f *fakeMessage) SetId(id uint64)                  { f.id = id }
+func (f *fakeMessage) Serialize(writer io.Writer) error { return nil }
+func (f *fakeMessage) IsFrom(entity *gpg.Entity) bool   { return false }
+func (f *fakeMessage) LegacyId() (uint64, bool)         { return f.legacyId, f.legacyId != 0 }
+func (f *fakeMessage) Handshake() *crypto.Handshake     { return nil }
+
+func TestMessageList_ids(t *testing.T) {
+	// both messages carry the same pubsub sequence number, which used to make them collide
+	first := newFakeMessage(t, "first", 1)
+	second := newFakeMessage(t, "second", 1)
+	inbox := NewMessageList()
+	sent := NewMessageList()
+	inbox.Add(first)
+	sent.Add(second)
+	if first.Id() != 1 || second.Id() != 1 {
+		t.Fatalf("Add() assigned local IDs %d and %d, want each list to start at 1", first.Id(), second.Id())
+	}
+	third := newFakeMessage(t, "third", 0)
+	inbox.Add(third)
+	if third.Id() != 2 {
+		t.Errorf("Add() assigned local ID %d, want 2", third.Id())
+	}
+	sent.Remove(second)
+	inbox.Add(second) // moved with an ID the inbox already has
+	if second.Id() != 3 || inbox.FromId(1) != first {
+		t.Errorf("Add() kept local ID %d of a message moved from another list, want 3", second.Id())
+	}
+	all := NewMessageListView(func(message crypto.Message) bool { return true }, inbox, sent)
+	if got := all.FromId(second.Id()); got != second {
+		t.Errorf("FromId() got = %v, want %v", got, second)
+	}
+	if got := all.FromCid(first.Cid()); got != first {
+		t.Errorf("FromCid() got = %v, want %v", got, first)
+	}
+	all.Remove(second)
+	if inbox.Len() != 2 || sent.Len() != 0 {
+		t.Errorf("Remove() left %d in inbox and %d in sent, want 2 and 0", inbox.Len(), sent.Len())
+	}
+}
+
+func TestNewMessageListFromFile_ids(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice")
+	bob := newLoopbackUser(t, network, "bob")
+	alice.mailbox.Contacts().Add(bob.identity.DefaultIdentity())
+	bob.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+	for _, text := range []string{"first", "second"} {
+		bob.send(t, text, alice)
+		alice.expect(t, MessageReceived)
+	}
+	dir, err := ioutil.TempDir("", "ipmail-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inbox")
+	if err = alice.mailbox.Messages().SaveToFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	config := alice.mailbox.(*mailbox).config
+	loaded := NewMessageListFromFile(file, nil, nil, config.Ipfs, config.Identity, config.Contacts)
+	if loaded == nil || loaded.Len() != 2 {
+		t.Fatalf("NewMessageListFromFile() = %v, want 2 messages", loaded)
+	}
+	added := newFakeMessage(t, "added", 0)
+	loaded.Add(added)
+	if added.Id() != 3 {
+		t.Errorf("Add() after loading assigned local ID %d, want 3", added.Id())
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		legacyId uint64
+		want     bool
+	}{
+		{"Legacy", 42, true},
+		{"Current", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := newFakeMessage(t, tt.name, tt.legacyId)
+			list := NewMessageList()
+			list.Add(msg)
+			labels := NewMessageLabels()
+			_ = labels.Move("42", ArchiveFolder)
+			flags := NewMessageFlags()
+			flags.Set("42", FlagStarred)
+			if got := MigrateLegacyKeys(labels, flags, list, nil); got != tt.want {
+				t.Errorf("MigrateLegacyKeys() = %v, want %v", got, tt.want)
+			}
+			key := MessageKey(msg)
+			if (labels.Folder(key) == ArchiveFolder) != tt.want {
+				t.Errorf("Folder() = %q after migrating", labels.Folder(key))
+			}
+			if flags.Has(key, FlagStarred) != tt.want {
+				t.Errorf("Has(FlagStarred) = %v, want %v", flags.Has(key, FlagStarred), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"io"
+	"ipmail/libipmail/util"
+	"strings"
+	"sync"
+)
+
+// IdentityKeyName is the IPNS key the identity is published under, so its name stays the same while the
+// node's own key is only used for the node
+const IdentityKeyName = "ipmail-identity"
+
+// NameSystem is implemented by transports which can publish IPNS records and resolve IPNS and DNSLink names,
+// like *Ipfs. A LoopbackNetwork stands in for it in tests
+type NameSystem interface {
+	// PublishName points the IPNS name of the key called key at p, making the key the first time,
+	// and returns the name as /ipns/<key hash>
+	PublishName(ctx context.Context, key string, p path.Path) (string, error)
+	// ResolveName resolves an /ipns/ name, whether a key hash or a domain with a DNSLink, to what it points at
+	ResolveName(ctx context.Context, name string) (path.Path, error)
+}
+
+// NameOfAddress turns a human readable address into the name NameSystem.ResolveName takes. An IPNS name is
+// given as /ipns/<key hash> or ipns:<key hash>, and name@domain is the DNSLink of the domain name.domain, which
+// is lowercased since domains aren't case sensitive while key hashes are
+func NameOfAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if strings.HasPrefix(address, "/ipns/") {
+		address = strings.TrimPrefix(address, "/ipns/")
+	} else if strings.HasPrefix(address, "ipns:") {
+		address = strings.TrimPrefix(address, "ipns:")
+	} else if at := strings.LastIndex(address, "@"); at > 0 {
+		address = strings.ToLower(address[:at] + "." + address[at+1:])
+		if !isDomain(address) {
+			return "", fmt.Errorf("%q is not a name@domain address", address)
+		}
+	} else {
+		return "", fmt.Errorf("%q is not an IPNS name or a name@domain address", address)
+	}
+	if len(address) == 0 || strings.ContainsAny(address, "/@ ") {
+		return "", errors.New("address has no name")
+	}
+	return "/ipns/" + address, nil
+}
+
+func isDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if len(labels) < 3 { // the name and at least a domain with a top level domain
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// certifiedBy is whether signer certified an identity of entity, which is how the old key of a contact vouches
+// for the key its address now points to
+func certifiedBy(entity *gpg.Entity, signer *gpg.Entity) bool {
+	for name, identity := range entity.Identities {
+		for _, sig := range identity.Signatures {
+			if sig.IssuerKeyId == nil || *sig.IssuerKeyId != signer.PrimaryKey.KeyId {
+				continue
+			}
+			if signer.PrimaryKey.VerifyUserIdSignature(name, entity.PrimaryKey, sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ContactNames are the addresses contacts were added by, which are resolved again to follow key changes
+type ContactNames interface {
+	Set(contact *gpg.Entity, address string)
+	// Get returns the address contact was added by, or false if they weren't added by one
+	Get(contact *gpg.Entity) (string, bool)
+	Remove(contact *gpg.Entity)
+	// ForEach calls do with the fingerprint of every contact added by an address
+	ForEach(do func(fingerprint string, address string))
+	Len() int
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type contactNames struct {
+	mtx sync.Mutex
+	// addresses are by contact fingerprint
+	addresses map[string]string
+}
+
+func NewContactNames() ContactNames {
+	return &contactNames{addresses: make(map[string]string)}
+}
+
+func NewContactNamesFromFile(file string, sealer util.Sealer) (ContactNames, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := &contactNames{addresses: make(map[string]string)}
+	r := bytes.NewBuffer(b)
+	for r.Len() > 0 {
+		fingerprint, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		result.addresses[fingerprint], err = util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (c *contactNames) Set(contact *gpg.Entity, address string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.addresses[entityFingerprint(contact)] = address
+}
+
+func (c *contactNames) Get(contact *gpg.Entity) (string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	address, ok := c.addresses[entityFingerprint(contact)]
+	return address, ok
+}
+
+func (c *contactNames) Remove(contact *gpg.Entity) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.addresses, entityFingerprint(contact))
+}
+
+func (c *contactNames) ForEach(do func(fingerprint string, address string)) {
+	c.mtx.Lock()
+	addresses := make(map[string]string, len(c.addresses))
+	for fingerprint, address := range c.addresses {
+		addresses[fingerprint] = address
+	}
+	c.mtx.Unlock()
+	for fingerprint, address := range addresses {
+		do(fingerprint, address)
+	}
+}
+
+func (c *contactNames) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.addresses)
+}
+
+func (c *contactNames) SaveToFile(file string, sealer util.Sealer) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		for fingerprint, address := range c.addresses {
+			err := util.WriteString(w, fingerprint)
+			if err != nil {
+				return err
+			}
+			err = util.WriteString(w, address)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,280 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNameOfAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		want    string
+		wantErr bool
+	}{
+		{"IPNS Path", "/ipns/k51qzi5uqu5dl", "/ipns/k51qzi5uqu5dl", false},
+		{"IPNS URI", "ipns:k51qzi5uqu5dl", "/ipns/k51qzi5uqu5dl", false},
+		{"Case Sensitive Key Hash", "ipns:QmKeyHash", "/ipns/QmKeyHash", false},
+		{"Name At Domain", " Alice@Example.com\n", "/ipns/alice.example.com", false},
+		{"Subdomain", "alice@mail.example.com", "/ipns/alice.mail.example.com", false},
+		{"No Top Level Domain", "alice@example", "", true},
+		{"No Name", "@example.com", "", true},
+		{"Empty Label", "alice@example..com", "", true},
+		{"Not A Domain", "alice@exa mple.com", "", true},
+		{"Empty IPNS Name", "ipns:", "", true},
+		{"IPFS Path", "/ipfs/bafy", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NameOfAddress(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NameOfAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NameOfAddress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContactNames(t *testing.T) {
+	identity, err := crypto.NewSelfIdentity("test", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := identity.DefaultIdentity()
+	dir, err := ioutil.TempDir("", "ipmail-names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "names")
+
+	names := NewContactNames()
+	names.Set(alice, "alice@example.com")
+	if err := names.SaveToFile(file, nil); err != nil {
+		t.Fatalf("SaveToFile() error = %v", err)
+	}
+	names, err = NewContactNamesFromFile(file, nil)
+	if err != nil {
+		t.Fatalf("NewContactNamesFromFile() error = %v", err)
+	}
+	if got, ok := names.Get(alice); !ok || got != "alice@example.com" {
+		t.Errorf("Get() = %q, %v, want the address saved", got, ok)
+	}
+	names.Remove(alice)
+	if _, ok := names.Get(alice); ok || names.Len() != 0 {
+		t.Error("Get() found a removed contact")
+	}
+}
+
+// publishIdentity adds a new identity to IPFS, returning it and its content ID
+// publishIdentity adds a new identity to ipfs, certified by certifier unless it is nil
+func publishIdentity(t *testing.T, ipfs Transport, certifier *gpg.Entity) (*gpg.Entity, cid.Cid) {
+	identity, err := crypto.NewSelfIdentity("alice", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certifier != nil {
+		for name := range identity.DefaultIdentity().Identities {
+			if err = identity.DefaultIdentity().SignIdentity(name, certifier, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err = identity.DefaultIdentity().Serialize(buf); err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := ipfs.AddFromReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity.DefaultIdentity(), resolved.Cid()
+}
+
+func TestMailbox_names(t *testing.T) {
+	ctx := context.Background()
+	network := NewLoopbackNetwork()
+	aliceIpfs := network.Join("alice")
+	alice := newTestMailbox(t, func(config *MailboxConfig) {
+		config.Ipfs = aliceIpfs
+	})
+	names := NewContactNames()
+	bob := newTestMailbox(t, func(config *MailboxConfig) {
+		config.Ipfs = network.Join("bob")
+		config.Names = names
+	})
+
+	oldKey, c := publishIdentity(t, aliceIpfs, nil)
+	name, err := alice.PublishName(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.SetDNSLink("alice.example.com", path.New(name))
+	if _, _, err = bob.AddContactByName(ctx, "bob@example.com"); err == nil {
+		t.Error("AddContactByName() of a domain without a DNSLink succeeded")
+	}
+	if _, _, err = newTestMailbox(t).AddContactByName(ctx, name); err != ErrNoNameSystem {
+		t.Errorf("AddContactByName() without a NameSystem error = %v, want %v", err, ErrNoNameSystem)
+	}
+
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"IPNS Name", "ipns:" + name[len("/ipns/"):]},
+		{"DNSLink", "alice@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entity, got, err := bob.AddContactByName(ctx, tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entity.PrimaryKey.Fingerprint != oldKey.PrimaryKey.Fingerprint || got != c {
+				t.Errorf("AddContactByName() = %X at %s, want %X at %s",
+					entity.PrimaryKey.Fingerprint, got, oldKey.PrimaryKey.Fingerprint, c)
+			}
+			if address, _ := names.Get(entity); address != tt.address {
+				t.Errorf("Names().Get() = %q, want %q", address, tt.address)
+			}
+		})
+	}
+
+	changes, err := bob.RefreshContacts(ctx)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("RefreshContacts() = %v, %v, want no changes", changes, err)
+	}
+	newKey, c := publishIdentity(t, aliceIpfs, nil)
+	if republished, err := alice.PublishName(ctx, c); err != nil || republished != name {
+		t.Fatalf("PublishName() = %s, %v, want the name to stay %s", republished, err, name)
+	}
+	changes, err = bob.RefreshContacts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !changes[0].Held {
+		t.Fatalf("RefreshContacts() = %v, want the key change the old key didn't certify held", changes)
+	}
+	change := changes[0]
+	if change.Old.PrimaryKey.Fingerprint != oldKey.PrimaryKey.Fingerprint ||
+		change.New.PrimaryKey.Fingerprint != newKey.PrimaryKey.Fingerprint || change.Cid != c {
+		t.Errorf("RefreshContacts() = %v, want the key change to %s", change, c)
+	}
+	if !containsEntity(oldKey, bob.Contacts().ToArray()) || containsEntity(newKey, bob.Contacts().ToArray()) {
+		t.Error("RefreshContacts() replaced the old key before the change was accepted")
+	}
+	if changes, err = bob.RefreshContacts(ctx); err != nil || len(changes) != 0 {
+		t.Errorf("RefreshContacts() = %v, %v, want the held change returned only once", changes, err)
+	}
+	if held := bob.HeldContactChanges(); len(held) != 1 || held[0].New != change.New {
+		t.Errorf("HeldContactChanges() = %v, want the held change", held)
+	}
+	if err = bob.AcceptContactChange(ctx, change); err != nil {
+		t.Fatal(err)
+	}
+	if containsEntity(oldKey, bob.Contacts().ToArray()) || !containsEntity(newKey, bob.Contacts().ToArray()) {
+		t.Error("AcceptContactChange() didn't replace the old key in the contacts")
+	}
+	if _, ok := names.Get(newKey); !ok {
+		t.Error("AcceptContactChange() didn't keep following the address")
+	}
+	if err = bob.AcceptContactChange(ctx, change); err == nil {
+		t.Error("AcceptContactChange() accepted a change twice")
+	}
+
+	certifiedKey, c := publishIdentity(t, aliceIpfs, newKey)
+	if _, err = alice.PublishName(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = bob.RefreshContacts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Held || changes[0].Cid != c {
+		t.Fatalf("RefreshContacts() = %v, want the key change the old key certified", changes)
+	}
+	if containsEntity(newKey, bob.Contacts().ToArray()) || !containsEntity(certifiedKey, bob.Contacts().ToArray()) {
+		t.Error("RefreshContacts() didn't replace the old key in the contacts")
+	}
+	if _, ok := names.Get(certifiedKey); !ok {
+		t.Error("RefreshContacts() didn't keep following the address")
+	}
+}
+
+// slowNames resolves names only once release is closed, telling resolving each time it starts
+type slowNames struct {
+	Transport
+	resolving chan struct{}
+	release   chan struct{}
+}
+
+func (s *slowNames) PublishName(ctx context.Context, key string, p path.Path) (string, error) {
+	return s.Transport.(NameSystem).PublishName(ctx, key, p)
+}
+
+func (s *slowNames) ResolveName(ctx context.Context, name string) (path.Path, error) {
+	if s.release != nil {
+		s.resolving <- struct{}{}
+		<-s.release
+	}
+	return s.Transport.(NameSystem).ResolveName(ctx, name)
+}
+
+func TestMailbox_RefreshContacts_resolving(t *testing.T) {
+	ctx := context.Background()
+	network := NewLoopbackNetwork()
+	aliceIpfs := network.Join("alice")
+	alice := newTestMailbox(t, func(config *MailboxConfig) {
+		config.Ipfs = aliceIpfs
+	})
+	bobIpfs := &slowNames{Transport: network.Join("bob")}
+	bob := newTestMailbox(t, func(config *MailboxConfig) {
+		config.Ipfs = bobIpfs
+		config.Names = NewContactNames()
+	})
+	_, c := publishIdentity(t, aliceIpfs, nil)
+	name, err := alice.PublishName(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = bob.AddContactByName(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	_, c = publishIdentity(t, aliceIpfs, nil)
+	if _, err = alice.PublishName(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+
+	bobIpfs.resolving, bobIpfs.release = make(chan struct{}, 1), make(chan struct{})
+	refreshed := make(chan []ContactChange)
+	go func() {
+		changes, _ := bob.RefreshContacts(ctx)
+		refreshed <- changes
+	}()
+	<-bobIpfs.resolving
+	held := make(chan struct{})
+	go func() {
+		bob.HeldContactChanges()
+		close(held)
+	}()
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Error("HeldContactChanges() waited for RefreshContacts() to resolve the names")
+	}
+	close(bobIpfs.release)
+	if changes := <-refreshed; len(changes) != 1 || !changes[0].Held {
+		t.Errorf("RefreshContacts() = %v, want the key change held", changes)
+	}
+}
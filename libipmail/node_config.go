@@ -0,0 +1,189 @@
+package ipmail
+
+import (
+	"bytes"
+	"fmt"
+	config "github.com/ipfs/go-ipfs-config"
+	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Routing int
+
+const (
+	// RoutingDht acts as a DHT server when the node is publicly reachable and as a client otherwise
+	RoutingDht Routing = iota
+	RoutingDhtClient
+	RoutingDhtServer
+	// RoutingNone only finds content on peers the node is already connected to
+	RoutingNone
+)
+
+var routingNames = map[Routing]string{
+	RoutingDht:       "dht",
+	RoutingDhtClient: "dhtclient",
+	RoutingDhtServer: "dhtserver",
+	RoutingNone:      "none",
+}
+
+func (r Routing) String() string {
+	if name, ok := routingNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseRouting is the inverse of Routing.String
+func ParseRouting(s string) (Routing, error) {
+	for routing, name := range routingNames {
+		if strings.EqualFold(s, name) {
+			return routing, nil
+		}
+	}
+	return RoutingDht, fmt.Errorf("\"%s\" is not one of dht, dhtclient, dhtserver or none", s)
+}
+
+func (r Routing) option() libp2p.RoutingOption {
+	switch r {
+	case RoutingDhtClient:
+		return libp2p.DHTClientOption
+	case RoutingDhtServer:
+		return libp2p.DHTServerOption
+	case RoutingNone:
+		return libp2p.NilRouterOption
+	}
+	return libp2p.DHTOption
+}
+
+// DefaultBootstrapNodes are the public IPFS bootstrap and cluster pinning nodes
+var DefaultBootstrapNodes = []string{
+	// IPFS Bootstrapper nodes.
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+	"/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+	"/ip4/104.131.131.82/udp/4001/quic/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+
+	// IPFS Cluster Pinning nodes
+	"/ip4/138.201.67.219/tcp/4001/p2p/QmUd6zHcbkbcs7SMxwLs48qZVX3vpcM8errYS7xEczwRMA",
+	"/ip4/138.201.67.219/udp/4001/quic/p2p/QmUd6zHcbkbcs7SMxwLs48qZVX3vpcM8errYS7xEczwRMA",
+	"/ip4/138.201.67.220/tcp/4001/p2p/QmNSYxZAiJHeLdkBg38roksAR9So7Y5eojks1yjEcUtZ7i",
+	"/ip4/138.201.67.220/udp/4001/quic/p2p/QmNSYxZAiJHeLdkBg38roksAR9So7Y5eojks1yjEcUtZ7i",
+	"/ip4/138.201.68.74/tcp/4001/p2p/QmdnXwLrC8p1ueiq2Qya8joNvk3TVVDAut7PrikmZwubtR",
+	"/ip4/138.201.68.74/udp/4001/quic/p2p/QmdnXwLrC8p1ueiq2Qya8joNvk3TVVDAut7PrikmZwubtR",
+	"/ip4/94.130.135.167/tcp/4001/p2p/QmUEMvxS2e7iDrereVYc5SWPauXPyNwxcy9BXZrC1QTcHE",
+	"/ip4/94.130.135.167/udp/4001/quic/p2p/QmUEMvxS2e7iDrereVYc5SWPauXPyNwxcy9BXZrC1QTcHE",
+}
+
+// DefaultTimeout is how long fetching or publishing waits before giving up on a CID nobody provides
+const DefaultTimeout = 2 * time.Minute
+
+// NodeConfig is how an in-process IPFS node joins the network
+type NodeConfig struct {
+	// Bootstrap are the peers connected to at startup. nil means DefaultBootstrapNodes on the public network
+	// and no peers on a private network
+	Bootstrap []string
+	// ListenAddrs are the swarm addresses to listen on. If empty the node listens on Port
+	ListenAddrs []string
+	// Port is the tcp and udp port to listen on when ListenAddrs is empty. 0 picks random ports
+	Port    int
+	Routing Routing
+	// Mdns finds other nodes on the local network
+	Mdns bool
+	// SwarmKey is the path to a swarm.key file. The node only talks to nodes with the same key
+	SwarmKey string
+	// Migrate upgrades a repo made by an older IPFS version instead of failing to open it. Migrating downloads and
+	// runs the fs-repo-migrations tool, and the repo can't be opened by the older version afterwards
+	Migrate bool
+	// Timeout bounds the operations which aren't given a context, like Cat and Publish. 0 never times out
+	Timeout time.Duration
+}
+
+func DefaultNodeConfig() NodeConfig {
+	return NodeConfig{
+		Routing: RoutingDht,
+		Mdns:    true,
+		Timeout: DefaultTimeout,
+	}
+}
+
+func (c NodeConfig) isPrivate() bool {
+	return len(c.SwarmKey) > 0
+}
+
+func (c NodeConfig) bootstrap() []string {
+	if c.Bootstrap != nil {
+		return c.Bootstrap
+	}
+	if c.isPrivate() {
+		return []string{}
+	}
+	return DefaultBootstrapNodes
+}
+
+func listenAddrsForPort(port int) []string {
+	p := strconv.Itoa(port)
+	return []string{
+		"/ip4/0.0.0.0/tcp/" + p,
+		"/ip6/::/tcp/" + p,
+		"/ip4/0.0.0.0/udp/" + p + "/quic",
+		"/ip6/::/udp/" + p + "/quic",
+	}
+}
+
+// apply changes cfg to match c. Random ports are left to the randomports profile
+func (c NodeConfig) apply(cfg *config.Config) {
+	cfg.Bootstrap = c.bootstrap()
+	if len(c.ListenAddrs) > 0 {
+		cfg.Addresses.Swarm = c.ListenAddrs
+	} else if c.Port > 0 {
+		cfg.Addresses.Swarm = listenAddrsForPort(c.Port)
+	}
+	cfg.Discovery.MDNS.Enabled = c.Mdns
+	if c.Mdns && cfg.Discovery.MDNS.Interval == 0 {
+		cfg.Discovery.MDNS.Interval = 10
+	}
+}
+
+// running returns a copy of cfg for the node to run with, which isn't saved so the repo still listens on QUIC
+// once it is used on the public network again
+func (c NodeConfig) running(cfg *config.Config) (*config.Config, error) {
+	result, err := cfg.Clone()
+	if err != nil || !c.isPrivate() {
+		return result, err
+	}
+	// QUIC doesn't support private networks so the node would fail to listen on it
+	swarm := make([]string, 0, len(result.Addresses.Swarm))
+	for _, addr := range result.Addresses.Swarm {
+		if !strings.Contains(addr, "/quic") {
+			swarm = append(swarm, addr)
+		}
+	}
+	result.Addresses.Swarm = swarm
+	return result, nil
+}
+
+func (c NodeConfig) usesRandomPorts() bool {
+	return len(c.ListenAddrs) == 0 && c.Port <= 0
+}
+
+// swarmKey reads the swarm key, which is nil on the public network
+func (c NodeConfig) swarmKey() ([]byte, error) {
+	if !c.isPrivate() {
+		return nil, nil
+	}
+	key, err := ioutil.ReadFile(c.SwarmKey)
+	if err != nil {
+		return nil, err
+	}
+	_, err = pnet.DecodeV1PSK(bytes.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid swarm key: %s", c.SwarmKey, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,121 @@
+package ipmail
+
+import (
+	config "github.com/ipfs/go-ipfs-config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRouting(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Routing
+		wantErr bool
+	}{
+		{"dht", RoutingDht, false},
+		{"dhtclient", RoutingDhtClient, false},
+		{"DHTServer", RoutingDhtServer, false},
+		{"none", RoutingNone, false},
+		{"gossip", RoutingDht, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRouting(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRouting() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRouting() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeConfig_apply(t *testing.T) {
+	random := []string{"/ip4/0.0.0.0/tcp/1234", "/ip4/0.0.0.0/udp/1234/quic"}
+	tests := []struct {
+		name          string
+		config        NodeConfig
+		wantBootstrap []string
+		// wantSwarm is what the repo is saved with, wantRunning what the node runs with
+		wantSwarm   []string
+		wantRunning []string
+		wantRandom  bool
+	}{
+		{"Default", DefaultNodeConfig(), DefaultBootstrapNodes, random, random, true},
+		{"No Bootstrap", NodeConfig{Bootstrap: []string{}}, []string{}, random, random, true},
+		{"Fixed Port", NodeConfig{Port: 4002}, DefaultBootstrapNodes, listenAddrsForPort(4002),
+			listenAddrsForPort(4002), false},
+		{"Listen Addrs", NodeConfig{ListenAddrs: []string{"/ip4/127.0.0.1/tcp/4003"}, Port: 4002},
+			DefaultBootstrapNodes, []string{"/ip4/127.0.0.1/tcp/4003"}, []string{"/ip4/127.0.0.1/tcp/4003"}, false},
+		{"Private", NodeConfig{SwarmKey: "swarm.key", Port: 4002}, []string{}, listenAddrsForPort(4002),
+			[]string{"/ip4/0.0.0.0/tcp/4002", "/ip6/::/tcp/4002"}, false},
+		{"Private Bootstrap", NodeConfig{SwarmKey: "swarm.key", Bootstrap: []string{"/ip4/10.0.0.1/tcp/4001"}},
+			[]string{"/ip4/10.0.0.1/tcp/4001"}, random, []string{"/ip4/0.0.0.0/tcp/1234"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Addresses.Swarm = random
+			tt.config.apply(cfg)
+			if !reflect.DeepEqual(cfg.Bootstrap, tt.wantBootstrap) {
+				t.Errorf("Bootstrap = %v, want %v", cfg.Bootstrap, tt.wantBootstrap)
+			}
+			if !reflect.DeepEqual(cfg.Addresses.Swarm, tt.wantSwarm) {
+				t.Errorf("Addresses.Swarm = %v, want %v", cfg.Addresses.Swarm, tt.wantSwarm)
+			}
+			running, err := tt.config.running(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(running.Addresses.Swarm, tt.wantRunning) {
+				t.Errorf("running() Addresses.Swarm = %v, want %v", running.Addresses.Swarm, tt.wantRunning)
+			}
+			if cfg.Discovery.MDNS.Enabled != tt.config.Mdns {
+				t.Errorf("MDNS.Enabled = %v, want %v", cfg.Discovery.MDNS.Enabled, tt.config.Mdns)
+			}
+			if got := tt.config.usesRandomPorts(); got != tt.wantRandom {
+				t.Errorf("usesRandomPorts() = %v, want %v", got, tt.wantRandom)
+			}
+		})
+	}
+}
+
+func TestNodeConfig_swarmKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-swarm-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	valid := filepath.Join(dir, "valid.key")
+	_ = ioutil.WriteFile(valid, []byte("/key/swarm/psk/1.0.0/\n/base16/\n"+
+		"6a0f1b2e3d4c5b6a79880f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a\n"), 0600)
+	invalid := filepath.Join(dir, "invalid.key")
+	_ = ioutil.WriteFile(invalid, []byte("not a key"), 0600)
+
+	tests := []struct {
+		name     string
+		swarmKey string
+		wantErr  bool
+		wantKey  bool
+	}{
+		{"Public", "", false, false},
+		{"Valid", valid, false, true},
+		{"Invalid", invalid, true, false},
+		{"Missing", filepath.Join(dir, "missing.key"), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := NodeConfig{SwarmKey: tt.swarmKey}.swarmKey()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("swarmKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := key != nil; got != tt.wantKey {
+				t.Errorf("swarmKey() = %q, want a key %v", key, tt.wantKey)
+			}
+		})
+	}
+}
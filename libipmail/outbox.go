@@ -0,0 +1,592 @@
+package ipmail
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxRetryDelay    = 5 * time.Second
+	outboxMaxRetryDelay = 10 * time.Minute
+)
+
+type OutboxState int
+
+const (
+	// OutboxQueued entries are waiting for their send time
+	OutboxQueued OutboxState = iota
+	// OutboxRetrying entries failed to publish at least once and will be tried again
+	OutboxRetrying
+	// OutboxSent entries have been published and are no longer in the outbox
+	OutboxSent
+	// OutboxCancelled entries were removed from the outbox before being sent
+	OutboxCancelled
+)
+
+func (s OutboxState) String() string {
+	switch s {
+	case OutboxQueued:
+		return "Queued"
+	case OutboxRetrying:
+		return "Retrying"
+	case OutboxSent:
+		return "Sent"
+	case OutboxCancelled:
+		return "Cancelled"
+	}
+	return "Unknown"
+}
+
+type OutboxEntry struct {
+	Id          uint64
+	State       OutboxState
+	SendAt      time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Cid         cid.Cid     // only set once the entry is sent
+	data        []byte      // the message if the outbox is kept in memory
+	body        string      // the file the message is spooled to otherwise
+	sealer      util.Sealer // what body is sealed with
+}
+
+// open reads the encrypted message of the entry
+func (e OutboxEntry) open() (io.ReadCloser, error) {
+	if len(e.body) == 0 {
+		return ioutil.NopCloser(bytes.NewBuffer(e.data)), nil
+	}
+	return util.OpenSealedStream(e.body, e.sealer)
+}
+
+func (e OutboxEntry) String() string {
+	result := "ID: " + strconv.FormatUint(e.Id, 10) + " " + e.State.String()
+	switch e.State {
+	case OutboxQueued:
+		result += " Sending at: " + e.SendAt.Format(time.Stamp)
+	case OutboxRetrying:
+		result += " Attempts: " + strconv.Itoa(e.Attempts) +
+			" Next attempt: " + e.NextAttempt.Format(time.Stamp) +
+			" Error: " + e.LastError
+	case OutboxSent:
+		result += " CID: " + e.Cid.String()
+	}
+	return result
+}
+
+type OutboxHandler func(entry OutboxEntry)
+
+// Outbox is a persistent queue of encrypted messages which keeps trying to publish
+// each message until it is sent or cancelled
+type Outbox interface {
+	// Enqueue schedules the encrypted message write writes (see Sender.Encrypt) to be sent at sendAt. It is spooled
+	// to disk as it is written so it is never held in memory
+	Enqueue(write func(w io.Writer) error, sendAt time.Time) (OutboxEntry, error)
+	// Cancel removes an entry from the outbox if it hasn't been sent yet
+	Cancel(id uint64) error
+	// SendNow makes an entry due immediately, skipping any undo window or backoff
+	SendNow(id uint64) error
+	// OnChange registers a handler called whenever an entry changes state
+	OnChange(handler OutboxHandler)
+	ForEach(do func(entry OutboxEntry))
+	FromIndex(idx int) (OutboxEntry, bool)
+	Len() int
+	io.Closer
+}
+
+type outbox struct {
+	mtx      sync.Mutex
+	list     *list.List
+	nextId   uint64
+	file     string
+	bodies   string // the directory messages are spooled to, empty if the outbox is kept in memory
+	sender   Sender
+	sealer   util.Sealer
+	handlers []OutboxHandler
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+// outboxBodies is the directory the messages of the outbox saved to file are spooled to
+func outboxBodies(file string) string {
+	return file + "-bodies"
+}
+
+// NewOutbox creates an outbox persisted to file and sealed with sealer, loading any entries left from a previous
+// run, and starts sending them with sender. An empty file means the outbox is kept in memory.
+func NewOutbox(sender Sender, file string, sealer util.Sealer) (Outbox, error) {
+	result := &outbox{
+		list:   list.New(),
+		nextId: 1,
+		file:   file,
+		sender: sender,
+		sealer: sealer,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if len(file) > 0 {
+		result.bodies = outboxBodies(file)
+		err := os.MkdirAll(result.bodies, 0700)
+		if err != nil {
+			return nil, err
+		}
+		err = result.load()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		result.removeUnlistedBodies()
+	}
+	go result.run()
+	return result, nil
+}
+
+func (o *outbox) load() error {
+	b, err := util.ReadSealedFile(o.file, o.sealer)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(b)
+	migrated := false
+	for buf.Len() > 0 {
+		entry, err := readOutboxEntry(buf)
+		if err != nil {
+			return fmt.Errorf("outbox file is corrupt: %s", err)
+		}
+		if entry.data != nil { // saved before messages were spooled
+			data := entry.data
+			err = o.spool(entry, func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			migrated = true
+		} else {
+			entry.body, entry.sealer = o.bodyFile(entry.Id), o.sealer
+		}
+		o.list.PushBack(entry)
+		if entry.Id >= o.nextId {
+			o.nextId = entry.Id + 1
+		}
+	}
+	if migrated {
+		o.save()
+	}
+	return nil
+}
+
+func (o *outbox) bodyFile(id uint64) string {
+	return filepath.Join(o.bodies, strconv.FormatUint(id, 10))
+}
+
+// spool writes the message of entry to its file, or keeps it in memory if the outbox is
+func (o *outbox) spool(entry *OutboxEntry, write func(w io.Writer) error) error {
+	if len(o.bodies) == 0 {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		err := write(buf)
+		if err != nil {
+			return err
+		}
+		entry.data = buf.Bytes()
+		return nil
+	}
+	entry.body, entry.sealer = o.bodyFile(entry.Id), o.sealer
+	entry.data = nil
+	return util.WriteSealedStream(entry.body, o.sealer, write)
+}
+
+// removeBody deletes the spooled message of an entry which left the outbox
+func (o *outbox) removeBody(entry OutboxEntry) {
+	if len(entry.body) == 0 {
+		return
+	}
+	err := os.Remove(entry.body)
+	if err != nil && !os.IsNotExist(err) {
+		println("warning: message", strconv.FormatUint(entry.Id, 10), "could not be removed from the outbox due to:", err.Error())
+	}
+}
+
+// removeUnlistedBodies deletes spooled messages left by a run which stopped before saving the outbox
+func (o *outbox) removeUnlistedBodies() {
+	infos, err := ioutil.ReadDir(o.bodies)
+	if err != nil {
+		return
+	}
+	listed := make(map[string]bool)
+	for elm := o.list.Front(); elm != nil; elm = elm.Next() {
+		listed[elm.Value.(*OutboxEntry).body] = true
+	}
+	for _, info := range infos {
+		if file := filepath.Join(o.bodies, info.Name()); !listed[file] {
+			_ = os.Remove(file)
+		}
+	}
+}
+
+// save must be called with mtx held
+func (o *outbox) save() {
+	if len(o.file) == 0 {
+		return
+	}
+	err := util.WriteSealedFile(o.file, o.sealer, func(w io.Writer) error {
+		for elm := o.list.Front(); elm != nil; elm = elm.Next() {
+			err := elm.Value.(*OutboxEntry).serialize(w)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		println("warning: outbox could not be saved to file due to:", err.Error())
+	}
+}
+
+func (o *outbox) notify(entry OutboxEntry) {
+	o.mtx.Lock()
+	handlers := append(make([]OutboxHandler, 0, len(o.handlers)), o.handlers...)
+	o.mtx.Unlock()
+	for _, handler := range handlers {
+		handler(entry)
+	}
+}
+
+func (o *outbox) wakeUp() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) Enqueue(write func(w io.Writer) error, sendAt time.Time) (OutboxEntry, error) {
+	o.mtx.Lock()
+	entry := &OutboxEntry{
+		Id:          o.nextId,
+		State:       OutboxQueued,
+		SendAt:      sendAt,
+		NextAttempt: sendAt,
+	}
+	o.nextId++
+	o.mtx.Unlock()
+	err := o.spool(entry, write) // without the lock, since encrypting a big message takes a while
+	if err != nil {
+		o.removeBody(*entry)
+		return OutboxEntry{}, err
+	}
+	o.mtx.Lock()
+	o.list.PushBack(entry)
+	o.save()
+	result := *entry
+	o.mtx.Unlock()
+	o.notify(result)
+	o.wakeUp()
+	return result, nil
+}
+
+func (o *outbox) find(id uint64) *list.Element {
+	for elm := o.list.Front(); elm != nil; elm = elm.Next() {
+		if elm.Value.(*OutboxEntry).Id == id {
+			return elm
+		}
+	}
+	return nil
+}
+
+func (o *outbox) Cancel(id uint64) error {
+	o.mtx.Lock()
+	elm := o.find(id)
+	if elm == nil {
+		o.mtx.Unlock()
+		return errors.New("message " + strconv.FormatUint(id, 10) + " is not in the outbox")
+	}
+	o.list.Remove(elm)
+	o.save()
+	entry := *elm.Value.(*OutboxEntry)
+	o.mtx.Unlock()
+	entry.State = OutboxCancelled
+	o.notify(entry)
+	o.removeBody(entry)
+	return nil
+}
+
+func (o *outbox) SendNow(id uint64) error {
+	o.mtx.Lock()
+	elm := o.find(id)
+	if elm == nil {
+		o.mtx.Unlock()
+		return errors.New("message " + strconv.FormatUint(id, 10) + " is not in the outbox")
+	}
+	now := time.Now()
+	entry := elm.Value.(*OutboxEntry)
+	entry.SendAt = now
+	entry.NextAttempt = now
+	o.mtx.Unlock()
+	o.wakeUp()
+	return nil
+}
+
+func (o *outbox) OnChange(handler OutboxHandler) {
+	if handler == nil {
+		return
+	}
+	o.mtx.Lock()
+	o.handlers = append(o.handlers, handler)
+	o.mtx.Unlock()
+}
+
+func (o *outbox) ForEach(do func(entry OutboxEntry)) {
+	o.mtx.Lock()
+	entries := make([]OutboxEntry, 0, o.list.Len())
+	for elm := o.list.Front(); elm != nil; elm = elm.Next() {
+		entries = append(entries, *elm.Value.(*OutboxEntry))
+	}
+	o.mtx.Unlock()
+	for _, entry := range entries {
+		do(entry)
+	}
+}
+
+func (o *outbox) FromIndex(idx int) (OutboxEntry, bool) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for i, elm := 0, o.list.Front(); elm != nil; i, elm = i+1, elm.Next() {
+		if i == idx {
+			return *elm.Value.(*OutboxEntry), true
+		}
+	}
+	return OutboxEntry{}, false
+}
+
+func (o *outbox) Len() int {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.list.Len()
+}
+
+func (o *outbox) Close() error {
+	select {
+	case <-o.done:
+		return errors.New("outbox already closed")
+	default:
+		close(o.done)
+	}
+	return nil
+}
+
+// nextDue returns the entry which should be attempted next, if any
+func (o *outbox) nextDue() (*OutboxEntry, time.Time) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	var due *OutboxEntry = nil
+	for elm := o.list.Front(); elm != nil; elm = elm.Next() {
+		entry := elm.Value.(*OutboxEntry)
+		if due == nil || entry.NextAttempt.Before(due.NextAttempt) {
+			due = entry
+		}
+	}
+	if due == nil {
+		return nil, time.Time{}
+	}
+	return due, due.NextAttempt
+}
+
+func (o *outbox) run() {
+	for {
+		entry, at := o.nextDue()
+		var timer <-chan time.Time = nil
+		if entry != nil {
+			wait := time.Until(at)
+			if wait <= 0 {
+				o.attempt(entry)
+				continue
+			}
+			timer = time.After(wait)
+		}
+		select {
+		case <-o.done:
+			return
+		case <-o.wake:
+		case <-timer:
+		}
+	}
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := outboxRetryDelay
+	for i := 1; i < attempts && delay < outboxMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxRetryDelay {
+		delay = outboxMaxRetryDelay
+	}
+	return delay
+}
+
+func (o *outbox) attempt(entry *OutboxEntry) {
+	o.mtx.Lock()
+	if o.find(entry.Id) == nil { // cancelled since it became due
+		o.mtx.Unlock()
+		return
+	}
+	o.mtx.Unlock()
+
+	sent, err := o.publish(entry)
+
+	o.mtx.Lock()
+	elm := o.find(entry.Id)
+	if err != nil && elm == nil { // cancelled while publishing
+		o.mtx.Unlock()
+		return
+	}
+	if err == nil {
+		if elm != nil {
+			o.list.Remove(elm)
+		}
+		entry.State = OutboxSent
+		entry.Cid = sent
+		entry.LastError = ""
+	} else {
+		entry.State = OutboxRetrying
+		entry.Attempts++
+		entry.LastError = err.Error()
+		entry.NextAttempt = time.Now().Add(retryDelay(entry.Attempts))
+	}
+	o.save()
+	result := *entry
+	o.mtx.Unlock()
+	o.notify(result)
+	if result.State == OutboxSent {
+		o.removeBody(result) // after the handlers, which may read it
+	}
+}
+
+func (o *outbox) publish(entry *OutboxEntry) (cid.Cid, error) {
+	body, err := entry.open()
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer body.Close()
+	return o.sender.Publish(body)
+}
+
+// outboxEntryVersion is written where entries saved before their messages were spooled start with their id
+const outboxEntryVersion = -1
+
+func (e *OutboxEntry) serialize(w io.Writer) error {
+	err := util.WriteInt64(w, outboxEntryVersion)
+	if err != nil {
+		return err
+	}
+	err = util.WriteUint64(w, e.Id)
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(w, e.SendAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(w, int64(e.Attempts))
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(w, e.NextAttempt.UnixNano())
+	if err != nil {
+		return err
+	}
+	return util.WriteString(w, e.LastError)
+}
+
+// readOutboxEntry reads an entry without its message, or with it if it was saved before messages were spooled
+func readOutboxEntry(r io.Reader) (*OutboxEntry, error) {
+	result := OutboxEntry{}
+	version, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if version == outboxEntryVersion {
+		result.Id, err = util.ReadUint64(r)
+		if err != nil {
+			return nil, err
+		}
+	} else if version >= 0 {
+		result.Id = uint64(version)
+	} else {
+		return nil, errors.New("unknown outbox entry version " + strconv.FormatInt(version, 10))
+	}
+	sendAt, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.SendAt = time.Unix(0, sendAt)
+	attempts, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Attempts = int(attempts)
+	nextAttempt, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.NextAttempt = time.Unix(0, nextAttempt)
+	result.LastError, err = util.ReadString(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != outboxEntryVersion {
+		result.data, err = util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if result.Attempts > 0 {
+		result.State = OutboxRetrying
+	}
+	return &result, nil
+}
+
+var sendAtLayouts = []string{
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"15:04",
+}
+
+// ParseSendAt parses when a message should be sent. It accepts a delay like "+1h30m",
+// a time of day like "15:04" (the next time that clock time comes around) or a local date
+// and time like "2006-01-02 15:04".
+func ParseSendAt(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "+") {
+		delay, err := time.ParseDuration(s[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(delay), nil
+	}
+	for _, layout := range sendAtLayouts {
+		at, err := time.ParseInLocation(layout, s, now.Location())
+		if err != nil {
+			continue
+		}
+		if layout == "15:04" {
+			at = time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+			if at.Before(now) {
+				at = at.AddDate(0, 0, 1)
+			}
+		}
+		return at, nil
+	}
+	return time.Time{}, fmt.Errorf("\"%s\" is not a time like \"+10m\", \"15:04\" or \"2006-01-02 15:04\"", s)
+}
@@ -0,0 +1,268 @@
+package ipmail
+
+import (
+	"bytes"
+	"errors"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSender struct {
+	mtx       sync.Mutex
+	failures  int
+	published [][]byte
+}
+
+func (f *fakeSender) Send(content io.Reader, sign bool, from *gpg.Entity, to ...*gpg.Entity) (cid.Cid, error) {
+	return cid.Undef, errors.New("not implemented")
+}
+
+func (f *fakeSender) Encrypt(w io.Writer, content io.Reader, sign bool, from *gpg.Entity, to ...*gpg.Entity) error {
+	_, err := io.Copy(w, content)
+	return err
+}
+
+func (f *fakeSender) Publish(encrypted io.Reader) (cid.Cid, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return cid.Undef, errors.New("not connected")
+	}
+	b, err := ioutil.ReadAll(encrypted)
+	if err != nil {
+		return cid.Undef, err
+	}
+	f.published = append(f.published, b)
+	return cid.Undef, nil
+}
+
+// enqueueTest queues message, failing the test if it can't
+func enqueueTest(t *testing.T, o Outbox, message string, sendAt time.Time) OutboxEntry {
+	entry, err := o.Enqueue(func(w io.Writer) error {
+		_, err := w.Write([]byte(message))
+		return err
+	}, sendAt)
+	if err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	return entry
+}
+
+func (f *fakeSender) Acknowledge(cid cid.Cid, signer *gpg.Entity) error {
+	return nil
+}
+
+func (f *fakeSender) publishMessage(cid cid.Cid) error {
+	return nil
+}
+
+func waitForState(t *testing.T, states <-chan OutboxEntry, want OutboxState) OutboxEntry {
+	for {
+		select {
+		case entry := <-states:
+			if entry.State == want {
+				return entry
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "outbox")
+
+	tests := []struct {
+		name     string
+		failures int
+		sendAt   time.Duration
+		cancel   bool
+		want     OutboxState
+	}{
+		{"Sent Immediately", 0, 0, false, OutboxSent},
+		{"Retried After Failure", 1, 0, false, OutboxSent},
+		{"Cancelled Before Send", 0, time.Hour, true, OutboxCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{failures: tt.failures}
+			o, err := NewOutbox(sender, file, nil)
+			if err != nil {
+				t.Fatalf("NewOutbox() error = %v", err)
+			}
+			defer o.Close()
+			states := make(chan OutboxEntry, 10)
+			o.OnChange(func(entry OutboxEntry) {
+				states <- entry
+			})
+			entry := enqueueTest(t, o, tt.name, time.Now().Add(tt.sendAt))
+			if tt.cancel {
+				if err := o.Cancel(entry.Id); err != nil {
+					t.Errorf("Cancel() error = %v", err)
+				}
+			}
+			if tt.failures > 0 {
+				retrying := waitForState(t, states, OutboxRetrying)
+				if retrying.Attempts != 1 {
+					t.Errorf("Attempts = %d, want 1", retrying.Attempts)
+				}
+				if err := o.SendNow(entry.Id); err != nil {
+					t.Errorf("SendNow() error = %v", err)
+				}
+			}
+			waitForState(t, states, tt.want)
+			if o.Len() != 0 {
+				t.Errorf("Len() = %d, want 0", o.Len())
+			}
+			sender.mtx.Lock()
+			published := len(sender.published)
+			sender.mtx.Unlock()
+			if (published == 1) != (tt.want == OutboxSent) {
+				t.Errorf("published %d messages, want state %s", published, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(outboxBodies(file), strconv.FormatUint(entry.Id, 10))); !os.IsNotExist(err) {
+				t.Errorf("message %d is still spooled after it left the outbox", entry.Id)
+			}
+		})
+	}
+}
+
+func TestOutbox_persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "outbox")
+
+	o, err := NewOutbox(&fakeSender{}, file, nil)
+	if err != nil {
+		t.Fatalf("NewOutbox() error = %v", err)
+	}
+	sendAt := time.Now().Add(time.Hour).Round(0)
+	entry := enqueueTest(t, o, "later", sendAt)
+	_ = o.Close()
+	if b, _ := ioutil.ReadFile(file); bytes.Contains(b, []byte("later")) {
+		t.Error("message was saved in the outbox file instead of being spooled")
+	}
+
+	reopened, err := NewOutbox(&fakeSender{}, file, nil)
+	if err != nil {
+		t.Fatalf("NewOutbox() error = %v", err)
+	}
+	defer reopened.Close()
+	got, ok := reopened.FromIndex(0)
+	if !ok {
+		t.Fatalf("FromIndex() found nothing after reopening")
+	}
+	if got.Id != entry.Id || !got.SendAt.Equal(sendAt) || readOutboxBody(t, got) != "later" {
+		t.Errorf("FromIndex() got = %v, want %v", got, entry)
+	}
+	if next := enqueueTest(t, reopened, "", sendAt); next.Id <= entry.Id {
+		t.Errorf("Enqueue() reused id %d", next.Id)
+	}
+	failed := errors.New("encryption failed")
+	if _, err := reopened.Enqueue(func(w io.Writer) error { return failed }, sendAt); err != failed {
+		t.Errorf("Enqueue() error = %v, want %v", err, failed)
+	}
+	if reopened.Len() != 2 {
+		t.Errorf("Len() = %d after a failed Enqueue(), want 2", reopened.Len())
+	}
+}
+
+func readOutboxBody(t *testing.T, entry OutboxEntry) string {
+	body, err := entry.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestOutbox_legacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "outbox")
+	err = util.WriteFileAtomic(file, func(w io.Writer) error {
+		// entries saved before messages were spooled: id, send time, attempts, next attempt, error, message
+		for _, id := range []uint64{3, 7} {
+			_ = util.WriteUint64(w, id)
+			for _, n := range []int64{time.Now().Add(time.Hour).UnixNano(), 0, time.Now().Add(time.Hour).UnixNano()} {
+				_ = util.WriteInt64(w, n)
+			}
+			_ = util.WriteString(w, "")
+			_ = util.WriteBytes(w, []byte("message "+strconv.FormatUint(id, 10)))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewOutbox(&fakeSender{}, file, nil)
+	if err != nil {
+		t.Fatalf("NewOutbox() error = %v", err)
+	}
+	defer o.Close()
+	if o.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", o.Len())
+	}
+	for i, want := range []string{"message 3", "message 7"} {
+		entry, _ := o.FromIndex(i)
+		if got := readOutboxBody(t, entry); got != want || len(entry.body) == 0 {
+			t.Errorf("FromIndex(%d) message = %q, want %q spooled", i, got, want)
+		}
+	}
+	if b, _ := ioutil.ReadFile(file); bytes.Contains(b, []byte("message")) {
+		t.Error("migrated outbox file still has the messages in it")
+	}
+}
+
+func TestParseSendAt(t *testing.T) {
+	now := time.Date(2020, 11, 5, 12, 30, 0, 0, time.Local)
+	tests := []struct {
+		name    string
+		s       string
+		want    time.Time
+		wantErr bool
+	}{
+		{"Delay", "+1h30m", now.Add(90 * time.Minute), false},
+		{"Later Today", "18:00", time.Date(2020, 11, 5, 18, 0, 0, 0, time.Local), false},
+		{"Tomorrow", "08:15", time.Date(2020, 11, 6, 8, 15, 0, 0, time.Local), false},
+		{"Date And Time", "2020-12-24 20:00", time.Date(2020, 12, 24, 20, 0, 0, 0, time.Local), false},
+		{"Invalid", "whenever", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSendAt(tt.s, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSendAt() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseSendAt() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package ipmail
+
+import (
+	"bytes"
+	"encoding/hex"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io"
+	"ipmail/libipmail/util"
+	"sync"
+	"time"
+)
+
+// PendingRequests are the people you sent a contact request to who haven't answered yet. Only their
+// accepts add them to your contacts, an accept from anyone else waits in the requests list like a request
+type PendingRequests interface {
+	Add(to *gpg.Entity, sentAt time.Time)
+	Has(entity *gpg.Entity) bool
+	// Answered forgets the request to entity, returning false if there was none
+	Answered(entity *gpg.Entity) bool
+	Len() int
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type pendingRequests struct {
+	mtx sync.Mutex
+	// sent is when each request was sent by the fingerprint of its recipient
+	sent map[string]time.Time
+}
+
+func NewPendingRequests() PendingRequests {
+	return &pendingRequests{sent: make(map[string]time.Time)}
+}
+
+func NewPendingRequestsFromFile(file string, sealer util.Sealer) (PendingRequests, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := &pendingRequests{sent: make(map[string]time.Time)}
+	r := bytes.NewBuffer(b)
+	for r.Len() > 0 {
+		fingerprint, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		sentAt, err := util.ReadInt64(r)
+		if err != nil {
+			return nil, err
+		}
+		result.sent[fingerprint] = time.Unix(sentAt, 0)
+	}
+	return result, nil
+}
+
+func entityFingerprint(entity *gpg.Entity) string {
+	return hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])
+}
+
+func (p *pendingRequests) Add(to *gpg.Entity, sentAt time.Time) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.sent[entityFingerprint(to)] = sentAt
+}
+
+func (p *pendingRequests) Has(entity *gpg.Entity) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	_, ok := p.sent[entityFingerprint(entity)]
+	return ok
+}
+
+func (p *pendingRequests) Answered(entity *gpg.Entity) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	fingerprint := entityFingerprint(entity)
+	_, ok := p.sent[fingerprint]
+	delete(p.sent, fingerprint)
+	return ok
+}
+
+func (p *pendingRequests) Len() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return len(p.sent)
+}
+
+func (p *pendingRequests) SaveToFile(file string, sealer util.Sealer) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		for fingerprint, sentAt := range p.sent {
+			err := util.WriteString(w, fingerprint)
+			if err != nil {
+				return err
+			}
+			err = util.WriteInt64(w, sentAt.Unix())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
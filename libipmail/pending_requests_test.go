@@ -0,0 +1,60 @@
+package ipmail
+
+import (
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPendingRequests(t *testing.T) {
+	entities := make([]*gpg.Entity, 2)
+	for i := range entities {
+		identity, err := crypto.NewSelfIdentity("test", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entities[i] = identity.DefaultIdentity()
+	}
+	alice, bob := entities[0], entities[1]
+	dir, err := ioutil.TempDir("", "ipmail-pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "pending")
+
+	p := NewPendingRequests()
+	p.Add(alice, time.Now())
+	if err := p.SaveToFile(file, nil); err != nil {
+		t.Fatalf("SaveToFile() error = %v", err)
+	}
+	p, err = NewPendingRequestsFromFile(file, nil)
+	if err != nil {
+		t.Fatalf("NewPendingRequestsFromFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		entity  *gpg.Entity
+		want    bool
+		wantLen int
+	}{
+		{"Never Sent", bob, false, 1},
+		{"Sent", alice, true, 0},
+		{"Answered Twice", alice, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Answered(tt.entity); got != tt.want {
+				t.Errorf("Answered() = %v, want %v", got, tt.want)
+			}
+			if p.Len() != tt.wantLen || p.Has(tt.entity) {
+				t.Errorf("Len() = %d, want %d", p.Len(), tt.wantLen)
+			}
+		})
+	}
+}
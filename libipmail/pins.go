@@ -0,0 +1,406 @@
+package ipmail
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"io"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultPinTtl is how long sent messages stay pinned when not every recipient acknowledges them
+const DefaultPinTtl = 14 * 24 * time.Hour
+
+// Pinner is implemented by transports which can keep content from being garbage collected
+type Pinner interface {
+	Pin(c cid.Cid) error
+	Unpin(c cid.Cid) error
+	// CollectGarbage deletes everything which isn't pinned and returns how many bytes it freed
+	CollectGarbage() (uint64, error)
+}
+
+// PinEntry is why a CID is pinned. It stays pinned while any of its reasons hold
+type PinEntry struct {
+	Cid cid.Cid
+	// Outgoing is a message we sent which is pinned until Waiting recipients acknowledge it or Expires passes.
+	// Only acks signed by one of Recipients count, which are fingerprints and empty for unknown recipients
+	Outgoing   bool
+	Expires    time.Time
+	Waiting    int
+	Recipients []string
+	AckedBy    []string
+	// Received is a message we received which is pinned while it is in one of our message lists
+	Received bool
+	// Remote are the request IDs of the pins on remote pinning services, by service name
+	Remote map[string]string
+}
+
+func (e PinEntry) outgoingDone(now time.Time) bool {
+	return !e.Outgoing || e.Waiting <= 0 || !now.Before(e.Expires)
+}
+
+// pinEntryVersion is written where entries saved before remote pinning start with their CID length
+const pinEntryVersion = -3
+
+// pinEntryUnsignedAcksVersion is the version of entries saved before acks were signed, which have no recipients
+const pinEntryUnsignedAcksVersion = -2
+
+func (e *PinEntry) serialize(w io.Writer) error {
+	err := util.WriteInt64(w, pinEntryVersion)
+	if err != nil {
+		return err
+	}
+	err = util.WriteBytes(w, e.Cid.Bytes())
+	if err != nil {
+		return err
+	}
+	var reasons uint64 = 0
+	if e.Outgoing {
+		reasons |= 1
+	}
+	if e.Received {
+		reasons |= 2
+	}
+	err = util.WriteUint64(w, reasons)
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(w, e.Expires.Unix())
+	if err != nil {
+		return err
+	}
+	err = util.WriteInt64(w, int64(e.Waiting))
+	if err != nil {
+		return err
+	}
+	err = util.WriteUint64(w, uint64(len(e.AckedBy)))
+	if err != nil {
+		return err
+	}
+	for _, fingerprint := range e.AckedBy {
+		err = util.WriteBytes(w, []byte(fingerprint))
+		if err != nil {
+			return err
+		}
+	}
+	err = util.WriteUint64(w, uint64(len(e.Recipients)))
+	if err != nil {
+		return err
+	}
+	for _, fingerprint := range e.Recipients {
+		err = util.WriteString(w, fingerprint)
+		if err != nil {
+			return err
+		}
+	}
+	services := make([]string, 0, len(e.Remote))
+	for service := range e.Remote {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	err = util.WriteUint64(w, uint64(len(services)))
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		err = util.WriteString(w, service)
+		if err != nil {
+			return err
+		}
+		err = util.WriteString(w, e.Remote[service])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPinEntry(r io.Reader) (*PinEntry, error) {
+	version, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	var cidBytes []byte
+	if version == pinEntryVersion || version == pinEntryUnsignedAcksVersion {
+		cidBytes, err = util.ReadBytes(r)
+	} else if version >= 0 {
+		cidBytes = make([]byte, version)
+		_, err = io.ReadFull(r, cidBytes)
+	} else {
+		return nil, errors.New("unknown pin version " + strconv.FormatInt(version, 10))
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := &PinEntry{}
+	result.Cid, err = cid.Cast(cidBytes)
+	if err != nil {
+		return nil, err
+	}
+	reasons, err := util.ReadUint64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Outgoing = reasons&1 != 0
+	result.Received = reasons&2 != 0
+	expires, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Expires = time.Unix(expires, 0)
+	waiting, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Waiting = int(waiting)
+	acks, err := util.ReadUint64(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < acks; i++ {
+		id, err := util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		result.AckedBy = append(result.AckedBy, string(id)) // peer IDs before acks were signed
+	}
+	if version == pinEntryVersion {
+		recipients, err := util.ReadUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < recipients; i++ {
+			fingerprint, err := util.ReadString(r)
+			if err != nil {
+				return nil, err
+			}
+			result.Recipients = append(result.Recipients, fingerprint)
+		}
+	} else if version != pinEntryUnsignedAcksVersion {
+		return result, nil
+	}
+	services, err := util.ReadUint64(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < services; i++ {
+		service, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		requestId, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		result.setRemote(service, requestId)
+	}
+	return result, nil
+}
+
+func (e *PinEntry) setRemote(service string, requestId string) {
+	if e.Remote == nil {
+		e.Remote = make(map[string]string)
+	}
+	e.Remote[service] = requestId
+}
+
+// copy doesn't share Remote or AckedBy with e, so it can be used without holding the store's lock
+func (e *PinEntry) copy() PinEntry {
+	result := *e
+	result.Recipients = append([]string(nil), e.Recipients...)
+	result.AckedBy = append([]string(nil), e.AckedBy...)
+	if e.Remote != nil {
+		result.Remote = make(map[string]string, len(e.Remote))
+		for service, requestId := range e.Remote {
+			result.Remote[service] = requestId
+		}
+	}
+	return result
+}
+
+// PinStore records which mail objects are pinned and why, so they can be unpinned once they aren't needed
+type PinStore interface {
+	// PinOutgoing records a sent message which waits for acks from recipients until ttl passes. recipients are
+	// the fingerprints of who it is to apart from us, with an empty one for each whose key isn't known
+	PinOutgoing(c cid.Cid, recipients []string, ttl time.Duration)
+	// PinReceived records a received message which is kept while it is in a message list
+	PinReceived(c cid.Cid)
+	// Acknowledge records that the recipient with the fingerprint from fetched the message c, after checking
+	// they signed the ack. It returns false if it changed nothing, like when from isn't a recipient of c
+	Acknowledge(c cid.Cid, from string) bool
+	// SetRemote records the request ID of the pin of c on a remote service, returning false if c isn't pinned
+	SetRemote(c cid.Cid, service string, requestId string) bool
+	Get(c cid.Cid) (PinEntry, bool)
+	// Expired returns the entries with no reason left to be pinned, given the messages still in lists
+	Expired(now time.Time, lists ...MessageList) []PinEntry
+	Remove(c cid.Cid)
+	ForEach(do func(entry PinEntry))
+	Len() int
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type pinStore struct {
+	mtx     sync.Mutex
+	entries map[string]*PinEntry
+}
+
+func NewPinStore() PinStore {
+	return &pinStore{
+		entries: make(map[string]*PinEntry),
+	}
+}
+
+func NewPinStoreFromFile(file string, sealer util.Sealer) (PinStore, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := &pinStore{
+		entries: make(map[string]*PinEntry),
+	}
+	r := bytes.NewBuffer(b)
+	for r.Len() > 0 {
+		entry, err := readPinEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		result.entries[entry.Cid.KeyString()] = entry
+	}
+	return result, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, compare := range values {
+		if compare == value {
+			return true
+		}
+	}
+	return false
+}
+
+// entry must be called with mtx held
+func (p *pinStore) entry(c cid.Cid) *PinEntry {
+	result, ok := p.entries[c.KeyString()]
+	if !ok {
+		result = &PinEntry{Cid: c}
+		p.entries[c.KeyString()] = result
+	}
+	return result
+}
+
+func (p *pinStore) PinOutgoing(c cid.Cid, recipients []string, ttl time.Duration) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	entry := p.entry(c)
+	entry.Outgoing = true
+	entry.Expires = time.Now().Add(ttl)
+	entry.Recipients = append([]string(nil), recipients...)
+	entry.Waiting = len(recipients) - len(entry.AckedBy)
+}
+
+func (p *pinStore) PinReceived(c cid.Cid) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.entry(c).Received = true
+}
+
+func (p *pinStore) Acknowledge(c cid.Cid, from string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	entry, ok := p.entries[c.KeyString()]
+	if !ok || len(from) == 0 || !containsString(entry.Recipients, from) || containsString(entry.AckedBy, from) {
+		return false
+	}
+	entry.AckedBy = append(entry.AckedBy, from)
+	entry.Waiting--
+	return true
+}
+
+func (p *pinStore) Get(c cid.Cid) (PinEntry, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	entry, ok := p.entries[c.KeyString()]
+	if !ok {
+		return PinEntry{}, false
+	}
+	return entry.copy(), true
+}
+
+func (p *pinStore) SetRemote(c cid.Cid, service string, requestId string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	entry, ok := p.entries[c.KeyString()]
+	if !ok {
+		return false
+	}
+	entry.setRemote(service, requestId)
+	return true
+}
+
+func (p *pinStore) Expired(now time.Time, lists ...MessageList) []PinEntry {
+	listed := make(map[string]bool)
+	for _, l := range lists {
+		if l == nil {
+			continue
+		}
+		l.ForEach(func(message crypto.Message) {
+			listed[message.Cid().KeyString()] = true
+		})
+	}
+	result := make([]PinEntry, 0)
+	p.ForEach(func(entry PinEntry) {
+		if entry.outgoingDone(now) && (!entry.Received || !listed[entry.Cid.KeyString()]) {
+			result = append(result, entry)
+		}
+	})
+	return result
+}
+
+func (p *pinStore) Remove(c cid.Cid) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.entries, c.KeyString())
+}
+
+// ForEach goes through the entries in CID order
+func (p *pinStore) ForEach(do func(entry PinEntry)) {
+	p.mtx.Lock()
+	entries := make([]PinEntry, 0, len(p.entries))
+	for _, entry := range p.entries {
+		entries = append(entries, entry.copy())
+	}
+	p.mtx.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Cid.KeyString() < entries[j].Cid.KeyString()
+	})
+	for _, entry := range entries {
+		do(entry)
+	}
+}
+
+func (p *pinStore) Len() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return len(p.entries)
+}
+
+func (p *pinStore) SaveToFile(file string, sealer util.Sealer) error {
+	entries := make([]PinEntry, 0, p.Len())
+	p.ForEach(func(entry PinEntry) {
+		entries = append(entries, entry)
+	})
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		for i := range entries {
+			err := entries[i].serialize(w)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,165 @@
+package ipmail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPinStore_Expired(t *testing.T) {
+	bobAndCarol := []string{"bob", "carol"}
+	tests := []struct {
+		name        string
+		outgoing    []string
+		acks        []string
+		received    bool
+		listed      bool
+		after       time.Duration
+		wantExpired bool
+	}{
+		{"Waiting For Acks", bobAndCarol, []string{"bob"}, false, false, 0, false},
+		{"Acknowledged", bobAndCarol, []string{"bob", "carol"}, false, false, 0, true},
+		{"Acknowledged Twice By One Recipient", bobAndCarol, []string{"bob", "bob"}, false, false, 0, false},
+		{"Acknowledged By Others", bobAndCarol, []string{"mallory", "eve"}, false, false, 0, false},
+		{"Unknown Recipient", []string{"bob", ""}, []string{"bob", ""}, false, false, 0, false},
+		{"Ttl Passed", bobAndCarol, nil, false, false, time.Hour, true},
+		{"Only To Yourself", []string{}, nil, false, false, 0, true},
+		{"Received In List", nil, nil, true, true, time.Hour, false},
+		{"Received Deleted", nil, nil, true, false, 0, true},
+		{"Received And Waiting", []string{"bob"}, nil, true, false, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins := NewPinStore()
+			msg := newFakeMessage(t, tt.name, 0)
+			if tt.outgoing != nil {
+				pins.PinOutgoing(msg.Cid(), tt.outgoing, time.Minute)
+			}
+			if tt.received {
+				pins.PinReceived(msg.Cid())
+			}
+			for _, from := range tt.acks {
+				pins.Acknowledge(msg.Cid(), from)
+			}
+			list := NewMessageList()
+			if tt.listed {
+				list.Add(msg)
+			}
+			expired := pins.Expired(time.Now().Add(tt.after), list)
+			if got := len(expired) == 1; got != tt.wantExpired {
+				t.Errorf("Expired() = %v, want expired %v", expired, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestPinStore_Acknowledge(t *testing.T) {
+	pins := NewPinStore()
+	pinned := newFakeMessage(t, "pinned", 0)
+	unknown := newFakeMessage(t, "unknown", 0)
+	pins.PinOutgoing(pinned.Cid(), []string{"bob", "carol"}, time.Minute)
+	tests := []struct {
+		name        string
+		message     *fakeMessage
+		from        string
+		want        bool
+		wantWaiting int
+	}{
+		{"First", pinned, "bob", true, 1},
+		{"Again", pinned, "bob", false, 1},
+		{"Not A Recipient", pinned, "mallory", false, 1},
+		{"Second", pinned, "carol", true, 0},
+		{"Not Pinned", unknown, "bob", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pins.Acknowledge(tt.message.Cid(), tt.from); got != tt.want {
+				t.Errorf("Acknowledge() = %v, want %v", got, tt.want)
+			}
+			entry, _ := pins.Get(tt.message.Cid())
+			if entry.Waiting != tt.wantWaiting {
+				t.Errorf("Waiting = %d, want %d", entry.Waiting, tt.wantWaiting)
+			}
+		})
+	}
+}
+
+func TestPinStore_persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "pins")
+
+	pins := NewPinStore()
+	sent := newFakeMessage(t, "sent", 0)
+	received := newFakeMessage(t, "received", 0)
+	pins.PinOutgoing(sent.Cid(), []string{"bob", "carol", ""}, time.Hour)
+	pins.Acknowledge(sent.Cid(), "bob")
+	pins.PinReceived(received.Cid())
+	pins.SetRemote(sent.Cid(), "pinata", "request")
+	if err := pins.SaveToFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewPinStoreFromFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != pins.Len() {
+		t.Fatalf("Len() = %d, want %d", loaded.Len(), pins.Len())
+	}
+	pins.ForEach(func(want PinEntry) {
+		got, ok := loaded.Get(want.Cid)
+		want.Expires = want.Expires.Truncate(time.Second)
+		if !ok || !got.Expires.Equal(want.Expires) {
+			t.Errorf("Get(%s) = %v, want %v", want.Cid, got, want)
+			return
+		}
+		got.Expires = want.Expires
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get(%s) = %v, want %v", want.Cid, got, want)
+		}
+	})
+}
+
+func TestPinStore_legacyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "pins")
+
+	// an entry saved before pins were versioned
+	sent := newFakeMessage(t, "sent", 0)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	buf := bytes.NewBuffer(make([]byte, 0))
+	_ = util.WriteBytes(buf, sent.Cid().Bytes())
+	_ = util.WriteUint64(buf, 1)
+	_ = util.WriteInt64(buf, expires.Unix())
+	_ = util.WriteInt64(buf, 1)
+	_ = util.WriteUint64(buf, 1)
+	_ = util.WriteBytes(buf, []byte("bob"))
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewPinStoreFromFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := loaded.Get(sent.Cid())
+	want := PinEntry{Cid: sent.Cid(), Outgoing: true, Expires: expires, Waiting: 1, AckedBy: []string{"bob"}}
+	if !ok || !got.Expires.Equal(want.Expires) {
+		t.Fatalf("Get() = %v, want %v", got, want)
+	}
+	got.Expires = want.Expires
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Get() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package ipmail
+
+import (
+	"bytes"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"io"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"sync"
+)
+
+// ProfileCache keeps the verified profiles of contacts, and your own, so they show without fetching them
+type ProfileCache interface {
+	// Get returns the profile of entity, or nil if none is cached
+	Get(entity *gpg.Entity) *crypto.Profile
+	// Set caches profile unless a newer profile of entity is already cached, returning if it was cached
+	Set(entity *gpg.Entity, profile *crypto.Profile) bool
+	Remove(entity *gpg.Entity)
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type profileCache struct {
+	mtx sync.Mutex
+	// profiles are by fingerprint
+	profiles map[string]*crypto.Profile
+}
+
+func NewProfileCache() ProfileCache {
+	return &profileCache{profiles: make(map[string]*crypto.Profile)}
+}
+
+func NewProfileCacheFromFile(file string, sealer util.Sealer) (ProfileCache, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := &profileCache{profiles: make(map[string]*crypto.Profile)}
+	r := bytes.NewBuffer(b)
+	for r.Len() > 0 {
+		fingerprint, err := util.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		result.profiles[fingerprint], err = crypto.ReadProfile(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (p *profileCache) Get(entity *gpg.Entity) *crypto.Profile {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.profiles[entityFingerprint(entity)]
+}
+
+func (p *profileCache) Set(entity *gpg.Entity, profile *crypto.Profile) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	fingerprint := entityFingerprint(entity)
+	if old, ok := p.profiles[fingerprint]; ok && old.Updated.After(profile.Updated) {
+		return false
+	}
+	p.profiles[fingerprint] = profile
+	return true
+}
+
+func (p *profileCache) Remove(entity *gpg.Entity) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.profiles, entityFingerprint(entity))
+}
+
+func (p *profileCache) SaveToFile(file string, sealer util.Sealer) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		for fingerprint, profile := range p.profiles {
+			err := util.WriteString(w, fingerprint)
+			if err != nil {
+				return err
+			}
+			err = profile.Serialize(w)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProfileCache(t *testing.T) {
+	identity, err := crypto.NewSelfIdentity("alice", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := identity.DefaultIdentity()
+	older := &crypto.Profile{DisplayName: "Old Alice"}
+	newer := &crypto.Profile{DisplayName: "Alice", Languages: []string{"en"}}
+	for _, profile := range []*crypto.Profile{older, newer} {
+		if err = profile.Sign(alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	older.Updated = newer.Updated.Add(-time.Hour) // its signature no longer matters once cached
+	dir, err := ioutil.TempDir("", "ipmail-profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "profiles")
+
+	tests := []struct {
+		name    string
+		profile *crypto.Profile
+		want    bool
+		wantGet string
+	}{
+		{"First", older, true, "Old Alice"},
+		{"Newer", newer, true, "Alice"},
+		{"Older", older, false, "Alice"},
+	}
+	profiles := NewProfileCache()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := profiles.Set(alice, tt.profile); got != tt.want {
+				t.Errorf("Set() = %v, want %v", got, tt.want)
+			}
+			if err := profiles.SaveToFile(file, nil); err != nil {
+				t.Fatalf("SaveToFile() error = %v", err)
+			}
+			loaded, err := NewProfileCacheFromFile(file, nil)
+			if err != nil {
+				t.Fatalf("NewProfileCacheFromFile() error = %v", err)
+			}
+			if got := loaded.Get(alice); got == nil || got.DisplayName != tt.wantGet || !got.Updated.Equal(profiles.Get(alice).Updated) {
+				t.Errorf("Get() = %v, want the profile of %s", got, tt.wantGet)
+			}
+		})
+	}
+}
+
+func TestMailbox_profiles(t *testing.T) {
+	ctx := context.Background()
+	network := NewLoopbackNetwork()
+	aliceIpfs := network.Join("alice")
+	alice := newTestMailbox(t, func(config *MailboxConfig) {
+		config.Ipfs = aliceIpfs
+	})
+	bob := newTestMailbox(t, func(config *MailboxConfig) {
+		config.Ipfs = network.Join("bob")
+	})
+	self := alice.Identity().DefaultIdentity()
+	if _, err := alice.SetProfile(crypto.Profile{DisplayName: "Alice", Bio: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	published := bytes.NewBuffer(make([]byte, 0))
+	if err := alice.SerializeIdentity(published, self); err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := aliceIpfs.AddFromReader(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := alice.PublishName(ctx, resolved.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = bob.AddContactByName(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.Profiles().Get(self); got == nil || got.DisplayName != "Alice" || got.Bio != "hi" {
+		t.Fatalf("Profiles().Get() = %v, want the profile alice published", got)
+	}
+
+	if _, err = alice.SetProfile(crypto.Profile{DisplayName: "Alice Liddell"}); err != nil {
+		t.Fatal(err)
+	}
+	published.Reset()
+	if err = alice.SerializeIdentity(published, self); err != nil {
+		t.Fatal(err)
+	}
+	if resolved, err = aliceIpfs.AddFromReader(published); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = alice.PublishName(ctx, resolved.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.RefreshContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := bob.Profiles().Get(self); got == nil || got.DisplayName != "Alice Liddell" {
+		t.Errorf("Profiles().Get() = %v, want the updated profile", got)
+	}
+}
@@ -1,6 +1,7 @@
 package ipmail
 
 import (
+	"context"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"io"
 	"sync"
@@ -9,63 +10,91 @@ import (
 type ReceiveFunction func(message iface.PubSubMessage)
 
 type Receiver interface {
-	OnMessage(function ReceiveFunction, isAsync bool)
+	// OnMessage adds a handler which is called for every message on the topic until ctx is done.
+	// Messages are held back until the first handler is added.
+	OnMessage(ctx context.Context, function ReceiveFunction, isAsync bool)
 	io.Closer
 	subscriptionHandler()
 }
 
+type receiveHandler struct {
+	function ReceiveFunction
+	isAsync  bool
+}
+
 type receiverImpl struct {
-	subscription   iface.PubSubSubscription
-	ipfs           *Ipfs
-	waitForHandler sync.Mutex
-	messageHandler ReceiveFunction
-	isAsync        bool
+	subscription iface.PubSubSubscription
+	ipfs         Transport
+	mtx          sync.Mutex
+	handlers     map[int]receiveHandler
+	nextHandler  int
+	ready        chan struct{}
+	readyOnce    sync.Once
 }
 
-func (r *receiverImpl) OnMessage(function ReceiveFunction, isAsync bool) {
-	if function != nil {
-		startHandler := r.messageHandler == nil
-		r.messageHandler = function
-		r.isAsync = isAsync
-		if startHandler {
-			r.waitForHandler.Unlock()
-		}
+func (r *receiverImpl) OnMessage(ctx context.Context, function ReceiveFunction, isAsync bool) {
+	if function == nil {
+		return
 	}
+	r.mtx.Lock()
+	id := r.nextHandler
+	r.nextHandler++
+	r.handlers[id] = receiveHandler{function, isAsync}
+	r.mtx.Unlock()
+	r.readyOnce.Do(func() {
+		close(r.ready)
+	})
+	go func() {
+		<-ctx.Done()
+		r.mtx.Lock()
+		delete(r.handlers, id)
+		r.mtx.Unlock()
+	}()
 }
 
 func (r *receiverImpl) Close() error {
 	err := r.subscription.Close()
-	r.waitForHandler.Unlock()
+	r.readyOnce.Do(func() {
+		close(r.ready)
+	})
 	return err
 }
 
 func (r *receiverImpl) subscriptionHandler() {
 	var err error
 	var message iface.PubSubMessage
-	r.waitForHandler.Lock()
-	if r.messageHandler == nil {
-		r.waitForHandler.Unlock()
-		return
-	}
+	<-r.ready
 	for message, err = r.subscription.Next(r.ipfs.Context()); err == nil && message != nil; message,
 		err = r.subscription.Next(r.ipfs.Context()) {
-		if r.isAsync {
-			go r.messageHandler(message)
-		} else {
-			r.messageHandler(message)
+		r.mtx.Lock()
+		handlers := make([]receiveHandler, 0, len(r.handlers))
+		for i := 0; i < r.nextHandler; i++ {
+			if handler, ok := r.handlers[i]; ok {
+				handlers = append(handlers, handler)
+			}
+		}
+		r.mtx.Unlock()
+		for _, handler := range handlers {
+			if handler.isAsync {
+				go handler.function(message)
+			} else {
+				handler.function(message)
+			}
 		}
 	}
 }
 
-func NewReceiver(topic string, ipfs *Ipfs) (Receiver, error) {
-	result := receiverImpl{}
+func NewReceiver(topic string, ipfs Transport) (Receiver, error) {
+	result := receiverImpl{
+		handlers: make(map[int]receiveHandler),
+		ready:    make(chan struct{}),
+	}
 	subscription, err := ipfs.Subscribe(topic)
 	if err != nil {
 		return nil, err
 	}
 	result.subscription = subscription
 	result.ipfs = ipfs
-	result.waitForHandler.Lock()
 	go result.subscriptionHandler()
 	return &result, nil
 }
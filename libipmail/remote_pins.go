@@ -0,0 +1,200 @@
+package ipmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RemotePin is the status of a pin request on a remote pinning service
+type RemotePin struct {
+	RequestId string
+	// Status is one of queued, pinning, pinned or failed
+	Status    string
+	Cid       cid.Cid
+	Name      string
+	Created   time.Time
+	Delegates []string
+}
+
+// RemotePinService pins content on a service implementing the IPFS Pinning Service API,
+// so mail can still be fetched while our node is offline
+type RemotePinService interface {
+	Name() string
+	Pin(c cid.Cid, name string) (RemotePin, error)
+	Status(requestId string) (RemotePin, error)
+	Unpin(requestId string) error
+	// List returns the pin requests for any of cids which are queued, pinning or pinned
+	List(cids ...cid.Cid) ([]RemotePin, error)
+}
+
+type remotePinService struct {
+	name     string
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// NewRemotePinService connects to the pinning service at endpoint, authenticating with the access token
+func NewRemotePinService(name string, endpoint string, token string) RemotePinService {
+	return &remotePinService{
+		name:     name,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (s *remotePinService) Name() string {
+	return s.name
+}
+
+// remotePinJson is a PinStatus object of the Pinning Service API
+type remotePinJson struct {
+	RequestId string    `json:"requestid"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+	Pin       struct {
+		Cid  string `json:"cid"`
+		Name string `json:"name,omitempty"`
+	} `json:"pin"`
+	Delegates []string `json:"delegates"`
+}
+
+func (j *remotePinJson) toRemotePin() (RemotePin, error) {
+	c, err := cid.Decode(j.Pin.Cid)
+	if err != nil {
+		return RemotePin{}, err
+	}
+	return RemotePin{
+		RequestId: j.RequestId,
+		Status:    j.Status,
+		Cid:       c,
+		Name:      j.Pin.Name,
+		Created:   j.Created,
+		Delegates: j.Delegates,
+	}, nil
+}
+
+func (s *remotePinService) call(method string, path string, body interface{}, result interface{}) error {
+	var content io.Reader = nil
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewBuffer(b)
+	}
+	request, err := http.NewRequest(method, s.endpoint+path, content)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+s.token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	b, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var failed struct {
+			Error struct {
+				Reason  string `json:"reason"`
+				Details string `json:"details"`
+			} `json:"error"`
+		}
+		reason := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &failed) == nil && len(failed.Error.Reason) > 0 {
+			reason = failed.Error.Reason
+			if len(failed.Error.Details) > 0 {
+				reason += ": " + failed.Error.Details
+			}
+		}
+		return fmt.Errorf("pinning service %s failed with %s: %s", s.name, response.Status, reason)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(b, result)
+}
+
+func (s *remotePinService) Pin(c cid.Cid, name string) (RemotePin, error) {
+	body := map[string]interface{}{"cid": c.String()}
+	if len(name) > 0 {
+		body["name"] = name
+	}
+	var result remotePinJson
+	err := s.call(http.MethodPost, "/pins", body, &result)
+	if err != nil {
+		return RemotePin{}, err
+	}
+	return result.toRemotePin()
+}
+
+func (s *remotePinService) Status(requestId string) (RemotePin, error) {
+	var result remotePinJson
+	err := s.call(http.MethodGet, "/pins/"+url.PathEscape(requestId), nil, &result)
+	if err != nil {
+		return RemotePin{}, err
+	}
+	return result.toRemotePin()
+}
+
+func (s *remotePinService) Unpin(requestId string) error {
+	return s.call(http.MethodDelete, "/pins/"+url.PathEscape(requestId), nil, nil)
+}
+
+func (s *remotePinService) List(cids ...cid.Cid) ([]RemotePin, error) {
+	if len(cids) == 0 {
+		return nil, errors.New("no CIDs to list")
+	}
+	query := url.Values{}
+	keys := make([]string, len(cids))
+	for i, c := range cids {
+		keys[i] = c.String()
+	}
+	query.Set("cid", strings.Join(keys, ","))
+	query.Set("status", "queued,pinning,pinned")
+	var list struct {
+		Results []remotePinJson `json:"results"`
+	}
+	err := s.call(http.MethodGet, "/pins?"+query.Encode(), nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]RemotePin, 0, len(list.Results))
+	for i := range list.Results {
+		pin, err := list.Results[i].toRemotePin()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pin)
+	}
+	return result, nil
+}
+
+// EnsureRemotePin pins c on service unless it already is, so content pinned on every start isn't requested twice
+func EnsureRemotePin(service RemotePinService, c cid.Cid, name string) (RemotePin, error) {
+	existing, err := service.List(c)
+	if err != nil {
+		return RemotePin{}, err
+	}
+	if len(existing) > 0 {
+		return existing[0], nil
+	}
+	return service.Pin(c, name)
+}
@@ -0,0 +1,250 @@
+package ipmail
+
+import (
+	"encoding/json"
+	"github.com/ipfs/go-cid"
+	"ipmail/libipmail/util"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mockPinningToken = "secret"
+
+// mockPinningService answers the Pinning Service API like a remote service which pins everything instantly
+type mockPinningService struct {
+	mtx    sync.Mutex
+	pins   map[string]*remotePinJson
+	nextId int
+}
+
+func newMockPinningService(t *testing.T) (*mockPinningService, *httptest.Server) {
+	s := &mockPinningService{
+		pins: make(map[string]*remotePinJson),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pins", s.collection)
+	mux.HandleFunc("/pins/", s.object)
+	server := httptest.NewServer(s.authorized(mux))
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func pinningError(w http.ResponseWriter, status int, reason string, details string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"reason": reason, "details": details},
+	})
+}
+
+func (s *mockPinningService) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+mockPinningToken {
+			pinningError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid access token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *mockPinningService) collection(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		pin := &remotePinJson{}
+		err := json.NewDecoder(r.Body).Decode(&pin.Pin)
+		if err != nil {
+			pinningError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+			return
+		}
+		if _, err := cid.Decode(pin.Pin.Cid); err != nil {
+			pinningError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+			return
+		}
+		s.nextId++
+		pin.RequestId = strconv.Itoa(s.nextId)
+		pin.Status = "pinned"
+		pin.Created = time.Now()
+		s.pins[pin.RequestId] = pin
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(pin)
+	case http.MethodGet:
+		cids := strings.Split(r.URL.Query().Get("cid"), ",")
+		results := make([]*remotePinJson, 0)
+		for _, pin := range s.pins {
+			for _, c := range cids {
+				if pin.Pin.Cid == c {
+					results = append(results, pin)
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"count": len(results), "results": results})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *mockPinningService) object(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	requestId := strings.TrimPrefix(r.URL.Path, "/pins/")
+	pin, ok := s.pins[requestId]
+	if !ok {
+		pinningError(w, http.StatusNotFound, "NOT_FOUND", "no pin request "+requestId)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(pin)
+	case http.MethodDelete:
+		delete(s.pins, requestId)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *mockPinningService) pinned(c cid.Cid) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, pin := range s.pins {
+		if pin.Pin.Cid == c.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *mockPinningService) len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.pins)
+}
+
+func TestRemotePinService(t *testing.T) {
+	_, server := newMockPinningService(t)
+	service := NewRemotePinService("mock", server.URL+"/", mockPinningToken)
+	c, _ := util.ContentCid([]byte("pin me"))
+	other, _ := util.ContentCid([]byte("not pinned"))
+
+	pin, err := service.Pin(c, "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pin.Cid.Equals(c) || pin.Name != "message" || pin.Status != "pinned" || len(pin.RequestId) == 0 {
+		t.Fatalf("Pin() = %+v", pin)
+	}
+	status, err := service.Status(pin.RequestId)
+	if err != nil || status.RequestId != pin.RequestId || !status.Cid.Equals(c) {
+		t.Errorf("Status() = %+v, %v", status, err)
+	}
+	tests := []struct {
+		name string
+		cids []cid.Cid
+		want int
+	}{
+		{"Pinned", []cid.Cid{c}, 1},
+		{"Not Pinned", []cid.Cid{other}, 0},
+		{"Either", []cid.Cid{other, c}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.List(tt.cids...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("List() = %v, want %d pins", got, tt.want)
+			}
+		})
+	}
+	if err := service.Unpin(pin.RequestId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Status(pin.RequestId); err == nil || !strings.Contains(err.Error(), "NOT_FOUND") {
+		t.Errorf("Status() after Unpin() error = %v, want NOT_FOUND", err)
+	}
+}
+
+func TestRemotePinService_unauthorized(t *testing.T) {
+	mock, server := newMockPinningService(t)
+	service := NewRemotePinService("mock", server.URL, "wrong")
+	c, _ := util.ContentCid([]byte("pin me"))
+	_, err := service.Pin(c, "")
+	if err == nil || !strings.Contains(err.Error(), "UNAUTHORIZED: invalid access token") {
+		t.Errorf("Pin() error = %v, want UNAUTHORIZED", err)
+	}
+	if mock.len() != 0 {
+		t.Errorf("%d pins were made without a valid token", mock.len())
+	}
+}
+
+func TestEnsureRemotePin(t *testing.T) {
+	mock, server := newMockPinningService(t)
+	service := NewRemotePinService("mock", server.URL, mockPinningToken)
+	c, _ := util.ContentCid([]byte("identity"))
+	first, err := EnsureRemotePin(service, c, "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EnsureRemotePin(service, c, "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.RequestId != second.RequestId || mock.len() != 1 {
+		t.Errorf("pinning twice made %d requests, want 1", mock.len())
+	}
+}
+
+func TestLoopback_remotePins(t *testing.T) {
+	mock, server := newMockPinningService(t)
+	service := NewRemotePinService("mock", server.URL, mockPinningToken)
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice", func(config *MailboxConfig) {
+		config.RemotePins = []RemotePinService{service}
+	})
+	bob := newLoopbackUser(t, network, "bob")
+	alice.mailbox.Contacts().Add(bob.identity.DefaultIdentity())
+	bob.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+
+	alice.send(t, "hi bob", bob)
+	sent := alice.expect(t, SentEcho).Cid
+	bob.expect(t, MessageReceived)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		entry, _ := alice.mailbox.Pins().Get(sent)
+		if len(entry.Remote["mock"]) > 0 && entry.Waiting == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message was never pinned remotely and acknowledged, pin is %v", entry)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !mock.pinned(sent) {
+		t.Fatal("message is not pinned on the service")
+	}
+
+	identity, _ := util.ContentCid([]byte("alice's identity"))
+	alice.mailbox.PinRemotely(identity, "identity")
+	for !mock.pinned(identity) {
+		if time.Now().After(deadline) {
+			t.Fatal("identity was never pinned remotely")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got, err := alice.mailbox.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Unpinned != 1 || mock.pinned(sent) || !mock.pinned(identity) {
+		t.Errorf("CollectGarbage() = %+v, message pinned %v, identity pinned %v",
+			got, mock.pinned(sent), mock.pinned(identity))
+	}
+}
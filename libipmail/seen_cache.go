@@ -0,0 +1,116 @@
+package ipmail
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/ipfs/go-cid"
+	"io"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"sync"
+)
+
+// DefaultSeenCacheSize is how many announced CIDs a SeenCache remembers before forgetting the oldest
+const DefaultSeenCacheSize = 10000
+
+// SeenCache remembers which message CIDs have already been announced so they are only fetched once
+type SeenCache interface {
+	// Add records c as seen, returning false if it had already been seen
+	Add(c cid.Cid) bool
+	Contains(c cid.Cid) bool
+	// AddMessages records every message in lists as seen
+	AddMessages(lists ...MessageList)
+	Len() int
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type seenCache struct {
+	mtx   sync.Mutex
+	size  int
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+func NewSeenCache(size int) SeenCache {
+	return &seenCache{
+		size:  size,
+		order: list.New(),
+		seen:  make(map[string]*list.Element),
+	}
+}
+
+func NewSeenCacheFromFile(file string, sealer util.Sealer, size int) (SeenCache, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	result := NewSeenCache(size)
+	r := bytes.NewBuffer(b)
+	for r.Len() > 0 {
+		cidBytes, err := util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		c, err := cid.Cast(cidBytes)
+		if err != nil {
+			return nil, err
+		}
+		result.Add(c)
+	}
+	return result, nil
+}
+
+func (s *seenCache) Add(c cid.Cid) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := c.KeyString()
+	if elm, ok := s.seen[key]; ok {
+		s.order.MoveToBack(elm)
+		return false
+	}
+	s.seen[key] = s.order.PushBack(c)
+	for s.size > 0 && s.order.Len() > s.size {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.seen, oldest.Value.(cid.Cid).KeyString())
+	}
+	return true
+}
+
+func (s *seenCache) Contains(c cid.Cid) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.seen[c.KeyString()]
+	return ok
+}
+
+func (s *seenCache) AddMessages(lists ...MessageList) {
+	for _, l := range lists {
+		if l == nil {
+			continue
+		}
+		l.ForEach(func(message crypto.Message) {
+			s.Add(message.Cid())
+		})
+	}
+}
+
+func (s *seenCache) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.order.Len()
+}
+
+func (s *seenCache) SaveToFile(file string, sealer util.Sealer) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		for elm := s.order.Front(); elm != nil; elm = elm.Next() {
+			err := util.WriteBytes(w, elm.Value.(cid.Cid).Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
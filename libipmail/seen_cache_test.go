@@ -0,0 +1,65 @@
+package ipmail
+
+import (
+	"io/ioutil"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeenCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		adds    []string
+		want    []bool
+		wantLen int
+	}{
+		{"Duplicate Dropped", 10, []string{"a", "b", "a"}, []bool{true, true, false}, 2},
+		{"Oldest Forgotten", 2, []string{"a", "b", "c", "a"}, []bool{true, true, true, true}, 2},
+		{"Unbounded", 0, []string{"a", "b", "c", "a"}, []bool{true, true, true, false}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSeenCache(tt.size)
+			for i, data := range tt.adds {
+				c, err := util.ContentCid([]byte(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := s.Add(c); got != tt.want[i] {
+					t.Errorf("Add(%q) = %v, want %v", data, got, tt.want[i])
+				}
+			}
+			if s.Len() != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", s.Len(), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestSeenCache_persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "seen")
+
+	msg := newFakeMessage(t, "announced twice", 0)
+	list := NewMessageList()
+	list.Add(msg)
+	s := NewSeenCache(DefaultSeenCacheSize)
+	s.AddMessages(list, nil)
+	if err := s.SaveToFile(file, nil); err != nil {
+		t.Fatalf("SaveToFile() error = %v", err)
+	}
+	got, err := NewSeenCacheFromFile(file, nil, DefaultSeenCacheSize)
+	if err != nil {
+		t.Fatalf("NewSeenCacheFromFile() error = %v", err)
+	}
+	if !got.Contains(msg.Cid()) || got.Add(msg.Cid()) {
+		t.Errorf("reloaded cache forgot %v", msg.Cid())
+	}
+}
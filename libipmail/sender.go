@@ -1,7 +1,6 @@
 package ipmail
 
 import (
-	"bytes"
 	_ "crypto/sha512"
 	"errors"
 	gpg "github.com/Geo25rey/crypto/openpgp"
@@ -14,24 +13,61 @@ import (
 
 type Sender interface {
 	Send(content io.Reader, sign bool, from *gpg.Entity, to ...*gpg.Entity) (cid.Cid, error)
+	// Encrypt writes a message to w for Publish without sending it, encrypting content as it is read
+	Encrypt(w io.Writer, content io.Reader, sign bool, from *gpg.Entity, to ...*gpg.Entity) error
+	// Publish adds an encrypted message to IPFS as it is read and notifies its recipients
+	Publish(encrypted io.Reader) (cid.Cid, error)
+	// Acknowledge tells the sender of a message that it was fetched so they can stop pinning it. The ack is
+	// signed by signer, which must be the recipient the message was encrypted to for the sender to count it
+	Acknowledge(cid cid.Cid, signer *gpg.Entity) error
 	publishMessage(cid cid.Cid) error
 }
 
 type senderCtx struct {
-	ipfs *Ipfs
+	ipfs Transport
 }
 
-func NewSender(ipfs *Ipfs) Sender {
+func NewSender(ipfs Transport) Sender {
 	return &senderCtx{ipfs: ipfs}
 }
 
+// Send encrypts content while it is added to IPFS, so a big message is never held in memory
 func (this *senderCtx) Send(content io.Reader, sign bool, from *gpg.Entity, to ...*gpg.Entity) (cid.Cid, error) {
+	err := checkRecipients(to)
+	if err != nil {
+		return cid.Undef, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(encrypt(writer, content, sign, from, to...))
+	}()
+	path, err := this.ipfs.AddFromReader(reader)
+	_ = reader.Close() // stops the encryption if adding failed
+	if err != nil {
+		return cid.Undef, err
+	}
+	return path.Cid(), this.publishMessage(path.Cid())
+}
+
+func (this *senderCtx) Encrypt(w io.Writer, content io.Reader, sign bool, from *gpg.Entity, to ...*gpg.Entity) error {
+	err := checkRecipients(to)
+	if err != nil {
+		return err
+	}
+	return encrypt(w, content, sign, from, to...)
+}
+
+func checkRecipients(to []*gpg.Entity) error {
 	for _, entity := range to {
 		if entity == nil {
-			return cid.Undef, errors.New("All message recipients must be in your contacts")
+			return errors.New("All message recipients must be in your contacts")
 		}
 	}
+	return nil
+}
 
+// encrypt writes content to w as a message, encrypting it as it is read
+func encrypt(w io.Writer, content io.Reader, sign bool, from *gpg.Entity, to ...*gpg.Entity) error {
 	var signer *gpg.Entity
 
 	if sign {
@@ -40,34 +76,31 @@ func (this *senderCtx) Send(content io.Reader, sign bool, from *gpg.Entity, to .
 		signer = nil
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0))
-
-	w2, err := armor.Encode(buf, crypto2.MessageEncoding, make(map[string]string))
+	w2, err := armor.Encode(w, crypto2.MessageEncoding, make(map[string]string))
 	if err != nil {
-		return cid.Undef, err
+		return err
 	}
 
 	w3, err := gpg.Encrypt(w2, to, signer, nil, util.DefaultEncryptionConfig())
 	if err != nil {
-		return cid.Undef, err
+		return err
 	}
 
 	_, err = io.Copy(w3, content)
 	if err != nil {
-		return cid.Undef, err
+		return err
 	}
 
 	err = w3.Close()
 	if err != nil {
-		return cid.Undef, err
+		return err
 	}
 
-	err = w2.Close()
-	if err != nil {
-		return cid.Undef, err
-	}
+	return w2.Close()
+}
 
-	path, err := this.ipfs.AddFromReader(buf)
+func (this *senderCtx) Publish(encrypted io.Reader) (cid.Cid, error) {
+	path, err := this.ipfs.AddFromReader(encrypted)
 	if err != nil {
 		return cid.Undef, err
 	}
@@ -82,3 +115,16 @@ func (this *senderCtx) publishMessage(cid cid.Cid) error {
 	toSend = append(toSend, crypto2.MessageCidPostfix...)
 	return this.ipfs.Publish(crypto2.MessageTopicName, toSend)
 }
+
+func (this *senderCtx) Acknowledge(cid cid.Cid, signer *gpg.Entity) error {
+	signature, err := crypto2.SignAck(cid, signer)
+	if err != nil {
+		return err
+	}
+	toSend := make([]byte, 0)
+	toSend = append(toSend, crypto2.MessageAckPrefix...)
+	toSend = append(toSend, cid.Bytes()...)
+	toSend = append(toSend, crypto2.MessageCidPostfix...)
+	toSend = append(toSend, signature...)
+	return this.ipfs.Publish(crypto2.MessageTopicName, toSend)
+}
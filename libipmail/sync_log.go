@@ -0,0 +1,586 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"io"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const syncEntryVersion = 1
+
+// syncPriority is the order the namespaces of a merged entry are applied in, so a contact is known before
+// their detail and a folder exists before messages are moved into it
+var syncPriority = []string{"contact/", "detail/", "folders/", "labels/", "message/", "folder/", "label/", "flag/"}
+
+// SyncOp sets the register Key of a SyncLog to Value, or removes it if Value is nil. Of two ops on the same key
+// the one with the higher Clock wins, and the higher Device if the clocks are equal
+type SyncOp struct {
+	Key    string
+	Value  []byte
+	Clock  uint64
+	Device string
+}
+
+// after reports whether op wins over other
+func (op SyncOp) after(other SyncOp) bool {
+	if op.Clock != other.Clock {
+		return op.Clock > other.Clock
+	}
+	return op.Device > other.Device
+}
+
+// SyncLog is a replicated log the devices of one account share their state through. Each entry is sealed with
+// the SyncKey, added to IPFS and links to the entries before it. The log merges into registers which keep the
+// last value written to each key, so devices end up with the same registers whatever order they merge in
+type SyncLog interface {
+	Key() crypto.SyncKey
+	// Device identifies this device in the ops it writes
+	Device() string
+	// Heads are the newest entries, which every other merged entry is reachable from
+	Heads() []cid.Cid
+	// Value returns the register key, which is false if it was never set or was removed
+	Value(key string) ([]byte, bool)
+	// Keys returns the keys with a value which start with prefix, in order
+	Keys(prefix string) []string
+	// Pending returns the keys starting with prefix whose merged value could not be applied yet
+	Pending(prefix string) []string
+	// Set returns an op setting key to value, nil to remove it, and applies it to the registers
+	Set(key string, value []byte) SyncOp
+	// Record returns the ops which turn the registers starting with one of prefixes into state and applies
+	// them. Registers which are pending are left as they are, since state doesn't have their value yet
+	Record(state map[string][]byte, prefixes ...string) []SyncOp
+	// Append adds an entry with ops after the heads to ipfs, pinning it if ipfs is a Pinner, and makes it the
+	// only head. Without ops nothing is added and cid.Undef is returned
+	Append(ops []SyncOp, ipfs Transport) (cid.Cid, error)
+	// Merge fetches the entries from head back to the ones already merged, pinning them if ipfs is a Pinner, and
+	// passes each op which changes a register to apply, returning how many did. Ops apply fails for stay pending
+	Merge(ctx context.Context, head cid.Cid, ipfs util.Cat, apply func(op SyncOp) error) (int, error)
+	// Retry passes the pending registers to apply again, returning how many were applied
+	Retry(apply func(op SyncOp) error) int
+	SaveToFile(file string, sealer util.Sealer) error
+}
+
+type syncLog struct {
+	mtx    sync.Mutex
+	key    crypto.SyncKey
+	device string
+	// clock is the highest clock of any op seen
+	clock     uint64
+	heads     []cid.Cid
+	merged    map[string]bool
+	registers map[string]SyncOp
+	pending   map[string]bool
+}
+
+// NewSyncLog starts an empty log sealed with key, which the first device of an account makes with
+// crypto.NewSyncKey and links every other device to
+func NewSyncLog(key crypto.SyncKey) (SyncLog, error) {
+	device := make([]byte, 16)
+	_, err := rand.Read(device)
+	if err != nil {
+		return nil, err
+	}
+	return newSyncLog(key, hex.EncodeToString(device)), nil
+}
+
+func newSyncLog(key crypto.SyncKey, device string) *syncLog {
+	return &syncLog{
+		key:       key,
+		device:    device,
+		heads:     make([]cid.Cid, 0),
+		merged:    make(map[string]bool),
+		registers: make(map[string]SyncOp),
+		pending:   make(map[string]bool),
+	}
+}
+
+func writeSyncOp(w io.Writer, op SyncOp) error {
+	err := util.WriteString(w, op.Key)
+	if err != nil {
+		return err
+	}
+	removed := uint64(0)
+	if op.Value == nil {
+		removed = 1
+	}
+	err = util.WriteUint64(w, removed)
+	if err != nil {
+		return err
+	}
+	err = util.WriteBytes(w, op.Value)
+	if err != nil {
+		return err
+	}
+	err = util.WriteUint64(w, op.Clock)
+	if err != nil {
+		return err
+	}
+	return util.WriteString(w, op.Device)
+}
+
+func readSyncOp(r io.Reader) (SyncOp, error) {
+	result := SyncOp{}
+	var err error
+	result.Key, err = util.ReadString(r)
+	if err != nil {
+		return result, err
+	}
+	removed, err := util.ReadUint64(r)
+	if err != nil {
+		return result, err
+	}
+	result.Value, err = util.ReadBytes(r)
+	if err != nil {
+		return result, err
+	}
+	if removed != 0 {
+		result.Value = nil
+	} else if result.Value == nil {
+		result.Value = make([]byte, 0)
+	}
+	result.Clock, err = util.ReadUint64(r)
+	if err != nil {
+		return result, err
+	}
+	result.Device, err = util.ReadString(r)
+	return result, err
+}
+
+func writeCids(w io.Writer, cids []cid.Cid) error {
+	err := util.WriteUint64(w, uint64(len(cids)))
+	if err != nil {
+		return err
+	}
+	for _, c := range cids {
+		err = util.WriteBytes(w, c.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCids(r *bytes.Buffer) ([]cid.Cid, error) {
+	count, err := util.ReadUint64(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, errors.New("too many content IDs")
+	}
+	result := make([]cid.Cid, 0, count)
+	for i := uint64(0); i < count; i++ {
+		b, err := util.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		c, err := cid.Cast(b)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func NewSyncLogFromFile(file string, sealer util.Sealer) (SyncLog, error) {
+	b, err := util.ReadSealedFile(file, sealer)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewBuffer(b)
+	key, err := util.ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	device, err := util.ReadString(r)
+	if err != nil {
+		return nil, err
+	}
+	result := newSyncLog(key, device)
+	result.clock, err = util.ReadUint64(r)
+	if err != nil {
+		return nil, err
+	}
+	result.heads, err = readCids(r)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := readCids(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range merged {
+		result.merged[c.KeyString()] = true
+	}
+	pending, err := readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range pending {
+		result.pending[key] = true
+	}
+	for r.Len() > 0 {
+		op, err := readSyncOp(r)
+		if err != nil {
+			return nil, err
+		}
+		result.registers[op.Key] = op
+	}
+	return result, nil
+}
+
+func (s *syncLog) SaveToFile(file string, sealer util.Sealer) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return util.WriteSealedFile(file, sealer, func(w io.Writer) error {
+		err := util.WriteBytes(w, s.key)
+		if err != nil {
+			return err
+		}
+		err = util.WriteString(w, s.device)
+		if err != nil {
+			return err
+		}
+		err = util.WriteUint64(w, s.clock)
+		if err != nil {
+			return err
+		}
+		err = writeCids(w, s.heads)
+		if err != nil {
+			return err
+		}
+		merged := make([]cid.Cid, 0, len(s.merged))
+		for key := range s.merged {
+			c, err := cid.Cast([]byte(key))
+			if err == nil {
+				merged = append(merged, c)
+			}
+		}
+		err = writeCids(w, merged)
+		if err != nil {
+			return err
+		}
+		err = writeStrings(w, s.sortedKeys(s.pending, ""))
+		if err != nil {
+			return err
+		}
+		for _, key := range s.sortedKeys(nil, "") {
+			err = writeSyncOp(w, s.registers[key])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sortedKeys returns the keys of set starting with prefix in order, or those of the registers if set is nil
+func (s *syncLog) sortedKeys(set map[string]bool, prefix string) []string {
+	result := make([]string, 0)
+	if set == nil {
+		for key := range s.registers {
+			if strings.HasPrefix(key, prefix) {
+				result = append(result, key)
+			}
+		}
+	} else {
+		for key := range set {
+			if strings.HasPrefix(key, prefix) {
+				result = append(result, key)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *syncLog) Key() crypto.SyncKey {
+	return s.key
+}
+
+func (s *syncLog) Device() string {
+	return s.device
+}
+
+func (s *syncLog) Heads() []cid.Cid {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append(make([]cid.Cid, 0, len(s.heads)), s.heads...)
+}
+
+func (s *syncLog) Value(key string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	op, ok := s.registers[key]
+	return op.Value, ok && op.Value != nil
+}
+
+func (s *syncLog) Keys(prefix string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result := make([]string, 0)
+	for _, key := range s.sortedKeys(nil, prefix) {
+		if s.registers[key].Value != nil {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+func (s *syncLog) Pending(prefix string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sortedKeys(s.pending, prefix)
+}
+
+// set makes a new op on key, which wins over every op seen so far
+func (s *syncLog) set(key string, value []byte) SyncOp {
+	s.clock++
+	op := SyncOp{Key: key, Value: value, Clock: s.clock, Device: s.device}
+	s.registers[key] = op
+	delete(s.pending, key)
+	return op
+}
+
+func (s *syncLog) Set(key string, value []byte) SyncOp {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.set(key, value)
+}
+
+func (s *syncLog) Record(state map[string][]byte, prefixes ...string) []SyncOp {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result := make([]SyncOp, 0)
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := state[key]
+		if value == nil {
+			value = make([]byte, 0) // nil would remove it
+		}
+		current, ok := s.registers[key]
+		if s.pending[key] || ok && current.Value != nil && bytes.Equal(current.Value, value) {
+			continue
+		}
+		result = append(result, s.set(key, value))
+	}
+	for _, prefix := range prefixes {
+		for _, key := range s.sortedKeys(nil, prefix) {
+			if _, ok := state[key]; ok || s.pending[key] || s.registers[key].Value == nil {
+				continue
+			}
+			result = append(result, s.set(key, nil))
+		}
+	}
+	return result
+}
+
+func (s *syncLog) Append(ops []SyncOp, ipfs Transport) (cid.Cid, error) {
+	if len(ops) == 0 {
+		return cid.Undef, nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err := util.WriteInt64(buf, syncEntryVersion)
+	if err != nil {
+		return cid.Undef, err
+	}
+	err = writeCids(buf, s.heads)
+	if err != nil {
+		return cid.Undef, err
+	}
+	for _, op := range ops {
+		err = writeSyncOp(buf, op)
+		if err != nil {
+			return cid.Undef, err
+		}
+	}
+	sealed, err := s.key.Seal(buf.Bytes())
+	if err != nil {
+		return cid.Undef, err
+	}
+	resolved, err := ipfs.AddFromBytes(sealed)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if pinner, ok := ipfs.(Pinner); ok {
+		_ = pinner.Pin(resolved.Cid()) // every device keeps the whole log so a device linked later can fetch it
+	}
+	s.merged[resolved.Cid().KeyString()] = true
+	s.heads = []cid.Cid{resolved.Cid()}
+	return resolved.Cid(), nil
+}
+
+type syncEntry struct {
+	prev []cid.Cid
+	ops  []SyncOp
+}
+
+// fetch reads the entry c, which must be sealed with the key of the log
+func (s *syncLog) fetch(ctx context.Context, c cid.Cid, ipfs util.Cat) (*syncEntry, error) {
+	sealed, err := util.CatWithContext(ctx, ipfs, path.IpfsPath(c))
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.key.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewBuffer(b)
+	version, err := util.ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != syncEntryVersion {
+		return nil, errors.New("unsupported sync entry version")
+	}
+	result := &syncEntry{ops: make([]SyncOp, 0)}
+	result.prev, err = readCids(r)
+	if err != nil {
+		return nil, err
+	}
+	for r.Len() > 0 {
+		op, err := readSyncOp(r)
+		if err != nil {
+			return nil, err
+		}
+		result.ops = append(result.ops, op)
+	}
+	return result, nil
+}
+
+func syncRank(key string) int {
+	for i, prefix := range syncPriority {
+		if strings.HasPrefix(key, prefix) {
+			return i
+		}
+	}
+	return len(syncPriority)
+}
+
+func (s *syncLog) Merge(ctx context.Context, head cid.Cid, ipfs util.Cat, apply func(op SyncOp) error) (int, error) {
+	s.mtx.Lock()
+	known := s.merged[head.KeyString()]
+	s.mtx.Unlock()
+	if known {
+		return 0, nil
+	}
+	// the new entries are fetched before anything is merged, so a log which can't be fetched whole is merged later
+	fetched := make(map[string]*syncEntry)
+	reached := make(map[string]bool) // entries merged before which are reachable from head
+	queue := []cid.Cid{head}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		s.mtx.Lock()
+		known := s.merged[c.KeyString()]
+		s.mtx.Unlock()
+		if known {
+			reached[c.KeyString()] = true
+			continue
+		}
+		if fetched[c.KeyString()] != nil {
+			continue
+		}
+		entry, err := s.fetch(ctx, c, ipfs)
+		if err != nil {
+			return 0, err
+		}
+		if pinner, ok := ipfs.(Pinner); ok {
+			_ = pinner.Pin(c)
+		}
+		fetched[c.KeyString()] = entry
+		queue = append(queue, entry.prev...)
+	}
+	ops := make([]SyncOp, 0)
+	for _, entry := range fetched {
+		ops = append(ops, entry.ops...)
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		if ri, rj := syncRank(ops[i].Key), syncRank(ops[j].Key); ri != rj {
+			return ri < rj
+		}
+		return ops[j].after(ops[i])
+	})
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	changed := make([]SyncOp, 0)
+	for _, op := range ops {
+		if op.Clock > s.clock {
+			s.clock = op.Clock
+		}
+		current, ok := s.registers[op.Key]
+		if ok && !op.after(current) {
+			continue
+		}
+		s.registers[op.Key] = op
+		changed = append(changed, op)
+	}
+	for key := range fetched {
+		s.merged[key] = true
+	}
+	heads := []cid.Cid{head}
+	for _, c := range s.heads {
+		if !reached[c.KeyString()] && !c.Equals(head) {
+			heads = append(heads, c)
+		}
+	}
+	s.heads = heads
+	applied := 0
+	for _, op := range changed {
+		if s.registers[op.Key].Device != op.Device || s.registers[op.Key].Clock != op.Clock {
+			continue // a later op on the same key was merged too
+		}
+		if s.apply(op, apply) {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// apply passes op to apply, keeping it pending if it fails
+func (s *syncLog) apply(op SyncOp, apply func(op SyncOp) error) bool {
+	s.mtx.Unlock() // apply may look at the registers
+	err := apply(op)
+	s.mtx.Lock()
+	if err != nil {
+		println("warning: synced", op.Key, "could not be applied due to:", err.Error())
+		s.pending[op.Key] = true
+		return false
+	}
+	delete(s.pending, op.Key)
+	return true
+}
+
+func (s *syncLog) Retry(apply func(op SyncOp) error) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	keys := s.sortedKeys(s.pending, "")
+	sort.SliceStable(keys, func(i, j int) bool {
+		return syncRank(keys[i]) < syncRank(keys[j])
+	})
+	applied := 0
+	for _, key := range keys {
+		if s.apply(s.registers[key], apply) {
+			applied++
+		}
+	}
+	return applied
+}
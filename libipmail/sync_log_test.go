@@ -0,0 +1,326 @@
+package ipmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"io/ioutil"
+	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syncedState is what a SyncLog merged into, kept the way applySynced keeps the state of a mailbox
+type syncedState map[string]string
+
+func (s syncedState) apply(op SyncOp) error {
+	if op.Value == nil {
+		delete(s, op.Key)
+	} else {
+		s[op.Key] = string(op.Value)
+	}
+	return nil
+}
+
+func (s syncedState) bytes() map[string][]byte {
+	result := make(map[string][]byte)
+	for key, value := range s {
+		result[key] = []byte(value)
+	}
+	return result
+}
+
+func TestSyncLog(t *testing.T) {
+	ipfs := NewLoopbackNetwork().Join("devices")
+	key, err := crypto.NewSyncKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := NewSyncLog(key)
+	b, _ := NewSyncLog(key)
+	stateA, stateB := syncedState{}, syncedState{}
+	record := func(log SyncLog, state syncedState) {
+		_, err := log.Append(log.Record(state.bytes(), "flag/", "folder/"), ipfs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	merge := func(log SyncLog, state syncedState, from SyncLog) {
+		for _, head := range from.Heads() {
+			if _, err := log.Merge(context.Background(), head, ipfs, state.apply); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		change    func()
+		want      syncedState
+		wantHeads int
+	}{
+		{"Merged", func() {
+			stateA["flag/m1/seen"], stateA["folder/m1"] = "", "Archive"
+			record(a, stateA)
+			merge(b, stateB, a)
+		}, syncedState{"flag/m1/seen": "", "folder/m1": "Archive"}, 1},
+		{"Concurrent", func() {
+			stateA["folder/m1"] = "Work"
+			stateB["folder/m1"], stateB["flag/m2/starred"] = "Trash", ""
+			record(a, stateA)
+			record(b, stateB)
+			merge(a, stateA, b)
+			merge(b, stateB, a)
+		}, nil, 2},
+		{"Removed", func() {
+			delete(stateB, "flag/m1/seen")
+			record(b, stateB)
+			merge(a, stateA, b)
+		}, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			if !reflect.DeepEqual(stateA, stateB) {
+				t.Errorf("devices merged into %v and %v, want the same", stateA, stateB)
+			}
+			if tt.want != nil && !reflect.DeepEqual(stateB, tt.want) {
+				t.Errorf("merged into %v, want %v", stateB, tt.want)
+			}
+			if got := len(a.Heads()); got != tt.wantHeads {
+				t.Errorf("Heads() = %d entries, want %d", got, tt.wantHeads)
+			}
+		})
+	}
+	if _, ok := a.Value("flag/m1/seen"); ok {
+		t.Error("a removed register still has a value")
+	}
+
+	t.Run("Pending", func(t *testing.T) {
+		c, _ := NewSyncLog(key)
+		failing := func(op SyncOp) error {
+			if op.Key == "folder/m1" {
+				return errors.New("no such folder")
+			}
+			return nil
+		}
+		if _, err := c.Merge(context.Background(), a.Heads()[0], ipfs, failing); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Pending(""); !reflect.DeepEqual(got, []string{"folder/m1"}) {
+			t.Fatalf("Pending() = %v, want the folder which couldn't be applied", got)
+		}
+		if ops := c.Record(map[string][]byte{"flag/m2/starred": {}}, "flag/", "folder/"); len(ops) != 0 {
+			t.Errorf("Record() = %v, want nothing as the folder is pending", ops)
+		}
+		if applied := c.Retry(syncedState{}.apply); applied != 1 || len(c.Pending("")) != 0 {
+			t.Errorf("Retry() = %d with %v pending, want the folder applied", applied, c.Pending(""))
+		}
+	})
+
+	t.Run("Saved", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "ipmail-sync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "sync")
+		if err = a.SaveToFile(file, nil); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := NewSyncLogFromFile(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Device() != a.Device() || !reflect.DeepEqual(loaded.Heads(), a.Heads()) ||
+			!reflect.DeepEqual(loaded.Keys(""), a.Keys("")) {
+			t.Error("the loaded log differs from the saved one")
+		}
+		if merged, err := loaded.Merge(context.Background(), b.Heads()[0], ipfs, syncedState{}.apply); err != nil || merged != 0 {
+			t.Errorf("Merge() = %d, %v, want nothing new", merged, err)
+		}
+	})
+
+	t.Run("Other Key", func(t *testing.T) {
+		other, _ := crypto.NewSyncKey()
+		c, _ := NewSyncLog(other)
+		if _, err := c.Merge(context.Background(), a.Heads()[0], ipfs, syncedState{}.apply); err == nil {
+			t.Error("Merge() opened entries sealed with another key")
+		}
+	})
+}
+
+func TestMailbox_Sync(t *testing.T) {
+	network := NewLoopbackNetwork()
+	alice := newLoopbackUser(t, network, "alice")
+	bob := newLoopbackUser(t, network, "bob")
+	alice.mailbox.Contacts().Add(bob.identity.DefaultIdentity())
+	bob.mailbox.Contacts().Add(alice.identity.DefaultIdentity())
+	bob.send(t, "hi alice", alice)
+	bob.expect(t, SentEcho)
+	received := alice.expect(t, MessageReceived).Message
+	key := MessageKey(received)
+
+	// the laptop of alice joins after the message was sent, so it only gets it through the sync log
+	device, err := crypto.NewDeviceKey("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptopIpfs := network.Join("laptop")
+	receiver, err := NewReceiver(crypto.MessageTopicName, laptopIpfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	links := make(chan *crypto.DeviceLink, 1)
+	go func() {
+		link, err := WaitForDeviceLink(ctx, receiver, laptopIpfs, device)
+		if err != nil {
+			t.Error(err)
+		}
+		links <- link
+	}()
+	shared, err := ShareDeviceKey(laptopIpfs, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := FetchDeviceKey(ctx, alice.mailbox.(*mailbox).config.Ipfs, shared)
+	if err != nil || fetched.PrimaryKey.Fingerprint != device.PrimaryKey.Fingerprint {
+		t.Fatalf("FetchDeviceKey() = %v, %v, want the key of the laptop", fetched, err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err = bob.identity.DefaultIdentity().Serialize(buf); err != nil {
+		t.Fatal(err)
+	}
+	identityLink, err := laptopIpfs.AddFromReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notDevices := []string{
+		crypto.NewIdentityUri(identityLink.Cid(), bob.identity.DefaultIdentity()).String(),
+		"ipfs:" + string(identityLink.Cid().Bytes()),
+	}
+	for _, link := range notDevices {
+		if _, err = FetchDeviceKey(ctx, alice.mailbox.(*mailbox).config.Ipfs, link); err == nil {
+			t.Errorf("FetchDeviceKey(%q) of something else than a device succeeded", link)
+		}
+	}
+	if err = alice.mailbox.LinkDevice(ctx, bob.identity.DefaultIdentity()); err == nil {
+		t.Error("LinkDevice() sent the identity of alice to bob")
+	}
+	time.Sleep(100 * time.Millisecond) // so the receiver is subscribed
+	if err = alice.mailbox.LinkDevice(ctx, fetched); err != nil {
+		t.Fatal(err)
+	}
+	link := <-links
+	if link == nil {
+		t.FailNow()
+	}
+	if got := link.Identity.DefaultIdentity().PrimaryKey.Fingerprint; got != alice.identity.DefaultIdentity().PrimaryKey.Fingerprint {
+		t.Fatal("the link isn't to the account of alice")
+	}
+	if devices := alice.mailbox.Devices(); len(devices) != 1 || devices[0].Fingerprint != entityFingerprint(device) {
+		t.Errorf("Devices() = %v, want the laptop", devices)
+	}
+	log, _ := NewSyncLog(link.SyncKey)
+	laptop := NewMailbox(MailboxConfig{
+		Ipfs:     laptopIpfs,
+		Sender:   NewSender(laptopIpfs),
+		Identity: link.Identity,
+		Contacts: crypto.NewContactsIdentityList(link.Identity.EntityList()),
+		Sync:     log,
+	})
+
+	result, err := laptop.Sync(ctx, link.Head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Merged == 0 || result.Pending != 0 || result.Recorded != 0 {
+		t.Errorf("Sync() = %+v, want everything merged and nothing new", result)
+	}
+	if !containsEntity(bob.identity.DefaultIdentity(), laptop.Contacts().ToArray()) {
+		t.Error("bob wasn't synced to the contacts of the laptop")
+	}
+	synced := laptop.Messages().FromCid(received.Cid())
+	if synced == nil || string(synced.Data()) != "hi alice" {
+		t.Fatal("the message from bob wasn't synced to the laptop")
+	}
+	dir, err := ioutil.TempDir("", "ipmail-synced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lists := []struct {
+		name    string
+		mailbox Mailbox
+	}{
+		{"laptop", laptop},       // synced without knowing where from
+		{"alice", alice.mailbox}, // received from the loopback node of bob
+	}
+	for _, list := range lists {
+		file := filepath.Join(dir, list.name)
+		if err = list.mailbox.Messages().SaveToFile(file, nil); err != nil {
+			t.Fatal(err)
+		}
+		config := list.mailbox.(*mailbox).config
+		loaded := NewMessageListFromFile(file, nil, config.Bodies, config.Ipfs, config.Identity, config.Contacts)
+		if loaded == nil || loaded.FromCid(received.Cid()) == nil {
+			t.Errorf("the messages of %v weren't read back after saving them", list.name)
+		}
+	}
+	value, _ := alice.mailbox.(*mailbox).syncLog().Value("message/" + key)
+	body, err := cid.Decode(strings.SplitN(string(value), " ", 2)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := util.CatWithContext(ctx, laptopIpfs, path.IpfsPath(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := received.Encrypted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, _ := ioutil.ReadAll(encrypted)
+	_ = encrypted.Close()
+	if bytes.Contains(published, inner) {
+		t.Error("the message was synced as it was encrypted to alice instead of sealed with the sync key")
+	}
+
+	if err = laptop.(*mailbox).config.Labels.Move(key, ArchiveFolder); err != nil {
+		t.Fatal(err)
+	}
+	laptop.(*mailbox).config.Flags.Set(key, FlagStarred)
+	result, err = laptop.Sync(ctx)
+	if err != nil || result.Recorded != 2 || !result.Head.Defined() {
+		t.Fatalf("Sync() = %+v, %v, want the folder and flag recorded", result, err)
+	}
+	if _, err = alice.mailbox.Sync(ctx, result.Head); err != nil {
+		t.Fatal(err)
+	}
+	labels, flags := alice.mailbox.(*mailbox).config.Labels, alice.mailbox.(*mailbox).config.Flags
+	if labels.Folder(key) != ArchiveFolder || !flags.Has(key, FlagStarred) {
+		t.Error("the folder and flag set on the laptop weren't synced back")
+	}
+
+	alice.mailbox.Messages().Remove(received)
+	result, err = alice.mailbox.Sync(ctx)
+	if err != nil || result.Recorded == 0 {
+		t.Fatalf("Sync() = %+v, %v, want the deletion recorded", result, err)
+	}
+	if _, err = laptop.Sync(ctx, result.Head); err != nil {
+		t.Fatal(err)
+	}
+	if laptop.Messages().Len() != 0 || laptop.(*mailbox).config.Flags.Flags(key) != 0 {
+		t.Error("the message deleted by alice is still on the laptop")
+	}
+}
@@ -0,0 +1,44 @@
+package ipmail
+
+import (
+	"context"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io"
+	"ipmail/libipmail/util"
+)
+
+// Transport stores encrypted mail by CID and announces it on pubsub topics.
+// *Ipfs is the transport used by the apps and NewLoopbackNetwork joins transports in memory for tests.
+// The methods without a context give up after the transport's timeout.
+type Transport interface {
+	util.Cat
+	util.CatContext
+	// CatReader streams the file instead of reading it into memory. ctx bounds the whole read
+	CatReader(ctx context.Context, resolved path.Resolved) (io.ReadCloser, error)
+	AddFromBytes(b []byte) (path.Resolved, error)
+	// AddFromReader adds the file while it is read from reader
+	AddFromReader(reader io.Reader) (path.Resolved, error)
+	Publish(topic string, toSend []byte) error
+	PublishContext(ctx context.Context, topic string, toSend []byte) error
+	Subscribe(topic string, options ...options.PubSubSubscribeOption) (iface.PubSubSubscription, error)
+	// Context is done when the transport shuts down
+	Context() context.Context
+	// Close shuts the transport down, ending its subscriptions
+	Close() error
+}
+
+var _ Transport = (*Ipfs)(nil)
+var _ Pinner = (*Ipfs)(nil)
+
+// NodeIdentity is implemented by transports which run their own node, like *Ipfs
+type NodeIdentity interface {
+	PeerId() (peer.ID, error)
+	// ExportIdentity writes the node's peer ID and private key
+	ExportIdentity(w io.Writer) error
+}
+
+var _ NodeIdentity = (*Ipfs)(nil)
+var _ NameSystem = (*Ipfs)(nil)
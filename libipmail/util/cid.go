@@ -0,0 +1,25 @@
+package util
+
+import (
+	"bytes"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs/importer"
+)
+
+// ContentCid returns the CID data would get from a default "ipfs add" without storing it anywhere
+func ContentCid(data []byte) (cid.Cid, error) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	node, err := importer.BuildDagFromReader(dag, chunker.DefaultSplitter(bytes.NewReader(data)))
+	if err != nil {
+		return cid.Undef, err
+	}
+	return node.Cid(), nil
+}
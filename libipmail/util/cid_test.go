@@ -0,0 +1,25 @@
+package util
+
+import "testing"
+
+func TestContentCid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"Empty", "", "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{"Hello World", "hello world\n", "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ContentCid([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("ContentCid() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("ContentCid() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
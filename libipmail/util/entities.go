@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"encoding/base64"
 	"fmt"
@@ -20,7 +21,67 @@ type Cat interface {
 	Cat(resolved path.Resolved) ([]byte, error)
 }
 
+// CatContext is implemented by a Cat which can give up fetching when ctx is done
+type CatContext interface {
+	CatContext(ctx context.Context, resolved path.Resolved) ([]byte, error)
+}
+
+// CatReader is implemented by a Cat which can stream the file instead of reading it into memory
+type CatReader interface {
+	CatReader(ctx context.Context, resolved path.Resolved) (io.ReadCloser, error)
+}
+
+// CatStream streams resolved if ipfs can, or reads all of it with CatWithContext first otherwise
+func CatStream(ctx context.Context, ipfs Cat, resolved path.Resolved) (io.ReadCloser, error) {
+	if c, ok := ipfs.(CatReader); ok {
+		return c.CatReader(ctx, resolved)
+	}
+	b, err := CatWithContext(ctx, ipfs, resolved)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// CatWithContext fetches resolved and returns when ctx is done, even if ipfs can't be cancelled
+func CatWithContext(ctx context.Context, ipfs Cat, resolved path.Resolved) ([]byte, error) {
+	if c, ok := ipfs.(CatContext); ok {
+		return c.CatContext(ctx, resolved)
+	}
+	type catResult struct {
+		b   []byte
+		err error
+	}
+	done := make(chan catResult, 1)
+	go func() {
+		b, err := ipfs.Cat(resolved)
+		done <- catResult{b, err}
+	}()
+	select {
+	case result := <-done:
+		return result.b, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func ParseEntity(str string, ipfs Cat) (*gpg.Entity, error) {
+	return ParseEntityContext(context.Background(), str, ipfs)
+}
+
+// ParseEntityContext is ParseEntity giving up on fetching an ipfs: entity when ctx is done
+func ParseEntityContext(ctx context.Context, str string, ipfs Cat) (*gpg.Entity, error) {
+	b, err := ReadEntityData(ctx, str, ipfs)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(b)
+	reader := packet.NewReader(buf)
+	return gpg.ReadEntity(reader)
+}
+
+// ReadEntityData returns the serialized entity ParseEntityContext reads, with anything published after it
+func ReadEntityData(ctx context.Context, str string, ipfs Cat) ([]byte, error) {
 	var b []byte = nil
 	if strings.HasPrefix(str, "file:") {
 		str = strings.TrimPrefix(str, "file:")
@@ -38,7 +99,7 @@ func ParseEntity(str string, ipfs Cat) (*gpg.Entity, error) {
 		if err != nil {
 			return nil, err
 		}
-		b, err = ipfs.Cat(path.IpfsPath(parse))
+		b, err = CatWithContext(ctx, ipfs, path.IpfsPath(parse))
 		if err != nil {
 			return nil, err
 		}
@@ -55,9 +116,7 @@ func ParseEntity(str string, ipfs Cat) (*gpg.Entity, error) {
 	} else {
 		return nil, fmt.Errorf("\"%s\" has an invalid prefix", str)
 	}
-	buf := bytes.NewBuffer(b)
-	reader := packet.NewReader(buf)
-	return gpg.ReadEntity(reader)
+	return b, nil
 }
 
 func EntityToString(entity *gpg.Entity) string {
@@ -98,10 +157,11 @@ func SaveEntitiesPrivate(w io.Writer, entities ...*gpg.Entity) error {
 
 func LoadEntities(r io.Reader) (gpg.EntityList, error) {
 	result := make(gpg.EntityList, 0)
+	packets := packet.NewReader(r) // an entity is only over once the next one starts, so the reader is shared
 	var err error
 	for true {
 		var entity *gpg.Entity
-		entity, err = gpg.ReadEntity(packet.NewReader(r))
+		entity, err = gpg.ReadEntity(packets)
 		if err != nil {
 			break
 		}
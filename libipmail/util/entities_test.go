@@ -0,0 +1,133 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	gpg "github.com/Geo25rey/crypto/openpgp"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// blockingCat never finds anything and can't be cancelled
+type blockingCat struct{}
+
+func (blockingCat) Cat(resolved path.Resolved) ([]byte, error) {
+	select {}
+}
+
+// instantCat finds everything and can be cancelled
+type instantCat struct{}
+
+func (instantCat) Cat(resolved path.Resolved) ([]byte, error) {
+	return []byte("found"), nil
+}
+
+func (c instantCat) CatContext(ctx context.Context, resolved path.Resolved) ([]byte, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return c.Cat(resolved)
+}
+
+// streamingCat finds everything and streams it
+type streamingCat struct{ instantCat }
+
+func (c streamingCat) CatReader(ctx context.Context, resolved path.Resolved) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewBufferString("streamed")), nil
+}
+
+func TestCatStream(t *testing.T) {
+	c, _ := ContentCid([]byte("found"))
+	tests := []struct {
+		name string
+		ipfs Cat
+		want string
+	}{
+		{"Streaming", streamingCat{}, "streamed"},
+		{"Not Streaming", instantCat{}, "found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := CatStream(context.Background(), tt.ipfs, path.IpfsPath(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if got, _ := ioutil.ReadAll(r); string(got) != tt.want {
+				t.Errorf("CatStream() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatWithContext(t *testing.T) {
+	c, _ := ContentCid([]byte("found"))
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ipfs    Cat
+		ctx     context.Context
+		want    string
+		wantErr bool
+	}{
+		{"Found", instantCat{}, context.Background(), "found", false},
+		{"Cancelled", instantCat{}, expired, "", true},
+		{"Blocking Cat Cancelled", blockingCat{}, expired, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(tt.ctx, time.Second)
+			defer cancel()
+			got, err := CatWithContext(ctx, tt.ipfs, path.IpfsPath(c))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CatWithContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("CatWithContext() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEntities(t *testing.T) {
+	entities := make(gpg.EntityList, 0)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		entity, err := gpg.NewEntity(name, "", "", DefaultEncryptionConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, entity)
+	}
+	tests := []struct {
+		name     string
+		entities gpg.EntityList
+	}{
+		{"None", entities[:0]},
+		{"One", entities[:1]},
+		{"Many", entities},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(make([]byte, 0))
+			if err := SaveEntities(buf, tt.entities...); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadEntities(buf)
+			if err != nil {
+				t.Fatalf("LoadEntities() error = %v", err)
+			}
+			if len(got) != len(tt.entities) {
+				t.Fatalf("LoadEntities() loaded %d entities, want %d", len(got), len(tt.entities))
+			}
+			for i := range got {
+				if !EntitiesEqual(got[i], tt.entities[i]) {
+					t.Errorf("LoadEntities()[%d] = %s, want %s", i, EntityToString(got[i]), EntityToString(tt.entities[i]))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// WriteFileAtomic writes to a temporary file next to file and renames it into place
+// once write succeeds, so a crash mid-save never leaves a truncated file behind
+func WriteFileAtomic(file string, write func(w io.Writer) error) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Sealer encrypts local files at rest. The functions taking one write plaintext when it is nil
+type Sealer interface {
+	Seal(plaintext []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+// ErrLocked is returned when reading a sealed file without its Sealer, or before it is unlocked
+var ErrLocked = errors.New("local files are encrypted and have not been unlocked")
+
+// ErrNotSealed is returned when reading a file in plaintext with a Sealer, which only SealFile and SealStreamFile
+// do to seal the files saved before there was a passphrase
+var ErrNotSealed = errors.New("local file is not encrypted although a passphrase is set")
+
+var sealedFileMagic = []byte("ipmail sealed\x00")
+
+var sealedStreamMagic = []byte("ipmail sealed stream\x00")
+
+// SealerSwitch is a Sealer which can be handed to the stores before there is anything to seal with, like before
+// a passphrase is set. It seals with the Sealer it was switched to last, and writes plaintext until then
+type SealerSwitch interface {
+	Sealer
+	// Sealing tells if the switch has a Sealer
+	Sealing() bool
+	// Switch makes s seal what is written from now on. A nil s writes plaintext again
+	Switch(s Sealer)
+}
+
+type sealerSwitch struct {
+	mtx    sync.RWMutex
+	sealer Sealer
+}
+
+// NewSealerSwitch makes a SealerSwitch writing plaintext until Switch is called
+func NewSealerSwitch() SealerSwitch {
+	return &sealerSwitch{}
+}
+
+func (s *sealerSwitch) current() Sealer {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.sealer
+}
+
+func (s *sealerSwitch) Sealing() bool {
+	return s.current() != nil
+}
+
+func (s *sealerSwitch) Switch(sealer Sealer) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sealer = sealer
+}
+
+func (s *sealerSwitch) Seal(plaintext []byte) ([]byte, error) {
+	sealer := s.current()
+	if sealer == nil {
+		return nil, errors.New("there is nothing to seal with yet")
+	}
+	return sealer.Seal(plaintext)
+}
+
+func (s *sealerSwitch) Open(sealed []byte) ([]byte, error) {
+	sealer := s.current()
+	if sealer == nil {
+		return nil, ErrLocked
+	}
+	return sealer.Open(sealed)
+}
+
+// sealing tells if s seals what is written with it
+func sealing(s Sealer) bool {
+	if s == nil {
+		return false
+	}
+	if sw, ok := s.(SealerSwitch); ok {
+		return sw.Sealing()
+	}
+	return true
+}
+
+// WriteSealedFile is WriteFileAtomic for local data, which is encrypted with s
+func WriteSealedFile(file string, s Sealer, write func(w io.Writer) error) error {
+	if !sealing(s) {
+		return WriteFileAtomic(file, write)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	err := write(buf)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.Seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(file, func(w io.Writer) error {
+		_, err := w.Write(sealedFileMagic)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(sealed)
+		return err
+	})
+}
+
+// ReadSealedFile reads a file written by WriteSealedFile with s. A file in plaintext is only read without a
+// Sealer, otherwise it fails with ErrNotSealed
+func ReadSealedFile(file string, s Sealer) ([]byte, error) {
+	return readSealedFile(file, s, !sealing(s))
+}
+
+func readSealedFile(file string, s Sealer, plaintext bool) ([]byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, sealedFileMagic) {
+		if !plaintext {
+			return nil, ErrNotSealed
+		}
+		return b, nil
+	}
+	if s == nil {
+		return nil, ErrLocked
+	}
+	return s.Open(b[len(sealedFileMagic):])
+}
+
+// IsSealedFile tells if file was written by WriteSealedFile or WriteSealedStream with a Sealer
+func IsSealedFile(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(sealedStreamMagic))
+	n, _ := io.ReadFull(f, magic)
+	return bytes.HasPrefix(magic[:n], sealedFileMagic) || bytes.Equal(magic[:n], sealedStreamMagic)
+}
+
+func newStreamAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WriteSealedStream is WriteSealedFile for data too big to hold in memory. With s it is encrypted in chunks
+// with a new key, which is stored sealed in front of them
+func WriteSealedStream(file string, s Sealer, write func(w io.Writer) error) error {
+	if !sealing(s) {
+		return WriteFileAtomic(file, write)
+	}
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	sealedKey, err := s.Seal(key)
+	if err != nil {
+		return err
+	}
+	aead, err := newStreamAead(key)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(file, func(w io.Writer) error {
+		_, err := w.Write(sealedStreamMagic)
+		if err != nil {
+			return err
+		}
+		err = WriteBytes(w, sealedKey)
+		if err != nil {
+			return err
+		}
+		sealing := SealStream(w, aead, nil)
+		err = write(sealing)
+		if err != nil {
+			return err
+		}
+		return sealing.Close()
+	})
+}
+
+// OpenSealedStream reads a file written by WriteSealedStream with s. Like with ReadSealedFile, a file in plaintext
+// is only read without a Sealer
+func OpenSealedStream(file string, s Sealer) (io.ReadCloser, error) {
+	return openSealedStream(file, s, !sealing(s))
+}
+
+func openSealedStream(file string, s Sealer, plaintext bool) (io.ReadCloser, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(sealedStreamMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		_ = f.Close()
+		return nil, err
+	}
+	if !bytes.Equal(magic[:n], sealedStreamMagic) {
+		if !plaintext {
+			_ = f.Close()
+			return nil, ErrNotSealed
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	aead, err := openStreamKey(f, s)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{OpenStream(f, aead, nil), f}, nil
+}
+
+// openStreamKey reads the key in front of a sealed stream
+func openStreamKey(r io.Reader, s Sealer) (cipher.AEAD, error) {
+	if s == nil {
+		return nil, ErrLocked
+	}
+	sealedKey, err := ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.Open(sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamAead(key)
+}
+
+// SealFile rewrites a local file with s, like once a passphrase is first set. It is the one way a file in
+// plaintext is read with a Sealer. A file which doesn't exist is skipped
+func SealFile(file string, s Sealer) error {
+	b, err := readSealedFile(file, s, true)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return WriteSealedFile(file, s, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// SealStreamFile is SealFile for files written by WriteSealedStream
+func SealStreamFile(file string, s Sealer) error {
+	r, err := openSealedStream(file, s, true)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return WriteSealedStream(file, s, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		closeErr := r.Close() // before the file is replaced
+		if err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
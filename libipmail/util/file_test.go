@@ -0,0 +1,163 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// xorSealer is a Sealer which only hides the plaintext from a byte search
+type xorSealer byte
+
+func (s xorSealer) Seal(plaintext []byte) ([]byte, error) {
+	result := make([]byte, len(plaintext))
+	for i, b := range plaintext {
+		result[i] = b ^ byte(s)
+	}
+	return result, nil
+}
+
+func (s xorSealer) Open(sealed []byte) ([]byte, error) {
+	return s.Seal(sealed)
+}
+
+func writeTestFile(t *testing.T, file string, s Sealer, content string) {
+	err := WriteSealedFile(file, s, func(w io.Writer) error {
+		_, err := w.Write([]byte(content))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteSealedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plain := filepath.Join(dir, "plain")
+	sealed := filepath.Join(dir, "sealed")
+	resealed := filepath.Join(dir, "resealed")
+	switched := filepath.Join(dir, "switched")
+	sw := NewSealerSwitch()
+	writeTestFile(t, plain, nil, "plain secret")
+	writeTestFile(t, resealed, nil, "legacy secret")
+	writeTestFile(t, switched, sw, "switched secret") // not sealed yet
+	writeTestFile(t, sealed, xorSealer(42), "sealed secret")
+	if err := SealFile(resealed, xorSealer(42)); err != nil {
+		t.Fatal(err)
+	}
+	sw.Switch(xorSealer(42))
+	if err := SealFile(switched, sw); err != nil {
+		t.Fatal(err)
+	}
+	if err := SealFile(filepath.Join(dir, "missing"), xorSealer(42)); err != nil {
+		t.Errorf("SealFile() of a missing file error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		sealer     Sealer
+		want       string
+		wantSealed bool
+		wantErr    error
+	}{
+		{"Plaintext", plain, xorSealer(42), "", false, ErrNotSealed},
+		{"Sealed", sealed, xorSealer(42), "sealed secret", true, nil},
+		{"Resealed", resealed, xorSealer(42), "legacy secret", true, nil},
+		{"Switched", switched, sw, "switched secret", true, nil},
+		{"Plaintext Without Sealer", plain, nil, "plain secret", false, nil},
+		{"Plaintext Before Switching", plain, NewSealerSwitch(), "plain secret", false, nil},
+		{"Sealed While Locked", sealed, nil, "", true, ErrLocked},
+		{"Sealed Before Switching", sealed, NewSealerSwitch(), "", true, ErrLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, _ := ioutil.ReadFile(tt.file)
+			if tt.wantSealed == bytes.Contains(raw, []byte("secret")) {
+				t.Errorf("file content = %q, want sealed %v", raw, tt.wantSealed)
+			}
+			if got := IsSealedFile(tt.file); got != tt.wantSealed {
+				t.Errorf("IsSealedFile() = %v, want %v", got, tt.wantSealed)
+			}
+			got, err := ReadSealedFile(tt.file, tt.sealer)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadSealedFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReadSealedFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSealedStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmail-sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(file string, s Sealer, content string) {
+		err := WriteSealedStream(file, s, func(w io.Writer) error {
+			_, err := w.Write([]byte(content))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain := filepath.Join(dir, "plain")
+	sealed := filepath.Join(dir, "sealed")
+	resealed := filepath.Join(dir, "resealed")
+	write(plain, nil, "plain secret")
+	write(resealed, nil, "legacy secret")
+	write(sealed, xorSealer(42), "sealed secret")
+	if err := SealStreamFile(resealed, xorSealer(42)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		sealer     Sealer
+		want       string
+		wantSealed bool
+		wantErr    error
+	}{
+		{"Plaintext", plain, xorSealer(42), "", false, ErrNotSealed},
+		{"Sealed", sealed, xorSealer(42), "sealed secret", true, nil},
+		{"Resealed", resealed, xorSealer(42), "legacy secret", true, nil},
+		{"Plaintext Without Sealer", plain, nil, "plain secret", false, nil},
+		{"Sealed While Locked", sealed, nil, "", true, ErrLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, _ := ioutil.ReadFile(tt.file)
+			if tt.wantSealed == bytes.Contains(raw, []byte("secret")) {
+				t.Errorf("file content = %q, want sealed %v", raw, tt.wantSealed)
+			}
+			if got := IsSealedFile(tt.file); got != tt.wantSealed {
+				t.Errorf("IsSealedFile() = %v, want %v", got, tt.wantSealed)
+			}
+			r, err := OpenSealedStream(tt.file, tt.sealer)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("OpenSealedStream() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			got, err := ioutil.ReadAll(r)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("OpenSealedStream() read %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
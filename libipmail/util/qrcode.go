@@ -0,0 +1,27 @@
+package util
+
+import (
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"image"
+	_ "image/jpeg" // so photos of QR codes can be decoded
+	_ "image/png"
+	"io"
+)
+
+// DecodeQrCode reads the text of the QR code in a PNG or JPEG image
+func DecodeQrCode(r io.Reader) (string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", err
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bitmap, nil)
+	if err != nil {
+		return "", err
+	}
+	return result.GetText(), nil
+}
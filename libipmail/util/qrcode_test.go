@@ -0,0 +1,45 @@
+package util
+
+import (
+	"bytes"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestDecodeQrCode(t *testing.T) {
+	const text = "ipmail:bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku?name=alice"
+	png, err := qrcode.Encode(text, qrcode.Low, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewBuffer(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo := bytes.NewBuffer(make([]byte, 0))
+	if err = jpeg.Encode(photo, img, &jpeg.Options{Quality: 75}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		image   []byte
+		wantErr bool
+	}{
+		{"PNG", png, false},
+		{"JPEG", photo.Bytes(), false},
+		{"Not An Image", []byte(text), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeQrCode(bytes.NewBuffer(tt.image))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeQrCode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != text {
+				t.Errorf("DecodeQrCode() = %q, want %q", got, text)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"fmt"
+	"io"
+)
+
+func WriteUint64(w io.Writer, val uint64) error {
+	_, err := w.Write(Uint64ToBytes(val))
+	return err
+}
+
+func ReadUint64(r io.Reader) (uint64, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+	return BytesToUint64(buf)
+}
+
+func WriteInt64(w io.Writer, val int64) error {
+	_, err := w.Write(Int64ToBytes(val))
+	return err
+}
+
+func ReadInt64(r io.Reader) (int64, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+	return BytesToInt64(buf)
+}
+
+// WriteBytes writes b prefixed by its length so it can be read back with ReadBytes
+func WriteBytes(w io.Writer, b []byte) error {
+	err := WriteInt64(w, int64(len(b)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func ReadBytes(r io.Reader) ([]byte, error) {
+	size, err := ReadInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid length %d", size)
+	}
+	result := make([]byte, size)
+	_, err = io.ReadFull(r, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func WriteString(w io.Writer, s string) error {
+	return WriteBytes(w, []byte(s))
+}
+
+func ReadString(r io.Reader) (string, error) {
+	b, err := ReadBytes(r)
+	return string(b), err
+}
@@ -0,0 +1,180 @@
+package util
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// streamChunkSize is how much of a stream SealStream encrypts at once, so neither side holds more of it in memory
+const streamChunkSize = 64 * 1024
+
+var errStreamCorrupt = errors.New("sealed stream is corrupt")
+
+// streamNonce numbers the chunks of a stream and marks the last one, so chunks can't be reordered, dropped or
+// cut off the end without OpenStream noticing
+func streamNonce(aead cipher.AEAD, chunk uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, chunk)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type sealingWriter struct {
+	w              io.Writer
+	aead           cipher.AEAD
+	additionalData []byte
+	buf            []byte
+	chunk          uint64
+	closed         bool
+}
+
+// SealStream encrypts what is written to it with aead in chunks, each authenticated with additionalData. The key
+// of aead must not seal anything else since the nonces are the chunk numbers. Close writes the last chunk, without
+// which OpenStream fails
+func SealStream(w io.Writer, aead cipher.AEAD, additionalData []byte) io.WriteCloser {
+	return &sealingWriter{w: w, aead: aead, additionalData: additionalData, buf: make([]byte, 0, streamChunkSize)}
+}
+
+func (s *sealingWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("sealed stream is closed")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == streamChunkSize {
+			err := s.flush(false) // only once more is written, since the last chunk has to be marked
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):streamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealingWriter) flush(last bool) error {
+	sealed := s.aead.Seal(nil, streamNonce(s.aead, s.chunk, last), s.buf, s.additionalData)
+	s.chunk++
+	s.buf = s.buf[:0]
+	return WriteBytes(s.w, sealed)
+}
+
+func (s *sealingWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+type openingReader struct {
+	r              io.Reader
+	aead           cipher.AEAD
+	additionalData []byte
+	buf            []byte
+	chunk          uint64
+	done           bool
+	err            error
+}
+
+// OpenStream decrypts a stream written by SealStream. Every chunk is authenticated before it is read, and the
+// stream only ends with io.EOF once its last chunk is, so a read error means the stream can't be trusted
+func OpenStream(r io.Reader, aead cipher.AEAD, additionalData []byte) io.Reader {
+	return &openingReader{r: r, aead: aead, additionalData: additionalData}
+}
+
+func (o *openingReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.err != nil {
+			return 0, o.err
+		}
+		if o.done {
+			o.err = o.checkEnd()
+			continue
+		}
+		o.err = o.next()
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (o *openingReader) next() error {
+	size, err := ReadInt64(o.r)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF // the last chunk is missing
+	} else if err != nil {
+		return err
+	}
+	if size < int64(o.aead.Overhead()) || size > int64(streamChunkSize+o.aead.Overhead()) {
+		return errStreamCorrupt
+	}
+	sealed := make([]byte, size)
+	_, err = io.ReadFull(o.r, sealed)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	o.buf, err = o.aead.Open(nil, streamNonce(o.aead, o.chunk, false), sealed, o.additionalData)
+	if err != nil {
+		o.buf, err = o.aead.Open(nil, streamNonce(o.aead, o.chunk, true), sealed, o.additionalData)
+		if err != nil {
+			return errStreamCorrupt
+		}
+		o.done = true
+	}
+	o.chunk++
+	return nil
+}
+
+// checkEnd makes sure nothing was added after the last chunk
+func (o *openingReader) checkEnd() error {
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(o.r, 1))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errStreamCorrupt
+	}
+	return io.EOF
+}
+
+// ErrTooLarge is what a BoundedReader fails with once more than its limit was read
+var ErrTooLarge = errors.New("stream is larger than allowed")
+
+type boundedReader struct {
+	r io.Reader
+	n int64
+}
+
+// BoundedReader reads r like io.LimitReader, but fails with ErrTooLarge rather than ending early when r holds more
+// than n bytes, so a cut off stream is never taken for all of it
+func BoundedReader(r io.Reader, n int64) io.Reader {
+	return &boundedReader{r: r, n: n}
+}
+
+func (b *boundedReader) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1] // one byte more than allowed tells a stream which is too large from one which just fits
+	}
+	n, err := b.r.Read(p)
+	if int64(n) > b.n {
+		n, b.n = int(b.n), -1
+		return n, ErrTooLarge
+	}
+	b.n -= int64(n)
+	return n, err
+}
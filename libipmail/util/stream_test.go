@@ -0,0 +1,120 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func sealTestStream(t *testing.T, key []byte, plaintext []byte) []byte {
+	aead, err := newStreamAead(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	w := SealStream(buf, aead, []byte("header"))
+	if _, err = w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func openTestStream(key []byte, sealed []byte, additionalData string) ([]byte, error) {
+	aead, err := newStreamAead(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(OpenStream(bytes.NewReader(sealed), aead, []byte(additionalData)))
+}
+
+func TestSealStream(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	big := make([]byte, 2*streamChunkSize+100)
+	_, _ = rand.Read(big)
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"Empty", []byte{}},
+		{"Short", []byte("secret")},
+		{"One Chunk", big[:streamChunkSize]},
+		{"Many Chunks", big},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := sealTestStream(t, key, tt.plaintext)
+			got, err := openTestStream(key, sealed, "header")
+			if err != nil || !bytes.Equal(got, tt.plaintext) {
+				t.Errorf("OpenStream() read %d bytes, %v, want %d bytes", len(got), err, len(tt.plaintext))
+			}
+		})
+	}
+}
+
+func TestOpenStream_tampered(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	plaintext := make([]byte, 2*streamChunkSize+100)
+	sealed := sealTestStream(t, key, plaintext)
+	chunk := 8 + streamChunkSize + 16 // length, chunk and tag
+	swapped := append(append(append([]byte{}, sealed[chunk:2*chunk]...), sealed[:chunk]...), sealed[2*chunk:]...)
+	flipped := append([]byte{}, sealed...)
+	flipped[100] ^= 1
+	other := make([]byte, 32)
+	tests := []struct {
+		name           string
+		key            []byte
+		sealed         []byte
+		additionalData string
+	}{
+		{"Truncated", key, sealed[:2*chunk], "header"},
+		{"Cut Mid Chunk", key, sealed[:len(sealed)-1], "header"},
+		{"Reordered", key, swapped, "header"},
+		{"Changed", key, flipped, "header"},
+		{"Appended", key, append(append([]byte{}, sealed...), sealed[:chunk]...), "header"},
+		{"Other Header", key, sealed, "other"},
+		{"Other Key", other, sealed, "header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := openTestStream(tt.key, tt.sealed, tt.additionalData); err == nil {
+				t.Error("OpenStream() read a tampered stream without an error")
+			}
+		})
+	}
+}
+
+func TestBoundedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		wantErr bool
+	}{
+		{"Smaller", 10, 11, false},
+		{"Fits", 2*streamChunkSize + 1, 2*streamChunkSize + 1, false},
+		{"Empty", 0, 0, false},
+		{"One Too Many", 11, 10, true},
+		{"Larger", 3 * streamChunkSize, streamChunkSize, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			got, err := ioutil.ReadAll(BoundedReader(bytes.NewReader(data), tt.limit))
+			if (err == ErrTooLarge) != tt.wantErr {
+				t.Fatalf("BoundedReader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if int64(len(got)) > tt.limit {
+				t.Errorf("BoundedReader() read %v bytes, more than %v", len(got), tt.limit)
+			}
+			if !tt.wantErr && len(got) != tt.size {
+				t.Errorf("BoundedReader() read %v bytes, want %v", len(got), tt.size)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/kyoh86/xdg"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -10,9 +11,12 @@ import (
 	"ipmail/gui"
 	"ipmail/libipmail"
 	"ipmail/libipmail/crypto"
+	"ipmail/libipmail/util"
 	"os"
 	"path"
 	"strings"
+	"time"
+	"unicode"
 )
 
 const configName = "config"
@@ -46,7 +50,39 @@ func parseCmdLine() error {
 	flag.String("messages", path.Join(dataDir, "messages"), "")
 	flag.String("sent", path.Join(dataDir, "sent"), "")
 	flag.String("requests", path.Join(dataDir, "requests"), "")
+	flag.String("drafts", path.Join(dataDir, "drafts"), "")
+	flag.String("outbox", path.Join(dataDir, "outbox"), "")
+	flag.String("labels", path.Join(dataDir, "labels"), "")
+	flag.String("flags", path.Join(dataDir, "flags"), "")
+	flag.String("seen", path.Join(dataDir, "seen"), "")
+	flag.String("pins", path.Join(dataDir, "pins"), "")
+	flag.String("sessions", path.Join(dataDir, "sessions"), "keeps the keys of the sessions messages to your contacts are sealed in")
+	flag.String("pending-requests", path.Join(dataDir, "pending-requests"), "keeps who you sent contact requests to until they answer")
+	flag.String("contact-names", path.Join(dataDir, "contact-names"), "keeps the addresses contacts were added by to follow their key changes")
+	flag.String("profiles", path.Join(dataDir, "profiles"), "keeps your profile and the profiles of your contacts")
+	flag.String("contact-details", path.Join(dataDir, "contact-details"), "keeps the nicknames and notes you gave contacts")
+	flag.String("sync", path.Join(dataDir, "sync"), "keeps the log your linked devices sync contacts, messages, folders and flags through")
+	flag.Duration("sync-interval", time.Minute, "how often linked devices are synced in the background, 0 to only sync with the sync command")
+	flag.Duration("name-refresh", time.Hour, "how often contacts added by an address are resolved again, 0 to never")
+	flag.Bool("forward-secrecy", true, "seal messages to contacts who published a prekey bundle with keys that are deleted once used")
+	flag.String("vault", path.Join(dataDir, "vault"), "keeps the key your local files are encrypted with once you set a passphrase")
+	flag.String("bodies", path.Join(dataDir, "bodies"), "directory the encrypted messages are kept in instead of in memory")
+	flag.Duration("pin-ttl", ipmail.DefaultPinTtl, "how long sent messages stay pinned when not every recipient acknowledges them")
+	flag.String("pinning-services", "", "comma separated remote pinning services to also pin sent messages and your identity on. "+
+		"Each needs pinning.<name>.endpoint and pinning.<name>.token in the config file")
+	flag.Duration("trash-retention", 30*24*time.Hour, "how long trashed messages are kept before being deleted forever")
+	flag.Duration("undo-send", 10*time.Second, "how long a sent message can be cancelled from the outbox")
 	flag.String("ipfs-repo", path.Join(dataDir, "ipfs-repo"), "")
+	flag.String("bootstrap", "", "comma separated peers to connect to at startup, \"none\" for no peers (default public IPFS nodes)")
+	flag.String("swarm-listen", "", "comma separated multiaddrs for the IPFS node to listen on")
+	flag.Int("swarm-port", 0, "port for the IPFS node to listen on when swarm-listen isn't set (default random)")
+	flag.String("routing", ipmail.RoutingDht.String(), "content routing of the IPFS node: dht, dhtclient, dhtserver or none")
+	flag.Bool("mdns", true, "find other ipmail users on the local network")
+	flag.String("swarm-key", "", "swarm.key of a private IPFS network to join instead of the public one")
+	flag.Bool("ipfs-migrate", false, "upgrade an ipfs-repo made by an older IPFS version with the downloaded fs-repo-migrations tool, after which older versions can't open it")
+	flag.Duration("ipfs-timeout", ipmail.DefaultTimeout, "how long fetching or publishing on IPFS waits before giving up")
+	flag.String("ipfs-api", "", "HTTP API of a running IPFS daemon to use instead of starting a node, e.g. /ip4/127.0.0.1/tcp/5001")
+	flag.Bool("ipfs-api-gc", false, "let the gc command garbage collect the daemon of ipfs-api, which also deletes what other applications on it didn't pin")
 	flag.Bool("experimental-gui", true, "")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
@@ -73,6 +109,73 @@ func parseCmdLine() error {
 	return err
 }
 
+// splitList splits a comma or space separated config value
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+func nodeConfig() (ipmail.NodeConfig, error) {
+	result := ipmail.DefaultNodeConfig()
+	bootstrap := strings.TrimSpace(viper.GetString("bootstrap"))
+	if bootstrap == "none" {
+		result.Bootstrap = []string{}
+	} else if len(bootstrap) > 0 {
+		result.Bootstrap = splitList(bootstrap)
+	}
+	result.ListenAddrs = splitList(viper.GetString("swarm-listen"))
+	result.Port = viper.GetInt("swarm-port")
+	routing, err := ipmail.ParseRouting(viper.GetString("routing"))
+	if err != nil {
+		return result, err
+	}
+	result.Routing = routing
+	result.Mdns = viper.GetBool("mdns")
+	result.SwarmKey = viper.GetString("swarm-key")
+	result.Migrate = viper.GetBool("ipfs-migrate")
+	result.Timeout = viper.GetDuration("ipfs-timeout")
+	return result, nil
+}
+
+func localFiles() ipmail.LocalFiles {
+	return ipmail.LocalFiles{
+		Vault:    viper.GetString("vault"),
+		Identity: viper.GetString("identity"),
+		Contacts: viper.GetString("contacts"),
+		Messages: viper.GetString("messages"),
+		Sent:     viper.GetString("sent"),
+		Requests: viper.GetString("requests"),
+		Drafts:   viper.GetString("drafts"),
+		Outbox:   viper.GetString("outbox"),
+		Labels:   viper.GetString("labels"),
+		Flags:    viper.GetString("flags"),
+		Seen:     viper.GetString("seen"),
+		Pins:     viper.GetString("pins"),
+		Sessions: viper.GetString("sessions"),
+		Pending:  viper.GetString("pending-requests"),
+		Names:    viper.GetString("contact-names"),
+		Profiles: viper.GetString("profiles"),
+		Details:  viper.GetString("contact-details"),
+		Sync:     viper.GetString("sync"),
+	}
+}
+
+// remotePinServices reads the credentials of the configured pinning services, which are only kept in the config file
+func remotePinServices() ([]ipmail.RemotePinService, error) {
+	names := splitList(viper.GetString("pinning-services"))
+	result := make([]ipmail.RemotePinService, 0, len(names))
+	for _, name := range names {
+		endpoint := viper.GetString("pinning." + name + ".endpoint")
+		if len(endpoint) == 0 {
+			return nil, fmt.Errorf("pinning service %s has no pinning.%s.endpoint in %s", name, name, viper.ConfigFileUsed())
+		}
+		token := viper.GetString("pinning." + name + ".token")
+		result = append(result, ipmail.NewRemotePinService(name, endpoint, token))
+	}
+	return result, nil
+}
+
 func main() {
 	err := setupConfig()
 	if err != nil {
@@ -82,8 +185,17 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	ipfsRepo := viper.GetString("ipfs-repo")
-	ipfs, err := ipmail.NewIpfsWithRepo(false, &ipfsRepo)
+	var ipfs ipmail.Transport
+	if api := viper.GetString("ipfs-api"); len(api) > 0 {
+		ipfs, err = ipmail.NewIpfsApi(api, viper.GetDuration("ipfs-timeout"), viper.GetBool("ipfs-api-gc"))
+	} else {
+		var config ipmail.NodeConfig
+		config, err = nodeConfig()
+		if err == nil {
+			ipfsRepo := viper.GetString("ipfs-repo")
+			ipfs, err = ipmail.NewIpfsWithConfig(false, &ipfsRepo, config)
+		}
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -92,22 +204,28 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	var identity crypto.SelfIdentity = nil
-	identityFile := viper.GetString("identity")
-	identity = crypto.NewSelfIdentityFromFile(identityFile) // nil if file not found
-	var contacts crypto.ContactsIdentityList = nil
-	contactsFile := viper.GetString("contacts")
-	contacts, _ = crypto.NewContactsIdentityListFromFile(contactsFile) // nil if file not found
-	messagesFile := viper.GetString("messages")
-	messages := ipmail.NewMessageListFromFile(messagesFile, ipfs, identity, contacts) // nil if file not found
-	sentFile := viper.GetString("sent")
-	sent := ipmail.NewMessageListFromFile(sentFile, ipfs, identity, contacts) // nil if file not found
-	requestsFile := viper.GetString("requests")
-	requests := ipmail.NewMessageListFromFile(requestsFile, ipfs, identity, contacts) // nil if file not found
+	sealer := util.NewSealerSwitch() // switched to the vault once the store is unlocked
+	bodies, err := crypto.NewBodyStore(viper.GetString("bodies"), sealer)
+	if err != nil {
+		panic(err)
+	}
+	store, err := ipmail.NewLocalStore(localFiles(), sealer, sender, bodies, ipfs) // locked if a passphrase is set
+	if err != nil {
+		panic(err)
+	}
+	remotePins, err := remotePinServices()
+	if err != nil {
+		panic(err)
+	}
 	if viper.GetBool("experimental-gui") {
-		gui.Run(ipfs, sender, receiver, identity, contacts, messages, sent, requests)
+		gui.Run(ipfs, sender, receiver, store, sealer, remotePins, bodies, pflag.Args())
 	} else {
-		cli.Run(ipfs, sender, receiver, identity, contacts, messages, sent, requests)
+		cli.Run(ipfs, sender, receiver, store, sealer, remotePins, bodies, pflag.Args())
 	}
+	store.Close()
 	receiver.Close()
+	err = ipfs.Close()
+	if err != nil {
+		println("warning: the IPFS node did not shut down cleanly due to:", err.Error())
+	}
 }